@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cfg "github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	"github.com/vmware/vmware-go-kcl-v2/clientlibrary/metrics/cloudwatch"
+	"github.com/vmware/vmware-go-kcl-v2/logger"
+)
+
+const (
+	// defaultKCLCloudWatchNamespace is the CloudWatch namespace KCL metrics are published under.
+	defaultKCLCloudWatchNamespace = "kinesis2sse"
+
+	// kclMetricsSummary publishes KCL workers' records and bytes processed, lag, and leases.
+	kclMetricsSummary = "summary"
+
+	// kclMetricsDetailed also publishes how long KCL workers take to get and process each batch of records.
+	kclMetricsDetailed = "detailed"
+)
+
+// kclCloudWatchMonitoringService publishes a KCL worker's metrics to CloudWatch.
+//
+// NOTE(mroberts): The KCL publishes under a namespace named after the application, but ours is random (see appName), so
+// we substitute a stable one. The KCL has no notion of metrics levels, either, so we drop the detailed metrics here.
+type kclCloudWatchMonitoringService struct {
+	*cloudwatch.MonitoringService
+	namespace string
+	detailed  bool
+}
+
+func (s *kclCloudWatchMonitoringService) Init(_, streamName, workerID string) error {
+	return s.MonitoringService.Init(s.namespace, streamName, workerID)
+}
+
+// DeleteMetricMillisBehindLatest is missing from the KCL's CloudWatch monitoring service.
+//
+// NOTE(mroberts): Lag is only ever published for shards the worker holds, so there is nothing to delete.
+func (s *kclCloudWatchMonitoringService) DeleteMetricMillisBehindLatest(string) {}
+
+func (s *kclCloudWatchMonitoringService) RecordGetRecordsTime(shard string, time float64) {
+	if s.detailed {
+		s.MonitoringService.RecordGetRecordsTime(shard, time)
+	}
+}
+
+func (s *kclCloudWatchMonitoringService) RecordProcessRecordsTime(shard string, time float64) {
+	if s.detailed {
+		s.MonitoringService.RecordProcessRecordsTime(shard, time)
+	}
+}
+
+// withKCLCloudWatchMetrics has a route's KCL worker publish its metrics to CloudWatch, in the specified region and with
+// the specified credentials, under the specified namespace and at the specified level.
+func withKCLCloudWatchMetrics(kclConfig *cfg.KinesisClientLibConfiguration, region string, creds aws.CredentialsProvider, namespace, level string, log logger.Logger) (*cfg.KinesisClientLibConfiguration, error) {
+	if namespace == "" {
+		return nil, errors.New("KCL CloudWatch namespace must not be empty")
+	}
+
+	if level != kclMetricsSummary && level != kclMetricsDetailed {
+		return nil, fmt.Errorf("KCL CloudWatch metrics level must be %q or %q", kclMetricsSummary, kclMetricsDetailed)
+	}
+
+	return kclConfig.WithMonitoringService(&kclCloudWatchMonitoringService{
+		MonitoringService: cloudwatch.NewMonitoringServiceWithOptions(region, creds, log, cloudwatch.DefaultCloudwatchMetricsBufferDuration),
+		namespace:         namespace,
+		detailed:          level == kclMetricsDetailed,
+	}), nil
+}
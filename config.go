@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration that can be loaded from files passed via --config. Unset fields fall back to the
+// corresponding flags, and flags passed explicitly override them.
+type Config struct {
+	// Host is the host or IP address to listen on.
+	Host string `json:"host"`
+
+	// Port is the port to listen on.
+	Port int `json:"port"`
+
+	// AppNamePrefix is the app name prefix to which a random suffix will be appended.
+	AppNamePrefix string `json:"appNamePrefix"`
+
+	// ShardSyncIntervalMillis is the shard sync interval in milliseconds, unless a route sets its own.
+	ShardSyncIntervalMillis int `json:"shardSyncIntervalMillis"`
+
+	// FailoverTimeMillis is the failover time in milliseconds, unless a route sets its own.
+	FailoverTimeMillis int `json:"failoverTimeMillis"`
+
+	// MaxRecords is the maximum number of records per GetRecords call, unless a route sets its own.
+	MaxRecords int `json:"maxRecords"`
+
+	// PollIntervalMillis is the time between GetRecords calls in milliseconds, unless a route sets its own.
+	PollIntervalMillis int `json:"pollIntervalMillis"`
+
+	// Region is the AWS region.
+	Region string `json:"region"`
+
+	// AWSProfile is the named AWS profile with which routes access their streams and checkpoints.
+	AWSProfile string `json:"awsProfile"`
+
+	// AssumeRoleARN is the ARN of an IAM role to assume to access routes' streams.
+	AssumeRoleARN string `json:"assumeRoleArn"`
+
+	// KinesisEndpoint and DynamoDBEndpoint are custom endpoint URLs, like LocalStack's.
+	KinesisEndpoint  string `json:"kinesisEndpoint"`
+	DynamoDBEndpoint string `json:"dynamodbEndpoint"`
+
+	// KCLCloudWatchMetrics enables publishing the KCL workers' own metrics to CloudWatch, under KCLCloudWatchNamespace
+	// and at KCLCloudWatchLevel ("summary" or "detailed").
+	KCLCloudWatchMetrics   bool   `json:"kclCloudWatchMetrics"`
+	KCLCloudWatchNamespace string `json:"kclCloudWatchNamespace"`
+	KCLCloudWatchLevel     string `json:"kclCloudWatchLevel"`
+
+	// HealthMaxLag is the consumer lag, like "60s", beyond which /health fails.
+	HealthMaxLag string `json:"healthMaxLag"`
+
+	// MemoryBudget is the estimated bytes of memory all routes' events may take up together.
+	MemoryBudget int `json:"memoryBudget"`
+
+	// DeadLetterFile is the path of a file to append each record a route is unable to serve to.
+	DeadLetterFile string `json:"deadLetterFile"`
+
+	// TLSCert and TLSKey are the paths to a PEM-encoded certificate and private key with which to serve HTTPS.
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+
+	// MaxConnectionDuration is how long, like "1h", a stream may stay open before it is ended.
+	MaxConnectionDuration string `json:"maxConnectionDuration"`
+
+	// WriteTimeout is how long, like "1m", a write to a client may take before its connection is closed.
+	WriteTimeout string `json:"writeTimeout"`
+
+	// MaxLookback is how far back, like "24h", the "since" query parameter may reach.
+	MaxLookback string `json:"maxLookback"`
+
+	// ReadHeaderTimeout, ReadTimeout, and IdleTimeout, like "2s", configure the HTTP server's timeouts.
+	ReadHeaderTimeout string `json:"readHeaderTimeout"`
+	ReadTimeout       string `json:"readTimeout"`
+	IdleTimeout       string `json:"idleTimeout"`
+
+	// WorkerStartAttempts is how many times to try starting each KCL worker before failing.
+	WorkerStartAttempts int `json:"workerStartAttempts"`
+
+	// WorkerStartRetryDelay is how long, like "1s", to wait before the first retry to start a KCL worker.
+	WorkerStartRetryDelay string `json:"workerStartRetryDelay"`
+
+	// ShutdownTimeout is how long, like "30s", to wait for connections to drain and KCL workers to stop on exit.
+	ShutdownTimeout string `json:"shutdownTimeout"`
+
+	// DrainTimeout is how long, like "5m", to wait for connections to close when draining.
+	DrainTimeout string `json:"drainTimeout"`
+
+	// Checkpointing is where to checkpoint progress through each shard: "memory", "dynamodb", "file", or "none".
+	Checkpointing string `json:"checkpointing"`
+
+	// CheckpointFile is the path to the JSON file to persist checkpoints to.
+	CheckpointFile string `json:"checkpointFile"`
+
+	// CORSAllowedOrigins are the origins browsers may connect from, or "*" for any.
+	CORSAllowedOrigins []string `json:"corsAllowedOrigins"`
+
+	// DisableCompression disables gzip-compressing SSE streams.
+	DisableCompression bool `json:"disableCompression"`
+
+	// DisableIndex disables listing the routes at "/" and in 404 responses.
+	DisableIndex bool `json:"disableIndex"`
+
+	// EnableViewer enables an HTML page at /viewer which connects to a route and lists its events.
+	EnableViewer bool `json:"enableViewer"`
+
+	// Preamble is the text of the comment which begins each SSE stream.
+	Preamble string `json:"preamble"`
+
+	// DisablePreamble disables the comment which begins each SSE stream.
+	DisablePreamble bool `json:"disablePreamble"`
+
+	// Greeting is the text of a comment sent at the start of each SSE stream, after the preamble.
+	Greeting string `json:"greeting"`
+
+	// RequestIDHeader is the header from which to read each stream's request ID, like "traceparent".
+	RequestIDHeader string `json:"requestIdHeader"`
+
+	// StreamHeaders are headers, like {"X-Accel-Buffering": "no"}, to set on each stream's response, overriding the
+	// defaults. An empty value removes the default.
+	StreamHeaders map[string]string `json:"streamHeaders"`
+
+	// RequestIDComment sends each stream's request ID in a comment at the start of the stream.
+	RequestIDComment bool `json:"requestIdComment"`
+
+	// Routes is the set of routes to serve.
+	Routes []RouteOptionsCLI `json:"routes"`
+}
+
+// loadConfigs loads and deep-merges the JSON or YAML config files at the specified paths, in order. Later files override earlier
+// ones: top-level fields are overridden individually, and routes are merged field-by-field, keyed by "path". Since
+// fields are merged on the parsed structs, an unset or zero value (like false) never overrides. loadConfigs returns
+// a description of each override, for debugging.
+func loadConfigs(paths []string) (Config, []string, error) {
+	var merged Config
+	var conflicts []string
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("unable to read config %q: %w", path, err)
+		}
+
+		config, err := parseConfig(path, data)
+		if err != nil {
+			return Config{}, nil, err
+		}
+
+		conflicts = append(conflicts, mergeConfig(&merged, config, path)...)
+	}
+
+	return merged, conflicts, nil
+}
+
+// parseConfig parses the config loaded from the specified path. Files ending in ".yaml" or ".yml" are parsed as YAML,
+// and anything else as JSON. Errors include the path and, where possible, the line at fault.
+func parseConfig(path string, data []byte) (Config, error) {
+	// By default, offsets into the JSON map to lines by counting newlines.
+	line := func(offset int64) int {
+		return 1 + bytes.Count(data[:min(offset, int64(len(data)))], []byte("\n"))
+	}
+
+	// NOTE(mroberts): Rather than duplicating every json tag as a yaml tag, we convert YAML to JSON and parse that. The
+	// conversion remembers where each JSON value came from, so that we can still report YAML lines.
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return Config{}, fmt.Errorf("unable to parse config %q: %w", path, err)
+		}
+
+		var converted yamlJSON
+		if err := converted.write(&node); err != nil {
+			return Config{}, fmt.Errorf("unable to parse config %q: %w", path, err)
+		}
+		data = converted.buf.Bytes()
+		line = converted.line
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return Config{}, fmt.Errorf("unable to parse config %q at line %d: %w", path, line(syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return Config{}, fmt.Errorf("unable to parse config %q at line %d: %w", path, line(typeErr.Offset), err)
+		}
+		return Config{}, fmt.Errorf("unable to parse config %q: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// yamlJSON converts a YAML document to JSON, recording the YAML line of each JSON value.
+type yamlJSON struct {
+	buf   bytes.Buffer
+	marks []yamlJSONMark // ordered by offset
+}
+
+// yamlJSONMark records that the JSON value starting at offset came from the YAML line.
+type yamlJSONMark struct {
+	offset int64
+	line   int
+}
+
+// write appends the node, converted to JSON.
+func (y *yamlJSON) write(node *yaml.Node) error {
+	y.marks = append(y.marks, yamlJSONMark{offset: int64(y.buf.Len()), line: node.Line})
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			y.buf.WriteString("null")
+			return nil
+		}
+		return y.write(node.Content[0])
+
+	case yaml.MappingNode:
+		y.buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: keys must be strings", key.Line)
+			}
+			if i > 0 {
+				y.buf.WriteByte(',')
+			}
+			marshalledKey, _ := json.Marshal(key.Value)
+			y.buf.Write(marshalledKey)
+			y.buf.WriteByte(':')
+			if err := y.write(value); err != nil {
+				return err
+			}
+		}
+		y.buf.WriteByte('}')
+
+	case yaml.SequenceNode:
+		y.buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				y.buf.WriteByte(',')
+			}
+			if err := y.write(item); err != nil {
+				return err
+			}
+		}
+		y.buf.WriteByte(']')
+
+	case yaml.AliasNode:
+		return y.write(node.Alias)
+
+	default:
+		var value any
+		if err := node.Decode(&value); err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		marshalledValue, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		y.buf.Write(marshalledValue)
+	}
+
+	return nil
+}
+
+// line returns the YAML line of the innermost JSON value starting before offset.
+func (y *yamlJSON) line(offset int64) int {
+	i := sort.Search(len(y.marks), func(i int) bool { return y.marks[i].offset >= offset })
+	if i == 0 {
+		return 1
+	}
+	return y.marks[i-1].line
+}
+
+// mergeConfig merges src, loaded from the specified path, into dst.
+func mergeConfig(dst *Config, src Config, path string) []string {
+	var conflicts []string
+
+	routes := src.Routes
+	src.Routes = nil
+	conflicts = append(conflicts, mergeFields(dst, src, func(field string) string {
+		return fmt.Sprintf("config %q overrides %q", path, field)
+	})...)
+
+	for _, srcRoute := range routes {
+		merged := false
+		for i := range dst.Routes {
+			if dst.Routes[i].Path != srcRoute.Path {
+				continue
+			}
+
+			conflicts = append(conflicts, mergeFields(&dst.Routes[i], srcRoute, func(field string) string {
+				return fmt.Sprintf("config %q overrides %q of route %q", path, field, srcRoute.Path)
+			})...)
+			merged = true
+			break
+		}
+
+		if !merged {
+			dst.Routes = append(dst.Routes, srcRoute)
+		}
+	}
+
+	return conflicts
+}
+
+// mergeFields sets each non-zero field of src on dst, which must be a pointer to the same struct type. It returns a
+// description of each non-zero field of dst that was overridden with a different value.
+func mergeFields[T any](dst *T, src T, describe func(field string) string) []string {
+	var conflicts []string
+
+	dstValue := reflect.ValueOf(dst).Elem()
+	srcValue := reflect.ValueOf(src)
+	for i := 0; i < srcValue.NumField(); i++ {
+		srcField := srcValue.Field(i)
+		if srcField.IsZero() {
+			continue
+		}
+
+		dstField := dstValue.Field(i)
+		if !dstField.IsZero() && !reflect.DeepEqual(dstField.Interface(), srcField.Interface()) {
+			field := srcValue.Type().Field(i)
+			if field.Tag.Get("redact") != "" {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s → %s", describe(field.Tag.Get("json")), redacted, redacted))
+			} else {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %v → %v", describe(field.Tag.Get("json")), dstField.Interface(), srcField.Interface()))
+			}
+		}
+
+		dstField.Set(srcField)
+	}
+
+	return conflicts
+}
+
+// redacted replaces the values of fields tagged `redact:"true"`, like API keys, in logs.
+const redacted = "REDACTED"
+
+// redactFields returns a copy of the structs with the values of their fields tagged `redact:"true"`, which must be
+// strings or slices of strings, replaced by redacted.
+func redactFields[T any](structs []T) []T {
+	redactedStructs := make([]T, len(structs))
+	for i, s := range structs {
+		value := reflect.ValueOf(&s).Elem()
+		for j := 0; j < value.NumField(); j++ {
+			field := value.Field(j)
+			if value.Type().Field(j).Tag.Get("redact") == "" || field.IsZero() {
+				continue
+			}
+
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString(redacted)
+			case reflect.Slice:
+				values := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+				for k := 0; k < field.Len(); k++ {
+					values.Index(k).SetString(redacted)
+				}
+				field.Set(values)
+			}
+		}
+		redactedStructs[i] = s
+	}
+
+	return redactedStructs
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigs(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+
+	base := filepath.Join(dir, "base.json")
+	err := os.WriteFile(base, []byte(`{
+		"port": 4444,
+		"region": "us-east-1",
+		"routes": [
+			{"path": "/foo", "stream": "foo", "capacity": 100, "start": "LATEST"},
+			{"path": "/bar", "stream": "bar"}
+		]
+	}`), 0o600)
+	r.NoError(err)
+
+	prod := filepath.Join(dir, "prod.json")
+	err = os.WriteFile(prod, []byte(`{
+		"region": "us-east-2",
+		"routes": [
+			{"path": "/foo", "capacity": 1000},
+			{"path": "/baz", "stream": "baz"}
+		]
+	}`), 0o600)
+	r.NoError(err)
+
+	config, conflicts, err := loadConfigs([]string{base, prod})
+	r.NoError(err)
+
+	r.Equal(Config{
+		Port:   4444,
+		Region: "us-east-2",
+		Routes: []RouteOptionsCLI{
+			{Path: "/foo", Stream: StreamNames{"foo"}, Capacity: 1000, Start: "LATEST"},
+			{Path: "/bar", Stream: StreamNames{"bar"}},
+			{Path: "/baz", Stream: StreamNames{"baz"}},
+		},
+	}, config)
+
+	r.Equal([]string{
+		`config "` + prod + `" overrides "region": us-east-1 → us-east-2`,
+		`config "` + prod + `" overrides "capacity" of route "/foo": 100 → 1000`,
+	}, conflicts)
+
+	// Unparseable configs are reported by path.
+	bogus := filepath.Join(dir, "bogus.json")
+	err = os.WriteFile(bogus, []byte(`bogus`), 0o600)
+	r.NoError(err)
+
+	_, _, err = loadConfigs([]string{base, bogus})
+	r.ErrorContains(err, bogus)
+}
+
+func TestRedactFields(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+
+	base := filepath.Join(dir, "base.json")
+	err := os.WriteFile(base, []byte(`{"routes": [{"path": "/foo", "stream": "foo", "apiKeys": ["old-secret"]}]}`), 0o600)
+	r.NoError(err)
+
+	rotated := filepath.Join(dir, "rotated.json")
+	err = os.WriteFile(rotated, []byte(`{"routes": [{"path": "/foo", "apiKeys": ["new-secret", "other-secret"]}]}`), 0o600)
+	r.NoError(err)
+
+	config, conflicts, err := loadConfigs([]string{base, rotated})
+	r.NoError(err)
+	r.Equal([]string{"new-secret", "other-secret"}, config.Routes[0].APIKeys)
+
+	// API keys are redacted from the conflicts, and from the effective config we log.
+	r.Equal([]string{
+		`config "` + rotated + `" overrides "apiKeys" of route "/foo": REDACTED → REDACTED`,
+	}, conflicts)
+
+	marshalledConfig, err := json.Marshal(Config{Routes: redactFields(config.Routes)})
+	r.NoError(err)
+	r.NotContains(string(marshalledConfig), "secret")
+	r.Contains(string(marshalledConfig), `"apiKeys":["REDACTED","REDACTED"]`)
+
+	// The routes themselves are unchanged.
+	r.Equal([]string{"new-secret", "other-secret"}, config.Routes[0].APIKeys)
+}
+
+func TestLoadConfigsYAML(t *testing.T) {
+	r := require.New(t)
+
+	dir := t.TempDir()
+
+	base := filepath.Join(dir, "base.yaml")
+	err := os.WriteFile(base, []byte(`port: 4444
+region: us-east-1
+corsAllowedOrigins: ["*"]
+routes:
+  - path: /foo
+    stream: foo
+    capacity: 100
+    schema:
+      type: object
+`), 0o600)
+	r.NoError(err)
+
+	prod := filepath.Join(dir, "prod.json")
+	err = os.WriteFile(prod, []byte(`{"routes": [{"path": "/foo", "capacity": 1000}]}`), 0o600)
+	r.NoError(err)
+
+	config, _, err := loadConfigs([]string{base, prod})
+	r.NoError(err)
+
+	r.Equal(Config{
+		Port:               4444,
+		Region:             "us-east-1",
+		CORSAllowedOrigins: []string{"*"},
+		Routes: []RouteOptionsCLI{
+			{Path: "/foo", Stream: StreamNames{"foo"}, Capacity: 1000, Schema: []byte(`{"type":"object"}`)},
+		},
+	}, config)
+}
+
+func TestLoadConfigsErrorLines(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, test := range []struct {
+		name     string
+		contents string
+		line     string
+	}{
+		{"syntax.json", "{\n  \"port\": 4444,\n  bogus\n}", "line 3"},
+		{"type.json", "{\n  \"port\": 4444,\n  \"routes\": [\n    {\"capacity\": \"lots\"}\n  ]\n}", "line 4"},
+		{"syntax.yaml", "port: 4444\nregion: us-east-1\nroutes: : bogus\n", "line 3"},
+		{"type.yml", "port: 4444\nroutes:\n  - path: /foo\n    capacity: lots\n", "line 4"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := require.New(t)
+
+			path := filepath.Join(dir, test.name)
+			err := os.WriteFile(path, []byte(test.contents), 0o600)
+			r.NoError(err)
+
+			_, _, err = loadConfigs([]string{path})
+			r.ErrorContains(err, path)
+			r.ErrorContains(err, test.line)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// resolveCredentials returns the credentials with which a route's KCL workers access its streams, and with which they
+// checkpoint, in the specified region. Both come from the named profile, if set, or else the default credential chain.
+// If roleARN is set, streams are accessed by assuming that role, like for cross-account access, while checkpoints stay
+// in our own account. If neither is set, both are nil, and the KCL uses the default credential chain itself.
+func resolveCredentials(ctx context.Context, region, profile, roleARN string) (kinesisCreds, dynamoDBCreds aws.CredentialsProvider, err error) {
+	if profile == "" && roleARN == "" {
+		return nil, nil, nil
+	}
+
+	if roleARN != "" {
+		if parsed, err := arn.Parse(roleARN); err != nil || parsed.Service != "iam" {
+			return nil, nil, fmt.Errorf("%q is not an IAM role ARN", roleARN)
+		}
+	}
+
+	optFns := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if profile != "" {
+		optFns = append(optFns, config.WithSharedConfigProfile(profile))
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+
+	// NOTE(mroberts): Without a profile, leave checkpoints to the KCL's default credential chain, as before.
+	if profile != "" {
+		dynamoDBCreds = awsConfig.Credentials
+	}
+
+	kinesisCreds = awsConfig.Credentials
+	if roleARN != "" {
+		kinesisCreds = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsConfig), roleARN))
+	}
+
+	return kinesisCreds, dynamoDBCreds, nil
+}
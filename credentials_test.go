@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCredentials(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	r.NoError(os.WriteFile(configFile, []byte("[profile other]\naws_access_key_id = AKIDOTHER\naws_secret_access_key = secret\n"), 0o600))
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDDEFAULT")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_PROFILE", "")
+
+	// Without a profile or role, the KCL uses the default credential chain itself.
+	kinesisCreds, dynamoDBCreds, err := resolveCredentials(ctx, "us-east-2", "", "")
+	r.NoError(err)
+	r.Nil(kinesisCreds)
+	r.Nil(dynamoDBCreds)
+
+	// A profile applies to both streams and checkpoints.
+	kinesisCreds, dynamoDBCreds, err = resolveCredentials(ctx, "us-east-2", "other", "")
+	r.NoError(err)
+	for _, creds := range []aws.CredentialsProvider{kinesisCreds, dynamoDBCreds} {
+		r.NotNil(creds)
+		value, err := creds.Retrieve(ctx)
+		r.NoError(err)
+		r.Equal("AKIDOTHER", value.AccessKeyID)
+	}
+
+	// A role only applies to streams.
+	kinesisCreds, dynamoDBCreds, err = resolveCredentials(ctx, "us-east-2", "", "arn:aws:iam::123456789012:role/kinesis-reader")
+	r.NoError(err)
+	r.IsType(&aws.CredentialsCache{}, kinesisCreds)
+	r.Nil(dynamoDBCreds)
+
+	for _, roleARN := range []string{"kinesis-reader", "arn:aws:kinesis:us-east-2:123456789012:stream/my-stream"} {
+		_, _, err = resolveCredentials(ctx, "us-east-2", "", roleARN)
+		r.ErrorContains(err, "is not an IAM role ARN", roleARN)
+	}
+}
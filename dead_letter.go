@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/markandrus/kinesis2sse/internal/kinesis2sse"
+)
+
+// deadLetterLine is how a kinesis2sse.DeadLetter is written to the --dead-letter-file, one per line. Data is
+// base64-encoded, since records aren't necessarily valid JSON, or even UTF-8.
+type deadLetterLine struct {
+	Route          string `json:"route"`
+	ShardID        string `json:"shardId,omitempty"`
+	SequenceNumber string `json:"sequenceNumber,omitempty"`
+	Reason         string `json:"reason"`
+	Error          string `json:"error,omitempty"`
+	Data           []byte `json:"data"`
+}
+
+// openDeadLetterFile opens the file at path for appending, and returns a function which writes each dead letter to it
+// as a line of JSON.
+func openDeadLetterFile(path string, log *slog.Logger) (func(kinesis2sse.DeadLetter), error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open dead-letter file: %w", err)
+	}
+	return deadLetterWriter(f, log), nil
+}
+
+// deadLetterWriter returns a function which writes each dead letter to w as a line of JSON. It's safe to call from
+// multiple KCL workers at once.
+func deadLetterWriter(w io.Writer, log *slog.Logger) func(kinesis2sse.DeadLetter) {
+	var lock sync.Mutex
+	return func(deadLetter kinesis2sse.DeadLetter) {
+		line := deadLetterLine{
+			Route:          deadLetter.Route,
+			ShardID:        deadLetter.ShardID,
+			SequenceNumber: deadLetter.SequenceNumber,
+			Reason:         deadLetter.Reason,
+			Data:           deadLetter.Data,
+		}
+		if deadLetter.Err != nil {
+			line.Error = deadLetter.Err.Error()
+		}
+
+		b, err := json.Marshal(line)
+		if err != nil {
+			log.Error("Unable to marshal dead letter", "err", err, "route", deadLetter.Route)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			log.Error("Unable to write dead letter", "err", err, "route", deadLetter.Route)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/markandrus/kinesis2sse/internal/kinesis2sse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenDeadLetterFile(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "dead-letters.ndjson")
+	r.NoError(os.WriteFile(path, []byte("{}\n"), 0o600))
+
+	deadLetter, err := openDeadLetterFile(path, slog.New(slog.DiscardHandler))
+	r.NoError(err)
+
+	deadLetter(kinesis2sse.DeadLetter{
+		Route:          "/",
+		ShardID:        "shardId-000000000000",
+		SequenceNumber: "1",
+		Data:           []byte("bogus"),
+		Reason:         "unparseable_json",
+		Err:            errors.New("invalid character 'b'"),
+	})
+	deadLetter(kinesis2sse.DeadLetter{Route: "/", Data: []byte(`{}`), Reason: "memlog_error"})
+
+	// Dead letters are appended, one per line.
+	b, err := os.ReadFile(path)
+	r.NoError(err)
+	r.Equal(`{}
+{"route":"/","shardId":"shardId-000000000000","sequenceNumber":"1","reason":"unparseable_json","error":"invalid character 'b'","data":"Ym9ndXM="}
+{"route":"/","reason":"memlog_error","data":"e30="}
+`, string(b))
+
+	_, err = openDeadLetterFile(filepath.Join(t.TempDir(), "missing", "dead-letters.ndjson"), slog.New(slog.DiscardHandler))
+	r.ErrorContains(err, "unable to open dead-letter file")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	kinesis2sse "github.com/markandrus/kinesis2sse/internal/kinesis2sse"
+)
+
+// listenFDsStart is the first file descriptor passed via the LISTEN_FDS protocol, following stdin, stdout and stderr.
+const listenFDsStart = 3
+
+// inheritedListener returns the listening socket passed to this process using systemd's LISTEN_FDS protocol, if any.
+// This is how both systemd socket activation and graceful restarts (see handOff) pass the socket. Only the first
+// passed file descriptor is used. If LISTEN_PID is set, it must match our PID.
+func inheritedListener() (net.Listener, error) {
+	unparsedFDs := os.Getenv("LISTEN_FDS")
+	if unparsedFDs == "" {
+		return nil, nil
+	}
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	// NOTE(mroberts): Unset these, so that they aren't inherited again by any child processes.
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_PID")
+
+	fds, err := strconv.Atoi(unparsedFDs)
+	if err != nil || fds < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS must be a positive integer, got %q", unparsedFDs)
+	}
+
+	f := os.NewFile(uintptr(listenFDsStart), "listener")
+	if f == nil {
+		return nil, errors.New("unable to open inherited listener")
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use inherited listener: %w", err)
+	}
+
+	return l, nil
+}
+
+// handOff starts a new kinesis2sse process with the same arguments, passing it the Service's listening socket using
+// the LISTEN_FDS protocol. Once it returns, new connections may be accepted by either process, and the caller should
+// stop the Service, letting existing connections drain.
+func handOff(s *kinesis2sse.Service) (*os.Process, error) {
+	f, err := s.ListenerFile()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// restartSignals trigger a graceful restart. Graceful restarts are only supported on Unix.
+var restartSignals []os.Signal
+
+// drainSignals trigger connection draining. Draining by signal is only supported on Unix.
+var drainSignals []os.Signal
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals trigger a graceful restart.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// drainSignals trigger connection draining.
+var drainSignals = []os.Signal{syscall.SIGUSR1}
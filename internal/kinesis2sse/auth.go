@@ -0,0 +1,34 @@
+package kinesis2sse
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// apiKey returns the API key the request carries, either as a bearer token in its Authorization header or, since
+// EventSource can't set headers, in its "api_key" query parameter. The header takes precedence.
+func apiKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	return r.URL.Query().Get("api_key")
+}
+
+// authorized returns true if keys is empty, or if the request carries one of keys.
+func authorized(r *http.Request, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+
+	// NOTE(mroberts): We compare against every key, rather than returning at the first match, so that timing doesn't
+	// reveal which key matched.
+	key := []byte(apiKey(r))
+	match := 0
+	for _, k := range keys {
+		match |= subtle.ConstantTimeCompare(key, []byte(k))
+	}
+
+	return match == 1
+}
@@ -0,0 +1,143 @@
+package kinesis2sse
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// BackfillS3Client is the subset of *s3.Client used to backfill routes from S3.
+type BackfillS3Client interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// backfill reads a route's archived records from S3 into its memlog before its KCL worker starts.
+type backfill struct {
+	client BackfillS3Client
+	bucket string
+	prefix string
+
+	// since and handoff bound the archived records we backfill: those at or after since, and before handoff, which is
+	// where the KCL worker starts.
+	since   time.Time
+	handoff time.Time
+
+	processor *dumpRecordProcessor
+	logger    *slog.Logger // required
+}
+
+// parseS3URI parses an S3 URI, like "s3://my-bucket/events/", into its bucket and key prefix.
+func parseS3URI(uri string) (bucket string, prefix string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not an S3 URI, like \"s3://my-bucket/events/\"", uri)
+	}
+
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// run backfills the archived records. Objects are read in key order, which for archives partitioned by time (like
+// Firehose's "YYYY/MM/DD/HH/" prefixes) is chronological, and records are written in order within each object.
+func (b *backfill) run(ctx context.Context) error {
+	// 1. List the objects under the prefix.
+	var keys []string
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(b.bucket), Prefix: aws.String(b.prefix)}
+	for {
+		output, err := b.client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return fmt.Errorf("unable to list s3://%s/%s: %w", b.bucket, b.prefix, err)
+		}
+
+		for _, object := range output.Contents {
+			// Objects are written after the records they contain, so older objects can't contain records we want.
+			if object.LastModified != nil && object.LastModified.Before(b.since) {
+				continue
+			}
+			keys = append(keys, aws.ToString(object.Key))
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+
+	// 2. Read each object's records into the memlog.
+	keep := func(timestamp time.Time) bool {
+		return !timestamp.Before(b.since) && timestamp.Before(b.handoff)
+	}
+
+	totalIngested, totalSkipped := 0, 0
+	for _, key := range keys {
+		records, err := b.read(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		ingested, skipped := b.processor.ingest(records, keep)
+		b.processor.stats.ingested(ingested, time.Now())
+		b.processor.stats.skipped(skipped)
+
+		totalIngested += ingested
+		for _, n := range skipped {
+			totalSkipped += n
+		}
+	}
+
+	b.logger.Info(fmt.Sprintf("Backfilled %d events from %d objects in s3://%s/%s", totalIngested, len(keys), b.bucket, b.prefix),
+		"skipped", totalSkipped)
+
+	return nil
+}
+
+// read returns the records in the object with the specified key. An object holds one or more JSON records, which may
+// be newline-delimited or simply concatenated, and may be gzipped. Since records have no arrival time of their own,
+// they're given the object's LastModified, which RawPassthrough routes index them by.
+func (b *backfill) read(ctx context.Context, key string) ([]types.Record, error) {
+	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(b.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get s3://%s/%s: %w", b.bucket, key, err)
+	}
+	defer func() { _ = output.Body.Close() }()
+
+	var body io.Reader = bufio.NewReader(output.Body)
+	if magic, err := body.(*bufio.Reader).Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress s3://%s/%s: %w", b.bucket, key, err)
+		}
+		defer func() { _ = gr.Close() }()
+		body = gr
+	}
+
+	var records []types.Record
+	decoder := json.NewDecoder(body)
+	for {
+		var data json.RawMessage
+		if err := decoder.Decode(&data); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			// NOTE(mroberts): We can't resynchronize after invalid JSON, so we keep what we read and skip the rest.
+			b.logger.Warn(fmt.Sprintf("Skipping the rest of s3://%s/%s due to un-parseable JSON", b.bucket, key), "err", err)
+			break
+		}
+
+		records = append(records, types.Record{Data: data, ApproximateArrivalTimestamp: output.LastModified})
+	}
+
+	return records, nil
+}
@@ -0,0 +1,318 @@
+package kinesis2sse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/embano1/memlog"
+	"github.com/stretchr/testify/require"
+	cfg "github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+)
+
+// fakeS3Object is an object served by fakeS3Client.
+type fakeS3Object struct {
+	key          string
+	lastModified time.Time
+	body         []byte
+}
+
+// fakeS3Client serves objects from memory, listing one object per page.
+type fakeS3Client struct {
+	objects []fakeS3Object
+}
+
+func (c *fakeS3Client) ListObjectsV2(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	i := 0
+	if params.ContinuationToken != nil {
+		for i < len(c.objects) && c.objects[i].key != *params.ContinuationToken {
+			i++
+		}
+	}
+
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(i+1 < len(c.objects))}
+	if i < len(c.objects) {
+		output.Contents = []s3types.Object{{Key: aws.String(c.objects[i].key), LastModified: aws.Time(c.objects[i].lastModified)}}
+	}
+	if i+1 < len(c.objects) {
+		output.NextContinuationToken = aws.String(c.objects[i+1].key)
+	}
+
+	return output, nil
+}
+
+func (c *fakeS3Client) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	for _, object := range c.objects {
+		if object.key == *params.Key {
+			return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(object.body)), LastModified: aws.Time(object.lastModified)}, nil
+		}
+	}
+
+	return nil, &s3types.NoSuchKey{}
+}
+
+func TestParseS3URI(t *testing.T) {
+	r := require.New(t)
+
+	bucket, prefix, err := parseS3URI("s3://my-bucket/events/")
+	r.NoError(err)
+	r.Equal("my-bucket", bucket)
+	r.Equal("events/", prefix)
+
+	bucket, prefix, err = parseS3URI("s3://my-bucket")
+	r.NoError(err)
+	r.Equal("my-bucket", bucket)
+	r.Equal("", prefix)
+
+	for _, uri := range []string{"my-bucket/events/", "https://my-bucket/events/", "s3:///events/"} {
+		_, _, err = parseS3URI(uri)
+		r.Error(err, uri)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	r := require.New(t)
+
+	handoff := time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)
+	since := handoff.Add(-7 * 24 * time.Hour)
+
+	event := func(timestamp time.Time, n int) string {
+		return fmt.Sprintf(`{"time":%q,"detail":{"event":%d}}`, timestamp.Format(time.RFC3339), n)
+	}
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write([]byte(event(since.Add(time.Hour), 1) + "\n" + event(since.Add(2*time.Hour), 2) + "\n"))
+	r.NoError(err)
+	r.NoError(gw.Close())
+
+	client := &fakeS3Client{objects: []fakeS3Object{
+		// This object is older than the window, so it isn't even read.
+		{key: "events/2023/12/01/00/a", lastModified: since.Add(-time.Hour), body: []byte(`bogus`)},
+		// This object straddles the start of the window.
+		{key: "events/2024/01/01/00/b", lastModified: since.Add(time.Hour), body: []byte(event(since.Add(-time.Minute), 0) + `bogus`)},
+		{key: "events/2024/01/01/01/c", lastModified: since.Add(3 * time.Hour), body: gzipped.Bytes()},
+		// This object straddles the handoff, and its records are concatenated rather than newline-delimited.
+		{key: "events/2024/01/08/00/d", lastModified: handoff.Add(time.Hour), body: []byte(event(handoff.Add(-time.Minute), 3) + event(handoff, 4) + `not json`)},
+	}}
+
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+	r.NoError(err)
+
+	t2o, err := NewTimestamp2Offset(100)
+	r.NoError(err)
+
+	b := &backfill{
+		client:  client,
+		bucket:  "my-bucket",
+		prefix:  "events/",
+		since:   since,
+		handoff: handoff,
+		processor: &dumpRecordProcessor{
+			ml:        ml,
+			t2o:       t2o,
+			stats:     newRouteStats(),
+			readiness: newReadiness(),
+			envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField},
+			logger:    slog.New(slog.DiscardHandler),
+		},
+		logger: slog.New(slog.DiscardHandler),
+	}
+
+	r.NoError(b.run(context.Background()))
+
+	var events []string
+	_, latest := ml.Range(context.Background())
+	for off := memlog.Offset(0); off <= latest; off++ {
+		record, err := ml.Read(context.Background(), off)
+		r.NoError(err)
+		events = append(events, string(record.Data))
+	}
+
+	r.Equal([]string{`{"event":1}`, `{"event":2}`, `{"event":3}`}, events)
+
+	timestamp, ok := t2o.TimestampForOffset(2)
+	r.True(ok)
+	r.Equal(handoff.Add(-time.Minute), timestamp)
+}
+
+func TestServiceBackfillOptions(t *testing.T) {
+	r := require.New(t)
+
+	newService := func(routeOptions RouteOptions) error {
+		routeOptions.Pattern = "/"
+		routeOptions.BackfillS3Client = &fakeS3Client{}
+		_, err := NewService(ServiceOptions{
+			Routes: []RouteOptions{routeOptions},
+			Logger: slog.New(slog.DiscardHandler),
+		})
+		return err
+	}
+
+	kclConfig := func(position cfg.InitialPositionInStream) *cfg.KinesisClientLibConfiguration {
+		return cfg.NewKinesisClientLibConfig("kinesis2sse-test", "test-stream", "us-east-2", "worker").
+			WithInitialPositionInStream(position)
+	}
+
+	// With LATEST, the KCL worker starts at the handoff instead.
+	latest := kclConfig(cfg.LATEST)
+	r.NoError(newService(RouteOptions{KCLConfig: latest, BackfillS3URI: "s3://my-bucket/events/", BackfillWindow: time.Hour}))
+	r.Equal(cfg.AT_TIMESTAMP, latest.InitialPositionInStream)
+	r.WithinDuration(time.Now(), *latest.InitialPositionInStreamExtended.Timestamp, time.Minute)
+
+	atTimestamp := kclConfig(cfg.LATEST).WithTimestampAtInitialPositionInStream(aws.Time(time.Unix(0, 0)))
+	r.NoError(newService(RouteOptions{KCLConfig: atTimestamp, BackfillS3URI: "s3://my-bucket/events/", BackfillWindow: time.Hour}))
+
+	err := newService(RouteOptions{KCLConfig: kclConfig(cfg.TRIM_HORIZON), BackfillS3URI: "s3://my-bucket/events/", BackfillWindow: time.Hour})
+	r.ErrorContains(err, "LATEST or AT_TIMESTAMP")
+
+	err = newService(RouteOptions{KCLConfig: kclConfig(cfg.LATEST), BackfillS3URI: "s3://my-bucket/events/"})
+	r.ErrorContains(err, "window")
+
+	err = newService(RouteOptions{KCLConfig: kclConfig(cfg.LATEST), BackfillWindow: time.Hour})
+	r.ErrorContains(err, "S3 URI")
+
+	err = newService(RouteOptions{KCLConfig: kclConfig(cfg.LATEST), BackfillS3URI: "my-bucket", BackfillWindow: time.Hour})
+	r.ErrorContains(err, "not an S3 URI")
+}
+
+// failingS3Client fails every request.
+type failingS3Client struct{}
+
+func (failingS3Client) ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return nil, errors.New("access denied")
+}
+
+func (failingS3Client) GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return nil, errors.New("access denied")
+}
+
+func TestServiceStartFailure(t *testing.T) {
+	r := require.New(t)
+
+	kclConfig := func(stream string) *cfg.KinesisClientLibConfiguration {
+		return cfg.NewKinesisClientLibConfig("kinesis2sse-test", stream, "us-east-2", "worker")
+	}
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{Pattern: "/a", KCLConfig: kclConfig("stream-a")},
+			{Pattern: "/b", KCLConfig: kclConfig("stream-b"), BackfillS3URI: "s3://my-bucket/events/", BackfillWindow: time.Hour, BackfillS3Client: failingS3Client{}},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// Routes start concurrently, but "/a" started anyway, so it's rolled back once "/b" fails.
+	err = s.Start()
+	r.ErrorContains(err, `unable to backfill route "/b" (stream "stream-b")`)
+	r.ErrorContains(err, "access denied")
+	r.ErrorContains(err, "rolled back 1 routes which had already started")
+}
+
+// barrierS3Client serves no objects, but each listing waits for every route sharing the barrier to list, too.
+type barrierS3Client struct {
+	fakeS3Client
+	barrier *sync.WaitGroup
+}
+
+func (c *barrierS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	c.barrier.Done()
+
+	arrived := make(chan struct{})
+	go func() {
+		c.barrier.Wait()
+		close(arrived)
+	}()
+
+	select {
+	case <-arrived:
+		return c.fakeS3Client.ListObjectsV2(ctx, params, optFns...)
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("routes didn't start concurrently")
+	}
+}
+
+// gatedS3Client serves no objects, but each listing first waits for an error, or nil, from its gate, and returns it.
+type gatedS3Client struct {
+	fakeS3Client
+	gate chan error
+}
+
+func (c *gatedS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	select {
+	case err := <-c.gate:
+		if err != nil {
+			return nil, err
+		}
+		return c.fakeS3Client.ListObjectsV2(ctx, params, optFns...)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestServiceStartConcurrently(t *testing.T) {
+	r := require.New(t)
+
+	kclConfig := func(stream string) *cfg.KinesisClientLibConfiguration {
+		return cfg.NewKinesisClientLibConfig("kinesis2sse-test", stream, "us-east-2", "worker")
+	}
+
+	var barrier sync.WaitGroup
+	patterns := []string{"/a", "/b", "/c"}
+	barrier.Add(len(patterns))
+
+	var routes []RouteOptions
+	for _, pattern := range patterns {
+		routes = append(routes, RouteOptions{
+			Pattern:          pattern,
+			KCLConfig:        kclConfig("stream" + strings.ReplaceAll(pattern, "/", "-")),
+			BackfillS3URI:    "s3://my-bucket/events/",
+			BackfillWindow:   time.Hour,
+			BackfillS3Client: &barrierS3Client{barrier: &barrier},
+		})
+	}
+
+	s, err := NewService(ServiceOptions{
+		Port:       -1,
+		Routes:     routes,
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// Each route's backfill waits for the others', so they only start if they start together.
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+
+	ready := make(chan struct{})
+	go func() {
+		defer close(ready)
+		_, _ = waitForStart(s)
+	}()
+
+	select {
+	case err := <-started:
+		r.FailNow("Start returned before the routes started", "%v", err)
+	case <-ready:
+	}
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+	r.NoError(<-started)
+}
@@ -0,0 +1,30 @@
+package kinesis2sse
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+)
+
+// handleBatch responds with a JSON array of the events currently in the memlog, from the same starting offset as a
+// stream would use (see readEvents).
+func (s *Service) handleBatch(rt route, w http.ResponseWriter, r *http.Request, params streamParams) {
+	off := startOffset(r.Context(), rt, params, s.logger.With(slog.String("route", rt.pattern)))
+
+	events, err := s.readEvents(r.Context(), rt, off, params)
+	if err != nil {
+		s.logger.Error("Unable to read events", "err", err)
+		writeError(w, r, "Internal Server Error", codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	buf.Write(bytes.Join(events, []byte{','}))
+	buf.WriteByte(']')
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		s.logger.Debug("Unable to write batch", "err", err)
+	}
+}
@@ -0,0 +1,20 @@
+package kinesis2sse
+
+import "encoding/base64"
+
+// encodeBinary encodes an opaque event, from a route with Binary set, as base64, so that it fits in an SSE "data"
+// field.
+func encodeBinary(data []byte) []byte {
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(encoded, data)
+	return encoded
+}
+
+// encodeBinaryJSON encodes an opaque event as a JSON string containing its base64 encoding, for NDJSON and JSON
+// clients. Base64 needs no escaping, so we just quote it.
+func encodeBinaryJSON(data []byte) []byte {
+	encoded := make([]byte, 0, base64.StdEncoding.EncodedLen(len(data))+2)
+	encoded = append(encoded, '"')
+	encoded = append(encoded, encodeBinary(data)...)
+	return append(encoded, '"')
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,6 +30,16 @@ type marshalledCheckpoint struct {
 	parentShardId  string
 }
 
+// ShardInfo is a point-in-time snapshot of a shard's lease and checkpoint.
+type ShardInfo struct {
+	Stream        string    `json:"stream,omitempty"`
+	ShardID       string    `json:"shardId"`
+	ParentShardID string    `json:"parentShardId,omitempty"`
+	AssignedTo    string    `json:"assignedTo"`
+	Checkpoint    string    `json:"checkpoint,omitempty"`
+	LeaseTimeout  time.Time `json:"leaseTimeout"`
+}
+
 func NewInMemoryCheckpointer(workerID string, logger *slog.Logger) chk.Checkpointer {
 	return &inMemoryCheckpointer{
 		workerID: workerID,
@@ -154,6 +166,27 @@ func (checkpointer *inMemoryCheckpointer) ClaimShard(shard *par.ShardStatus, _ s
 	return checkpointer.saveItem(shard.ID, item)
 }
 
+// shards returns a snapshot of each shard's lease and checkpoint, sorted by shard ID. Since there's only one worker,
+// every shard is assigned to it.
+func (checkpointer *inMemoryCheckpointer) shards() []ShardInfo {
+	checkpointer.lock.Lock()
+	defer checkpointer.lock.Unlock()
+
+	shards := make([]ShardInfo, 0, len(checkpointer.m))
+	for shardID, item := range checkpointer.m {
+		shards = append(shards, ShardInfo{
+			ShardID:       shardID,
+			ParentShardID: item.parentShardId,
+			AssignedTo:    checkpointer.workerID,
+			Checkpoint:    item.sequenceNumber,
+			LeaseTimeout:  item.leaseTimeout,
+		})
+	}
+	slices.SortFunc(shards, func(a, b ShardInfo) int { return strings.Compare(a.ShardID, b.ShardID) })
+
+	return shards
+}
+
 func (checkpointer *inMemoryCheckpointer) saveItem(shardID string, item marshalledCheckpoint) error {
 	checkpointer.lock.Lock()
 	defer checkpointer.lock.Unlock()
@@ -0,0 +1,74 @@
+package kinesis2sse
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/embano1/memlog"
+)
+
+// DefaultCloudEventsType is the CloudEvents "type" of events which lack the route's CloudEventsTypeField.
+const DefaultCloudEventsType = "kinesis2sse.event"
+
+// cloudEvent is a CloudEvent in the JSON structured format (application/cloudevents+json). See
+//
+//	https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/formats/json-format.md
+type structuredCloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+
+	// KinesisSequence is an extension attribute with the Kinesis sequence number of the event's record.
+	KinesisSequence string `json:"kinesissequence,omitempty"`
+}
+
+// formatCloudEvent wraps the event at the specified offset in a CloudEvent. Its "id" is the offset, its "time" is the
+// event's timestamp, its "source" is the route's primary stream (or else its pattern), and its "type" is the event's
+// CloudEventsTypeField. JSON events are its "data"; other events are "data_base64", if the route is Binary, or else a
+// string. If includeSequence is set, its "kinesissequence" is the Kinesis sequence number of its record, if known.
+func (rt route) formatCloudEvent(off memlog.Offset, data []byte, includeSequence bool) []byte {
+	event := structuredCloudEvent{
+		SpecVersion: "1.0",
+		ID:          strconv.Itoa(int(off)),
+		Source:      rt.stream(),
+		Type:        DefaultCloudEventsType,
+	}
+
+	if event.Source == "" {
+		event.Source = rt.pattern
+	}
+
+	if timestamp, ok := rt.t2o.TimestampForOffset(int(off)); ok {
+		event.Time = timestamp.UTC().Format(TimestampFormat)
+	}
+
+	if includeSequence {
+		event.KinesisSequence, _ = rt.t2o.SequenceNumberForOffset(int(off))
+	}
+
+	switch {
+	case rt.binary:
+		event.DataContentType = "application/octet-stream"
+		event.DataBase64 = data
+	case json.Valid(data):
+		event.DataContentType = "application/json"
+		event.Data = data
+		if rt.cloudEventsTypeField != "" {
+			if eventType, ok := eventName(data, rt.cloudEventsTypeField); ok {
+				event.Type = eventType
+			}
+		}
+	default:
+		event.DataContentType = "text/plain"
+		event.Data, _ = json.Marshal(string(data))
+	}
+
+	// NOTE(mroberts): This can't fail: every field is a string, valid JSON, or bytes.
+	encoded, _ := json.Marshal(event)
+	return encoded
+}
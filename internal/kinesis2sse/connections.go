@@ -0,0 +1,111 @@
+package kinesis2sse
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connection tracks an active connection's parameters and progress. Counters are updated by handleFunc and may be read
+// concurrently.
+type connection struct {
+	remoteAddr  string
+	connectedAt time.Time
+	since       string
+	until       string
+	limit       int
+
+	bytesSent  atomic.Int64
+	eventsSent atomic.Int64
+	offset     atomic.Int64
+}
+
+// sent records that the specified number of events, through the specified offset, were written to the connection.
+func (c *connection) sent(off int, events int, bytes int) {
+	c.bytesSent.Add(int64(bytes))
+	c.eventsSent.Add(int64(events))
+	c.offset.Store(int64(off))
+}
+
+// ConnectionInfo is a point-in-time snapshot of an active connection.
+type ConnectionInfo struct {
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Since       string    `json:"since,omitempty"`
+	Until       string    `json:"until,omitempty"`
+	Limit       int       `json:"limit,omitempty"`
+	BytesSent   int64     `json:"bytesSent"`
+	EventsSent  int64     `json:"eventsSent"`
+	Offset      int64     `json:"offset"`
+}
+
+// connectionRegistry is the set of a route's active connections. It's safe for concurrent use.
+type connectionRegistry struct {
+	lock        *sync.Mutex
+	connections map[*connection]struct{}
+
+	// lastActive is when a connection was last added or removed, or else when the registry was created.
+	lastActive time.Time
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{
+		lock:        &sync.Mutex{},
+		connections: make(map[*connection]struct{}),
+		lastActive:  time.Now(),
+	}
+}
+
+func (r *connectionRegistry) add(c *connection) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.connections[c] = struct{}{}
+	r.lastActive = time.Now()
+}
+
+func (r *connectionRegistry) remove(c *connection) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.connections, c)
+	r.lastActive = time.Now()
+}
+
+// idle returns when a connection was last added or removed, and whether there are no active connections.
+func (r *connectionRegistry) idle() (time.Time, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastActive, len(r.connections) == 0
+}
+
+// len returns the number of active connections.
+func (r *connectionRegistry) len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.connections)
+}
+
+// list returns a snapshot of the active connections, oldest first.
+func (r *connectionRegistry) list() []ConnectionInfo {
+	r.lock.Lock()
+	infos := make([]ConnectionInfo, 0, len(r.connections))
+	for c := range r.connections {
+		infos = append(infos, ConnectionInfo{
+			RemoteAddr:  c.remoteAddr,
+			ConnectedAt: c.connectedAt,
+			Since:       c.since,
+			Until:       c.until,
+			Limit:       c.limit,
+			BytesSent:   c.bytesSent.Load(),
+			EventsSent:  c.eventsSent.Load(),
+			Offset:      c.offset.Load(),
+		})
+	}
+	r.lock.Unlock()
+
+	slices.SortFunc(infos, func(a, b ConnectionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	return infos
+}
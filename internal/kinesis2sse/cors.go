@@ -0,0 +1,59 @@
+package kinesis2sse
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// DefaultAllowedOrigins allows any origin.
+var DefaultAllowedOrigins = []string{"*"}
+
+// corsAllowedHeaders are the request headers which browsers may send cross-origin.
+var corsAllowedHeaders = []string{"Authorization", "Cache-Control", "Last-Event-ID"}
+
+// CORSOptions configure Cross-Origin Resource Sharing (CORS) for the SSE routes and /health.
+type CORSOptions struct {
+	// AllowedOrigins are the origins, like "https://example.com", which browsers may request from. "*" allows any
+	// origin. Defaults to DefaultAllowedOrigins; set it to an empty, non-nil slice to disallow cross-origin requests.
+	AllowedOrigins []string
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin for the specified Origin, if it's allowed.
+func (c CORSOptions) allowOrigin(origin string) (string, bool) {
+	if slices.Contains(c.AllowedOrigins, "*") {
+		return "*", true
+	}
+
+	if origin != "" && slices.Contains(c.AllowedOrigins, origin) {
+		return origin, true
+	}
+
+	return "", false
+}
+
+// setCORSHeaders sets the CORS headers for a request, if its origin is allowed. It returns true if the request was a
+// preflight request, which has been fully handled.
+func (c CORSOptions) setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	allowOrigin, ok := c.allowOrigin(r.Header.Get("Origin"))
+	if ok {
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+	}
+
+	// NOTE(mroberts): When we echo a specific origin, caches must not serve the response to other origins.
+	if allowOrigin != "*" && len(c.AllowedOrigins) > 0 {
+		w.Header().Add("Vary", "Origin")
+	}
+
+	if r.Method != http.MethodOptions {
+		return false
+	}
+
+	if ok {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join([]string{http.MethodGet, http.MethodOptions}, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
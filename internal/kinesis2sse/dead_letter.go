@@ -0,0 +1,49 @@
+package kinesis2sse
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// DeadLetterReasonTooLarge is the DeadLetter.Reason of events dropped for exceeding RouteOptions.MaxEventBytes. Other
+// reasons match the kinesis2sse_events_skipped_by_reason_total metric's "reason" label, like "unparseable_json" or
+// "memlog_error".
+const DeadLetterReasonTooLarge = "too_large"
+
+// DeadLetter is a record which a route was unable to serve.
+type DeadLetter struct {
+	// Route is the pattern of the route which read the record.
+	Route string
+
+	// ShardID is the shard the record was read from. It's prefixed by the stream's name if the route is fed by multiple
+	// streams, and empty for backfilled records.
+	ShardID string
+
+	// SequenceNumber is the record's sequence number, if any.
+	SequenceNumber string
+
+	// Data is the record's raw bytes, as read from Kinesis.
+	Data []byte
+
+	// Reason is why the record couldn't be served, like "unparseable_json" or DeadLetterReasonTooLarge.
+	Reason string
+
+	// Err describes what went wrong.
+	Err error
+}
+
+// appendDeadLetter appends the record to deadLetters, to send to the route's dead-letter sink, if it has one.
+func (dd *dumpRecordProcessor) appendDeadLetter(deadLetters []DeadLetter, record types.Record, reason string, err error) []DeadLetter {
+	if dd.deadLetterFunc == nil {
+		return deadLetters
+	}
+
+	return append(deadLetters, DeadLetter{
+		Route:          dd.route,
+		ShardID:        dd.shardID,
+		SequenceNumber: aws.ToString(record.SequenceNumber),
+		Data:           record.Data,
+		Reason:         reason,
+		Err:            err,
+	})
+}
@@ -0,0 +1,386 @@
+package kinesis2sse
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	cfg "github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+)
+
+const (
+	// DefaultMaxDynamicRoutes is the default number of routes a DynamicRouteOptions may create at once.
+	DefaultMaxDynamicRoutes = 100
+
+	// DefaultDynamicRouteIdleTimeout is how long, by default, a dynamic route may go without connections before it's
+	// removed.
+	DefaultDynamicRouteIdleTimeout = 10 * time.Minute
+
+	// maxDynamicRouteSweepInterval is the longest we wait between looking for idle dynamic routes.
+	maxDynamicRouteSweepInterval = time.Minute
+)
+
+// DynamicRouteOptions configures a pattern with wildcards, like "/tenants/{tenant}/events", whose matches are each
+// served by their own route, like "/tenants/acme/events". Each route is created, using AddRoute, when it's first
+// requested, and removed, using RemoveRoute, once it's been idle for IdleTimeout.
+type DynamicRouteOptions struct {
+	// Pattern is the pattern to pass to http.ServeMux.HandleFunc. It must have at least one wildcard, and each wildcard
+	// must match a single path segment. Values other than Kinesis Stream names, which consist of letters, digits, "_",
+	// "-", and ".", are rejected with 404 Not Found.
+	Pattern string
+
+	// StreamTemplate is the name of each route's Kinesis Stream, with the Pattern's wildcards substituted, like
+	// "{tenant}-events".
+	StreamTemplate string
+
+	// NewKCLConfig returns the KCL configuration for each route's Kinesis Stream. If unset, routes have no KCL worker.
+	NewKCLConfig func(stream string) (*cfg.KinesisClientLibConfiguration, error)
+
+	// Route is the template of each route's options. Its Pattern and KCL configurations must be unset.
+	Route RouteOptions
+
+	// MaxRoutes is the number of routes which may exist at once. Once it's reached, requesting another route removes
+	// the least recently active route without any connections, or, if every route has connections, is rejected with
+	// 503 Service Unavailable. Routes which are still starting count towards it, too. Defaults to
+	// DefaultMaxDynamicRoutes.
+	//
+	// NOTE(mroberts): We only remove a route once the route replacing it has started, so that requests for streams
+	// which don't exist can't remove routes which do. Until then, one more route than MaxRoutes exists, which a
+	// ServiceOptions.MemoryBudget must leave room for.
+	MaxRoutes int
+
+	// IdleTimeout is how long a route may go without connections before it's removed. Defaults to
+	// DefaultDynamicRouteIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// errDynamicRouteLimit is returned when a dynamic route can't be created, because MaxRoutes routes with connections
+// already exist.
+var errDynamicRouteLimit = errors.New("too many dynamic routes")
+
+var (
+	// wildcardRegexp matches the wildcards of an http.ServeMux pattern, like "{tenant}", capturing their names.
+	wildcardRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+	// wildcardValueRegexp matches the values we substitute for wildcards, which are valid Kinesis Stream names.
+	wildcardValueRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// dynamicRoute is a validated DynamicRouteOptions, along with the routes created from it.
+type dynamicRoute struct {
+	DynamicRouteOptions
+	wildcards []string
+
+	// routes are the patterns of the routes created from the DynamicRouteOptions, and creating are those of the routes
+	// being created. They're guarded by Service.dynamicLock.
+	routes   map[string]struct{}
+	creating map[string]*dynamicRouteCreation
+}
+
+// dynamicRouteCreation is a route being created from a dynamic route. Requests for the route while it's being created
+// wait for done, and then share its err.
+type dynamicRouteCreation struct {
+	done chan struct{}
+	err  error
+}
+
+func newDynamicRoute(options DynamicRouteOptions) (*dynamicRoute, error) {
+	if err := validatePattern(options.Pattern); err != nil {
+		return nil, err
+	}
+
+	var wildcards []string
+	for _, match := range wildcardRegexp.FindAllStringSubmatch(patternPath(options.Pattern), -1) {
+		name := match[1]
+		switch {
+		case name == "$":
+			continue
+		case strings.HasSuffix(name, "..."):
+			return nil, fmt.Errorf("wildcard %q must match a single path segment", name)
+		}
+		wildcards = append(wildcards, name)
+	}
+	if len(wildcards) == 0 {
+		return nil, fmt.Errorf("pattern %q must have a wildcard", options.Pattern)
+	}
+
+	if options.NewKCLConfig != nil && options.StreamTemplate == "" {
+		return nil, errors.New("stream template must be set")
+	}
+	for _, match := range wildcardRegexp.FindAllStringSubmatch(options.StreamTemplate, -1) {
+		if !slices.Contains(wildcards, match[1]) {
+			return nil, fmt.Errorf("stream template %q uses wildcard %q, which the pattern lacks", options.StreamTemplate, match[1])
+		}
+	}
+
+	if options.Route.Pattern != "" || options.Route.KCLConfig != nil || len(options.Route.AdditionalKCLConfigs) > 0 {
+		return nil, errors.New("route template must not set a pattern or KCL configs")
+	}
+
+	if options.MaxRoutes < 0 {
+		return nil, errors.New("max routes must be non-negative")
+	}
+	if options.MaxRoutes == 0 {
+		options.MaxRoutes = DefaultMaxDynamicRoutes
+	}
+
+	if options.IdleTimeout < 0 {
+		return nil, errors.New("idle timeout must be non-negative")
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = DefaultDynamicRouteIdleTimeout
+	}
+
+	return &dynamicRoute{
+		DynamicRouteOptions: options,
+		wildcards:           wildcards,
+		routes:              make(map[string]struct{}),
+		creating:            make(map[string]*dynamicRouteCreation),
+	}, nil
+}
+
+// matches returns whether the request's wildcard values are all valid Kinesis Stream names.
+func (dr *dynamicRoute) matches(r *http.Request) bool {
+	for _, name := range dr.wildcards {
+		value := r.PathValue(name)
+		if !wildcardValueRegexp.MatchString(value) || value == "." || value == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// expand substitutes the request's wildcard values into the template, which is the Pattern or StreamTemplate.
+func (dr *dynamicRoute) expand(template string, r *http.Request) string {
+	return wildcardRegexp.ReplaceAllStringFunc(template, func(wildcard string) string {
+		name := wildcard[1 : len(wildcard)-1]
+		if !slices.Contains(dr.wildcards, name) {
+			return wildcard
+		}
+		return r.PathValue(name)
+	})
+}
+
+// handleDynamic serves a request matching a dynamic route's Pattern, first creating the route for its wildcards'
+// values, unless it already exists. Once the route exists, the ServeMux routes further requests to it directly, since
+// its pattern is more specific.
+func (s *Service) handleDynamic(dr *dynamicRoute, w http.ResponseWriter, r *http.Request) {
+	if !dr.matches(r) {
+		writeError(w, r, "404 page not found", codeNotFound, http.StatusNotFound)
+		return
+	}
+
+	pattern := dr.expand(dr.Pattern, r)
+	rt, err := s.dynamicRouteFor(dr, pattern, r)
+	if err != nil {
+		if errors.Is(err, errDynamicRouteLimit) {
+			w.Header().Set("Retry-After", jitteredRetryAfter(DefaultConnectionLimitRetryAfter))
+			writeError(w, r, "Service Unavailable", codeTooManyRoutes, http.StatusServiceUnavailable)
+			return
+		}
+		s.logger.Error("Unable to create dynamic route", "err", err, "route", pattern)
+		writeError(w, r, "Service Unavailable", codeServiceUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	s.handleFunc(rt, w, r)
+}
+
+// dynamicRouteFor returns the route with the specified pattern, creating it from the dynamic route if it doesn't exist.
+// If MaxRoutes routes exist already, it removes the least recently active route without any connections once the new
+// route has started.
+//
+// NOTE(mroberts): Starting a route may take a while, since its KCL worker retries, so we don't hold dynamicLock
+// meanwhile. Instead, concurrent requests for the same route wait for the first to create it. Removing a route waits
+// for its KCL workers to shut down, so we don't hold dynamicLock for that, either.
+func (s *Service) dynamicRouteFor(dr *dynamicRoute, pattern string, r *http.Request) (route, error) {
+	// 1. Return the route, if it exists, or else wait for the request which is creating it.
+	s.dynamicLock.Lock()
+	routes := s.routesSnapshot()
+	if rt, ok := routes[pattern]; ok {
+		s.dynamicLock.Unlock()
+		return rt, nil
+	}
+
+	if creation, ok := dr.creating[pattern]; ok {
+		s.dynamicLock.Unlock()
+		select {
+		case <-creation.done:
+		case <-r.Context().Done():
+			return route{}, r.Context().Err()
+		}
+		if creation.err != nil {
+			return route{}, creation.err
+		}
+		rt, ok := s.routesSnapshot()[pattern]
+		if !ok {
+			return route{}, fmt.Errorf("route %q was removed", pattern)
+		}
+		return rt, nil
+	}
+
+	// 2. Check that there's room for the route, counting those being created, and those we could remove.
+	dr.forgetRemoved(routes)
+	if len(dr.routes)+len(dr.creating) >= dr.MaxRoutes+len(dr.idle(routes, "")) {
+		s.dynamicLock.Unlock()
+		return route{}, errDynamicRouteLimit
+	}
+
+	creation := &dynamicRouteCreation{done: make(chan struct{})}
+	dr.creating[pattern] = creation
+	s.dynamicLock.Unlock()
+
+	// 3. Create and start the route.
+	err := s.addDynamicRoute(dr, pattern, r)
+
+	s.dynamicLock.Lock()
+	delete(dr.creating, pattern)
+	if err != nil {
+		creation.err = err
+		close(creation.done)
+		s.dynamicLock.Unlock()
+		return route{}, err
+	}
+	dr.routes[pattern] = struct{}{}
+	s.logger.Info("Created dynamic route", "route", pattern)
+
+	// 4. Choose a route to make room for it, if MaxRoutes routes existed already. If every other route gained
+	// connections meanwhile, choose it instead.
+	routes = s.routesSnapshot()
+	dr.forgetRemoved(routes)
+	evict := ""
+	if len(dr.routes) > dr.MaxRoutes {
+		evict = pattern
+		if idle := dr.idle(routes, pattern); len(idle) > 0 {
+			evict = idle[0]
+		}
+		delete(dr.routes, evict)
+	}
+	if evict == pattern {
+		creation.err = errDynamicRouteLimit
+	}
+	close(creation.done)
+	s.dynamicLock.Unlock()
+
+	// 5. Remove the route we chose, now that we've released dynamicLock.
+	if evict != "" {
+		if err := s.RemoveRoute(evict); err != nil {
+			return route{}, err
+		}
+
+		if evict == pattern {
+			return route{}, errDynamicRouteLimit
+		}
+		s.logger.Info("Removed dynamic route to make room for another", "route", evict, "for", pattern)
+	}
+
+	rt, ok := s.routesSnapshot()[pattern]
+	if !ok {
+		return route{}, fmt.Errorf("route %q was removed", pattern)
+	}
+	return rt, nil
+}
+
+// addDynamicRoute adds the route with the specified pattern, using AddRoute, from the dynamic route's template.
+func (s *Service) addDynamicRoute(dr *dynamicRoute, pattern string, r *http.Request) error {
+	routeOptions := dr.Route
+	routeOptions.Pattern = pattern
+	if dr.NewKCLConfig != nil {
+		kclConfig, err := dr.NewKCLConfig(dr.expand(dr.StreamTemplate, r))
+		if err != nil {
+			return err
+		}
+		routeOptions.KCLConfig = kclConfig
+	}
+
+	return s.AddRoute(routeOptions)
+}
+
+// forgetRemoved forgets the routes which were removed some other way, like by RemoveRoute. The caller must hold
+// Service.dynamicLock.
+func (dr *dynamicRoute) forgetRemoved(routes map[string]route) {
+	for created := range dr.routes {
+		if _, ok := routes[created]; !ok {
+			delete(dr.routes, created)
+		}
+	}
+}
+
+// idle returns the patterns of the routes without any connections, other than except, from least to most recently
+// active. The caller must hold Service.dynamicLock.
+func (dr *dynamicRoute) idle(routes map[string]route, except string) []string {
+	var patterns []string
+	lastActive := make(map[string]time.Time)
+	for created := range dr.routes {
+		if created == except {
+			continue
+		}
+		if at, idle := routes[created].connections.idle(); idle {
+			patterns = append(patterns, created)
+			lastActive[created] = at
+		}
+	}
+
+	slices.SortFunc(patterns, func(a, b string) int {
+		return lastActive[a].Compare(lastActive[b])
+	})
+	return patterns
+}
+
+// sweepDynamicRoutes periodically removes idle dynamic routes, until the service stops.
+func (s *Service) sweepDynamicRoutes() {
+	interval := maxDynamicRouteSweepInterval
+	for _, dr := range s.dynamicRoutes {
+		interval = min(interval, dr.IdleTimeout/2)
+	}
+
+	ticker := time.NewTicker(max(interval, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.removeIdleDynamicRoutes(now)
+		}
+	}
+}
+
+// removeIdleDynamicRoutes removes the dynamic routes which have had no connections for their IdleTimeout.
+//
+// NOTE(mroberts): A client may connect between checking that a route is idle and removing it, in which case its stream
+// ends, like for any removed route, and reconnecting creates the route again. We remove the routes after releasing
+// dynamicLock, since removing a route waits for its KCL workers to shut down.
+func (s *Service) removeIdleDynamicRoutes(now time.Time) {
+	// 1. Choose the idle routes, and forget them.
+	var evict []string
+	s.dynamicLock.Lock()
+	routes := s.routesSnapshot()
+	for _, dr := range s.dynamicRoutes {
+		dr.forgetRemoved(routes)
+		for created := range dr.routes {
+			lastActive, idle := routes[created].connections.idle()
+			if !idle || now.Sub(lastActive) < dr.IdleTimeout {
+				continue
+			}
+
+			delete(dr.routes, created)
+			evict = append(evict, created)
+		}
+	}
+	s.dynamicLock.Unlock()
+
+	// 2. Remove them.
+	for _, pattern := range evict {
+		if err := s.RemoveRoute(pattern); err != nil {
+			s.logger.Error("Unable to remove idle dynamic route", "err", err, "route", pattern)
+			continue
+		}
+		s.logger.Info("Removed idle dynamic route", "route", pattern)
+	}
+}
@@ -0,0 +1,89 @@
+package kinesis2sse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// Encoding determines how a route's events are stored in its memlog. Compressed events are decompressed before they're
+// served, so clients can't tell the difference.
+type Encoding string
+
+const (
+	// EncodingNone stores events uncompressed. This is the default.
+	EncodingNone Encoding = "none"
+
+	// EncodingGzip stores gzip-compressed events. It compresses better than EncodingSnappy, but costs more CPU.
+	EncodingGzip Encoding = "gzip"
+
+	// EncodingSnappy stores Snappy-compressed events. It's cheap to compress and decompress, but compresses less.
+	EncodingSnappy Encoding = "snappy"
+)
+
+// NOTE(mroberts): gzip.Writers allocate hundreds of kilobytes each, so we reuse them between events.
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// validate returns the encoding, defaulting to EncodingNone, or an error if it's unknown.
+func (e Encoding) validate() (Encoding, error) {
+	switch e {
+	case "":
+		return EncodingNone, nil
+	case EncodingNone, EncodingGzip, EncodingSnappy:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q", e)
+	}
+}
+
+// encode returns the event as it should be written to the memlog.
+func (e Encoding) encode(data []byte) ([]byte, error) {
+	switch e {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		gz := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(gz)
+
+		gz.Reset(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case EncodingSnappy:
+		return snappy.Encode(nil, data), nil
+	default:
+		return data, nil
+	}
+}
+
+// decode returns the event as it was before encode.
+func (e Encoding) decode(data []byte) ([]byte, error) {
+	switch e {
+	case EncodingGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+
+		return io.ReadAll(gz)
+	case EncodingSnappy:
+		return snappy.Decode(nil, data)
+	default:
+		return data, nil
+	}
+}
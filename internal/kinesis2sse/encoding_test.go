@@ -0,0 +1,74 @@
+package kinesis2sse
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sampleEvent returns a text-heavy JSON event, typical of what routes serve.
+func sampleEvent(i int) []byte {
+	var items []string
+	for j := 0; j < 5; j++ {
+		items = append(items, fmt.Sprintf(`{"sku":"SKU-%04d","description":"Widget, size %d, in the standard color","quantity":%d,"status":"shipped"}`, j, j, j+1))
+	}
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"order.updated","customer":{"name":"Jane Doe","email":"jane.doe@example.com"},"items":[%s]}`, i, strings.Join(items, ",")))
+}
+
+func TestEncoding(t *testing.T) {
+	r := require.New(t)
+
+	encoding, err := Encoding("").validate()
+	r.NoError(err)
+	r.Equal(EncodingNone, encoding)
+
+	_, err = Encoding("zstd").validate()
+	r.ErrorContains(err, `unknown encoding "zstd"`)
+
+	event := sampleEvent(0)
+	sizes := make(map[Encoding]int)
+	for _, encoding := range []Encoding{EncodingNone, EncodingGzip, EncodingSnappy} {
+		encoded, err := encoding.encode(event)
+		r.NoError(err, encoding)
+		sizes[encoding] = len(encoded)
+
+		decoded, err := encoding.decode(encoded)
+		r.NoError(err, encoding)
+		r.Equal(event, decoded, encoding)
+	}
+
+	// Uncompressed events are stored as-is, whereas compressed events take up less memory, gzip's least of all.
+	r.Equal(len(event), sizes[EncodingNone])
+	r.Less(sizes[EncodingSnappy], sizes[EncodingNone])
+	r.Less(sizes[EncodingGzip], sizes[EncodingSnappy])
+
+	_, err = EncodingGzip.decode([]byte("not gzip"))
+	r.Error(err)
+}
+
+// BenchmarkEncoding measures the CPU cost of each encoding, to compress an event and decompress it once, along with
+// how many bytes of memory it stores per event.
+func BenchmarkEncoding(b *testing.B) {
+	event := sampleEvent(0)
+	for _, encoding := range []Encoding{EncodingNone, EncodingGzip, EncodingSnappy} {
+		b.Run(string(encoding), func(b *testing.B) {
+			var encoded []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if encoded, err = encoding.encode(event); err != nil {
+					b.Fatal(err)
+				}
+				decoded, err := encoding.decode(encoded)
+				if err != nil {
+					b.Fatal(err)
+				} else if !bytes.Equal(event, decoded) {
+					b.Fatal("decoded event doesn't match")
+				}
+			}
+			b.ReportMetric(float64(len(encoded)), "stored-bytes/event")
+		})
+	}
+}
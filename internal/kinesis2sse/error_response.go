@@ -0,0 +1,56 @@
+package kinesis2sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// errorCode is a stable, machine-readable identifier of an error response, so that clients and API gateways can handle
+// errors without parsing their messages.
+type errorCode string
+
+const (
+	codeBadRequest         errorCode = "bad_request"
+	codeUnauthorized       errorCode = "unauthorized"
+	codeNotFound           errorCode = "not_found"
+	codeNotAcceptable      errorCode = "not_acceptable"
+	codeInternalError      errorCode = "internal_error"
+	codeServiceUnavailable errorCode = "service_unavailable"
+	codeStartingUp         errorCode = "starting_up"
+	codeDraining           errorCode = "draining"
+	codeTooManyConnections errorCode = "too_many_connections"
+	codeTooManyRoutes      errorCode = "too_many_routes"
+	codeLagging            errorCode = "lagging"
+	codeNotReady           errorCode = "not_ready"
+)
+
+// errorResponse is the body of an error response to clients which accept JSON.
+type errorResponse struct {
+	Error string    `json:"error"`
+	Code  errorCode `json:"code"`
+}
+
+// writeError responds with the status and message, like http.Error. If the client negotiated JSON or NDJSON with its
+// Accept header, the response is instead a JSON object with the message and code, like
+//
+//	{"error":"Unauthorized","code":"unauthorized"}
+func writeError(w http.ResponseWriter, r *http.Request, message string, code errorCode, status int) {
+	if mode, ok := negotiateMode(r); !ok || mode == modeSSE {
+		http.Error(w, message, status)
+		return
+	}
+
+	body, err := json.Marshal(errorResponse{Error: message, Code: code})
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	// NOTE(mroberts): Like http.Error, we drop headers which described a body we're no longer sending.
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "%s\n", body)
+}
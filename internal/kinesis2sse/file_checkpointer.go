@@ -0,0 +1,171 @@
+package kinesis2sse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// checkpointFile is a JSON file storing each route's checkpoints, keyed by route pattern and then shard ID. It's shared
+// by every route's fileCheckpointer, and safe for concurrent use.
+type checkpointFile struct {
+	path   string
+	routes map[string]map[string]persistedCheckpoint
+	logger *slog.Logger // required
+	lock   *sync.Mutex
+}
+
+// persistedCheckpoint is the JSON representation of a marshalledCheckpoint. We don't persist lease timeouts, since
+// leases don't outlive the process.
+type persistedCheckpoint struct {
+	SequenceNumber string `json:"sequenceNumber"`
+	ParentShardID  string `json:"parentShardId,omitempty"`
+}
+
+// newCheckpointFile loads the checkpoint file at path. If the file is missing or corrupt, it logs a warning and starts
+// fresh.
+func newCheckpointFile(path string, logger *slog.Logger) *checkpointFile {
+	f := &checkpointFile{
+		path:   path,
+		routes: make(map[string]map[string]persistedCheckpoint),
+		logger: logger,
+		lock:   &sync.Mutex{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("Checkpoint file does not exist. Starting fresh", "path", path)
+		return f
+	} else if err != nil {
+		logger.Warn("Unable to read checkpoint file. Starting fresh", "path", path, "err", err)
+		return f
+	}
+
+	var routes map[string]map[string]persistedCheckpoint
+	if err := json.Unmarshal(data, &routes); err != nil {
+		logger.Warn("Unable to parse checkpoint file. Starting fresh", "path", path, "err", err)
+		return f
+	}
+	if routes != nil {
+		f.routes = routes
+	}
+
+	return f
+}
+
+// load returns the route's checkpoints.
+func (f *checkpointFile) load(pattern string) map[string]marshalledCheckpoint {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	m := make(map[string]marshalledCheckpoint, len(f.routes[pattern]))
+	for shardID, checkpoint := range f.routes[pattern] {
+		m[shardID] = marshalledCheckpoint{
+			sequenceNumber: checkpoint.SequenceNumber,
+			parentShardId:  checkpoint.ParentShardID,
+		}
+	}
+
+	return m
+}
+
+// save replaces the route's checkpoints and writes the file. It writes to a temporary file first and renames it, so
+// that a crash mid-write can't corrupt the file.
+func (f *checkpointFile) save(pattern string, m map[string]marshalledCheckpoint) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	checkpoints := make(map[string]persistedCheckpoint, len(m))
+	for shardID, item := range m {
+		checkpoints[shardID] = persistedCheckpoint{
+			SequenceNumber: item.sequenceNumber,
+			ParentShardID:  item.parentShardId,
+		}
+	}
+	f.routes[pattern] = checkpoints
+
+	data, err := json.Marshal(f.routes)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// fileCheckpointer is an inMemoryCheckpointer which persists a route's checkpoints to a checkpointFile, so that they
+// survive restarts of a single kinesis2sse process.
+type fileCheckpointer struct {
+	*inMemoryCheckpointer
+	file    *checkpointFile
+	pattern string
+}
+
+func newFileCheckpointer(workerID string, file *checkpointFile, pattern string, logger *slog.Logger) chk.Checkpointer {
+	return &fileCheckpointer{
+		inMemoryCheckpointer: &inMemoryCheckpointer{
+			workerID: workerID,
+			m:        make(map[string]marshalledCheckpoint),
+			logger:   logger,
+			lock:     &sync.Mutex{},
+		},
+		file:    file,
+		pattern: pattern,
+	}
+}
+
+// Init reloads the route's checkpoints from the file.
+func (checkpointer *fileCheckpointer) Init() error {
+	checkpointer.logger.Debug("Init")
+
+	m := checkpointer.file.load(checkpointer.pattern)
+
+	checkpointer.lock.Lock()
+	defer checkpointer.lock.Unlock()
+	checkpointer.m = m
+
+	return nil
+}
+
+// CheckpointSequence records the shard's checkpoint, and then persists the route's checkpoints to the file.
+func (checkpointer *fileCheckpointer) CheckpointSequence(shard *par.ShardStatus) error {
+	if err := checkpointer.inMemoryCheckpointer.CheckpointSequence(shard); err != nil {
+		return err
+	}
+
+	checkpointer.lock.Lock()
+	m := make(map[string]marshalledCheckpoint, len(checkpointer.m))
+	for shardID, item := range checkpointer.m {
+		m[shardID] = item
+	}
+	checkpointer.lock.Unlock()
+
+	if err := checkpointer.file.save(checkpointer.pattern, m); err != nil {
+		return fmt.Errorf("unable to save checkpoint file: %w", err)
+	}
+
+	return nil
+}
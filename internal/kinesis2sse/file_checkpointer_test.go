@@ -0,0 +1,60 @@
+package kinesis2sse
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+func TestFileCheckpointer(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	logger := slog.New(slog.DiscardHandler)
+
+	// A missing file starts fresh.
+	checkpointer := newFileCheckpointer("worker-1", newCheckpointFile(path, logger), "/", logger)
+	r.NoError(checkpointer.Init())
+
+	shard := &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	r.ErrorIs(checkpointer.FetchCheckpoint(shard), chk.ErrSequenceIDNotFound)
+
+	r.NoError(checkpointer.GetLease(shard, "worker-1"))
+	shard.SetCheckpoint("42")
+	r.NoError(checkpointer.CheckpointSequence(shard))
+
+	// Another route's checkpoints are kept separately in the same file.
+	other := newFileCheckpointer("worker-1", newCheckpointFile(path, logger), "/other", logger)
+	r.NoError(other.Init())
+	otherShard := &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	otherShard.SetCheckpoint("7")
+	r.NoError(other.CheckpointSequence(otherShard))
+
+	// After a "restart", each route resumes from its checkpoints.
+	file := newCheckpointFile(path, logger)
+
+	checkpointer = newFileCheckpointer("worker-2", file, "/", logger)
+	r.NoError(checkpointer.Init())
+	shard = &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	r.NoError(checkpointer.FetchCheckpoint(shard))
+	r.Equal("42", shard.GetCheckpoint())
+	r.Equal("worker-2", shard.GetLeaseOwner())
+
+	other = newFileCheckpointer("worker-2", file, "/other", logger)
+	r.NoError(other.Init())
+	otherShard = &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	r.NoError(other.FetchCheckpoint(otherShard))
+	r.Equal("7", otherShard.GetCheckpoint())
+
+	// A corrupt file starts fresh.
+	r.NoError(os.WriteFile(path, []byte("not json"), 0o600))
+	checkpointer = newFileCheckpointer("worker-3", newCheckpointFile(path, logger), "/", logger)
+	r.NoError(checkpointer.Init())
+	r.ErrorIs(checkpointer.FetchCheckpoint(&par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}), chk.ErrSequenceIDNotFound)
+}
@@ -0,0 +1,71 @@
+package kinesis2sse
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// eventFilter matches JSON events whose value at a dotted key path, like "detail.status", equals a literal value.
+type eventFilter struct {
+	path  []string
+	value string
+}
+
+// parseFilter parses a filter expression of the form "<path>==<value>", like "detail.status==active".
+func parseFilter(expr string) (eventFilter, error) {
+	unparsedPath, value, ok := strings.Cut(expr, "==")
+	if !ok {
+		return eventFilter{}, errors.New(`filter must be of the form "<path>==<value>"`)
+	}
+
+	path := strings.Split(unparsedPath, ".")
+	for _, key := range path {
+		if key == "" {
+			return eventFilter{}, errors.New("filter path must be a non-empty, dot-separated list of keys")
+		}
+	}
+
+	return eventFilter{path: path, value: value}, nil
+}
+
+// matches returns true if the event's value at the filter's path equals the filter's value. Strings are compared
+// as-is, and other values (like numbers and booleans) are compared by their JSON encoding. Events which aren't JSON
+// objects, or which lack the path, don't match.
+func (f eventFilter) matches(event any) bool {
+	event, ok := lookup(event, f.path)
+	if !ok {
+		return false
+	}
+
+	switch v := event.(type) {
+	case string:
+		return v == f.value
+	case map[string]any, []any:
+		return false
+	default:
+		encoded, err := json.Marshal(v)
+		return err == nil && string(encoded) == f.value
+	}
+}
+
+// matchesAll returns true if the JSON event matches every filter. If there are no filters, every event matches,
+// without being parsed.
+func matchesAll(filters []eventFilter, data []byte) bool {
+	if len(filters) == 0 {
+		return true
+	}
+
+	var event any
+	if err := json.Unmarshal(data, &event); err != nil {
+		return false
+	}
+
+	for _, filter := range filters {
+		if !filter.matches(event) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,36 @@
+package kinesis2sse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	r := require.New(t)
+
+	for _, expr := range []string{"", "detail.status", "detail..status==active", "==active"} {
+		_, err := parseFilter(expr)
+		r.Error(err, expr)
+	}
+
+	for expr, expected := range map[string]bool{
+		"detail.status==active":   true,
+		"detail.status==inactive": false,
+		"detail.count==3":         true,
+		"detail.ok==true":         true,
+		"detail.missing==":        false,
+		"detail==active":          false,
+		"detail.status.x==active": false,
+		"url==a==b":               true,
+	} {
+		filter, err := parseFilter(expr)
+		r.NoError(err, expr)
+		r.Equal(expected, matchesAll([]eventFilter{filter}, []byte(`{"detail":{"status":"active","count":3,"ok":true},"url":"a==b"}`)), expr)
+	}
+
+	filter, err := parseFilter("detail.status==active")
+	r.NoError(err)
+	r.False(matchesAll([]eventFilter{filter}, []byte(`not json`)))
+	r.True(matchesAll(nil, []byte(`not json`)))
+}
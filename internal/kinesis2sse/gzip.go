@@ -0,0 +1,67 @@
+package kinesis2sse
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipResponseWriter is an http.ResponseWriter which gzip-compresses the response. Flushing flushes the gzip.Writer
+// before the underlying http.ResponseWriter, so that each SSE reaches the client as soon as it's written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+
+	return &gzipResponseWriter{ResponseWriter: w, gz: gzip.NewWriter(w)}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (w *gzipResponseWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// FlushError is used by http.ResponseController.
+func (w *gzipResponseWriter) FlushError() error {
+	if err := w.gz.Flush(); err != nil {
+		return err
+	}
+
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap is used by http.ResponseController, for example to set write deadlines.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close writes the gzip footer. It does not close the underlying http.ResponseWriter.
+func (w *gzipResponseWriter) Close() error {
+	return w.gz.Close()
+}
+
+// acceptsGzip returns true if the request's Accept-Encoding header includes gzip, and doesn't refuse it with "q=0".
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+
+	return false
+}
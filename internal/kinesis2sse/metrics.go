@@ -0,0 +1,132 @@
+package kinesis2sse
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	activeConnectionsDesc = prometheus.NewDesc(
+		"kinesis2sse_active_connections",
+		"Number of currently-open connections.",
+		[]string{"route"}, nil,
+	)
+	connectionsDesc = prometheus.NewDesc(
+		"kinesis2sse_connections_total",
+		"Total number of connections accepted.",
+		[]string{"route"}, nil,
+	)
+	eventsIngestedDesc = prometheus.NewDesc(
+		"kinesis2sse_events_ingested_total",
+		"Total number of events written to the memlog.",
+		[]string{"route"}, nil,
+	)
+	eventsSkippedDesc = prometheus.NewDesc(
+		"kinesis2sse_events_skipped_total",
+		"Total number of records skipped during ingest, for example due to un-parseable JSON.",
+		[]string{"route"}, nil,
+	)
+	eventsSkippedByReasonDesc = prometheus.NewDesc(
+		"kinesis2sse_events_skipped_by_reason_total",
+		"Total number of records skipped during ingest, by reason.",
+		[]string{"route", "reason"}, nil,
+	)
+	eventsDroppedDesc = prometheus.NewDesc(
+		"kinesis2sse_events_dropped_total",
+		"Total number of events dropped during ingest for exceeding the route's maximum event size.",
+		[]string{"route"}, nil,
+	)
+	eventsDeliveredDesc = prometheus.NewDesc(
+		"kinesis2sse_events_delivered_total",
+		"Total number of events written to clients.",
+		[]string{"route"}, nil,
+	)
+	capacityDesc = prometheus.NewDesc(
+		"kinesis2sse_capacity",
+		"Configured number of events the route retains.",
+		[]string{"route"}, nil,
+	)
+	earliestOffsetDesc = prometheus.NewDesc(
+		"kinesis2sse_earliest_offset",
+		"Earliest offset served from the memlog, or -1 if it's empty.",
+		[]string{"route"}, nil,
+	)
+	latestOffsetDesc = prometheus.NewDesc(
+		"kinesis2sse_latest_offset",
+		"Latest offset written to the memlog, or -1 if it's empty.",
+		[]string{"route"}, nil,
+	)
+	eventsRetainedDesc = prometheus.NewDesc(
+		"kinesis2sse_events_retained",
+		"Number of events currently served from the memlog.",
+		[]string{"route"}, nil,
+	)
+	eventsEvictedDesc = prometheus.NewDesc(
+		"kinesis2sse_events_evicted_total",
+		"Total number of events evicted from the memlog to stay within the route's capacity.",
+		[]string{"route"}, nil,
+	)
+	millisBehindLatestDesc = prometheus.NewDesc(
+		"kinesis2sse_millis_behind_latest",
+		"Maximum MillisBehindLatest reported across the route's shards.",
+		[]string{"route"}, nil,
+	)
+	shardMillisBehindLatestDesc = prometheus.NewDesc(
+		"kinesis2sse_shard_millis_behind_latest",
+		"Latest MillisBehindLatest reported for the shard.",
+		[]string{"route", "shard"}, nil,
+	)
+)
+
+// routesCollector is a prometheus.Collector which exports each route's stats. Rather than updating separate
+// Prometheus metrics alongside routeStats, it reads a snapshot of routeStats on each scrape.
+type routesCollector struct {
+	// routes returns the current routes, which change as routes are added and removed.
+	routes func() map[string]route
+}
+
+// Describe implements prometheus.Collector.
+func (c routesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeConnectionsDesc
+	ch <- connectionsDesc
+	ch <- eventsIngestedDesc
+	ch <- eventsSkippedDesc
+	ch <- eventsSkippedByReasonDesc
+	ch <- eventsDroppedDesc
+	ch <- eventsDeliveredDesc
+	ch <- capacityDesc
+	ch <- earliestOffsetDesc
+	ch <- latestOffsetDesc
+	ch <- eventsRetainedDesc
+	ch <- eventsEvictedDesc
+	ch <- millisBehindLatestDesc
+	ch <- shardMillisBehindLatestDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c routesCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for pattern, rt := range c.routes() {
+		stats := rt.snapshot(context.Background(), now)
+		ch <- prometheus.MustNewConstMetric(activeConnectionsDesc, prometheus.GaugeValue, float64(stats.ActiveConnections), pattern)
+		ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.CounterValue, float64(stats.TotalConnections), pattern)
+		ch <- prometheus.MustNewConstMetric(eventsIngestedDesc, prometheus.CounterValue, float64(stats.EventsIngested), pattern)
+		ch <- prometheus.MustNewConstMetric(eventsSkippedDesc, prometheus.CounterValue, float64(stats.EventsSkipped), pattern)
+		for reason, n := range stats.EventsSkippedByReason {
+			ch <- prometheus.MustNewConstMetric(eventsSkippedByReasonDesc, prometheus.CounterValue, float64(n), pattern, reason)
+		}
+		ch <- prometheus.MustNewConstMetric(eventsDroppedDesc, prometheus.CounterValue, float64(stats.EventsDropped), pattern)
+		ch <- prometheus.MustNewConstMetric(eventsDeliveredDesc, prometheus.CounterValue, float64(stats.EventsDelivered), pattern)
+		ch <- prometheus.MustNewConstMetric(capacityDesc, prometheus.GaugeValue, float64(stats.Capacity), pattern)
+		ch <- prometheus.MustNewConstMetric(earliestOffsetDesc, prometheus.GaugeValue, float64(stats.EarliestOffset), pattern)
+		ch <- prometheus.MustNewConstMetric(latestOffsetDesc, prometheus.GaugeValue, float64(stats.LatestOffset), pattern)
+		ch <- prometheus.MustNewConstMetric(eventsRetainedDesc, prometheus.GaugeValue, float64(stats.EventsRetained), pattern)
+		ch <- prometheus.MustNewConstMetric(eventsEvictedDesc, prometheus.CounterValue, float64(stats.EventsEvicted), pattern)
+		ch <- prometheus.MustNewConstMetric(millisBehindLatestDesc, prometheus.GaugeValue, float64(stats.MillisBehindLatest), pattern)
+		for shardID, lag := range rt.stats.shardLags() {
+			ch <- prometheus.MustNewConstMetric(shardMillisBehindLatestDesc, prometheus.GaugeValue, float64(lag.Milliseconds()), pattern, shardID)
+		}
+	}
+}
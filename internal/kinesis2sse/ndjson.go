@@ -0,0 +1,17 @@
+package kinesis2sse
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// formatNDJSON formats a JSON event as a single NDJSON line. It returns false if the event isn't valid JSON.
+func formatNDJSON(data []byte) (string, bool) {
+	var line bytes.Buffer
+	if err := json.Compact(&line, data); err != nil {
+		return "", false
+	}
+	line.WriteByte('\n')
+
+	return line.String(), true
+}
@@ -0,0 +1,75 @@
+package kinesis2sse
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// mode is the representation of events a client negotiated with its Accept header.
+type mode int
+
+const (
+	// modeSSE streams events as SSEs. This is the default.
+	modeSSE mode = iota
+
+	// modeNDJSON streams events as newline-delimited JSON (NDJSON), without the SSE framing.
+	modeNDJSON
+
+	// modeJSON responds with a one-shot JSON array of events.
+	modeJSON
+)
+
+// modes maps the media ranges we accept to the mode they select.
+var modes = map[string]mode{
+	"text/event-stream":    modeSSE,
+	"text/*":               modeSSE,
+	"*/*":                  modeSSE,
+	"application/x-ndjson": modeNDJSON,
+	"application/json":     modeJSON,
+}
+
+// negotiateMode chooses the mode for a request from its Accept header: the supported media range with the highest
+// quality, breaking ties by which is listed first. Requests without an Accept header get SSEs. It returns false if the
+// header doesn't accept any mode, in which case the request should be rejected with 406 Not Acceptable.
+func negotiateMode(r *http.Request) (mode, bool) {
+	best, bestQuality, accepted := modeSSE, 0.0, false
+	present := false
+	for _, header := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(header, ",") {
+			if strings.TrimSpace(mediaRange) == "" {
+				continue
+			}
+			present = true
+
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+
+			m, ok := modes[mediaType]
+			if !ok {
+				continue
+			}
+
+			quality := 1.0
+			if q, ok := params["q"]; ok {
+				if quality, err = strconv.ParseFloat(q, 64); err != nil {
+					continue
+				}
+			}
+
+			// NOTE(mroberts): A quality of 0 means "not acceptable".
+			if quality > bestQuality {
+				best, bestQuality, accepted = m, quality, true
+			}
+		}
+	}
+
+	if !present {
+		return modeSSE, true
+	}
+
+	return best, accepted
+}
@@ -0,0 +1,50 @@
+package kinesis2sse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateMode(t *testing.T) {
+	r := require.New(t)
+
+	negotiate := func(accept ...string) (mode, bool) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, value := range accept {
+			req.Header.Add("Accept", value)
+		}
+		return negotiateMode(req)
+	}
+
+	for accept, expected := range map[string]mode{
+		"":                                    modeSSE,
+		"text/event-stream":                   modeSSE,
+		"text/*":                              modeSSE,
+		"*/*":                                 modeSSE,
+		"application/x-ndjson":                modeNDJSON,
+		"application/json":                    modeJSON,
+		"application/json, text/event-stream": modeJSON,
+		"text/event-stream, application/json": modeSSE,
+		"text/event-stream;q=0.5, application/json":   modeJSON,
+		"application/json;q=0, text/event-stream":     modeSSE,
+		"image/png, application/x-ndjson;q=0.1":       modeNDJSON,
+		"application/json;q=bogus, text/event-stream": modeSSE,
+	} {
+		m, ok := negotiate(accept)
+		r.True(ok, accept)
+		r.Equal(expected, m, accept)
+	}
+
+	// Multiple Accept headers are considered together.
+	m, ok := negotiate("image/png", "application/json")
+	r.True(ok)
+	r.Equal(modeJSON, m)
+
+	for _, accept := range []string{"image/png", "application/xml, text/html", "text/event-stream;q=0"} {
+		_, ok := negotiate(accept)
+		r.False(ok, accept)
+	}
+}
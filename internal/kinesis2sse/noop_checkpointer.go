@@ -0,0 +1,92 @@
+package kinesis2sse
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+// noopCheckpointer is a Checkpointer which does as little as the KCL allows: it grants every lease, and forgets every
+// checkpoint, so each shard is always read from the KCL configuration's initial position.
+//
+// NOTE(mroberts): The one thing we do remember is which shards have ended, because after a reshard, the KCL won't start
+// reading a child shard until its parent's checkpoint is SHARD_END.
+type noopCheckpointer struct {
+	logger *slog.Logger // required
+	lock   sync.Mutex
+	ended  map[string]struct{}
+}
+
+func newNoopCheckpointer(logger *slog.Logger) chk.Checkpointer {
+	return &noopCheckpointer{
+		logger: logger,
+		ended:  make(map[string]struct{}),
+	}
+}
+
+func (checkpointer *noopCheckpointer) Init() error {
+	return nil
+}
+
+func (checkpointer *noopCheckpointer) GetLease(shard *par.ShardStatus, newAssignTo string) error {
+	checkpointer.logger.Debug(fmt.Sprintf("GetLease: shardID=%q; newAssignTo=%q", shard.ID, newAssignTo))
+
+	shard.Mux.Lock()
+	shard.AssignedTo = newAssignTo
+	shard.LeaseTimeout = time.Now().AddDate(1, 0, 0).UTC()
+	shard.Mux.Unlock()
+
+	return nil
+}
+
+func (checkpointer *noopCheckpointer) CheckpointSequence(shard *par.ShardStatus) error {
+	if shard.GetCheckpoint() == chk.ShardEnd {
+		checkpointer.logger.Debug(fmt.Sprintf("CheckpointSequence: shardID=%q ended", shard.ID))
+
+		checkpointer.lock.Lock()
+		checkpointer.ended[shard.ID] = struct{}{}
+		checkpointer.lock.Unlock()
+	}
+	return nil
+}
+
+func (checkpointer *noopCheckpointer) FetchCheckpoint(shard *par.ShardStatus) error {
+	checkpointer.lock.Lock()
+	_, ended := checkpointer.ended[shard.ID]
+	checkpointer.lock.Unlock()
+
+	if !ended {
+		return chk.ErrSequenceIDNotFound
+	}
+
+	shard.SetCheckpoint(chk.ShardEnd)
+	return nil
+}
+
+func (checkpointer *noopCheckpointer) RemoveLeaseInfo(shardID string) error {
+	checkpointer.lock.Lock()
+	delete(checkpointer.ended, shardID)
+	checkpointer.lock.Unlock()
+	return nil
+}
+
+func (checkpointer *noopCheckpointer) RemoveLeaseOwner(string) error {
+	return nil
+}
+
+func (checkpointer *noopCheckpointer) GetLeaseOwner(string) (string, error) {
+	return "", chk.ErrSequenceIDNotFound
+}
+
+// ListActiveWorkers and ClaimShard are only used for lease stealing, which we disable.
+func (checkpointer *noopCheckpointer) ListActiveWorkers(map[string]*par.ShardStatus) (map[string][]*par.ShardStatus, error) {
+	return map[string][]*par.ShardStatus{}, nil
+}
+
+func (checkpointer *noopCheckpointer) ClaimShard(*par.ShardStatus, string) error {
+	return nil
+}
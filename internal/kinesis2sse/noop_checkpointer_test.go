@@ -0,0 +1,40 @@
+package kinesis2sse
+
+import (
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
+)
+
+func TestNoopCheckpointer(t *testing.T) {
+	r := require.New(t)
+
+	checkpointer := newNoopCheckpointer(slog.New(slog.DiscardHandler))
+	r.NoError(checkpointer.Init())
+
+	shard := &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	r.ErrorIs(checkpointer.FetchCheckpoint(shard), chk.ErrSequenceIDNotFound)
+
+	// Leases are always granted, so the KCL worker doesn't lease the shard again.
+	r.NoError(checkpointer.GetLease(shard, "worker-1"))
+	r.Equal("worker-1", shard.GetLeaseOwner())
+
+	// Checkpoints are forgotten.
+	shard.SetCheckpoint("42")
+	r.NoError(checkpointer.CheckpointSequence(shard))
+	r.ErrorIs(checkpointer.FetchCheckpoint(&par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}), chk.ErrSequenceIDNotFound)
+
+	// Except that the shard ended, so that its children can be read after a reshard.
+	shard.SetCheckpoint(chk.ShardEnd)
+	r.NoError(checkpointer.CheckpointSequence(shard))
+	parent := &par.ShardStatus{ID: "shard-0", Mux: &sync.RWMutex{}}
+	r.NoError(checkpointer.FetchCheckpoint(parent))
+	r.Equal(chk.ShardEnd, parent.GetCheckpoint())
+
+	r.NoError(checkpointer.RemoveLeaseInfo("shard-0"))
+	r.ErrorIs(checkpointer.FetchCheckpoint(parent), chk.ErrSequenceIDNotFound)
+}
@@ -0,0 +1,266 @@
+package kinesis2sse
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/embano1/memlog"
+)
+
+// streamParams are the query parameters and headers which control a stream.
+type streamParams struct {
+	// since is the unparsed "since" query parameter.
+	since string
+
+	// timestamp is the parsed "since" query parameter, if any.
+	timestamp *time.Time
+
+	// until is the unparsed "until" query parameter.
+	until string
+
+	// untilTimestamp is the parsed "until" query parameter, if any. The stream ends at the first event at or after it.
+	untilTimestamp *time.Time
+
+	// lastEventID is the parsed Last-Event-ID header, if any.
+	lastEventID *memlog.Offset
+
+	// from is the parsed "from" query parameter, if any: the offset of the first event to send.
+	from *memlog.Offset
+
+	// last is the parsed "last" query parameter, if any: the number of most recent events to replay.
+	last *int
+
+	// limit is the "limit" query parameter. Zero means unlimited.
+	limit int
+
+	// endMarker is the "end_marker" query parameter. When set, bounded streams end with a final "end" event.
+	endMarker bool
+
+	// schema is the "schema" query parameter. When set, a "schema" event is sent on connect.
+	schema bool
+
+	// includeTimestamp is the "include_timestamp" query parameter. When set, each event is preceded by a comment with
+	// its timestamp.
+	includeTimestamp bool
+
+	// includeSequence is the "include_sequence" query parameter. When set, each event is preceded by a comment with the
+	// Kinesis sequence number of its record, and CloudEvents carry it in a "kinesissequence" attribute.
+	includeSequence bool
+
+	// batch is the "batch" query parameter. When positive, SSE streams send up to this many events at a time, as a
+	// single SSE whose data is a JSON array. Zero means one event per SSE.
+	batch int
+
+	// batchDelay is the "batch_delay" query parameter: the longest an event waits for its batch to fill before the batch
+	// is sent anyway. Defaults to DefaultBatchDelay.
+	batchDelay time.Duration
+
+	// speed is the "speed" query parameter. When positive, events are paced by the deltas between their timestamps,
+	// divided by speed. Zero means as fast as possible.
+	speed float64
+
+	// pretty is the "pretty" query parameter. When set, JSON events are indented across multiple "data" lines.
+	pretty bool
+
+	// cloudEvents is set by the "format=cloudevents" query parameter. When set, each event is wrapped in a CloudEvent.
+	cloudEvents bool
+
+	// filters are the parsed "filter" query parameters. Only events matching every filter are sent.
+	filters []eventFilter
+
+	// replay is set by the "mode=replay" query parameter. When set, the stream sends the events already in memory from
+	// "since" up to "until", or else the latest event, and then ends, rather than waiting for new events.
+	replay bool
+}
+
+// parseTimestamp parses a timestamp query parameter, which may be an RFC3339 timestamp or a positive duration ago. If
+// maxLookback is positive, the timestamp must be no further back than that. An empty value returns nil.
+func parseTimestamp(name, value string, maxLookback time.Duration) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	now := time.Now()
+
+	// 1. First try RFC3339.
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		// 2. Then try duration. A unitless number, like "1", isn't one, except for "0", which we reject as well.
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration or RFC3339 timestamp", name)
+		}
+		ts = now.Add(-1 * d)
+	}
+
+	// 3. Check the lookback against the same time we subtracted the duration from, so that exactly maxLookback passes.
+	if maxLookback > 0 && ts.Before(now.Add(-1*maxLookback)) {
+		return nil, fmt.Errorf("%s must be within the last %s", name, maxLookback)
+	}
+
+	return &ts, nil
+}
+
+// parseStreamParams parses the query parameters and headers which control a stream. If maxLookback is positive, "since"
+// may reach back no further than that.
+func parseStreamParams(r *http.Request, maxLookback time.Duration) (streamParams, error) {
+	query := r.URL.Query()
+
+	var params streamParams
+
+	// 1. Check the "since" and "until" query parameters.
+	var err error
+	params.since = query.Get("since")
+	if params.timestamp, err = parseTimestamp("since", params.since, maxLookback); err != nil {
+		return streamParams{}, err
+	}
+
+	params.until = query.Get("until")
+	if params.untilTimestamp, err = parseTimestamp("until", params.until, 0); err != nil {
+		return streamParams{}, err
+	}
+
+	if params.timestamp != nil && params.untilTimestamp != nil && params.untilTimestamp.Before(*params.timestamp) {
+		return streamParams{}, errors.New("until must not be before since")
+	}
+
+	// 2. Check the Last-Event-ID header, which EventSource clients send when reconnecting.
+	if unparsedLastEventID := r.Header.Get("Last-Event-ID"); unparsedLastEventID != "" {
+		lastEventID, err := strconv.Atoi(unparsedLastEventID)
+		if err != nil || lastEventID < 0 {
+			return streamParams{}, errors.New("Last-Event-ID must be a non-negative integer")
+		}
+		off := memlog.Offset(lastEventID)
+		params.lastEventID = &off
+	}
+
+	// 3. Check the "from" query parameter, which resumes from an offset a client stored from an event's ID.
+	if unparsedFrom := query.Get("from"); unparsedFrom != "" {
+		from, err := strconv.Atoi(unparsedFrom)
+		if err != nil || from < 0 {
+			return streamParams{}, errors.New("from must be a non-negative integer")
+		}
+		off := memlog.Offset(from)
+		params.from = &off
+	}
+
+	// 4. Check the "last" query parameter.
+	if unparsedLast := query.Get("last"); unparsedLast != "" {
+		last, err := strconv.Atoi(unparsedLast)
+		if err != nil || last < 0 {
+			return streamParams{}, errors.New("last must be a non-negative integer")
+		}
+		params.last = &last
+	}
+
+	// 5. Check the "limit" query parameter.
+	if unparsedLimit := query.Get("limit"); unparsedLimit != "" {
+		var err error
+		if params.limit, err = strconv.Atoi(unparsedLimit); err != nil || params.limit < 0 {
+			return streamParams{}, errors.New("limit must be a non-negative integer")
+		}
+	}
+
+	// 6. Check the "end_marker" query parameter.
+	if unparsedEndMarker := query.Get("end_marker"); unparsedEndMarker != "" {
+		var err error
+		if params.endMarker, err = strconv.ParseBool(unparsedEndMarker); err != nil {
+			return streamParams{}, errors.New("end_marker must be a boolean")
+		}
+	}
+
+	// 7. Check the "schema" query parameter.
+	if unparsedSchema := query.Get("schema"); unparsedSchema != "" {
+		var err error
+		if params.schema, err = strconv.ParseBool(unparsedSchema); err != nil {
+			return streamParams{}, errors.New("schema must be a boolean")
+		}
+	}
+
+	// 8. Check the "include_timestamp" query parameter.
+	if unparsedIncludeTimestamp := query.Get("include_timestamp"); unparsedIncludeTimestamp != "" {
+		var err error
+		if params.includeTimestamp, err = strconv.ParseBool(unparsedIncludeTimestamp); err != nil {
+			return streamParams{}, errors.New("include_timestamp must be a boolean")
+		}
+	}
+
+	// 9. Check the "speed" query parameter.
+	if unparsedSpeed := query.Get("speed"); unparsedSpeed != "" {
+		var err error
+		if params.speed, err = strconv.ParseFloat(unparsedSpeed, 64); err != nil || params.speed < 0 || math.IsInf(params.speed, 0) {
+			return streamParams{}, errors.New("speed must be a non-negative number")
+		}
+	}
+
+	// 10. Check the "pretty" query parameter.
+	if unparsedPretty := query.Get("pretty"); unparsedPretty != "" {
+		var err error
+		if params.pretty, err = strconv.ParseBool(unparsedPretty); err != nil {
+			return streamParams{}, errors.New("pretty must be a boolean")
+		}
+	}
+
+	// 11. Check the "format" query parameter.
+	switch format := query.Get("format"); format {
+	case "":
+	case "cloudevents":
+		params.cloudEvents = true
+	default:
+		return streamParams{}, errors.New(`format must be "cloudevents"`)
+	}
+
+	// 12. Check the "filter" query parameters.
+	for _, expr := range query["filter"] {
+		filter, err := parseFilter(expr)
+		if err != nil {
+			return streamParams{}, err
+		}
+		params.filters = append(params.filters, filter)
+	}
+
+	// 13. Check the "include_sequence" query parameter.
+	if unparsedIncludeSequence := query.Get("include_sequence"); unparsedIncludeSequence != "" {
+		var err error
+		if params.includeSequence, err = strconv.ParseBool(unparsedIncludeSequence); err != nil {
+			return streamParams{}, errors.New("include_sequence must be a boolean")
+		}
+	}
+
+	// 14. Check the "batch" and "batch_delay" query parameters.
+	if unparsedBatch := query.Get("batch"); unparsedBatch != "" {
+		var err error
+		if params.batch, err = strconv.Atoi(unparsedBatch); err != nil || params.batch <= 0 {
+			return streamParams{}, errors.New("batch must be a positive integer")
+		}
+	}
+
+	params.batchDelay = DefaultBatchDelay
+	if unparsedBatchDelay := query.Get("batch_delay"); unparsedBatchDelay != "" {
+		var err error
+		if params.batchDelay, err = time.ParseDuration(unparsedBatchDelay); err != nil || params.batchDelay <= 0 {
+			return streamParams{}, errors.New("batch_delay must be a positive duration")
+		}
+		if params.batch == 0 {
+			return streamParams{}, errors.New("batch_delay requires batch")
+		}
+	}
+
+	// 15. Check the "mode" query parameter.
+	switch mode := query.Get("mode"); mode {
+	case "", "live":
+	case "replay":
+		if params.timestamp == nil {
+			return streamParams{}, errors.New("mode=replay requires since")
+		}
+		params.replay = true
+	default:
+		return streamParams{}, errors.New(`mode must be "live" or "replay"`)
+	}
+
+	return params, nil
+}
@@ -0,0 +1,64 @@
+package kinesis2sse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// reservedPaths are the paths of the service's own endpoints, which routes can't use.
+var reservedPaths = []string{"/health", "/ready", "/stats", "/metrics", "/version", "/viewer", "/admin/connections", "/admin/shards"}
+
+// patternPath returns the path of an http.ServeMux pattern, which may be preceded by a method and/or host, like
+// "GET example.com/events".
+func patternPath(pattern string) string {
+	if _, rest, ok := strings.Cut(pattern, " "); ok {
+		pattern = strings.TrimLeft(rest, " \t")
+	}
+
+	if i := strings.Index(pattern, "/"); i > 0 {
+		return pattern[i:]
+	}
+
+	return pattern
+}
+
+// validatePattern returns an error if the pattern is empty or uses a reserved path.
+func validatePattern(pattern string) error {
+	path := patternPath(pattern)
+	if path == "" {
+		return fmt.Errorf("pattern %q must not be empty", pattern)
+	}
+
+	for _, reserved := range reservedPaths {
+		if path == reserved {
+			return fmt.Errorf("pattern %q conflicts with the built-in %s endpoint", pattern, reserved)
+		}
+	}
+
+	return nil
+}
+
+// validatePatterns validates each route pattern, and checks that none is repeated. It returns an error listing every
+// problem, rather than just the first, so that they can all be fixed at once.
+func validatePatterns(patterns []string) error {
+	var problems []string
+
+	seen := make(map[string]int, len(patterns))
+	for i, pattern := range patterns {
+		if err := validatePattern(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("route at index %d: %s", i, err))
+		}
+
+		if j, ok := seen[pattern]; ok {
+			problems = append(problems, fmt.Sprintf("routes at indexes %d and %d both use pattern %q", j, i, pattern))
+			continue
+		}
+		seen[pattern] = i
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid route patterns: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
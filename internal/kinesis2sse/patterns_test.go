@@ -0,0 +1,64 @@
+package kinesis2sse
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatternPath(t *testing.T) {
+	r := require.New(t)
+
+	r.Equal("/events", patternPath("/events"))
+	r.Equal("/events", patternPath("GET /events"))
+	r.Equal("/events", patternPath("example.com/events"))
+	r.Equal("/events", patternPath("GET example.com/events"))
+	r.Equal("", patternPath(""))
+}
+
+func TestValidatePatterns(t *testing.T) {
+	r := require.New(t)
+
+	r.NoError(validatePatterns([]string{"/", "/a", "GET /b", "/health/", "/healthz"}))
+
+	err := validatePatterns([]string{"/a", "/health", "/a", "GET /metrics", "", "/a"})
+	r.EqualError(err, `invalid route patterns: `+
+		`route at index 1: pattern "/health" conflicts with the built-in /health endpoint; `+
+		`routes at indexes 0 and 2 both use pattern "/a"; `+
+		`route at index 3: pattern "GET /metrics" conflicts with the built-in /metrics endpoint; `+
+		`route at index 4: pattern "" must not be empty; `+
+		`routes at indexes 0 and 5 both use pattern "/a"`)
+}
+
+func TestServiceInvalidPatterns(t *testing.T) {
+	r := require.New(t)
+
+	_, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/a",
+			},
+			{
+				Pattern: "/a",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.ErrorContains(err, `routes at indexes 0 and 1 both use pattern "/a"`)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/a",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	err = s.AddRoute(RouteOptions{Pattern: "/ready"})
+	r.ErrorContains(err, "conflicts with the built-in /ready endpoint")
+}
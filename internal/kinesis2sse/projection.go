@@ -0,0 +1,73 @@
+package kinesis2sse
+
+import (
+	"errors"
+	"strings"
+)
+
+// projection selects the values at dotted key paths, like "order.id", from JSON events, omitting everything else.
+type projection [][]string
+
+// parseProjection parses dotted key paths into a projection. No paths returns a nil projection, which keeps events
+// whole.
+func parseProjection(unparsedPaths []string) (projection, error) {
+	var p projection
+	for _, unparsedPath := range unparsedPaths {
+		path := strings.Split(unparsedPath, ".")
+		for _, key := range path {
+			if key == "" {
+				return nil, errors.New("projection paths must be non-empty, dot-separated lists of keys")
+			}
+		}
+		p = append(p, path)
+	}
+
+	return p, nil
+}
+
+// apply returns a JSON object holding the event's values at the projection's paths, nested as they were in the event.
+// Paths the event lacks, including paths through values which aren't JSON objects, are omitted. A nil projection
+// returns the event unchanged.
+func (p projection) apply(event any) any {
+	if p == nil {
+		return event
+	}
+
+	projected := map[string]any{}
+	for _, path := range p {
+		value, ok := lookup(event, path)
+		if !ok {
+			continue
+		}
+
+		// Create the parents of the value, as needed. If a shorter path already kept a parent whole, then the value is
+		// already there.
+		parent := projected
+		for _, key := range path[:len(path)-1] {
+			child, ok := parent[key].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				parent[key] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = value
+	}
+
+	return projected
+}
+
+// lookup returns the JSON event's value at the path, or false if it lacks the path.
+func lookup(event any, path []string) (any, bool) {
+	for _, key := range path {
+		object, ok := event.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if event, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return event, true
+}
@@ -0,0 +1,119 @@
+package kinesis2sse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+
+	"github.com/embano1/memlog"
+)
+
+// readRecords returns an iterator over the records in the memlog from off through the latest offset at the time of
+// the call. Unlike ml.Stream, it never blocks waiting for new records, so it's the backbone of one-shot responses,
+// whereas streams use streamEvents. Records purged while reading are skipped.
+func readRecords(ctx context.Context, ml *memlog.Log, off memlog.Offset) iter.Seq2[memlog.Record, error] {
+	return func(yield func(memlog.Record, error) bool) {
+		_, latest := ml.Range(ctx)
+		for off = max(off, 0); off <= latest; off++ {
+			record, err := ml.Read(ctx, off)
+			if errors.Is(err, memlog.ErrOutOfRange) {
+				// The record was purged after we looked up the starting offset.
+				continue
+			} else if err != nil {
+				yield(memlog.Record{}, fmt.Errorf("unable to read offset %d: %w", off, err))
+				return
+			}
+
+			if !yield(record, nil) {
+				return
+			}
+		}
+	}
+}
+
+// replayEvents streams the records in the memlog from off through the latest offset at the time of the call, until the
+// context is cancelled or the returned stop function is called. Unlike streamEvents, it never waits for new records, so
+// the returned channel is closed once they've all been received.
+func replayEvents(ctx context.Context, ml *memlog.Log, off memlog.Offset) (<-chan memlog.Record, func()) {
+	ctx, stop := context.WithCancel(ctx)
+	events := make(chan memlog.Record)
+
+	// NOTE(mroberts): Look up the latest offset now, rather than when the goroutine starts, so that events written in
+	// the meantime aren't replayed.
+	_, latest := ml.Range(ctx)
+
+	go func() {
+		defer close(events)
+
+		for record, err := range readRecords(ctx, ml, off) {
+			if err != nil || record.Metadata.Offset > latest {
+				return
+			}
+
+			select {
+			case events <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, stop
+}
+
+// readEvents collects the events a stream with the specified parameters would send, starting from off, but only up to
+// and excluding "until", if set, or else the latest offset, and at most params.limit of them, unless it's zero. Events
+// which aren't valid JSON are skipped, unless the route is Binary, in which case each event is a base64-encoded JSON
+// string.
+func (s *Service) readEvents(ctx context.Context, rt route, off memlog.Offset, params streamParams) ([][]byte, error) {
+	var events [][]byte
+	for record, err := range readRecords(ctx, rt.ml, off) {
+		if err != nil {
+			return nil, err
+		}
+
+		off := record.Metadata.Offset
+		if params.untilTimestamp != nil && reachedUntil(rt.t2o, off, *params.untilTimestamp) {
+			break
+		}
+
+		data, err := rt.encoding.decode(record.Data)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Skipping offset %d, which we were unable to decode", off), "err", err)
+			continue
+		}
+
+		if !rt.binary && !matchesAll(params.filters, data) {
+			continue
+		}
+
+		data, ok := rt.formatJSONEvent(off, data, params)
+		if !ok {
+			s.logger.Debug(fmt.Sprintf("Skipping offset %d, which is not valid JSON", off))
+			continue
+		}
+
+		events = append(events, data)
+		if params.limit > 0 && len(events) >= params.limit {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// formatJSONEvent returns the event at the specified offset as an element of a JSON array: a CloudEvent, if
+// params.cloudEvents is set, a base64-encoded JSON string, if the route is Binary, or else the event itself. It returns
+// false if the event isn't valid JSON.
+func (rt route) formatJSONEvent(off memlog.Offset, data []byte, params streamParams) ([]byte, bool) {
+	switch {
+	case params.cloudEvents:
+		return rt.formatCloudEvent(off, data, params.includeSequence), true
+	case rt.binary:
+		return encodeBinaryJSON(data), true
+	default:
+		return data, json.Valid(data)
+	}
+}
@@ -0,0 +1,90 @@
+package kinesis2sse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/embano1/memlog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRecords(t *testing.T) {
+	r := require.New(t)
+
+	ctx := context.Background()
+	ml, err := memlog.New(ctx, memlog.WithMaxSegmentSize(3))
+	r.NoError(err)
+
+	collect := func(off memlog.Offset, n int) []string {
+		var data []string
+		for record, err := range readRecords(ctx, ml, off) {
+			r.NoError(err)
+			data = append(data, string(record.Data))
+			if len(data) == n {
+				break
+			}
+		}
+		return data
+	}
+
+	// An empty memlog has nothing to read, rather than blocking.
+	r.Empty(collect(0, 0))
+
+	// [0, 1, 2, 3, 4, 5, 6], of which [0, 1, 2] have been purged.
+	for i := 0; i < 7; i++ {
+		_, err = ml.Write(ctx, []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	r.Equal([]string{`{"event":3}`, `{"event":4}`, `{"event":5}`, `{"event":6}`}, collect(0, 0))
+	r.Equal([]string{`{"event":5}`, `{"event":6}`}, collect(5, 0))
+	r.Equal([]string{`{"event":4}`}, collect(4, 1))
+	r.Empty(collect(7, 0))
+}
+
+func TestReadEvents(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	rt := s.routes["/"]
+	for i, data := range []string{`{"event":0}`, `not json`, `{"event":2}`, `{"event":3}`} {
+		err = rt.t2o.Add(i, time.UnixMilli(int64(i)*1_000))
+		r.NoError(err)
+		_, err = rt.ml.Write(context.Background(), []byte(data))
+		r.NoError(err)
+	}
+
+	read := func(off memlog.Offset, params streamParams) []string {
+		events, err := s.readEvents(context.Background(), rt, off, params)
+		r.NoError(err)
+
+		var data []string
+		for _, event := range events {
+			data = append(data, string(event))
+		}
+		return data
+	}
+
+	// Events which aren't JSON are skipped, and don't count toward the limit.
+	r.Equal([]string{`{"event":0}`, `{"event":2}`, `{"event":3}`}, read(0, streamParams{}))
+	r.Equal([]string{`{"event":0}`, `{"event":2}`}, read(0, streamParams{limit: 2}))
+
+	until := time.UnixMilli(3_000)
+	r.Equal([]string{`{"event":2}`}, read(1, streamParams{untilTimestamp: &until}))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
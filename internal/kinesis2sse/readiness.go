@@ -0,0 +1,56 @@
+package kinesis2sse
+
+import "sync"
+
+// readiness tracks whether a route's KCL worker has started consuming. A route becomes ready once every shard it has
+// initialized has processed its first batch of records, which may be empty. After that, it stays ready. It's safe for
+// concurrent use.
+type readiness struct {
+	lock *sync.Mutex
+
+	// shards stores, for each initialized shard, whether it has processed a batch.
+	shards map[string]bool
+
+	ready bool
+}
+
+func newReadiness() *readiness {
+	return &readiness{
+		lock:   &sync.Mutex{},
+		shards: make(map[string]bool),
+	}
+}
+
+// initialized records that the shard's record processor was initialized.
+func (r *readiness) initialized(shardID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.shards[shardID]; !ok {
+		r.shards[shardID] = false
+	}
+}
+
+// processed records that the shard processed a batch of records, and marks the route ready if every initialized shard
+// has.
+func (r *readiness) processed(shardID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.shards[shardID] = true
+	if r.ready {
+		return
+	}
+
+	for _, processed := range r.shards {
+		if !processed {
+			return
+		}
+	}
+	r.ready = true
+}
+
+// isReady returns true once the route is ready.
+func (r *readiness) isReady() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ready
+}
@@ -0,0 +1,29 @@
+package kinesis2sse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadiness(t *testing.T) {
+	r := require.New(t)
+
+	readiness := newReadiness()
+
+	// Not ready before any shard is initialized…
+	r.False(readiness.isReady())
+
+	// …nor while any initialized shard has yet to process a batch.
+	readiness.initialized("shard-0")
+	readiness.initialized("shard-1")
+	readiness.processed("shard-0")
+	r.False(readiness.isReady())
+
+	readiness.processed("shard-1")
+	r.True(readiness.isReady())
+
+	// Once ready, new shards don't make the route unready.
+	readiness.initialized("shard-2")
+	r.True(readiness.isReady())
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 	"github.com/embano1/memlog"
 	kc "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
 )
@@ -17,107 +18,317 @@ import (
 //   https://github.com/vmware/vmware-go-kcl-v2/blob/main/test/worker_test.go
 //
 
-func recordProcessorFactory(ml *memlog.Log, t2o *Timestamp2Offset, logger *slog.Logger) kc.IRecordProcessorFactory {
+// envelope describes where each record's timestamp and payload are found.
+type envelope struct {
+	// timeField is the top-level field containing the record's RFC 3339 timestamp.
+	timeField string
+
+	// payloadField is the top-level field containing the event to write to the memlog.
+	payloadField string
+
+	// timestampFallback determines how records whose timeField is missing or un-parseable are timestamped.
+	timestampFallback TimestampFallback
+
+	// raw writes each record to the memlog unchanged, timestamped by its ApproximateArrivalTimestamp, instead of
+	// unwrapping it.
+	raw bool
+
+	// projection selects the fields of the payload to write to the memlog. If nil, the whole payload is written.
+	projection projection
+
+	// full writes the whole record to the memlog, with its payload projected, instead of just the payload. If keys is
+	// set, only those top-level fields are written alongside the payload.
+	full bool
+	keys []string
+
+	// encoding determines how the event is compressed, if at all, before it's written to the memlog.
+	encoding Encoding
+}
+
+// skipReason is why a record was skipped during ingest. It labels the kinesis2sse_events_skipped_by_reason_total metric.
+type skipReason string
+
+const (
+	skipUnparseableJSON skipReason = "unparseable_json"
+	skipMissingTime     skipReason = "missing_time"
+	skipUnparseableTime skipReason = "unparseable_time"
+	skipMissingPayload  skipReason = "missing_payload"
+	skipMarshalError    skipReason = "marshal_error"
+	skipMemlogError     skipReason = "memlog_error"
+)
+
+func recordProcessorFactory(ml *memlog.Log, t2o *Timestamp2Offset, stats *routeStats, readiness *readiness, envelope envelope, monotonicTimestamps bool, maxEventBytes int, shardPrefix string, route string, deadLetterFunc func(DeadLetter), logger *slog.Logger) kc.IRecordProcessorFactory {
 	return &dumpRecordProcessorFactory{
-		ml:     ml,
-		t2o:    t2o,
-		logger: logger,
+		shardPrefix:         shardPrefix,
+		route:               route,
+		deadLetterFunc:      deadLetterFunc,
+		ml:                  ml,
+		t2o:                 t2o,
+		stats:               stats,
+		readiness:           readiness,
+		envelope:            envelope,
+		monotonicTimestamps: monotonicTimestamps,
+		maxEventBytes:       maxEventBytes,
+		logger:              logger,
 	}
 }
 
 type dumpRecordProcessorFactory struct {
-	ml     *memlog.Log
-	t2o    *Timestamp2Offset
-	logger *slog.Logger // required
+	shardPrefix         string
+	route               string
+	deadLetterFunc      func(DeadLetter)
+	ml                  *memlog.Log
+	t2o                 *Timestamp2Offset
+	stats               *routeStats
+	readiness           *readiness
+	envelope            envelope
+	monotonicTimestamps bool
+	maxEventBytes       int
+	logger              *slog.Logger // required
 }
 
 func (d *dumpRecordProcessorFactory) CreateProcessor() kc.IRecordProcessor {
 	return &dumpRecordProcessor{
-		ml:     d.ml,
-		t2o:    d.t2o,
-		logger: d.logger,
+		shardPrefix:         d.shardPrefix,
+		route:               d.route,
+		deadLetterFunc:      d.deadLetterFunc,
+		ml:                  d.ml,
+		t2o:                 d.t2o,
+		stats:               d.stats,
+		readiness:           d.readiness,
+		envelope:            d.envelope,
+		monotonicTimestamps: d.monotonicTimestamps,
+		maxEventBytes:       d.maxEventBytes,
+		logger:              d.logger,
 	}
 }
 
 type dumpRecordProcessor struct {
-	ml     *memlog.Log
-	t2o    *Timestamp2Offset
-	logger *slog.Logger // required
+	ml                  *memlog.Log
+	t2o                 *Timestamp2Offset
+	stats               *routeStats
+	readiness           *readiness
+	envelope            envelope
+	monotonicTimestamps bool
+	maxEventBytes       int          // zero means unlimited
+	logger              *slog.Logger // required
+	shardID             string
+
+	// shardPrefix distinguishes the shards of routes fed by multiple streams, whose shard IDs may collide. It's prepended
+	// to the shard ID wherever the route's shards are tracked.
+	shardPrefix string
+
+	// route is the route's pattern, and deadLetterFunc, if set, receives the records it can't serve.
+	route          string
+	deadLetterFunc func(DeadLetter)
 }
 
 func (dd *dumpRecordProcessor) Initialize(input *kc.InitializationInput) {
+	dd.shardID = dd.shardPrefix + input.ShardId
+	dd.readiness.initialized(dd.shardID)
 	dd.logger.Debug(fmt.Sprintf("Processing ShardId: %v at checkpoint: %v", input.ShardId, aws.ToString(input.ExtendedSequenceNumber.SequenceNumber)))
 }
 
 func (dd *dumpRecordProcessor) ProcessRecords(input *kc.ProcessRecordsInput) {
+	dd.stats.behind(dd.shardID, time.Duration(input.MillisBehindLatest)*time.Millisecond)
+	dd.readiness.processed(dd.shardID)
+
 	// don't process empty record
 	if len(input.Records) == 0 {
 		return
 	}
 
+	// NOTE(mroberts): We don't need to de-aggregate records published by the Kinesis Producer Library (KPL) with
+	// aggregation enabled. The KCL's shard consumer already does this (using awslabs/kinesis-aggregation) before
+	// calling ProcessRecords, so each record here is an individual user record, which is also why we checkpoint at the
+	// end of the batch below.
+	ingested, skipped := dd.ingest(input.Records, nil)
+
+	dd.stats.ingested(ingested, time.Now())
+	dd.stats.skipped(skipped)
+
+	// checkpoint it after processing this batch.
+	// Especially, for processing de-aggregated KPL records, checkpointing has to happen at the end of batch
+	// because de-aggregated records share the same sequence number.
+	lastRecordSequenceNumber := input.Records[len(input.Records)-1].SequenceNumber
+	// Calculate the time taken from polling records and delivering to record processor for a batch.
+	if input.CacheEntryTime != nil {
+		diff := input.CacheExitTime.Sub(*input.CacheEntryTime)
+		dd.logger.Debug(fmt.Sprintf("Checkpoint progress at: %v, MillisBehindLatest = %v, KCLProcessTime = %v", lastRecordSequenceNumber, input.MillisBehindLatest, diff))
+	}
+	if input.Checkpointer != nil {
+		_ = input.Checkpointer.Checkpoint(lastRecordSequenceNumber)
+	}
+}
+
+// ingest writes the records' events to the memlog and indexes them by timestamp, returning how many were ingested and
+// how many were skipped, by reason. If keep is set, records whose timestamps it rejects are neither. Events larger than
+// maxEventBytes are dropped, which is counted separately.
+func (dd *dumpRecordProcessor) ingest(records []types.Record, keep func(timestamp time.Time) bool) (ingested int, skipped map[skipReason]int) {
+	// Hold Timestamp2Offset's lock for the whole batch, rather than for each record, so that LastTimestampUnlocked sees
+	// the timestamp we last added.
 	dd.t2o.Lock()
-	for _, v := range input.Records {
-		var awsEvent map[string]any
-		var err error
-		if err = json.Unmarshal(v.Data, &awsEvent); err != nil {
-			dd.logger.Warn("Skipping an event due to un-parseable JSON", "err", err)
-			continue
-		}
+	ingested, skipped, deadLetters := dd.ingestUnlocked(records, keep)
+	dd.t2o.Unlock()
+
+	// NOTE(mroberts): The dead-letter sink may block, for example on a file write, so we only send to it once we've
+	// released the lock, which every stream reading from the route needs.
+	for _, deadLetter := range deadLetters {
+		dd.deadLetterFunc(deadLetter)
+	}
 
-		timestampString, ok := awsEvent["time"].(string)
-		if !ok {
-			dd.logger.Warn(`Skipping an event due to missing "time" key`)
+	return ingested, skipped
+}
+
+// ingestUnlocked is like ingest, but the caller must hold Timestamp2Offset's lock, and send the returned dead letters.
+func (dd *dumpRecordProcessor) ingestUnlocked(records []types.Record, keep func(timestamp time.Time) bool) (ingested int, skipped map[skipReason]int, deadLetters []DeadLetter) {
+	skipped = make(map[skipReason]int)
+	for _, v := range records {
+		bytes, timestamp, reason, err := dd.unwrap(v)
+		if reason != "" {
+			skipped[reason]++
+			deadLetters = dd.appendDeadLetter(deadLetters, v, string(reason), err)
 			continue
 		}
-		var timestamp time.Time
-		if timestamp, err = time.Parse(time.RFC3339, timestampString); err != nil {
-			dd.logger.Warn(`Skipping an event due to un-parseable "time" key`, "err", err)
+
+		if keep != nil && !keep(timestamp) {
 			continue
 		}
 
-		cloudEvent, ok := awsEvent["detail"]
-		if !ok {
-			dd.logger.Warn(`Skipping an event due to missing "detail" key`)
+		if dd.maxEventBytes > 0 && len(bytes) > dd.maxEventBytes {
+			dd.logger.Warn(fmt.Sprintf("Dropping an event because it exceeds %d bytes", dd.maxEventBytes), "bytes", len(bytes))
+			dd.stats.dropped(1)
+			deadLetters = dd.appendDeadLetter(deadLetters, v, DeadLetterReasonTooLarge, fmt.Errorf("event of %d bytes exceeds %d bytes", len(bytes), dd.maxEventBytes))
 			continue
 		}
 
-		bytes, err := json.Marshal(cloudEvent)
+		// NOTE(mroberts): maxEventBytes limits the event as it's served, so we check it before compressing.
+		bytes, err = dd.envelope.encoding.encode(bytes)
 		if err != nil {
-			dd.logger.Error(`Skipping an event because we were unable to marshal it to JSON`, "err", err)
+			dd.logger.Error("Skipping an event because we were unable to encode it", "err", err, "encoding", dd.envelope.encoding)
+			skipped[skipMarshalError]++
+			deadLetters = dd.appendDeadLetter(deadLetters, v, string(skipMarshalError), err)
 			continue
 		}
 
 		off, err := dd.ml.Write(context.Background(), bytes)
 		if err != nil {
 			dd.logger.Error(`Skipping an event because we were unable to write it to the memlog`, "err", err)
+			skipped[skipMemlogError]++
+			deadLetters = dd.appendDeadLetter(deadLetters, v, string(skipMemlogError), err)
 			continue
 		}
 
-		if err = dd.t2o.Add(int(off), timestamp); err != nil {
+		// Clamp skewed timestamps to the last indexed timestamp, so that the index stays monotonic.
+		if dd.monotonicTimestamps {
+			if lastTimestamp, ok := dd.t2o.LastTimestampUnlocked(); ok && timestamp.Before(lastTimestamp) {
+				timestamp = lastTimestamp
+			}
+		}
+
+		if err = dd.t2o.AddWithSequenceNumberUnlocked(int(off), timestamp, aws.ToString(v.SequenceNumber)); err != nil {
 			// NOTE(mroberts): If we get an error here, it's really a programming error.
 			dd.logger.Error("Incorrect usage of Timestamp2Offset. Programming error or memory corruption? Exiting!", "err", err)
 			panic(err)
 		}
+
+		ingested++
 	}
-	dd.t2o.Unlock()
 
-	// checkpoint it after processing this batch.
-	// Especially, for processing de-aggregated KPL records, checkpointing has to happen at the end of batch
-	// because de-aggregated records share the same sequence number.
-	lastRecordSequenceNumber := input.Records[len(input.Records)-1].SequenceNumber
-	// Calculate the time taken from polling records and delivering to record processor for a batch.
-	if input.CacheEntryTime != nil {
-		diff := input.CacheExitTime.Sub(*input.CacheEntryTime)
-		dd.logger.Debug(fmt.Sprintf("Checkpoint progress at: %v, MillisBehindLatest = %v, KCLProcessTime = %v", lastRecordSequenceNumber, input.MillisBehindLatest, diff))
+	return ingested, skipped, deadLetters
+}
+
+// unwrap returns the event to write to the memlog for the record, and its timestamp. If the record should be skipped, it
+// logs why and returns the reason, and an error describing it, instead.
+func (dd *dumpRecordProcessor) unwrap(record types.Record) ([]byte, time.Time, skipReason, error) {
+	// In raw passthrough mode, records are served as-is, so there's nothing to parse.
+	if dd.envelope.raw {
+		return record.Data, arrivalTimestamp(record), "", nil
 	}
-	if input.Checkpointer != nil {
-		_ = input.Checkpointer.Checkpoint(lastRecordSequenceNumber)
+
+	var awsEvent map[string]any
+	var err error
+	if err = json.Unmarshal(record.Data, &awsEvent); err != nil {
+		dd.logger.Warn("Skipping an event due to un-parseable JSON", "err", err)
+		return nil, time.Time{}, skipUnparseableJSON, err
+	}
+
+	var timestamp time.Time
+	timestampString, ok := awsEvent[dd.envelope.timeField].(string)
+	if !ok {
+		if timestamp, ok = dd.fallbackTimestamp(record); !ok {
+			dd.logger.Warn(fmt.Sprintf("Skipping an event due to missing %q key", dd.envelope.timeField))
+			return nil, time.Time{}, skipMissingTime, fmt.Errorf("missing %q key", dd.envelope.timeField)
+		}
+	} else if timestamp, err = time.Parse(time.RFC3339, timestampString); err != nil {
+		if timestamp, ok = dd.fallbackTimestamp(record); !ok {
+			dd.logger.Warn(fmt.Sprintf("Skipping an event due to un-parseable %q key", dd.envelope.timeField), "err", err)
+			return nil, time.Time{}, skipUnparseableTime, fmt.Errorf("un-parseable %q key: %w", dd.envelope.timeField, err)
+		}
 	}
+
+	cloudEvent, ok := awsEvent[dd.envelope.payloadField]
+	if !ok {
+		dd.logger.Warn(fmt.Sprintf("Skipping an event due to missing %q key", dd.envelope.payloadField))
+		return nil, time.Time{}, skipMissingPayload, fmt.Errorf("missing %q key", dd.envelope.payloadField)
+	}
+
+	var event any = dd.envelope.projection.apply(cloudEvent)
+	if dd.envelope.full {
+		event = dd.envelope.wrap(awsEvent, event)
+	}
+
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		dd.logger.Error(`Skipping an event because we were unable to marshal it to JSON`, "err", err)
+		return nil, time.Time{}, skipMarshalError, err
+	}
+
+	return bytes, timestamp, "", nil
+}
+
+// wrap returns the record with its payload replaced, keeping only the envelope's keys, if set, alongside it.
+func (e envelope) wrap(record map[string]any, payload any) map[string]any {
+	if e.keys != nil {
+		wrapped := make(map[string]any, len(e.keys)+1)
+		for _, key := range e.keys {
+			if value, ok := record[key]; ok {
+				wrapped[key] = value
+			}
+		}
+		record = wrapped
+	}
+
+	record[e.payloadField] = payload
+	return record
+}
+
+// fallbackTimestamp returns the timestamp of a record whose envelope lacks a valid one, according to the route's
+// TimestampFallback, or false if the record should be skipped.
+func (dd *dumpRecordProcessor) fallbackTimestamp(record types.Record) (time.Time, bool) {
+	switch dd.envelope.timestampFallback {
+	case TimestampFallbackArrival:
+		return arrivalTimestamp(record), true
+	case TimestampFallbackNow:
+		return time.Now(), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// arrivalTimestamp returns when Kinesis received the record, or now, if that's unknown, like for backfilled records.
+func arrivalTimestamp(record types.Record) time.Time {
+	if record.ApproximateArrivalTimestamp != nil {
+		return *record.ApproximateArrivalTimestamp
+	}
+	return time.Now()
 }
 
 func (dd *dumpRecordProcessor) Shutdown(input *kc.ShutdownInput) {
 	dd.logger.Info(fmt.Sprintf("Shutdown Reason: %v", aws.ToString(kc.ShutdownReasonMessage(input.ShutdownReason))))
 
+	dd.stats.shardEnded(dd.shardID)
+
 	// When the value of {@link ShutdownInput#getShutdownReason()} is
 	// {@link com.amazonaws.services.kinesis.clientlibrary.lib.worker.ShutdownReason#TERMINATE} it is required that you
 	// checkpoint. Failure to do so will result in an IllegalArgumentException, and the KCL no longer making progress.
@@ -2,9 +2,12 @@ package kinesis2sse
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 	"github.com/embano1/memlog"
 	"github.com/stretchr/testify/require"
@@ -27,10 +30,15 @@ func TestRecordProcessor(t *testing.T) {
 	t2o, err := NewTimestamp2Offset(100)
 	r.NoError(err)
 
+	stats := newRouteStats()
+
 	rp := dumpRecordProcessor{
-		ml:     ml,
-		t2o:    t2o,
-		logger: slog.New(slog.DiscardHandler),
+		ml:        ml,
+		t2o:       t2o,
+		stats:     stats,
+		readiness: newReadiness(),
+		envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField},
+		logger:    slog.New(slog.DiscardHandler),
 	}
 
 	rp.ProcessRecords(&kc.ProcessRecordsInput{
@@ -66,6 +74,10 @@ func TestRecordProcessor(t *testing.T) {
 	_, err = ml.Read(context.Background(), 2)
 	r.Error(err)
 
+	r.Equal(int64(2), stats.snapshot(time.Now()).EventsIngested)
+	r.Equal(int64(3), stats.snapshot(time.Now()).EventsSkipped)
+	r.Equal(map[string]int64{"unparseable_json": 1, "missing_time": 1, "missing_payload": 1}, stats.snapshot(time.Now()).EventsSkippedByReason)
+
 	// Can process more…
 
 	rp.ProcessRecords(&kc.ProcessRecordsInput{
@@ -83,3 +95,516 @@ func TestRecordProcessor(t *testing.T) {
 	_, err = ml.Read(context.Background(), 3)
 	r.Error(err)
 }
+
+func TestRecordProcessorMonotonicTimestamps(t *testing.T) {
+	skewedEvents := []types.Record{
+		{
+			Data: []byte(`{"time":"1970-01-01T00:00:00.500Z","detail":{"event":0}}`),
+		},
+		{
+			Data: []byte(`{"time":"1970-01-01T00:00:00.250Z","detail":{"event":1}}`),
+		},
+	}
+
+	r := require.New(t)
+
+	for _, monotonicTimestamps := range []bool{false, true} {
+		ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+		r.NoError(err)
+
+		t2o, err := NewTimestamp2Offset(100)
+		r.NoError(err)
+
+		rp := dumpRecordProcessor{
+			ml:                  ml,
+			t2o:                 t2o,
+			stats:               newRouteStats(),
+			readiness:           newReadiness(),
+			envelope:            envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField},
+			monotonicTimestamps: monotonicTimestamps,
+			logger:              slog.New(slog.DiscardHandler),
+		}
+
+		rp.ProcessRecords(&kc.ProcessRecordsInput{
+			Records: skewedEvents,
+		})
+
+		// Both events are written regardless.
+		_, latest := ml.Range(context.Background())
+		r.Equal(memlog.Offset(1), latest)
+
+		off, ok := t2o.NearestOffset(time.UnixMilli(200))
+		r.True(ok)
+		if monotonicTimestamps {
+			// [0 → 500, 1 → 500]
+			r.Equal(0, off)
+		} else {
+			// [0 → 500, 1 → 250]
+			r.Equal(1, off)
+		}
+	}
+}
+
+func TestRecordProcessorEnvelope(t *testing.T) {
+	r := require.New(t)
+
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+	r.NoError(err)
+
+	t2o, err := NewTimestamp2Offset(100)
+	r.NoError(err)
+
+	stats := newRouteStats()
+
+	rp := dumpRecordProcessor{
+		ml:        ml,
+		t2o:       t2o,
+		stats:     stats,
+		readiness: newReadiness(),
+		envelope:  envelope{timeField: "timestamp", payloadField: "data"},
+		logger:    slog.New(slog.DiscardHandler),
+	}
+
+	rp.ProcessRecords(&kc.ProcessRecordsInput{
+		Records: []types.Record{
+			{
+				Data: []byte(`{"timestamp":"1970-01-01T00:00:01Z","data":{"event":0}}`),
+			},
+			{
+				// Configured fields don't fall back to the defaults.
+				Data: []byte(`{"time":"1970-01-01T00:00:02Z","detail":{"event":1}}`),
+			},
+		},
+	})
+
+	rec, err := ml.Read(context.Background(), 0)
+	r.NoError(err)
+	r.Equal(`{"event":0}`, string(rec.Data))
+
+	off, ok := t2o.NearestOffset(time.Unix(1, 0))
+	r.True(ok)
+	r.Equal(0, off)
+
+	r.Equal(int64(1), stats.snapshot(time.Now()).EventsIngested)
+	r.Equal(int64(1), stats.snapshot(time.Now()).EventsSkipped)
+}
+
+func TestRecordProcessorFullEnvelope(t *testing.T) {
+	r := require.New(t)
+
+	process := func(keys []string) *memlog.Log {
+		ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+		r.NoError(err)
+
+		t2o, err := NewTimestamp2Offset(100)
+		r.NoError(err)
+
+		p, err := parseProjection([]string{"order.id"})
+		r.NoError(err)
+
+		rp := dumpRecordProcessor{
+			ml:        ml,
+			t2o:       t2o,
+			stats:     newRouteStats(),
+			readiness: newReadiness(),
+			envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField, projection: p, full: true, keys: keys},
+			logger:    slog.New(slog.DiscardHandler),
+		}
+
+		rp.ProcessRecords(&kc.ProcessRecordsInput{
+			Records: []types.Record{
+				{
+					Data: []byte(`{"time":"1970-01-01T00:00:01Z","source":"shop","detail-type":"OrderPlaced","detail":{"order":{"id":1,"status":"paid"}}}`),
+				},
+			},
+		})
+
+		return ml
+	}
+
+	// The whole record is served, with its payload projected.
+	rec, err := process(nil).Read(context.Background(), 0)
+	r.NoError(err)
+	r.Equal(`{"detail":{"order":{"id":1}},"detail-type":"OrderPlaced","source":"shop","time":"1970-01-01T00:00:01Z"}`, string(rec.Data))
+
+	// Or only some of its keys, alongside its payload. Keys the record lacks are omitted.
+	rec, err = process([]string{"detail-type", "missing"}).Read(context.Background(), 0)
+	r.NoError(err)
+	r.Equal(`{"detail":{"order":{"id":1}},"detail-type":"OrderPlaced"}`, string(rec.Data))
+
+	for routeOptions, expected := range map[*RouteOptions]string{
+		{Pattern: "/", Envelope: "partial"}:                              `unknown envelope "partial"`,
+		{Pattern: "/", EnvelopeKeys: []string{"source"}}:                 "envelope keys require the full envelope",
+		{Pattern: "/", Envelope: EnvelopeFull, RawPassthrough: true}:     "full envelope can't be used with raw passthrough or binary",
+		{Pattern: "/", Envelope: EnvelopeFull, EnvelopeKeys: []string{}}: "",
+		{Pattern: "/", Envelope: EnvelopeDetail}:                         "",
+	} {
+		_, err := NewService(ServiceOptions{
+			Routes:     []RouteOptions{*routeOptions},
+			disableKCL: true,
+			Logger:     slog.New(slog.DiscardHandler),
+		})
+		if expected == "" {
+			r.NoError(err)
+		} else {
+			r.EqualError(err, `route "/": `+expected)
+		}
+	}
+}
+
+func TestRecordProcessorRawPassthrough(t *testing.T) {
+	r := require.New(t)
+
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+	r.NoError(err)
+
+	t2o, err := NewTimestamp2Offset(100)
+	r.NoError(err)
+
+	stats := newRouteStats()
+
+	rp := dumpRecordProcessor{
+		ml:        ml,
+		t2o:       t2o,
+		stats:     stats,
+		readiness: newReadiness(),
+		envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField, raw: true},
+		logger:    slog.New(slog.DiscardHandler),
+	}
+
+	arrival := time.Unix(1, 0)
+	rp.ProcessRecords(&kc.ProcessRecordsInput{
+		Records: []types.Record{
+			{
+				Data:                        []byte(`{"time":"1970-01-01T00:00:02Z","detail":{"event":0}}`),
+				ApproximateArrivalTimestamp: &arrival,
+			},
+			{
+				Data:                        []byte(`bogus`),
+				ApproximateArrivalTimestamp: &arrival,
+			},
+		},
+	})
+
+	// Records are written unchanged, even if they aren't JSON…
+	rec, err := ml.Read(context.Background(), 0)
+	r.NoError(err)
+	r.Equal(`{"time":"1970-01-01T00:00:02Z","detail":{"event":0}}`, string(rec.Data))
+
+	rec, err = ml.Read(context.Background(), 1)
+	r.NoError(err)
+	r.Equal(`bogus`, string(rec.Data))
+
+	r.Equal(int64(2), stats.snapshot(time.Now()).EventsIngested)
+	r.Equal(int64(0), stats.snapshot(time.Now()).EventsSkipped)
+
+	// …and indexed by their arrival timestamps.
+	timestamp, ok := t2o.TimestampForOffset(0)
+	r.True(ok)
+	r.Equal(arrival, timestamp)
+}
+
+func TestRecordProcessorProjection(t *testing.T) {
+	r := require.New(t)
+
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+	r.NoError(err)
+
+	t2o, err := NewTimestamp2Offset(100)
+	r.NoError(err)
+
+	p, err := parseProjection([]string{"order.id", "order.status", "order.customer.name", "region"})
+	r.NoError(err)
+
+	rp := dumpRecordProcessor{
+		ml:        ml,
+		t2o:       t2o,
+		stats:     newRouteStats(),
+		readiness: newReadiness(),
+		envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField, projection: p},
+		logger:    slog.New(slog.DiscardHandler),
+	}
+
+	rp.ProcessRecords(&kc.ProcessRecordsInput{
+		Records: []types.Record{
+			{
+				Data: []byte(`{"time":"1970-01-01T00:00:01Z","detail":{"order":{"id":1,"status":"paid","items":[1,2],"customer":"alice"},"region":"us"}}`),
+			},
+			{
+				// Paths the payload lacks are omitted.
+				Data: []byte(`{"time":"1970-01-01T00:00:02Z","detail":{"other":true}}`),
+			},
+		},
+	})
+
+	rec, err := ml.Read(context.Background(), 0)
+	r.NoError(err)
+	r.Equal(`{"order":{"id":1,"status":"paid"},"region":"us"}`, string(rec.Data))
+
+	rec, err = ml.Read(context.Background(), 1)
+	r.NoError(err)
+	r.Equal(`{}`, string(rec.Data))
+
+	// A nil projection keeps the whole payload.
+	r.Equal(map[string]any{"a": 1.0}, projection(nil).apply(map[string]any{"a": 1.0}))
+
+	_, err = parseProjection([]string{"order..id"})
+	r.Error(err)
+}
+
+func TestRecordProcessorMaxEventBytes(t *testing.T) {
+	r := require.New(t)
+
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+	r.NoError(err)
+
+	t2o, err := NewTimestamp2Offset(100)
+	r.NoError(err)
+
+	stats := newRouteStats()
+
+	rp := dumpRecordProcessor{
+		ml:            ml,
+		t2o:           t2o,
+		stats:         stats,
+		readiness:     newReadiness(),
+		envelope:      envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField},
+		maxEventBytes: len(`{"event":0}`),
+		logger:        slog.New(slog.DiscardHandler),
+	}
+
+	rp.ProcessRecords(&kc.ProcessRecordsInput{
+		Records: []types.Record{
+			{
+				Data: []byte(`{"time":"1970-01-01T00:00:01Z","detail":{"event":0}}`),
+			},
+			{
+				Data: []byte(`{"time":"1970-01-01T00:00:02Z","detail":{"event":"too large"}}`),
+			},
+			{
+				Data: []byte(`{"time":"1970-01-01T00:00:03Z","detail":{"event":2}}`),
+			},
+		},
+	})
+
+	// The oversized event is dropped, rather than written.
+	rec, err := ml.Read(context.Background(), 1)
+	r.NoError(err)
+	r.Equal(`{"event":2}`, string(rec.Data))
+
+	snapshot := stats.snapshot(time.Now())
+	r.Equal(int64(2), snapshot.EventsIngested)
+	r.Equal(int64(0), snapshot.EventsSkipped)
+	r.Equal(int64(1), snapshot.EventsDropped)
+}
+
+func TestRecordProcessorTimestampFallback(t *testing.T) {
+	r := require.New(t)
+
+	arrival := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	records := []types.Record{
+		{
+			Data:                        []byte(`{"time":"1970-01-01T00:00:01Z","detail":{"event":0}}`),
+			ApproximateArrivalTimestamp: &arrival,
+		},
+		{
+			Data:                        []byte(`{"detail":{"event":1}}`),
+			ApproximateArrivalTimestamp: &arrival,
+		},
+		{
+			Data:                        []byte(`{"time":"yesterday","detail":{"event":2}}`),
+			ApproximateArrivalTimestamp: &arrival,
+		},
+	}
+
+	process := func(fallback TimestampFallback) (*Timestamp2Offset, RouteStats) {
+		ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+		r.NoError(err)
+
+		t2o, err := NewTimestamp2Offset(100)
+		r.NoError(err)
+
+		stats := newRouteStats()
+		rp := dumpRecordProcessor{
+			ml:        ml,
+			t2o:       t2o,
+			stats:     stats,
+			readiness: newReadiness(),
+			envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField, timestampFallback: fallback},
+			logger:    slog.New(slog.DiscardHandler),
+		}
+		rp.ProcessRecords(&kc.ProcessRecordsInput{Records: records})
+
+		return t2o, stats.snapshot(time.Now())
+	}
+
+	// By default, records without a valid timestamp are skipped.
+	_, stats := process(TimestampFallbackSkip)
+	r.Equal(int64(1), stats.EventsIngested)
+	r.Equal(map[string]int64{"missing_time": 1, "unparseable_time": 1}, stats.EventsSkippedByReason)
+
+	// They may be timestamped by when Kinesis received them…
+	t2o, stats := process(TimestampFallbackArrival)
+	r.Equal(int64(3), stats.EventsIngested)
+	r.Zero(stats.EventsSkipped)
+	for off, expected := range []time.Time{time.Unix(1, 0), arrival, arrival} {
+		timestamp, ok := t2o.TimestampForOffset(off)
+		r.True(ok)
+		r.True(expected.Equal(timestamp), off)
+	}
+
+	// …or by when we ingest them.
+	before := time.Now()
+	t2o, stats = process(TimestampFallbackNow)
+	r.Equal(int64(3), stats.EventsIngested)
+	for off := 1; off < 3; off++ {
+		timestamp, ok := t2o.TimestampForOffset(off)
+		r.True(ok)
+		r.False(timestamp.Before(before), off)
+	}
+
+	_, err := NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/", TimestampFallback: "later"}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.ErrorContains(err, `unknown timestamp fallback "later"`)
+}
+
+func TestRecordProcessorEncoding(t *testing.T) {
+	r := require.New(t)
+
+	records := make([]types.Record, 10)
+	for i := range records {
+		records[i] = types.Record{Data: []byte(fmt.Sprintf(`{"time":"1970-01-01T00:00:01Z","detail":%s}`, sampleEvent(i)))}
+	}
+
+	// Compressed events take less memory.
+	process := func(encoding Encoding) (*memlog.Log, *Timestamp2Offset) {
+		ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+		r.NoError(err)
+
+		t2o, err := NewTimestamp2Offset(100)
+		r.NoError(err)
+
+		rp := dumpRecordProcessor{
+			ml:        ml,
+			t2o:       t2o,
+			stats:     newRouteStats(),
+			readiness: newReadiness(),
+			envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField, encoding: encoding},
+			logger:    slog.New(slog.DiscardHandler),
+		}
+		rp.ProcessRecords(&kc.ProcessRecordsInput{Records: records})
+
+		return ml, t2o
+	}
+
+	stored := make(map[Encoding]int)
+	for _, encoding := range []Encoding{EncodingNone, EncodingGzip, EncodingSnappy} {
+		ml, t2o := process(encoding)
+		oldest, ok := t2o.OldestOffset()
+		r.True(ok, encoding)
+		r.Equal(0, oldest, encoding)
+
+		// The events are stored encoded, and decode to what they were.
+		for i := range records {
+			record, err := ml.Read(context.Background(), memlog.Offset(i))
+			r.NoError(err, encoding)
+			stored[encoding] += len(record.Data)
+
+			data, err := encoding.decode(record.Data)
+			r.NoError(err, encoding)
+			r.JSONEq(string(sampleEvent(i)), string(data), encoding)
+		}
+	}
+
+	r.Less(stored[EncodingSnappy], stored[EncodingNone])
+	r.Less(stored[EncodingGzip], stored[EncodingSnappy])
+}
+
+func TestRecordProcessorSequenceNumber(t *testing.T) {
+	r := require.New(t)
+
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100))
+	r.NoError(err)
+
+	t2o, err := NewTimestamp2Offset(100)
+	r.NoError(err)
+
+	rp := dumpRecordProcessor{
+		ml:        ml,
+		t2o:       t2o,
+		stats:     newRouteStats(),
+		readiness: newReadiness(),
+		envelope:  envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField},
+		logger:    slog.New(slog.DiscardHandler),
+	}
+	rp.ProcessRecords(&kc.ProcessRecordsInput{Records: []types.Record{
+		{Data: []byte(`{"time":"1970-01-01T00:00:00Z","detail":{}}`), SequenceNumber: aws.String("1")},
+		{Data: []byte(`{"time":"1970-01-01T00:00:00Z","detail":{}}`), SequenceNumber: aws.String("2")},
+	}})
+
+	for off, expected := range []string{"1", "2"} {
+		sequenceNumber, ok := t2o.SequenceNumberForOffset(off)
+		r.True(ok, off)
+		r.Equal(expected, sequenceNumber, off)
+	}
+}
+
+func TestRecordProcessorDeadLetter(t *testing.T) {
+	r := require.New(t)
+
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(100), memlog.WithMaxRecordDataSize(len(`{"event":"large"}`)))
+	r.NoError(err)
+
+	t2o, err := NewTimestamp2Offset(100)
+	r.NoError(err)
+
+	var deadLetters []DeadLetter
+	rp := dumpRecordProcessor{
+		ml:            ml,
+		t2o:           t2o,
+		stats:         newRouteStats(),
+		readiness:     newReadiness(),
+		envelope:      envelope{timeField: DefaultTimeField, payloadField: DefaultPayloadField},
+		maxEventBytes: len(`{"event":"larger"}`),
+		logger:        slog.New(slog.DiscardHandler),
+		shardID:       "shardId-000000000000",
+		route:         "/",
+		deadLetterFunc: func(deadLetter DeadLetter) {
+			// The sink may block, so it's called without holding Timestamp2Offset's lock.
+			r.True(t2o.TryLock())
+			t2o.Unlock()
+			deadLetters = append(deadLetters, deadLetter)
+		},
+	}
+
+	records := []types.Record{
+		{Data: []byte(`bogus`), SequenceNumber: aws.String("0")},
+		{Data: []byte(`{"detail":{}}`), SequenceNumber: aws.String("1")},
+		{Data: []byte(`{"time":"1970-01-01T00:00:00Z","detail":{"event":"too large"}}`), SequenceNumber: aws.String("2")},
+		{Data: []byte(`{"time":"1970-01-01T00:00:00Z","detail":{"event":"larger"}}`), SequenceNumber: aws.String("3")},
+		{Data: []byte(`{"time":"1970-01-01T00:00:00Z","detail":{"event":0}}`), SequenceNumber: aws.String("4")},
+	}
+	rp.ProcessRecords(&kc.ProcessRecordsInput{Records: records})
+
+	// Every record but the last is dead-lettered, unchanged, along with why.
+	r.Len(deadLetters, 4)
+	for i, deadLetter := range deadLetters {
+		r.Equal("/", deadLetter.Route)
+		r.Equal("shardId-000000000000", deadLetter.ShardID)
+		r.Equal(aws.ToString(records[i].SequenceNumber), deadLetter.SequenceNumber)
+		r.Equal(records[i].Data, deadLetter.Data)
+		r.Error(deadLetter.Err)
+	}
+	r.Equal("unparseable_json", deadLetters[0].Reason)
+	r.Equal("missing_time", deadLetters[1].Reason)
+	r.Equal(DeadLetterReasonTooLarge, deadLetters[2].Reason)
+	r.Equal("memlog_error", deadLetters[3].Reason)
+	r.ErrorIs(deadLetters[3].Err, memlog.ErrRecordTooLarge)
+
+	rec, err := ml.Read(context.Background(), 0)
+	r.NoError(err)
+	r.Equal(`{"event":0}`, string(rec.Data))
+}
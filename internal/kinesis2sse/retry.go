@@ -0,0 +1,48 @@
+package kinesis2sse
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// retry calls f up to attempts times, until it succeeds, waiting delay before the first retry and doubling it after
+// each. Before each retry, it calls onRetry with the failed attempt (starting from 1), the delay, and the error. It
+// returns f's last error, including if ctx is done while waiting.
+func retry(ctx context.Context, attempts int, delay time.Duration, f func() error, onRetry func(attempt int, delay time.Duration, err error)) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+
+		onRetry(attempt, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay *= 2
+	}
+}
+
+// jitter returns a random duration between d and twice d, so that clients told to wait d before reconnecting don't all
+// reconnect at once.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + rand.N(d)
+}
+
+// jitteredRetryAfter returns a Retry-After of at least the specified number of seconds, with jitter (see jitter),
+// rounded up to whole seconds.
+func jitteredRetryAfter(seconds int) string {
+	d := jitter(time.Duration(seconds) * time.Second)
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
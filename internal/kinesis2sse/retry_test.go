@@ -0,0 +1,73 @@
+package kinesis2sse
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	failures := func(n int) func() error {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= n {
+				return errors.New("unavailable")
+			}
+			return nil
+		}
+	}
+
+	// Succeeds on the first attempt, without retrying.
+	var delays []time.Duration
+	onRetry := func(attempt int, delay time.Duration, err error) {
+		r.Equal(len(delays)+1, attempt)
+		r.EqualError(err, "unavailable")
+		delays = append(delays, delay)
+	}
+	r.NoError(retry(ctx, 3, time.Millisecond, failures(0), onRetry))
+	r.Empty(delays)
+
+	// Succeeds after retrying, doubling the delay each time.
+	r.NoError(retry(ctx, 3, time.Millisecond, failures(2), onRetry))
+	r.Equal([]time.Duration{time.Millisecond, 2 * time.Millisecond}, delays)
+
+	// Fails once the attempts are exhausted.
+	delays = nil
+	r.EqualError(retry(ctx, 3, time.Millisecond, failures(3), onRetry), "unavailable")
+	r.Len(delays, 2)
+
+	// A single attempt means no retries.
+	delays = nil
+	r.EqualError(retry(ctx, 1, time.Millisecond, failures(1), onRetry), "unavailable")
+	r.Empty(delays)
+
+	// Gives up early if the context is done while waiting.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	delays = nil
+	start := time.Now()
+	r.EqualError(retry(ctx, 3, time.Hour, failures(3), onRetry), "unavailable")
+	r.Len(delays, 1)
+	r.Less(time.Since(start), time.Minute)
+}
+
+func TestJitter(t *testing.T) {
+	r := require.New(t)
+
+	r.Zero(jitter(0))
+
+	for range 100 {
+		d := jitter(time.Second)
+		r.GreaterOrEqual(d, time.Second)
+		r.Less(d, 2*time.Second)
+
+		r.Contains([]string{"5", "6", "7", "8", "9", "10"}, jitteredRetryAfter(5))
+	}
+}
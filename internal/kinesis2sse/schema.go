@@ -0,0 +1,40 @@
+package kinesis2sse
+
+import (
+	"encoding/json"
+)
+
+// inferShape returns the shape of a JSON event: the event with each value replaced by the name of its JSON type
+// ("string", "number", "boolean", or "null"). Arrays are represented by the shape of their first element, if any.
+func inferShape(data []byte) ([]byte, error) {
+	var event any
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(shapeOf(event))
+}
+
+func shapeOf(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		shape := make(map[string]any, len(v))
+		for k, vv := range v {
+			shape[k] = shapeOf(vv)
+		}
+		return shape
+	case []any:
+		if len(v) == 0 {
+			return []any{}
+		}
+		return []any{shapeOf(v[0])}
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
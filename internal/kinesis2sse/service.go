@@ -1,283 +1,2446 @@
 package kinesis2sse
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/embano1/memlog"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	chk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/checkpoint"
 	cfg "github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
 	wk "github.com/vmware/vmware-go-kcl-v2/clientlibrary/worker"
 )
 
 const (
-	DefaultServicePort = 4444
-	DefaultCapacity    = 100_000
-	DefaultHost        = ""
+	DefaultServicePort       = 4444
+	DefaultCapacity          = 100_000
+	DefaultHost              = ""
+	DefaultSlowClientTimeout = 10 * time.Second
+	DefaultWriteTimeout      = time.Minute
+
+	// MaxPreallocatedBytes is the most memory a route may preallocate for its Capacity. The memlog and Timestamp2Offset
+	// preallocate memory for each event of capacity (see memoryPerEvent) as soon as the route is created, so a larger
+	// capacity would take the process down before the route could be rejected.
+	MaxPreallocatedBytes = 1 << 30
+
+	// MaxCapacity is the largest RouteOptions.Capacity, which preallocates MaxPreallocatedBytes.
+	MaxCapacity = MaxPreallocatedBytes / memoryPerEvent
+
+	// DefaultReadHeaderTimeout is how long the server waits to read a request's headers.
+	DefaultReadHeaderTimeout = 2 * time.Second
+
+	// DefaultBatchDelay is the longest an event waits for its batch to fill, for clients which pass "batch".
+	DefaultBatchDelay = 100 * time.Millisecond
+
+	// DefaultWorkerStartAttempts is how many times each KCL worker is started before giving up. One means no retries.
+	DefaultWorkerStartAttempts = 1
+
+	// DefaultWorkerStartRetryDelay is how long to wait before retrying to start a KCL worker the first time.
+	DefaultWorkerStartRetryDelay = time.Second
+
+	// DefaultTimeField and DefaultPayloadField are the fields of the EventBridge-style envelope events arrive in.
+	DefaultTimeField    = "time"
+	DefaultPayloadField = "detail"
+
+	// DefaultLagLogInterval is how often each route's consumer lag, and any records it skipped, are logged.
+	DefaultLagLogInterval = time.Minute
+
+	// DefaultEmptyLogHeartbeatInterval is how often heartbeats are sent to clients which connect before a route has any
+	// events, if the route doesn't configure a HeartbeatInterval, so that they know the stream is alive.
+	DefaultEmptyLogHeartbeatInterval = 15 * time.Second
+
+	// DefaultFlushInterval is how long events may wait to be flushed, if a route sets FlushEvery, but not FlushInterval.
+	DefaultFlushInterval = time.Second
+
+	// DefaultRequestIDHeader is the header from which each stream's request ID is read, and to which it's echoed.
+	DefaultRequestIDHeader = "X-Request-Id"
+
+	// DefaultPreamble is the text of the comment which begins each SSE stream.
+	DefaultPreamble = "ok"
+
+	// DefaultConnectionLimitRetryAfter is the minimum Retry-After, in seconds, sent to clients rejected by
+	// MaxConnections. Like every Retry-After we send, it's jittered, so that rejected clients don't all retry at once.
+	DefaultConnectionLimitRetryAfter = 5
+
+	// DefaultStartingUpRetryAfter is the minimum Retry-After, in seconds, sent to clients which connect to a route before
+	// Start has started the KCL workers.
+	DefaultStartingUpRetryAfter = 1
+
+	// DefaultDrainingRetryAfter is the minimum Retry-After, in seconds, sent to clients which connect to a route after
+	// Drain was called.
+	DefaultDrainingRetryAfter = 1
+
+	// DefaultEndedRetryMillis is the minimum SSE "retry", in milliseconds, sent to clients whose streams we end because
+	// they're overloaded, or because the service is draining or stopping, if the route doesn't configure RetryMillis.
+	// It's jittered, so that the clients don't all reconnect at once.
+	DefaultEndedRetryMillis = 3000
+
+	// TimestampFormat is the format of the event timestamps sent to clients which pass "include_timestamp=true": RFC
+	// 3339 with milliseconds.
+	TimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// SlowClientPolicy determines what happens when a client can't keep up with a route's events.
+type SlowClientPolicy string
+
+const (
+	// SlowClientBlock blocks on writes to the client, however long they take. This is the default.
+	SlowClientBlock SlowClientPolicy = "block"
+
+	// SlowClientDisconnect closes the connection when a write to the client doesn't complete in time.
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+
+	// SlowClientSkip drops the events a client is behind on when a write to the client doesn't complete in time, so
+	// that it catches up to live. The skipped offsets are reported to the client in a "gap" event.
+	SlowClientSkip SlowClientPolicy = "skip"
+)
+
+// EnvelopeMode determines how much of each record's envelope a route serves.
+type EnvelopeMode string
+
+const (
+	// EnvelopeDetail serves only the record's PayloadField. This is the default.
+	EnvelopeDetail EnvelopeMode = "detail"
+
+	// EnvelopeFull serves the whole record, like an EventBridge event's "detail-type", "source", and "time" alongside
+	// its "detail", or else only its EnvelopeKeys and PayloadField.
+	EnvelopeFull EnvelopeMode = "full"
+)
+
+// TimestampFallback determines how a route timestamps records whose TimeField is missing or un-parseable.
+type TimestampFallback string
+
+const (
+	// TimestampFallbackSkip skips such records. This is the default.
+	TimestampFallbackSkip TimestampFallback = "skip"
+
+	// TimestampFallbackArrival timestamps such records by when Kinesis received them (their
+	// ApproximateArrivalTimestamp).
+	TimestampFallbackArrival TimestampFallback = "arrival"
+
+	// TimestampFallbackNow timestamps such records by when we ingest them.
+	TimestampFallbackNow TimestampFallback = "now"
+)
+
+// Checkpointing determines where KCL workers checkpoint their progress through each shard.
+type Checkpointing string
+
+const (
+	// CheckpointingInMemory keeps checkpoints in memory, so that after a restart, each route resumes from its KCL
+	// configuration's initial position. This is the default.
+	CheckpointingInMemory Checkpointing = "memory"
+
+	// CheckpointingDynamoDB persists checkpoints to the DynamoDB table named by each route's KCL configuration, which
+	// is created if it doesn't exist. After a restart, each route resumes each shard from its last checkpoint.
+	CheckpointingDynamoDB Checkpointing = "dynamodb"
+
+	// CheckpointingFile persists checkpoints to a JSON file (see ServiceOptions.CheckpointFile), which suits a single
+	// kinesis2sse process. After a restart, each route resumes each shard from its last checkpoint.
+	CheckpointingFile Checkpointing = "file"
+
+	// CheckpointingNone doesn't checkpoint at all, which avoids even in-memory lease bookkeeping. It suits a route whose
+	// stream has a single shard, read by a single kinesis2sse process. Like CheckpointingInMemory, each route resumes
+	// from its KCL configuration's initial position, and so does each KCL worker which restarts reading a shard.
+	CheckpointingNone Checkpointing = "none"
 )
 
+// validate returns the checkpointing to use, which defaults to fallback.
+func (checkpointing Checkpointing) validate(fallback Checkpointing) (Checkpointing, error) {
+	switch checkpointing {
+	case "":
+		return fallback, nil
+	case CheckpointingInMemory, CheckpointingDynamoDB, CheckpointingFile, CheckpointingNone:
+		return checkpointing, nil
+	default:
+		return "", fmt.Errorf("unknown checkpointing %q", checkpointing)
+	}
+}
+
 type ServiceOptions struct {
+	// Host is the host or IP address to listen on, like "127.0.0.1" to only accept local connections. Defaults to
+	// DefaultHost, which listens on all interfaces.
+	Host string
+
 	// Port is the HTTP port to listen on. Defaults to 4444. Set this to -1 to choose a random port.
 	Port int
 
 	// Routes is the set of routes to serve.
 	Routes []RouteOptions
 
+	// DynamicRoutes are patterns with wildcards, each match of which is served by a route created on demand.
+	DynamicRoutes []DynamicRouteOptions
+
 	// Logger is the logger to use.
 	Logger *slog.Logger // required
 
+	// MemoryBudget, if set, is the number of bytes of memory every route's events may take up together. Each route's
+	// share is estimated as the most its memlog may retain, twice its Capacity of events of up to its MaxEventBytes,
+	// which must be set, plus the memory preallocated for each event of its Capacity. Routes which would exceed the
+	// budget are rejected. Defaults to 0 (unlimited).
+	MemoryBudget int
+
+	// DeadLetter, if set, receives each record a route is unable to serve, like one which isn't valid JSON, exceeds
+	// RouteOptions.MaxEventBytes, or fails to be written to the route's memlog, so that it can be captured and replayed.
+	// It's called synchronously as records are ingested, so it should return quickly.
+	DeadLetter func(DeadLetter)
+
+	// HealthMaxLag is the default consumer lag beyond which /health reports a route as unhealthy. Routes can override
+	// this with RouteOptions.HealthMaxLag, and requests can override both with the "max_lag" query parameter. Defaults
+	// to 0 (lag is not checked).
+	HealthMaxLag time.Duration
+
+	// LagLogInterval is how often to log each route's consumer lag (its shards' MillisBehindLatest) at info level, along
+	// with any records it skipped since the last log at warn level. Defaults to 1 minute. Set this to a negative
+	// duration to disable these logs.
+	LagLogInterval time.Duration
+
+	// AdminToken is the bearer token required by the /admin endpoints. If empty, the /admin endpoints are disabled.
+	AdminToken string
+
+	// Listener, if set, is served instead of listening on Port. Use this to serve a listening socket inherited from
+	// another process, like systemd or a previous kinesis2sse process during a graceful restart.
+	Listener net.Listener
+
+	// TLSCertFile and TLSKeyFile, if both set, are the paths to a PEM-encoded certificate (chain) and private key with
+	// which to serve HTTPS instead of HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// MaxConnectionDuration is how long a stream may stay open before we end it, which gives clients a predictable
+	// reconnect cadence and bounds the resources each connection uses. Zero means unlimited.
+	MaxConnectionDuration time.Duration
+
+	// ReadHeaderTimeout, ReadTimeout, and IdleTimeout configure the http.Server, like its fields of the same names.
+	// ReadHeaderTimeout defaults to 2 seconds, and ReadTimeout and IdleTimeout to 0 (no timeout, although IdleTimeout
+	// falls back to ReadTimeout). ReadTimeout only bounds reading the request, so it doesn't end SSE streams.
+	//
+	// NOTE(mroberts): There's deliberately no option for the http.Server's WriteTimeout, since it would end every SSE
+	// stream after a fixed duration. SSE streams bound each write with WriteTimeout instead.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	IdleTimeout       time.Duration
+
+	// WriteTimeout bounds how long any one write to a client may take before we close its connection, whatever the
+	// route's SlowClientPolicy, so that a stalled client doesn't hold on to its handler indefinitely. Defaults to 1
+	// minute.
+	WriteTimeout time.Duration
+
+	// MaxLookback, if positive, is how far back the "since" query parameter may reach, whether as a duration or a
+	// timestamp. Requests reaching back further are rejected with a 400. Zero means unlimited.
+	MaxLookback time.Duration
+
+	// WorkerStartAttempts is how many times to try starting each KCL worker before rolling back and failing, so that
+	// a stream which is briefly unavailable, like during a deploy, doesn't fail the whole service. Defaults to 1 (no
+	// retries).
+	WorkerStartAttempts int
+
+	// WorkerStartRetryDelay is how long to wait before the first retry to start a KCL worker. It doubles after each
+	// attempt. Defaults to 1 second.
+	WorkerStartRetryDelay time.Duration
+
+	// CORS configures which origins browsers may connect from. By default, any origin is allowed.
+	CORS CORSOptions
+
+	// DisableCompression disables gzip-compressing SSE streams for clients which accept it. Use this when a proxy
+	// already handles compression.
+	DisableCompression bool
+
+	// Preamble is the text of the comment which begins each SSE stream, signaling that it's live. Defaults to
+	// DefaultPreamble, which is sent as ": ok". It must be a single line.
+	Preamble string
+
+	// DisablePreamble disables the preamble, for clients which choke on comments. Routes' RetryMillis and the Greeting
+	// are still sent.
+	DisablePreamble bool
+
+	// Greeting, if set, is the text of a comment sent after the preamble and the route's RetryMillis, like a banner. It
+	// must be a single line.
+	Greeting string
+
+	// RequestIDHeader is the header, like "X-Request-Id" or "traceparent", from which to read each stream's request ID,
+	// as injected by a proxy at the edge. It's attached to the stream's logs and echoed back in the response header of
+	// the same name, so that they can be correlated with upstream traces. If a request doesn't have one, we generate a
+	// UUID. Defaults to DefaultRequestIDHeader.
+	RequestIDHeader string
+
+	// RequestIDComment sends the request ID in a ": request-id" comment at the start of each SSE stream, after the
+	// Greeting, for clients which can't read response headers, like EventSource.
+	RequestIDComment bool
+
+	// StreamHeaders are set on each SSE and NDJSON stream's response, in addition to the defaults, "Cache-Control:
+	// no-cache", "Connection: keep-alive", and "X-Accel-Buffering: no", which keep proxies like nginx from buffering
+	// events. A header here overrides the default of the same name, and a header with an empty value removes it.
+	StreamHeaders http.Header
+
+	// DisableIndex disables the index, which otherwise lists the routes' patterns and streams as JSON at "/", and in the
+	// 404 response to any other path no route matches. Use this to avoid exposing the service's topology. The index is
+	// also disabled when a route's pattern claims "/".
+	DisableIndex bool
+
+	// EnableViewer serves an HTML page at /viewer which connects to a chosen route and lists its events as they
+	// arrive, for demos and debugging. It's disabled by default.
+	EnableViewer bool
+
+	// Version and Commit identify the build, as served at /version, along with the Go version. Typically they're set
+	// at build time.
+	Version string
+	Commit  string
+
+	// Checkpointing determines where KCL workers checkpoint their progress, unless a route sets its own. Defaults to
+	// CheckpointingInMemory.
+	Checkpointing Checkpointing
+
+	// CheckpointFile is the path to the JSON file used by CheckpointingFile. Setting it selects CheckpointingFile, if
+	// Checkpointing is unset. If the file is missing or corrupt, we start fresh.
+	CheckpointFile string
+
 	// disableKCL allows disabling the KCL worker, and callers must update the memlog.Log themselves. Only for testing.
 	disableKCL bool
 }
 
 type RouteOptions struct {
-	// Pattern is the pattern to pass to http.ServeMux.HandleFunc.
+	// Pattern is the pattern to pass to http.ServeMux.HandleFunc. It also identifies the route to Service.RemoveRoute.
 	Pattern string
 
 	// Capacity is the number of events that will be kept in memory. Defaults to 100,000.
 	Capacity int
 
+	// MaxEventBytes is the maximum size, in bytes, of an event. Larger events are dropped during ingest, with a warning,
+	// rather than written to the memlog, which protects memory and keeps SSE frames within client limits. It may be at
+	// most memlog.DefaultMaxRecordDataBytes (1 MiB), which the memlog rejects larger events by regardless. Defaults to 0
+	// (the memlog's limit).
+	MaxEventBytes int
+
 	// KCLConfig is the Kinesis Client Library (KCL) configuration to use.
 	KCLConfig *cfg.KinesisClientLibConfiguration
+
+	// AdditionalKCLConfigs, if set, are the KCL configurations of more streams to feed into the route, for when one
+	// logical stream is split across multiple Kinesis Streams. Each gets its own KCL worker, and they all write to the
+	// same memlog, so events are ordered by when we ingested them, not by their timestamps: events from different
+	// streams may be interleaved out of timestamp order. Backfill can't be used with additional streams.
+	AdditionalKCLConfigs []*cfg.KinesisClientLibConfiguration
+
+	// HealthMaxLag is the consumer lag beyond which /health reports this route as unhealthy. Defaults to
+	// ServiceOptions.HealthMaxLag.
+	HealthMaxLag time.Duration
+
+	// MonotonicTimestamps clamps each event's indexed timestamp to be no earlier than the previous event's, so that
+	// "since" lookups are unaffected by producer clock skew. See Timestamp2Offset.NearestOffset.
+	MonotonicTimestamps bool
+
+	// SlowClientPolicy determines what happens when a client can't keep up. Defaults to SlowClientBlock.
+	SlowClientPolicy SlowClientPolicy
+
+	// SlowClientTimeout is how long a write to a client may take before the client is considered slow. Only used by
+	// SlowClientDisconnect and SlowClientSkip. Defaults to 10 seconds.
+	SlowClientTimeout time.Duration
+
+	// MaxLag is the number of events a client may fall behind the latest event before we close its connection with an
+	// ": overloaded" comment. This bounds the resources a client which can't keep up holds onto, regardless of
+	// SlowClientPolicy. Zero means unlimited.
+	MaxLag int
+
+	// Schema is a JSON Schema describing the route's events, sent to clients which pass "schema=true". If unset, the
+	// shape of the most recent event is sent instead.
+	Schema json.RawMessage
+
+	// RetryMillis is sent to clients as the SSE "retry" field, which is how long they should wait before reconnecting.
+	// If unset, no "retry" field is sent, and clients use their default.
+	RetryMillis int
+
+	// HeartbeatInterval is how often to send a heartbeat comment to idle clients, which keeps proxies and load balancers
+	// from closing their connections. If unset, no heartbeats are sent.
+	HeartbeatInterval time.Duration
+
+	// FlushEvery and FlushInterval trade latency for throughput, by buffering events and flushing them to each client
+	// together. Events are flushed once FlushEvery of them are buffered, or FlushInterval after the first of them was,
+	// whichever comes first. If neither is set, every event is flushed as soon as it's written. If only FlushEvery is
+	// set, FlushInterval defaults to DefaultFlushInterval, so that a lull doesn't strand events.
+	FlushEvery    int
+	FlushInterval time.Duration
+
+	// MaxConnections is the maximum number of concurrent streams the route serves. Clients beyond this are rejected with
+	// 503 Service Unavailable. Zero means unlimited.
+	MaxConnections int
+
+	// CloudEventsTypeField is a top-level field of each event to use as its CloudEvents "type", for clients which pass
+	// "format=cloudevents". If unset, or if an event's field is missing or not a string, its type is
+	// DefaultCloudEventsType.
+	CloudEventsTypeField string
+
+	// EventNameField is a top-level field of each event, like "detail-type", to use as its SSE event name. If unset, or
+	// if an event's field is missing or not a string, the event is unnamed (and so dispatched as "message").
+	EventNameField string
+
+	// TimeField is the top-level field of each record containing its RFC 3339 timestamp. Defaults to "time".
+	TimeField string
+
+	// PayloadField is the top-level field of each record containing the event to serve. Defaults to "detail".
+	//
+	// Records missing either field are skipped, unless TimestampFallback applies. Configured fields replace the
+	// defaults, rather than falling back to them, so a record with "time" but not the configured TimeField is skipped,
+	// too.
+	PayloadField string
+
+	// TimestampFallback determines how records whose TimeField is missing or un-parseable are timestamped, rather than
+	// skipped. Defaults to TimestampFallbackSkip.
+	TimestampFallback TimestampFallback
+
+	// Envelope determines whether to serve only each record's PayloadField, or the whole record. Records missing the
+	// PayloadField are skipped either way. Defaults to EnvelopeDetail.
+	Envelope EnvelopeMode
+
+	// EnvelopeKeys, if set, are the top-level fields of each record to serve alongside its PayloadField, rather than the
+	// whole record. Requires EnvelopeFull.
+	EnvelopeKeys []string
+
+	// RawPassthrough serves each record unchanged, rather than unwrapping it from an envelope, and indexes it by the
+	// time Kinesis received it (its ApproximateArrivalTimestamp). TimeField, PayloadField, and Envelope are ignored. Use this for
+	// streams of arbitrary JSON, or even non-JSON, records.
+	RawPassthrough bool
+
+	// Binary treats each record as opaque bytes, like a Protobuf message: it's ingested as if RawPassthrough were set,
+	// and served base64-encoded (as a JSON string to NDJSON and JSON clients). Filters, EventNameField, and inferred
+	// schemas don't apply.
+	Binary bool
+
+	// Projection, if set, is a list of dotted key paths, like "order.id", into each record's payload. Only the values at
+	// these paths are served, nested as they were in the payload, which slims down events for clients which only need a
+	// few fields. Paths a payload lacks are omitted. If unset, payloads are served whole. Projection can't be used with
+	// RawPassthrough or Binary.
+	Projection []string
+
+	// Checkpointing determines where the route's KCL workers checkpoint their progress. Defaults to
+	// ServiceOptions.Checkpointing. CheckpointingFile requires ServiceOptions.CheckpointFile.
+	Checkpointing Checkpointing
+
+	// Encoding determines how events are stored in the memlog. Compressing them trades CPU, to compress each event as
+	// it's ingested and decompress it each time it's served, for memory. Since Capacity counts events, not bytes,
+	// compression doesn't let the route serve more events, and since MaxEventBytes counts uncompressed bytes, it doesn't
+	// lower the route's share of ServiceOptions.MemoryBudget either. Defaults to EncodingNone.
+	Encoding Encoding
+
+	// BackfillS3URI, if set, is an S3 prefix, like "s3://my-bucket/events/", of archived records in the same format as
+	// the stream's (see TimeField, PayloadField, and RawPassthrough). Each object holds one or more JSON records,
+	// newline-delimited or concatenated, and optionally gzipped. Before the route's KCL worker starts, we write the
+	// archived records from the last BackfillWindow to the memlog, so that "since" can reach back further than the
+	// stream's retention.
+	//
+	// The KCL worker must start at LATEST or AT_TIMESTAMP, which is the handoff: we backfill archived records timestamped
+	// before it, and the worker consumes live records from it, so every archived event precedes every live event. With
+	// LATEST, the handoff is when the route is created, and the worker starts there, rather than wherever LATEST is
+	// once backfilling completes, so that no records are missed in between. Archived records are compared by their
+	// timestamps, and live records by the time Kinesis received them, so records produced around the handoff with skewed
+	// timestamps may be served twice or not at all. If the worker resumes from a persisted checkpoint instead (see
+	// Checkpointing), records between the handoff and the checkpoint may be served twice.
+	BackfillS3URI string
+
+	// BackfillWindow is how far back from the handoff to backfill. Required with BackfillS3URI.
+	BackfillWindow time.Duration
+
+	// BackfillS3Client is the S3 client to backfill with. Defaults to a client using the default AWS configuration, in
+	// the KCL configuration's region and with its credentials.
+	BackfillS3Client BackfillS3Client
+
+	// APIKeys, if set, are the keys clients must present, either as a bearer token or in the "api_key" query parameter,
+	// to connect to the route. Clients without a matching key are rejected with 401 Unauthorized. If unset, the route is
+	// unauthenticated.
+	APIKeys []string
 }
 
 type Service struct {
-	cancel func()
-	port   int
-	routes map[string]route
-	logger *slog.Logger // required
-	srv    *http.Server
-	l      net.Listener
-	cond   *sync.Cond
+	host       string
+	port       int
+	logger     *slog.Logger // required
+	adminToken string
+	inherited  net.Listener
+
+	tlsCertFile           string
+	tlsKeyFile            string
+	maxConnectionDuration time.Duration
+	writeTimeout          time.Duration
+	maxLookback           time.Duration
+	workerStartAttempts   int
+	workerStartRetryDelay time.Duration
+	cors                  CORSOptions
+	disableCompression    bool
+	disableIndex          bool
+	enableViewer          bool
+	version               VersionInfo
+
+	// preamble and greeting are the comments which begin each SSE stream, before and after the route's retry, if any.
+	// Either may be empty.
+	preamble string
+	greeting string
+
+	requestIDHeader  string
+	requestIDComment bool
+	streamHeaders    http.Header
+
+	// These are used to construct routes, including those added by AddRoute.
+	healthMaxLag   time.Duration
+	memoryBudget   int
+	deadLetter     func(DeadLetter)
+	checkpointing  Checkpointing
+	checkpointFile *checkpointFile
+	disableKCL     bool
+
+	// dynamicRoutes create routes on demand. dynamicLock serializes creating and removing them.
+	dynamicRoutes []*dynamicRoute
+	dynamicLock   sync.Mutex
+
+	// routesLock guards routes and mux, which AddRoute and RemoveRoute replace while serving.
+	routesLock sync.RWMutex
+	routes     map[string]route
+	mux        *http.ServeMux
+	metrics    http.Handler
+
+	// changeLock serializes Start, Stop, AddRoute, and RemoveRoute, which may block on KCL workers. pending are the
+	// routes which AddRoute is starting, which it releases changeLock for.
+	changeLock sync.Mutex
+	started    bool
+	stopped    bool
+	pending    map[string]route
+
+	// startingUp is set while Start is starting the KCL workers. We listen beforehand, so that clients aren't refused,
+	// but the routes respond 503 Service Unavailable until the workers have started.
+	startingUp atomic.Bool
+
+	// draining is set once Drain is called, after which the routes respond 503 Service Unavailable to new clients.
+	// Cancelling drainCtx ends the streams of existing clients.
+	draining    atomic.Bool
+	drainCtx    context.Context
+	drainCancel context.CancelFunc
+
+	// lagLogInterval is how often logLag logs, until stop is closed.
+	lagLogInterval time.Duration
+	stop           chan struct{}
+
+	srv  *http.Server
+	l    net.Listener
+	cond *sync.Cond
 }
 
 type route struct {
-	ml   *memlog.Log
-	t2o  *Timestamp2Offset
-	wrkr *wk.Worker
+	// ctx is done when the route is removed, which ends its streams. cancel removes it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	pattern string
+	streams []string // the primary stream, followed by any additional streams
+
+	ml           *memlog.Log
+	capacity     int
+	memory       int // the estimated bytes of memory the route's events take up, which counts against MemoryBudget
+	t2o          *Timestamp2Offset
+	stats        *routeStats
+	readiness    *readiness
+	connections  *connectionRegistry
+	workers      []routeWorker
+	backfill     *backfill
+	healthMaxLag time.Duration
+
+	slowClientPolicy  SlowClientPolicy
+	slowClientTimeout time.Duration
+
+	maxLag int
+
+	schema []byte
+
+	retryMillis int
+
+	heartbeatInterval time.Duration
+
+	flushEvery    int
+	flushInterval time.Duration
+
+	eventNameField string
+
+	cloudEventsTypeField string
+
+	binary bool
+
+	encoding Encoding
+
+	apiKeys []string
+
+	// slots is a counting semaphore bounding concurrent streams, if MaxConnections is set.
+	slots chan struct{}
 }
 
 // NewService returns a new Service using the specified KCL configuration.
 func NewService(options ServiceOptions) (*Service, error) {
-	p := options.Port
-	if p == 0 {
-		p = DefaultServicePort
-	} else if p == -1 {
-		p = 0
+	if (options.TLSCertFile == "") != (options.TLSKeyFile == "") {
+		return nil, errors.New("TLS cert file and key file must be set together")
 	}
 
-	handler := http.NewServeMux()
-
-	ctx, cancel := context.WithCancel(context.Background())
-
-	s := &Service{
-		cancel: cancel,
-		port:   p,
-		routes: make(map[string]route),
-		logger: options.Logger,
-		srv:    &http.Server{ReadHeaderTimeout: 2 * time.Second, Handler: handler},
-		l:      nil,
-		cond:   &sync.Cond{L: &sync.Mutex{}},
+	defaultCheckpointing := CheckpointingInMemory
+	if options.CheckpointFile != "" {
+		defaultCheckpointing = CheckpointingFile
+	}
+	checkpointing, err := options.Checkpointing.validate(defaultCheckpointing)
+	if err != nil {
+		return nil, err
 	}
 
-	handler.HandleFunc("/health", func(resp http.ResponseWriter, _ *http.Request) {
-		resp.WriteHeader(200)
-	})
+	// NOTE(mroberts): Routes may checkpoint to the file even if the default is to checkpoint elsewhere.
+	if checkpointing == CheckpointingFile && options.CheckpointFile == "" {
+		return nil, errors.New("checkpoint file must be set if checkpointing to a file")
+	}
 
-	for _, routeOptions := range options.Routes {
-		capacity := routeOptions.Capacity
-		if capacity < 0 {
-			return nil, errors.New("capacity must be non-negative")
-		}
-		if capacity == 0 {
-			capacity = DefaultCapacity
-		}
+	// NOTE(mroberts): A line break would end the comment early, and let it inject fields.
+	if strings.ContainsAny(options.Preamble, "\r\n") {
+		return nil, errors.New("preamble must be a single line")
+	}
+	if strings.ContainsAny(options.Greeting, "\r\n") {
+		return nil, errors.New("greeting must be a single line")
+	}
 
-		ml, err := memlog.New(ctx, memlog.WithMaxSegmentSize(capacity))
-		if err != nil {
-			return nil, err
+	var preamble string
+	if !options.DisablePreamble {
+		preamble = options.Preamble
+		if preamble == "" {
+			preamble = DefaultPreamble
 		}
+		preamble = fmt.Sprintf(": %s\n\n", preamble)
+	}
 
-		t2o, err := NewTimestamp2Offset(capacity)
-		if err != nil {
-			return nil, err
-		}
+	var greeting string
+	if options.Greeting != "" {
+		greeting = fmt.Sprintf(": %s\n\n", options.Greeting)
+	}
 
-		var wrkr *wk.Worker
-		if !options.disableKCL {
-			// NOTE(mroberts): We don't support checkpointing. Everything is resumed from `start`.
-			kclConfig := routeOptions.KCLConfig.WithLeaseStealing(false)
-			wrkr = wk.NewWorker(recordProcessorFactory(ml, t2o, s.logger), kclConfig).
-				WithCheckpointer(NewInMemoryCheckpointer(kclConfig.WorkerID, s.logger))
-		}
+	writeTimeout := options.WriteTimeout
+	if writeTimeout < 0 {
+		return nil, errors.New("write timeout must be non-negative")
+	} else if writeTimeout == 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
 
-		handler.HandleFunc(routeOptions.Pattern, func(w http.ResponseWriter, r *http.Request) {
-			s.handleFunc(ml, t2o, w, r)
-		})
+	if options.MaxLookback < 0 {
+		return nil, errors.New("max lookback must be non-negative")
+	}
 
-		s.routes[routeOptions.Pattern] = route{
-			ml:   ml,
-			t2o:  t2o,
-			wrkr: wrkr,
-		}
+	workerStartAttempts := options.WorkerStartAttempts
+	if workerStartAttempts < 0 {
+		return nil, errors.New("worker start attempts must be non-negative")
+	} else if workerStartAttempts == 0 {
+		workerStartAttempts = DefaultWorkerStartAttempts
 	}
 
-	return s, nil
-}
+	workerStartRetryDelay := options.WorkerStartRetryDelay
+	if workerStartRetryDelay < 0 {
+		return nil, errors.New("worker start retry delay must be non-negative")
+	} else if workerStartRetryDelay == 0 {
+		workerStartRetryDelay = DefaultWorkerStartRetryDelay
+	}
 
-// Start starts the KCL workers and HTTP server. Only call this method once.
-func (s *Service) Start() error {
-	// 1. Start all the KCLs workers.
-	started := make([]*wk.Worker, 0, len(s.routes))
-	for _, r := range s.routes {
-		if r.wrkr == nil {
-			continue
-		}
+	if options.ReadHeaderTimeout < 0 || options.ReadTimeout < 0 || options.IdleTimeout < 0 {
+		return nil, errors.New("server timeouts must be non-negative")
+	}
 
-		if err := r.wrkr.Start(); err != nil {
-			// If one of them fails, shut them all down.
-			for _, wrkr := range started {
-				wrkr.Shutdown()
-			}
-			return err
-		}
+	readHeaderTimeout := options.ReadHeaderTimeout
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = DefaultReadHeaderTimeout
+	}
 
-		started = append(started, r.wrkr)
+	srv := &http.Server{
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       options.ReadTimeout,
+		IdleTimeout:       options.IdleTimeout,
 	}
 
-	// 2. Acquire a port and broadcast the condition variable.
-	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", DefaultHost, s.port))
+	streamHeaders, err := newStreamHeaders(options.StreamHeaders)
 	if err != nil {
-		// If this fails, also shutdown the KCL workers.
-		for _, wrkr := range started {
-			wrkr.Shutdown()
-		}
-		return err
+		return nil, err
 	}
 
-	s.cond.L.Lock()
-	s.l = l
-	s.cond.L.Unlock()
-	s.cond.Broadcast()
+	requestIDHeader := options.RequestIDHeader
+	if requestIDHeader == "" {
+		requestIDHeader = DefaultRequestIDHeader
+	} else if strings.ContainsAny(requestIDHeader, " \t\r\n:") {
+		return nil, fmt.Errorf("invalid request ID header %q", requestIDHeader)
+	}
 
-	// 3. Start serving.
-	if err := s.srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
-		return err
+	p := options.Port
+	if p == 0 {
+		p = DefaultServicePort
+	} else if p == -1 {
+		p = 0
 	}
 
-	return nil
-}
+	s := &Service{
+		host:       options.Host,
+		port:       p,
+		routes:     make(map[string]route),
+		pending:    make(map[string]route),
+		logger:     options.Logger,
+		adminToken: options.AdminToken,
+		inherited:  options.Listener,
+		srv:        srv,
+		l:          nil,
+		cond:       &sync.Cond{L: &sync.Mutex{}},
 
-// Addr blocks until the listener has acquired its port and address.
-func (s *Service) Addr() (*net.TCPAddr, error) {
-	s.cond.L.Lock()
-	for s.l == nil {
-		s.cond.Wait()
+		tlsCertFile:           options.TLSCertFile,
+		tlsKeyFile:            options.TLSKeyFile,
+		maxConnectionDuration: options.MaxConnectionDuration,
+		writeTimeout:          writeTimeout,
+		maxLookback:           options.MaxLookback,
+		workerStartAttempts:   workerStartAttempts,
+		workerStartRetryDelay: workerStartRetryDelay,
+		cors:                  options.CORS,
+		disableCompression:    options.DisableCompression,
+		disableIndex:          options.DisableIndex,
+		enableViewer:          options.EnableViewer,
+		version:               VersionInfo{Version: options.Version, Commit: options.Commit, GoVersion: runtime.Version()},
+		preamble:              preamble,
+		greeting:              greeting,
+		requestIDHeader:       requestIDHeader,
+		requestIDComment:      options.RequestIDComment,
+		streamHeaders:         streamHeaders,
+
+		healthMaxLag:  options.HealthMaxLag,
+		memoryBudget:  options.MemoryBudget,
+		deadLetter:    options.DeadLetter,
+		checkpointing: checkpointing,
+		disableKCL:    options.disableKCL,
+
+		lagLogInterval: options.LagLogInterval,
+		stop:           make(chan struct{}),
 	}
-	defer s.cond.L.Unlock()
+	s.drainCtx, s.drainCancel = context.WithCancel(context.Background())
 
-	addr, ok := s.l.Addr().(*net.TCPAddr)
-	if !ok {
-		return nil, errors.New("failed to get *net.TCPAddr")
+	if s.lagLogInterval == 0 {
+		s.lagLogInterval = DefaultLagLogInterval
 	}
+	s.srv.Handler = http.HandlerFunc(s.dispatch)
 
-	return addr, nil
-}
+	if s.cors.AllowedOrigins == nil {
+		s.cors.AllowedOrigins = DefaultAllowedOrigins
+	}
 
-// Stop stops the KCL workers and HTTP server. Only call this method once.
-func (s *Service) Stop(ctx context.Context) error {
-	s.cancel()
+	// NOTE(mroberts): We use our own registry, rather than the global one, so that multiple Services (e.g., in tests)
+	// don't conflict.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		routesCollector{routes: s.routesSnapshot},
+	)
+	s.metrics = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 
-	var wait sync.WaitGroup
+	// Every route's fileCheckpointer shares the checkpoint file.
+	if options.CheckpointFile != "" {
+		s.checkpointFile = newCheckpointFile(options.CheckpointFile, s.logger)
+	}
 
-	// Shutdown KCL workers.
-	for _, r := range s.routes {
-		wrkr := r.wrkr
-		if wrkr != nil {
-			wait.Add(1)
-			go func() {
-				defer wait.Done()
-				wrkr.Shutdown()
-			}()
+	// NOTE(mroberts): http.ServeMux would panic on duplicate patterns, so we validate them all up front.
+	patterns := make([]string, 0, len(options.Routes)+len(options.DynamicRoutes))
+	for _, routeOptions := range options.Routes {
+		patterns = append(patterns, routeOptions.Pattern)
+	}
+	for _, dynamicRouteOptions := range options.DynamicRoutes {
+		patterns = append(patterns, dynamicRouteOptions.Pattern)
+	}
+	if err := validatePatterns(patterns); err != nil {
+		return nil, err
+	}
+
+	for _, dynamicRouteOptions := range options.DynamicRoutes {
+		dr, err := newDynamicRoute(dynamicRouteOptions)
+		if err != nil {
+			return nil, fmt.Errorf("dynamic route %q: %w", dynamicRouteOptions.Pattern, err)
 		}
+		s.dynamicRoutes = append(s.dynamicRoutes, dr)
 	}
 
-	// Shutdown HTTP server.
-	err := s.srv.Shutdown(ctx)
+	for _, routeOptions := range options.Routes {
+		rt, err := s.newRoute(routeOptions)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", routeOptions.Pattern, err)
+		}
 
-	wait.Wait()
-	return err
+		s.routes[routeOptions.Pattern] = rt
+	}
+
+	mux, err := s.newMux(s.routes)
+	if err != nil {
+		return nil, err
+	}
+	s.mux = mux
+
+	return s, nil
 }
 
-func (s *Service) handleFunc(ml *memlog.Log, t2o *Timestamp2Offset, w http.ResponseWriter, r *http.Request) {
-	// 1. Ensure we can cast to http.Flusher. Some http.ResponseWriter wrappers can break this functionality.
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		s.logger.Error("SSE not supported")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+// unavailable responds 503 Service Unavailable, and returns true, if the routes can't serve clients yet, because Start
+// hasn't started the KCL workers, or anymore, because Drain was called.
+func (s *Service) unavailable(w http.ResponseWriter, r *http.Request) bool {
+	if s.startingUp.Load() {
+		w.Header().Set("Retry-After", jitteredRetryAfter(DefaultStartingUpRetryAfter))
+		writeError(w, r, "Service Unavailable", codeStartingUp, http.StatusServiceUnavailable)
+		return true
 	}
 
-	// 2. Check the "since" query parameter.
-	var timestamp *time.Time
-	since := r.URL.Query().Get("since")
-	if since != "" {
-		// 2.1. First try RFC3339.
-		ts, err := time.Parse(time.RFC3339, since)
-		if err != nil {
-			// 2.2. Then try duration.
-			d, err := time.ParseDuration(since)
-			if err != nil {
-				http.Error(w, "Bad Request", http.StatusBadRequest)
-				return
-			}
-			ts = time.Now().Add(-1 * d)
-		}
-		timestamp = &ts
+	// NOTE(mroberts): While draining, new clients should reconnect to another instance.
+	if s.draining.Load() {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", jitteredRetryAfter(DefaultDrainingRetryAfter))
+		writeError(w, r, "Service Unavailable", codeDraining, http.StatusServiceUnavailable)
+		return true
 	}
 
-	// 3. Start sending SSEs.
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "text/event-stream")
+	return false
+}
 
-	if _, err := fmt.Fprint(w, ":ok\n\n"); err != nil {
-		return
+// memoryPerEvent is the memory preallocated for each event of a route's capacity: the memlog's records, of which it
+// keeps up to twice capacity, and Timestamp2Offset's entries. It excludes the events' data, which MaxEventBytes bounds.
+const memoryPerEvent = 2*int(unsafe.Sizeof(memlog.Record{})) + int(unsafe.Sizeof(timestamp2OffsetEntry{}))
+
+// newRoute validates the route options, and constructs the route's memlog, Timestamp2Offset, and KCL worker (without
+// starting it).
+func (s *Service) newRoute(routeOptions RouteOptions) (route, error) {
+	capacity := routeOptions.Capacity
+	if capacity < 0 {
+		return route{}, errors.New("capacity must be non-negative")
+	}
+	if capacity == 0 {
+		capacity = DefaultCapacity
+	}
+	if capacity > MaxCapacity {
+		return route{}, fmt.Errorf("capacity must be at most %d", MaxCapacity)
 	}
 
-	flusher.Flush()
+	if routeOptions.MaxEventBytes < 0 {
+		return route{}, errors.New("max event bytes must be non-negative")
+	}
+	if routeOptions.MaxEventBytes > memlog.DefaultMaxRecordDataBytes {
+		return route{}, fmt.Errorf("max event bytes must be at most %d", memlog.DefaultMaxRecordDataBytes)
+	}
 
-	// Initialize off to the latest offset in the log.
-	_, off := ml.Range(r.Context())
-	if off < 0 {
-		off = 0
+	// NOTE(mroberts): We check the budget before creating the memlog, since that's what allocates the memory. The
+	// memlog retains up to twice capacity events, so only MaxEventBytes bounds their data. On 32-bit platforms, the
+	// estimate itself can overflow.
+	if capacity > math.MaxInt/(memoryPerEvent+2*routeOptions.MaxEventBytes) {
+		return route{}, errors.New("capacity and max event bytes take more memory than can be addressed")
 	}
+	memory := capacity * (memoryPerEvent + 2*routeOptions.MaxEventBytes)
+	if s.memoryBudget > 0 {
+		if routeOptions.MaxEventBytes == 0 {
+			return route{}, errors.New("max event bytes must be set to fit within the memory budget")
+		}
 
-	// If "since" was provided, look up an offset by timestamp.
-	if timestamp != nil {
-		if nearestOff, ok := t2o.NearestOffset(*timestamp); ok {
-			off = memlog.Offset(nearestOff)
+		used := 0
+		for _, rt := range s.routesSnapshot() {
+			used += rt.memory
+		}
+		for _, rt := range s.pending {
+			used += rt.memory
+		}
+		if memory > s.memoryBudget-used {
+			return route{}, fmt.Errorf("capacity takes an estimated %d bytes, but only %d of the %d-byte memory budget remain", memory, max(s.memoryBudget-used, 0), s.memoryBudget)
 		}
 	}
 
-	stream := ml.Stream(r.Context(), off)
+	// NOTE(mroberts): memlog always keeps exactly two segments, active and history, each of WithMaxSegmentSize offsets,
+	// and drops the whole history segment when the active one fills. There's no option for the number of segments, so
+	// eviction granularity is fixed at one segment. Sizing segments by capacity means the memlog retains between
+	// capacity and twice capacity events, and Timestamp2Offset (see startOffset) trims what we serve back to capacity.
+	ml, err := memlog.New(context.Background(), memlog.WithMaxSegmentSize(capacity))
+	if err != nil {
+		return route{}, err
+	}
 
-	for {
-		if cloudEvent, ok := stream.Next(); ok {
-			ssEvent := fmt.Sprintf("data: %s\n\n", string(cloudEvent.Data))
+	t2o, err := NewTimestamp2Offset(capacity)
+	if err != nil {
+		return route{}, err
+	}
 
-			if _, err := fmt.Fprint(w, ssEvent); err != nil {
-				break
-			}
+	slowClientPolicy := routeOptions.SlowClientPolicy
+	switch slowClientPolicy {
+	case "":
+		slowClientPolicy = SlowClientBlock
+	case SlowClientBlock, SlowClientDisconnect, SlowClientSkip:
+	default:
+		return route{}, fmt.Errorf("unknown slow client policy %q", slowClientPolicy)
+	}
 
-			flusher.Flush()
-			continue
+	slowClientTimeout := routeOptions.SlowClientTimeout
+	if slowClientTimeout < 0 {
+		return route{}, errors.New("slow client timeout must be non-negative")
+	}
+	if slowClientTimeout == 0 {
+		slowClientTimeout = DefaultSlowClientTimeout
+	}
+
+	// NOTE(mroberts): SSE data can't span lines without re-prefixing, so we compact the schema up front.
+	var schema []byte
+	if len(routeOptions.Schema) > 0 {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, routeOptions.Schema); err != nil {
+			return route{}, fmt.Errorf("schema must be valid JSON: %w", err)
 		}
+		schema = compacted.Bytes()
+	}
 
-		break
+	if routeOptions.MaxLag < 0 {
+		return route{}, errors.New("max lag must be non-negative")
 	}
+
+	if routeOptions.RetryMillis < 0 {
+		return route{}, errors.New("retry must be non-negative")
+	}
+
+	if routeOptions.MaxConnections < 0 {
+		return route{}, errors.New("max connections must be non-negative")
+	}
+
+	var slots chan struct{}
+	if routeOptions.MaxConnections > 0 {
+		slots = make(chan struct{}, routeOptions.MaxConnections)
+	}
+
+	if routeOptions.HeartbeatInterval < 0 {
+		return route{}, errors.New("heartbeat interval must be non-negative")
+	}
+
+	if routeOptions.FlushEvery < 0 {
+		return route{}, errors.New("flush every must be non-negative")
+	}
+	if routeOptions.FlushInterval < 0 {
+		return route{}, errors.New("flush interval must be non-negative")
+	}
+	flushInterval := routeOptions.FlushInterval
+	if routeOptions.FlushEvery > 0 && flushInterval == 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
+	envelope := envelope{
+		timeField:         routeOptions.TimeField,
+		payloadField:      routeOptions.PayloadField,
+		timestampFallback: routeOptions.TimestampFallback,
+		raw:               routeOptions.RawPassthrough || routeOptions.Binary,
+	}
+	if envelope.encoding, err = routeOptions.Encoding.validate(); err != nil {
+		return route{}, err
+	}
+	switch routeOptions.Envelope {
+	case "", EnvelopeDetail:
+		if len(routeOptions.EnvelopeKeys) > 0 {
+			return route{}, errors.New("envelope keys require the full envelope")
+		}
+	case EnvelopeFull:
+		if envelope.raw {
+			return route{}, errors.New("full envelope can't be used with raw passthrough or binary")
+		}
+		envelope.full = true
+		envelope.keys = routeOptions.EnvelopeKeys
+	default:
+		return route{}, fmt.Errorf("unknown envelope %q", routeOptions.Envelope)
+	}
+	switch envelope.timestampFallback {
+	case "":
+		envelope.timestampFallback = TimestampFallbackSkip
+	case TimestampFallbackSkip, TimestampFallbackArrival, TimestampFallbackNow:
+	default:
+		return route{}, fmt.Errorf("unknown timestamp fallback %q", envelope.timestampFallback)
+	}
+	if envelope.timeField == "" {
+		envelope.timeField = DefaultTimeField
+	}
+	if envelope.payloadField == "" {
+		envelope.payloadField = DefaultPayloadField
+	}
+	if len(routeOptions.Projection) > 0 {
+		if envelope.raw {
+			return route{}, errors.New("projection can't be used with raw passthrough or binary")
+		}
+		if envelope.projection, err = parseProjection(routeOptions.Projection); err != nil {
+			return route{}, err
+		}
+	}
+
+	stats := newRouteStats()
+	readiness := newReadiness()
+
+	healthMaxLag := routeOptions.HealthMaxLag
+	if healthMaxLag < 0 {
+		return route{}, errors.New("health max lag must be non-negative")
+	}
+	if healthMaxLag == 0 {
+		healthMaxLag = s.healthMaxLag
+	}
+
+	var backfill *backfill
+	if routeOptions.BackfillS3URI != "" {
+		if backfill, err = s.newBackfill(routeOptions); err != nil {
+			return route{}, err
+		}
+		backfill.processor = &dumpRecordProcessor{
+			ml:                  ml,
+			t2o:                 t2o,
+			stats:               stats,
+			readiness:           readiness,
+			envelope:            envelope,
+			monotonicTimestamps: routeOptions.MonotonicTimestamps,
+			maxEventBytes:       routeOptions.MaxEventBytes,
+			logger:              s.logger,
+			route:               routeOptions.Pattern,
+			deadLetterFunc:      s.deadLetter,
+		}
+	} else if routeOptions.BackfillWindow != 0 {
+		return route{}, errors.New("backfill window requires a backfill S3 URI")
+	}
+
+	if len(routeOptions.AdditionalKCLConfigs) > 0 && backfill != nil {
+		return route{}, errors.New("backfill can't be used with additional streams")
+	}
+
+	if routeOptions.Checkpointing, err = routeOptions.Checkpointing.validate(s.checkpointing); err != nil {
+		return route{}, err
+	}
+	if routeOptions.Checkpointing == CheckpointingFile && s.checkpointFile == nil {
+		return route{}, errors.New("checkpoint file must be set if checkpointing to a file")
+	}
+
+	var kclConfigs []*cfg.KinesisClientLibConfiguration
+	if routeOptions.KCLConfig != nil {
+		kclConfigs = append(kclConfigs, routeOptions.KCLConfig)
+	}
+	for _, kclConfig := range routeOptions.AdditionalKCLConfigs {
+		if kclConfig == nil {
+			return route{}, errors.New("additional KCL configs must be non-nil")
+		}
+		kclConfigs = append(kclConfigs, kclConfig)
+	}
+
+	streams := make([]string, 0, len(kclConfigs))
+	for _, kclConfig := range kclConfigs {
+		if slices.Contains(streams, kclConfig.StreamName) {
+			return route{}, fmt.Errorf("stream %q feeds the route more than once", kclConfig.StreamName)
+		}
+		streams = append(streams, kclConfig.StreamName)
+	}
+
+	var workers []routeWorker
+	if !s.disableKCL {
+		for i, kclConfig := range kclConfigs {
+			workers = append(workers, s.newRouteWorker(routeOptions, kclConfig, i, len(kclConfigs) > 1, ml, t2o, stats, readiness, envelope))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rt := route{
+		ctx:          ctx,
+		cancel:       cancel,
+		pattern:      routeOptions.Pattern,
+		streams:      streams,
+		ml:           ml,
+		capacity:     capacity,
+		memory:       memory,
+		t2o:          t2o,
+		stats:        stats,
+		readiness:    readiness,
+		connections:  newConnectionRegistry(),
+		workers:      workers,
+		backfill:     backfill,
+		healthMaxLag: healthMaxLag,
+
+		slowClientPolicy:  slowClientPolicy,
+		slowClientTimeout: slowClientTimeout,
+
+		maxLag: routeOptions.MaxLag,
+
+		schema: schema,
+
+		retryMillis: routeOptions.RetryMillis,
+
+		heartbeatInterval: routeOptions.HeartbeatInterval,
+
+		flushEvery:    routeOptions.FlushEvery,
+		flushInterval: flushInterval,
+
+		eventNameField: routeOptions.EventNameField,
+
+		cloudEventsTypeField: routeOptions.CloudEventsTypeField,
+
+		binary: routeOptions.Binary,
+
+		encoding: envelope.encoding,
+
+		apiKeys: routeOptions.APIKeys,
+
+		slots: slots,
+	}
+
+	return rt, nil
+}
+
+// newBackfill returns the route's backfill, without its processor. With LATEST, it also points the route's KCL
+// configuration at the handoff (see RouteOptions.BackfillS3URI).
+func (s *Service) newBackfill(routeOptions RouteOptions) (*backfill, error) {
+	bucket, prefix, err := parseS3URI(routeOptions.BackfillS3URI)
+	if err != nil {
+		return nil, err
+	}
+
+	if routeOptions.BackfillWindow <= 0 {
+		return nil, errors.New("backfill window must be positive")
+	}
+
+	// 1. Determine the handoff.
+	handoff := time.Now()
+	if kclConfig := routeOptions.KCLConfig; kclConfig != nil {
+		switch kclConfig.InitialPositionInStream {
+		case cfg.LATEST:
+			kclConfig.WithTimestampAtInitialPositionInStream(&handoff)
+		case cfg.AT_TIMESTAMP:
+			handoff = *kclConfig.InitialPositionInStreamExtended.Timestamp
+		default:
+			return nil, errors.New("backfill requires the KCL worker to start at LATEST or AT_TIMESTAMP")
+		}
+	}
+
+	// 2. Create an S3 client, unless one was provided.
+	client := routeOptions.BackfillS3Client
+	if client == nil {
+		var optFns []func(*config.LoadOptions) error
+		if kclConfig := routeOptions.KCLConfig; kclConfig != nil {
+			optFns = append(optFns, config.WithRegion(kclConfig.RegionName))
+			if kclConfig.KinesisCredentials != nil {
+				optFns = append(optFns, config.WithCredentialsProvider(kclConfig.KinesisCredentials))
+			}
+		}
+
+		awsConfig, err := config.LoadDefaultConfig(context.Background(), optFns...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load AWS configuration for backfill: %w", err)
+		}
+		client = s3.NewFromConfig(awsConfig)
+	}
+
+	return &backfill{
+		client:  client,
+		bucket:  bucket,
+		prefix:  prefix,
+		since:   handoff.Add(-routeOptions.BackfillWindow),
+		handoff: handoff,
+		logger:  s.logger.With(slog.String("route", routeOptions.Pattern)),
+	}, nil
+}
+
+// routeWorker is the KCL worker consuming one of a route's streams.
+type routeWorker struct {
+	stream string
+	wrkr   *wk.Worker
+
+	// checkpointer holds the worker's shard state, which /admin/shards reports. It's nil unless the route checkpoints in
+	// memory or to a file.
+	checkpointer *inMemoryCheckpointer
+}
+
+// newRouteWorker returns a KCL worker consuming the ith of the route's streams into its memlog. If the route is fed by
+// multiple streams, shardPrefixed distinguishes their shards by stream.
+func (s *Service) newRouteWorker(routeOptions RouteOptions, kclConfig *cfg.KinesisClientLibConfiguration, i int, shardPrefixed bool, ml *memlog.Log, t2o *Timestamp2Offset, stats *routeStats, readiness *readiness, envelope envelope) routeWorker {
+	// NOTE(mroberts): We also process empty batches, so that routes on empty shards become ready.
+	kclConfig = kclConfig.WithLeaseStealing(false).WithCallProcessRecordsEvenForEmptyRecordList(true)
+
+	// NOTE(mroberts): The primary stream's checkpoints are keyed by the route's pattern alone, as they were before routes
+	// could have additional streams, so that existing checkpoint files still resume.
+	checkpointKey := routeOptions.Pattern
+	if i > 0 {
+		checkpointKey = fmt.Sprintf("%s#%s", routeOptions.Pattern, kclConfig.StreamName)
+	}
+
+	// NOTE(mroberts): By default, we don't persist checkpoints. Everything is resumed from `start`.
+	var checkpointer chk.Checkpointer
+	var shards *inMemoryCheckpointer
+	switch routeOptions.Checkpointing {
+	case CheckpointingInMemory:
+		checkpointer = NewInMemoryCheckpointer(kclConfig.WorkerID, s.logger)
+		shards = checkpointer.(*inMemoryCheckpointer)
+	case CheckpointingDynamoDB:
+		checkpointer = chk.NewDynamoCheckpoint(kclConfig)
+	case CheckpointingFile:
+		checkpointer = newFileCheckpointer(kclConfig.WorkerID, s.checkpointFile, checkpointKey, s.logger)
+		shards = checkpointer.(*fileCheckpointer).inMemoryCheckpointer
+	case CheckpointingNone:
+		checkpointer = newNoopCheckpointer(s.logger)
+	}
+
+	var shardPrefix string
+	if shardPrefixed {
+		shardPrefix = kclConfig.StreamName + "/"
+	}
+
+	wrkr := wk.NewWorker(recordProcessorFactory(ml, t2o, stats, readiness, envelope, routeOptions.MonotonicTimestamps, routeOptions.MaxEventBytes, shardPrefix, routeOptions.Pattern, s.deadLetter, s.logger), kclConfig).
+		WithCheckpointer(checkpointer)
+
+	return routeWorker{stream: kclConfig.StreamName, wrkr: wrkr, checkpointer: shards}
+}
+
+// stream returns the route's primary stream, if any.
+func (rt route) stream() string {
+	if len(rt.streams) == 0 {
+		return ""
+	}
+	return rt.streams[0]
+}
+
+// startRoute backfills the route from S3, if configured, and then starts its KCL workers, if any. If one of its KCL
+// workers fails to start, even after retrying, it shuts down those which already started.
+func (s *Service) startRoute(rt route) error {
+	if rt.backfill != nil {
+		if err := rt.backfill.run(rt.ctx); err != nil {
+			return fmt.Errorf("unable to backfill route %q (stream %q): %w", rt.pattern, rt.stream(), err)
+		}
+	}
+
+	for i, w := range rt.workers {
+		if err := s.startWorker(rt, w); err != nil {
+			s.shutDownWorkers(rt.pattern, rt.workers[:i], fmt.Sprintf("since stream %q failed to start", w.stream))
+			return fmt.Errorf("unable to start KCL worker for route %q (stream %q): %w", rt.pattern, w.stream, err)
+		}
+	}
+
+	return nil
+}
+
+// startRoutes backfills and starts the routes' KCL workers, concurrently, since each worker's Start makes AWS API calls
+// and acquires leases, which adds up with many routes. It's all or nothing: if any route fails to start, it waits for
+// the rest, shuts down those which started, and returns the failures, in order of pattern, so that they're
+// reproducible. Otherwise, it returns the started routes.
+func (s *Service) startRoutes(routes map[string]route) ([]route, error) {
+	patterns := slices.Sorted(maps.Keys(routes))
+	errs := make([]error, len(patterns))
+
+	var wg sync.WaitGroup
+	for i, pattern := range patterns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.startRoute(routes[pattern])
+		}()
+	}
+	wg.Wait()
+
+	started := make([]route, 0, len(patterns))
+	var failed []string
+	for i, pattern := range patterns {
+		if errs[i] != nil {
+			failed = append(failed, pattern)
+			continue
+		}
+		started = append(started, routes[pattern])
+	}
+
+	if len(failed) > 0 {
+		// If any of them failed, shut them all down.
+		s.rollBack(started, fmt.Sprintf("since route %q failed to start", failed[0]))
+		return nil, fmt.Errorf("%w (rolled back %d routes which had already started)", errors.Join(errs...), len(started))
+	}
+
+	return started, nil
+}
+
+// startWorker starts one of the route's KCL workers, retrying with exponential backoff up to the service's
+// WorkerStartAttempts, and logging each failed attempt. It gives up early if the route is removed.
+func (s *Service) startWorker(rt route, w routeWorker) error {
+	return retry(rt.ctx, s.workerStartAttempts, s.workerStartRetryDelay, w.wrkr.Start, func(attempt int, delay time.Duration, err error) {
+		s.logger.Warn(fmt.Sprintf("Unable to start KCL worker for route %q (stream %q) (attempt %d of %d); retrying in %s", rt.pattern, w.stream, attempt, s.workerStartAttempts, delay), "err", err)
+	})
+}
+
+// rollBack shuts down the KCL workers of routes which started before a failure, logging each.
+func (s *Service) rollBack(started []route, reason string) {
+	for _, rt := range started {
+		s.shutDownWorkers(rt.pattern, rt.workers, reason)
+	}
+}
+
+// shutDownWorkers shuts down the route's specified KCL workers, logging each.
+func (s *Service) shutDownWorkers(pattern string, workers []routeWorker, reason string) {
+	for _, w := range workers {
+		s.logger.Info(fmt.Sprintf("Shutting down KCL worker for route %q (stream %q) %s", pattern, w.stream, reason))
+		w.wrkr.Shutdown()
+	}
+}
+
+// newMux returns an http.ServeMux serving the specified routes, in addition to the service's own endpoints.
+func (s *Service) newMux(routes map[string]route) (mux *http.ServeMux, err error) {
+	// NOTE(mroberts): ServeMux panics on invalid or conflicting patterns. A bad AddRoute shouldn't crash the service,
+	// so we return an error instead.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to register routes: %v", r)
+		}
+	}()
+
+	mux = http.NewServeMux()
+
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/ready", s.handleReady)
+
+	mux.HandleFunc("/stats", s.handleStats)
+
+	mux.HandleFunc("/version", s.handleVersion)
+
+	mux.Handle("/metrics", s.metrics)
+
+	if s.enableViewer {
+		mux.HandleFunc("/viewer", s.handleViewer)
+	}
+
+	if s.adminToken != "" {
+		mux.HandleFunc("/admin/connections", s.requireAdmin(s.handleAdminConnections))
+		mux.HandleFunc("/admin/shards", s.requireAdmin(s.handleAdminShards))
+	}
+
+	indexed := !s.disableIndex
+	for pattern, rt := range routes {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if s.unavailable(w, r) {
+				return
+			}
+
+			s.handleFunc(rt, w, r)
+		})
+
+		if patternPath(pattern) == "/" {
+			indexed = false
+		}
+	}
+
+	for _, dr := range s.dynamicRoutes {
+		mux.HandleFunc(dr.Pattern, func(w http.ResponseWriter, r *http.Request) {
+			if s.unavailable(w, r) {
+				return
+			}
+
+			s.handleDynamic(dr, w, r)
+		})
+	}
+
+	if indexed {
+		mux.HandleFunc("/", s.handleIndex)
+	}
+
+	return mux, nil
+}
+
+// dispatch serves the request with the current http.ServeMux. Since ServeMux can't unregister handlers, AddRoute and
+// RemoveRoute build a new one from the route map and swap it in.
+func (s *Service) dispatch(w http.ResponseWriter, r *http.Request) {
+	s.routesLock.RLock()
+	mux := s.mux
+	s.routesLock.RUnlock()
+
+	mux.ServeHTTP(w, r)
+}
+
+// routesSnapshot returns a copy of the route map, which is safe to iterate while routes are added and removed.
+func (s *Service) routesSnapshot() map[string]route {
+	s.routesLock.RLock()
+	defer s.routesLock.RUnlock()
+
+	return maps.Clone(s.routes)
+}
+
+// AddRoute adds a route to the service. If the service has started, this also starts the route's KCL worker.
+//
+// NOTE(mroberts): Starting the KCL worker may take a while, since it retries, so AddRoute doesn't hold changeLock
+// meanwhile. Instead, the route waits in pending, which reserves its pattern and its share of the memory budget.
+func (s *Service) AddRoute(routeOptions RouteOptions) error {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+
+	if s.stopped {
+		return errors.New("service is stopped")
+	}
+
+	// 1. Construct the route, and check that a ServeMux can include it.
+	routes := s.routesSnapshot()
+	if _, ok := routes[routeOptions.Pattern]; ok {
+		return fmt.Errorf("route %q already exists", routeOptions.Pattern)
+	}
+	if _, ok := s.pending[routeOptions.Pattern]; ok {
+		return fmt.Errorf("route %q already exists", routeOptions.Pattern)
+	}
+	if err := validatePattern(routeOptions.Pattern); err != nil {
+		return err
+	}
+
+	rt, err := s.newRoute(routeOptions)
+	if err != nil {
+		return fmt.Errorf("route %q: %w", routeOptions.Pattern, err)
+	}
+	routes[routeOptions.Pattern] = rt
+
+	if _, err := s.newMux(routes); err != nil {
+		rt.cancel()
+		return err
+	}
+
+	// 2. Backfill and start the KCL worker, if the service has started. Otherwise, Start will.
+	if s.started {
+		s.pending[routeOptions.Pattern] = rt
+		s.changeLock.Unlock()
+		err := s.startRoute(rt)
+		s.changeLock.Lock()
+		delete(s.pending, routeOptions.Pattern)
+
+		if err != nil {
+			rt.cancel()
+			return err
+		}
+		if s.stopped {
+			s.shutDownWorkers(rt.pattern, rt.workers, "since the service stopped")
+			rt.cancel()
+			return errors.New("service is stopped")
+		}
+	}
+
+	// 3. Start serving the route, alongside any routes which were added or removed meanwhile.
+	routes = s.routesSnapshot()
+	routes[routeOptions.Pattern] = rt
+
+	mux, err := s.newMux(routes)
+	if err != nil {
+		s.shutDownWorkers(rt.pattern, rt.workers, "since we were unable to serve it")
+		rt.cancel()
+		return err
+	}
+
+	s.routesLock.Lock()
+	s.routes[routeOptions.Pattern] = rt
+	s.mux = mux
+	s.routesLock.Unlock()
+
+	return nil
+}
+
+// RemoveRoute removes the route with the specified pattern from the service. It stops serving the route, ends the
+// route's open streams with an ": end" comment, and shuts down its KCL worker.
+func (s *Service) RemoveRoute(pattern string) error {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+
+	if s.stopped {
+		return errors.New("service is stopped")
+	}
+
+	// 1. Stop serving the route.
+	routes := s.routesSnapshot()
+	rt, ok := routes[pattern]
+	if !ok {
+		return fmt.Errorf("route %q does not exist", pattern)
+	}
+	delete(routes, pattern)
+
+	mux, err := s.newMux(routes)
+	if err != nil {
+		return err
+	}
+
+	s.routesLock.Lock()
+	delete(s.routes, pattern)
+	s.mux = mux
+	s.routesLock.Unlock()
+
+	// 2. End its open streams. These keep a reference to the route's memlog until they return.
+	rt.cancel()
+
+	// 3. Shut down its KCL workers.
+	for _, w := range rt.workers {
+		w.wrkr.Shutdown()
+	}
+
+	return nil
+}
+
+// Start starts the HTTP server and KCL workers. Only call this method once.
+//
+// The HTTP server starts listening first, so that clients and load balancers can connect right away. Until the KCL
+// workers have started, the routes respond 503 Service Unavailable, as does /ready.
+func (s *Service) Start() error {
+	s.startingUp.Store(true)
+	defer s.startingUp.Store(false)
+
+	// 1. Acquire a port, unless we inherited a listener, and broadcast the condition variable.
+	l := s.inherited
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", net.JoinHostPort(s.host, strconv.Itoa(s.port))); err != nil {
+			return err
+		}
+	}
+
+	s.cond.L.Lock()
+	s.l = l
+	s.cond.L.Unlock()
+	s.cond.Broadcast()
+
+	// 2. Start serving, over TLS if configured.
+	served := make(chan error, 1)
+	go func() {
+		if s.tlsCertFile != "" {
+			served <- s.srv.ServeTLS(l, s.tlsCertFile, s.tlsKeyFile)
+		} else {
+			served <- s.srv.Serve(l)
+		}
+	}()
+
+	// 3. Backfill and start all the KCLs workers.
+	s.changeLock.Lock()
+	started, err := s.startRoutes(s.routesSnapshot())
+	if err != nil {
+		s.changeLock.Unlock()
+		_ = s.srv.Close()
+		<-served
+		return err
+	}
+	s.startingUp.Store(false)
+	s.started = true
+	s.changeLock.Unlock()
+
+	if s.lagLogInterval > 0 {
+		go s.logLag()
+	}
+
+	if len(s.dynamicRoutes) > 0 {
+		go s.sweepDynamicRoutes()
+	}
+
+	// 4. Serve until Stop.
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		// If this fails, also shutdown the KCL workers.
+		s.rollBack(started, "since we were unable to serve")
+		return err
+	}
+
+	return nil
+}
+
+// Addr blocks until the listener has acquired its port and address.
+func (s *Service) Addr() (*net.TCPAddr, error) {
+	s.cond.L.Lock()
+	for s.l == nil {
+		s.cond.Wait()
+	}
+	defer s.cond.L.Unlock()
+
+	addr, ok := s.l.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("failed to get *net.TCPAddr")
+	}
+
+	return addr, nil
+}
+
+// ListenerFile blocks until the listener has acquired its port and address, and then returns a duplicate of its file
+// descriptor. Pass this to another process to hand off the listening socket during a graceful restart.
+func (s *Service) ListenerFile() (*os.File, error) {
+	s.cond.L.Lock()
+	for s.l == nil {
+		s.cond.Wait()
+	}
+	defer s.cond.L.Unlock()
+
+	l, ok := s.l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("failed to get listener file")
+	}
+
+	return l.File()
+}
+
+const (
+	// drainPollInterval is how often Drain checks whether existing streams have ended.
+	drainPollInterval = 100 * time.Millisecond
+
+	// stopGracePeriod is how long Stop waits for the streams it ends to close, once ctx is done, before closing their
+	// connections.
+	stopGracePeriod = time.Second
+)
+
+// activeConnections returns the number of active connections across all routes.
+func (s *Service) activeConnections() int {
+	active := 0
+	for _, rt := range s.routesSnapshot() {
+		active += rt.connections.len()
+	}
+	return active
+}
+
+// awaitConnections waits up to timeout for every active connection to close.
+func (s *Service) awaitConnections(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for s.activeConnections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// isStopped returns whether Stop was called.
+func (s *Service) isStopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain stops the service from accepting new clients, so that traffic can shift to another instance, without ending
+// existing clients' streams. From here on, the routes respond 503 Service Unavailable, and /ready reports the service
+// as not ready. The KCL workers keep running.
+//
+// Drain waits for existing streams to end until ctx is done. At that point, it ends any remaining streams with an
+// ": end" comment and returns an error wrapping ctx.Err(). Call Stop afterward to stop the service.
+func (s *Service) Drain(ctx context.Context) error {
+	s.draining.Store(true)
+	s.srv.SetKeepAlivesEnabled(false)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		active := s.activeConnections()
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.drainCancel()
+			return fmt.Errorf("timed out waiting for %d connections to close: %w", active, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops the HTTP server and KCL workers. Only call this method once.
+//
+// Stop waits for in-flight connections to close and KCL workers to shut down until ctx is done. At that point, it
+// closes any remaining connections and returns an error wrapping ctx.Err(), without waiting further for the workers.
+func (s *Service) Stop(ctx context.Context) error {
+	// Prevent routes from being added or removed from here on.
+	s.changeLock.Lock()
+	s.stopped = true
+	close(s.stop)
+	routes := s.routesSnapshot()
+	for _, rt := range s.pending {
+		// Give up starting routes which AddRoute hasn't finished adding. It shuts down their KCL workers itself.
+		rt.cancel()
+	}
+	s.changeLock.Unlock()
+
+	// Shutdown HTTP server. We do this before shutting down the KCL workers, so that connections which are still
+	// draining continue receiving events.
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		// NOTE(mroberts): Shutdown doesn't close active connections when ctx is done, so we close them ourselves. But
+		// first, we end their streams, and give them a moment to send a jittered "retry" (see writeEndedRetry).
+		s.drainCancel()
+		s.awaitConnections(stopGracePeriod)
+
+		if closeErr := s.srv.Close(); closeErr != nil {
+			err = errors.Join(err, closeErr)
+		}
+		err = fmt.Errorf("unable to shut down the HTTP server gracefully: %w", err)
+	}
+
+	var wait sync.WaitGroup
+
+	// Shutdown KCL workers.
+	for _, r := range routes {
+		for _, w := range r.workers {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				w.wrkr.Shutdown()
+			}()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("timed out waiting for KCL workers to shut down: %w", ctx.Err()))
+	}
+
+	return err
+}
+
+// logLag periodically logs each route's consumer lag, and any records it skipped since the last log, until the service
+// stops. Routes whose KCL workers haven't reported on any shards yet are skipped.
+func (s *Service) logLag() {
+	ticker := time.NewTicker(s.lagLogInterval)
+	defer ticker.Stop()
+
+	// previous holds each route's stats as of the last log, so that we can log the records skipped since.
+	previous := make(map[string]RouteStats)
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		for pattern, rt := range s.routesSnapshot() {
+			stats := rt.stats.snapshot(now)
+			s.logSkipped(pattern, stats, previous[pattern])
+			previous[pattern] = stats
+
+			shardLags := rt.stats.shardLags()
+			if len(shardLags) == 0 {
+				continue
+			}
+
+			var maxLag time.Duration
+			shards := make(map[string]int64, len(shardLags))
+			for shardID, lag := range shardLags {
+				maxLag = max(maxLag, lag)
+				shards[shardID] = lag.Milliseconds()
+			}
+
+			s.logger.Info("Consumer lag",
+				slog.String("route", pattern),
+				slog.Int64("millisBehindLatest", maxLag.Milliseconds()),
+				slog.Any("shards", shards))
+		}
+	}
+}
+
+// logSkipped logs how many of the route's records were skipped between two snapshots of its stats, by reason, and what
+// share of the records that is, so that a producer schema change which skips every record doesn't go unnoticed.
+func (s *Service) logSkipped(pattern string, stats, previous RouteStats) {
+	// NOTE(mroberts): A route removed and re-added under the same pattern starts counting from zero again.
+	if stats.EventsSkipped < previous.EventsSkipped {
+		previous = RouteStats{}
+	}
+
+	skipped := stats.EventsSkipped - previous.EventsSkipped
+	if skipped == 0 {
+		return
+	}
+	ingested := stats.EventsIngested - previous.EventsIngested
+
+	reasons := make(map[string]int64, len(stats.EventsSkippedByReason))
+	for reason, n := range stats.EventsSkippedByReason {
+		if n -= previous.EventsSkippedByReason[reason]; n > 0 {
+			reasons[reason] = n
+		}
+	}
+
+	s.logger.Warn("Skipped events",
+		slog.String("route", pattern),
+		slog.Int64("skipped", skipped),
+		slog.Int64("ingested", ingested),
+		slog.Float64("skippedPercent", 100*float64(skipped)/float64(skipped+ingested)),
+		slog.Any("reasons", reasons))
+}
+
+// handleHealth responds 200, unless a route's consumer lag exceeds its threshold, in which case it responds 503. The
+// "max_lag" query parameter overrides the configured thresholds for all routes.
+func (s *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if s.cors.setCORSHeaders(w, r) {
+		return
+	}
+
+	var maxLag time.Duration
+	if unparsedMaxLag := r.URL.Query().Get("max_lag"); unparsedMaxLag != "" {
+		var err error
+		if maxLag, err = time.ParseDuration(unparsedMaxLag); err != nil || maxLag <= 0 {
+			writeError(w, r, "Bad Request", codeBadRequest, http.StatusBadRequest)
+			return
+		}
+	}
+
+	for pattern, rt := range s.routesSnapshot() {
+		threshold := rt.healthMaxLag
+		if maxLag > 0 {
+			threshold = maxLag
+		}
+		if threshold == 0 {
+			continue
+		}
+
+		if lag := rt.stats.lag(); lag > threshold {
+			writeError(w, r, fmt.Sprintf("Route %q is %s behind, exceeding %s", pattern, lag, threshold), codeLagging, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+// handleReady responds 200 once every route's KCL worker has started consuming (see readiness), and 503 before then.
+// Unlike /health, which reports whether the service is alive, this reports whether it should receive traffic.
+func (s *Service) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.cors.setCORSHeaders(w, r) {
+		return
+	}
+
+	if s.startingUp.Load() {
+		writeError(w, r, "Service is starting", codeStartingUp, http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.draining.Load() {
+		writeError(w, r, "Service is draining", codeDraining, http.StatusServiceUnavailable)
+		return
+	}
+
+	for pattern, rt := range s.routesSnapshot() {
+		if !rt.readiness.isReady() {
+			writeError(w, r, fmt.Sprintf("Route %q is not ready", pattern), codeNotReady, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+// handleStats serves a JSON object mapping each route pattern to its RouteStats.
+func (s *Service) handleStats(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	routes := s.routesSnapshot()
+	stats := make(map[string]RouteStats, len(routes))
+	for pattern, r := range routes {
+		stats[pattern] = r.snapshot(context.Background(), now)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.logger.Error("Unable to encode stats", "err", err)
+	}
+}
+
+// VersionInfo identifies the running build, as served at /version.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+}
+
+// handleVersion serves the VersionInfo as JSON, so that operators can tell which build is deployed.
+func (s *Service) handleVersion(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.version); err != nil {
+		s.logger.Error("Unable to encode version", "err", err)
+	}
+}
+
+// RouteInfo describes a route in the index.
+type RouteInfo struct {
+	Pattern           string   `json:"pattern"`
+	Stream            string   `json:"stream"`
+	AdditionalStreams []string `json:"additionalStreams,omitempty"`
+}
+
+// handleIndex serves a JSON array of the routes, ordered by pattern. It responds 200 at "/", and 404 at any other path,
+// since it only serves those because no route matched.
+func (s *Service) handleIndex(w http.ResponseWriter, r *http.Request) {
+	routes := s.routesSnapshot()
+	infos := make([]RouteInfo, 0, len(routes))
+	for pattern, rt := range routes {
+		info := RouteInfo{Pattern: pattern, Stream: rt.stream()}
+		if len(rt.streams) > 1 {
+			info.AdditionalStreams = rt.streams[1:]
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b RouteInfo) int {
+		return strings.Compare(a.Pattern, b.Pattern)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path != "/" {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		s.logger.Error("Unable to encode index", "err", err)
+	}
+}
+
+// requireAdmin wraps an /admin handler, responding 401 unless the request carries the admin bearer token.
+func (s *Service) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, "Unauthorized", codeUnauthorized, http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// handleAdminConnections serves a JSON object mapping each route pattern to its active connections.
+func (s *Service) handleAdminConnections(w http.ResponseWriter, _ *http.Request) {
+	routes := s.routesSnapshot()
+	connections := make(map[string][]ConnectionInfo, len(routes))
+	for pattern, r := range routes {
+		connections[pattern] = r.connections.list()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(connections); err != nil {
+		s.logger.Error("Unable to encode connections", "err", err)
+	}
+}
+
+// handleAdminShards serves a JSON object mapping each route pattern to its shards' leases and checkpoints. Routes which
+// checkpoint to DynamoDB are omitted, since their state is in the table.
+func (s *Service) handleAdminShards(w http.ResponseWriter, _ *http.Request) {
+	routes := s.routesSnapshot()
+	shards := make(map[string][]ShardInfo, len(routes))
+	for pattern, r := range routes {
+		for _, w := range r.workers {
+			if w.checkpointer == nil {
+				continue
+			}
+			if shards[pattern] == nil {
+				shards[pattern] = []ShardInfo{}
+			}
+			for _, shard := range w.checkpointer.shards() {
+				shard.Stream = w.stream
+				shards[pattern] = append(shards[pattern], shard)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shards); err != nil {
+		s.logger.Error("Unable to encode shards", "err", err)
+	}
+}
+
+func (s *Service) handleFunc(rt route, w http.ResponseWriter, r *http.Request) {
+	// Use the request ID injected at the edge, if any, and echo it back, so that the stream can be traced end to end.
+	requestID := r.Header.Get(s.requestIDHeader)
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+	w.Header().Set(s.requestIDHeader, requestID)
+
+	// 1. Handle CORS, including preflight requests.
+	if s.cors.setCORSHeaders(w, r) {
+		return
+	}
+
+	// 2. Require an API key, if the route is configured with any.
+	if !authorized(r, rt.apiKeys) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, "Unauthorized", codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	// 3. Ensure we can cast to http.Flusher. Some http.ResponseWriter wrappers can break this functionality.
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.logger.Error("SSE not supported")
+		writeError(w, r, "Internal Server Error", codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	// 4. Parse the query parameters and headers.
+	params, err := parseStreamParams(r, s.maxLookback)
+	if err != nil {
+		writeError(w, r, err.Error(), codeBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	// 5. Negotiate the mode. Clients which can't use EventSource may ask for a JSON array of events instead, or for
+	// NDJSON, which is streamed like SSEs, but without the SSE framing. Either way, they start from the same offset.
+	mode, ok := negotiateMode(r)
+	if !ok {
+		writeError(w, r, "Not Acceptable", codeNotAcceptable, http.StatusNotAcceptable)
+		return
+	}
+
+	if mode == modeJSON {
+		s.handleBatch(rt, w, r, params)
+		return
+	}
+
+	ndjson := mode == modeNDJSON
+
+	// Reject the stream if the route is already serving MaxConnections.
+	if rt.slots != nil {
+		select {
+		case rt.slots <- struct{}{}:
+			defer func() { <-rt.slots }()
+		default:
+			w.Header().Set("Retry-After", jitteredRetryAfter(DefaultConnectionLimitRetryAfter))
+			writeError(w, r, "Service Unavailable", codeTooManyConnections, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	rt.stats.connected()
+	defer rt.stats.disconnected()
+
+	conn := &connection{
+		remoteAddr:  r.RemoteAddr,
+		connectedAt: time.Now(),
+		since:       params.since,
+		until:       params.until,
+		limit:       params.limit,
+	}
+	rt.connections.add(conn)
+	defer rt.connections.remove(conn)
+
+	// Log the connection's open and close. The close line repeats the parameters, so that it's a complete access log
+	// without --debug, and both lines share a request ID, so that they can be correlated with it.
+	logger := s.logger.With(
+		slog.String("requestId", requestID),
+		slog.String("route", rt.pattern),
+		slog.String("remoteAddr", r.RemoteAddr),
+		slog.String("since", params.since),
+		slog.String("from", r.URL.Query().Get("from")),
+		slog.String("lastEventId", r.Header.Get("Last-Event-ID")))
+	logger.Debug("Connection opened")
+
+	reason := "write failed"
+	defer func() {
+		logger.Info("Connection closed",
+			slog.String("duration", time.Since(conn.connectedAt).String()),
+			slog.Int64("eventsDelivered", conn.eventsSent.Load()),
+			slog.String("reason", reason))
+	}()
+
+	// 6. Start sending SSEs, compressed if the client accepts it.
+	if !s.disableCompression && acceptsGzip(r) {
+		gw := newGzipResponseWriter(w)
+		defer func() { _ = gw.Close() }()
+		w, flusher = gw, gw
+	}
+
+	rc := http.NewResponseController(w)
+
+	// NOTE(mroberts): A write to a stuck client blocks until its deadline, even if the client goes away in the meantime,
+	// so we expire the deadline as soon as the request's context is done in order to fail the write promptly.
+	stopInterrupt := context.AfterFunc(r.Context(), func() {
+		_ = rc.SetWriteDeadline(time.Now())
+	})
+	defer stopInterrupt()
+
+	// Bound the writes before the first event, too. Each event's write extends the deadline.
+	if err := rc.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Error("Unable to set write deadline", "err", err)
+	}
+
+	s.setStreamHeaders(w)
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		if _, err := fmt.Fprint(w, s.preamble); err != nil {
+			return
+		}
+
+		if rt.retryMillis > 0 {
+			if _, err := fmt.Fprintf(w, "retry: %d\n\n", rt.retryMillis); err != nil {
+				return
+			}
+		}
+
+		if _, err := fmt.Fprint(w, s.greeting); err != nil {
+			return
+		}
+
+		if s.requestIDComment {
+			if _, err := fmt.Fprintf(w, ": request-id %s\n\n", requestID); err != nil {
+				return
+			}
+		}
+	}
+
+	flusher.Flush()
+
+	if params.schema && !ndjson {
+		s.writeSchema(rt, w, flusher, r)
+	}
+
+	off := startOffset(r.Context(), rt, params, logger)
+	conn.offset.Store(int64(off))
+
+	// If the route has no events yet, for example because its KCL worker hasn't processed any records, let the client
+	// know, rather than leave it with nothing but ":ok".
+	_, latest := rt.ml.Range(r.Context())
+	empty := latest < 0
+	if empty && !ndjson {
+		if _, err := fmt.Fprint(w, ": no data yet\n\n"); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+
+	// End the stream if the route is removed, or if the service finishes draining.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(rt.ctx, cancel)
+	defer stop()
+	stopDrain := context.AfterFunc(s.drainCtx, cancel)
+	defer stopDrain()
+
+	// Bound the stream by MaxConnectionDuration, if set.
+	if s.maxConnectionDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.maxConnectionDuration)
+		defer cancel()
+	}
+
+	// 7. Send events until the stream ends. However it ends, the streamWriter lets the client know why.
+	sw := newStreamWriter(ctx, s, rt, w, flusher, rc, r, conn, params, ndjson, empty)
+	defer sw.stop()
+	defer func() { reason = sw.reason }()
+
+	// NOTE(mroberts): Stream.Next blocks until the next event, so we read events in a separate goroutine in order to
+	// send heartbeats in between. Replays only read the events already in the memlog, so they end rather than block.
+	source := streamEvents
+	if params.replay {
+		source = replayEvents
+	}
+	events, stopStream := source(ctx, rt.ml, off)
+	defer func() { stopStream() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			sw.expire()
+			return
+		case <-sw.heartbeats:
+			if !sw.writeHeartbeat() {
+				return
+			}
+		case <-sw.batchDeadline:
+			if !sw.flushBatch() {
+				return
+			}
+		case <-sw.flushDeadline:
+			if !sw.flushBuffered() {
+				return
+			}
+		case cloudEvent, ok := <-events:
+			if !ok && params.replay && ctx.Err() == nil {
+				// We replayed every event in the window.
+				sw.finish("replay finished")
+				return
+			}
+			if !ok {
+				sw.expire()
+				return
+			}
+
+			// We reached the end of a stream bounded by "until".
+			if params.untilTimestamp != nil && reachedUntil(rt.t2o, cloudEvent.Metadata.Offset, *params.untilTimestamp) {
+				sw.finish("until reached")
+				return
+			}
+
+			// Close the connection if the client has fallen too far behind to catch up.
+			if rt.maxLag > 0 {
+				if _, latest := rt.ml.Range(ctx); latest-cloudEvent.Metadata.Offset > memlog.Offset(rt.maxLag) {
+					sw.finish("overloaded")
+					return
+				}
+			}
+
+			ssEvent, element, ok := sw.format(cloudEvent)
+			if !ok {
+				conn.offset.Store(int64(cloudEvent.Metadata.Offset))
+				continue
+			}
+
+			if params.speed > 0 && !sw.pace(cloudEvent.Metadata.Offset) {
+				return
+			}
+
+			start := time.Now()
+
+			if !sw.writeEvent(cloudEvent.Metadata.Offset, ssEvent, element) {
+				return
+			}
+
+			// We reached the end of a stream bounded by "limit".
+			if sw.reachedLimit() {
+				sw.finish("limit reached")
+				return
+			}
+
+			// With SlowClientSkip, a slow write means the client is falling behind, so skip ahead to the latest offset.
+			if rt.slowClientPolicy == SlowClientSkip && time.Since(start) > rt.slowClientTimeout {
+				if _, latest := rt.ml.Range(ctx); latest > cloudEvent.Metadata.Offset+1 {
+					if !sw.writeGap(cloudEvent.Metadata.Offset+1, latest-1) {
+						return
+					}
+					stopStream()
+					events, stopStream = source(ctx, rt.ml, latest)
+				}
+			}
+		}
+	}
+}
+
+// pace waits for the specified delay, returning false if the context is done first.
+func pace(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// eventName returns the string value of the specified top-level field of a JSON event, if any, for use as its SSE
+// event name.
+func eventName(data []byte, field string) (string, bool) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", false
+	}
+
+	var name string
+	if err := json.Unmarshal(event[field], &name); err != nil || name == "" {
+		return "", false
+	}
+
+	// NOTE(mroberts): A line break would end the "event" field early, and let the event inject other fields.
+	if strings.ContainsAny(name, "\r\n") {
+		return "", false
+	}
+
+	return name, true
+}
+
+// streamEvents streams events from the memlog, starting at the specified offset, until the context is cancelled, the
+// returned stop function is called, or the stream ends. The returned channel is closed when streaming stops.
+func streamEvents(ctx context.Context, ml *memlog.Log, off memlog.Offset) (<-chan memlog.Record, func()) {
+	ctx, stop := context.WithCancel(ctx)
+	events := make(chan memlog.Record)
+
+	go func() {
+		defer close(events)
+
+		stream := ml.Stream(ctx, off)
+		for {
+			cloudEvent, ok := stream.Next()
+			if !ok {
+				return
+			}
+
+			select {
+			case events <- cloudEvent:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, stop
+}
+
+// startOffset returns the offset to start streaming from. Last-Event-ID takes precedence over "from", which takes
+// precedence over "last", which takes precedence over "since", from most to least precise. Last-Event-ID comes first
+// because EventSource clients send it when reconnecting to the same URL, "from" and all. Otherwise, we start from the
+// latest offset in the log.
+func startOffset(ctx context.Context, rt route, params streamParams, logger *slog.Logger) memlog.Offset {
+	// Initialize off to the latest offset in the log.
+	earliest, latest := rt.ml.Range(ctx)
+	off := latest
+	if off < 0 {
+		off = 0
+	}
+
+	// Hold Timestamp2Offset's lock throughout, so that the offset we look up by timestamp isn't evicted before we clamp
+	// it to the oldest offset.
+	rt.t2o.Lock()
+	defer rt.t2o.Unlock()
+
+	if params.lastEventID != nil {
+		// If Last-Event-ID was provided, resume from the next offset. If that's in the future (for example, because we
+		// restarted and our offsets reset), fall back to the latest offset.
+		if next := *params.lastEventID + 1; next <= latest+1 {
+			off = max(next, earliest)
+		}
+	} else if params.from != nil {
+		// If "from" was provided, resume from that offset, clamped to the events we have. Unlike Last-Event-ID, it is the
+		// offset of the first event to send, rather than the last event received.
+		off = min(max(*params.from, earliest, 0), latest+1)
+	} else if params.last != nil {
+		// If "last" was provided, replay that many of the most recent events.
+		off = max(latest-memlog.Offset(*params.last)+1, earliest, 0)
+	} else if params.timestamp != nil {
+		// If "since" was provided, look up an offset by timestamp. If it's before every event we have, like when it reaches
+		// back beyond our retention, this is the oldest offset. If every event is before it, only stream new events,
+		// rather than replaying one from before the requested time.
+		nearestOff, ok := rt.t2o.NearestOffsetAfterUnlocked(*params.timestamp)
+		if ok {
+			off = memlog.Offset(nearestOff)
+		} else if latest >= 0 {
+			off = latest + 1
+		}
+
+		// NOTE(mroberts): This helps diagnose complaints that "since" returned nothing.
+		if !ok {
+			logger.Debug("No events since the requested timestamp",
+				slog.String("timestamp", params.timestamp.UTC().Format(TimestampFormat)),
+				slog.Bool("empty", latest < 0))
+		}
+	}
+
+	// The memlog may retain events which Timestamp2Offset has already evicted by size. Don't serve those.
+	if oldestOff, ok := rt.t2o.OldestOffsetUnlocked(); ok && off < memlog.Offset(oldestOff) {
+		off = memlog.Offset(oldestOff)
+	}
+
+	return off
+}
+
+// writeSchema writes a "schema" event containing the route's configured schema or, if none, the shape of its most
+// recent event. If there is neither, nothing is written.
+func (s *Service) writeSchema(rt route, w http.ResponseWriter, flusher http.Flusher, r *http.Request) {
+	schema := rt.schema
+	if schema == nil {
+		// Binary events are opaque, so we can't infer their shape.
+		if rt.binary {
+			return
+		}
+
+		_, latest := rt.ml.Range(r.Context())
+		if latest < 0 {
+			return
+		}
+
+		rec, err := rt.ml.Read(r.Context(), latest)
+		if err != nil {
+			return
+		}
+
+		data, err := rt.encoding.decode(rec.Data)
+		if err != nil {
+			return
+		}
+
+		if schema, err = inferShape(data); err != nil {
+			s.logger.Debug("Unable to infer schema", "err", err)
+			return
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "event: schema\ndata: %s\n\n", schema); err != nil {
+		return
+	}
+
+	flusher.Flush()
+}
+
+// reachedUntil returns true if the event at the specified offset is at or after the "until" timestamp. Events which
+// Timestamp2Offset has already evicted are assumed to be before it.
+func reachedUntil(t2o *Timestamp2Offset, off memlog.Offset, until time.Time) bool {
+	timestamp, ok := t2o.TimestampForOffset(int(off))
+	return ok && !timestamp.Before(until)
+}
+
+// formatData formats an event's data as the value of an SSE "data" field. Events ingested with RawPassthrough may span
+// lines, in which case we continue each line in its own "data" field, which EventSource rejoins with line feeds.
+func formatData(data []byte) string {
+	if !bytes.ContainsAny(data, "\r\n") {
+		return string(data)
+	}
+
+	lines := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(data))
+	return strings.ReplaceAll(lines, "\n", "\ndata: ")
+}
+
+// indentData indents a JSON event for readability, for clients which pass "pretty=true". formatData then splits it
+// across multiple "data" lines. Events which aren't JSON are returned unchanged.
+func indentData(data []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return data
+	}
+
+	return buf.Bytes()
+}
+
+// writeEndedRetry writes a jittered SSE "retry" ahead of the final comment of a stream we're ending, so that clients
+// whose streams end at the same time don't all reconnect at once. The retry is based on the route's retryMillis, if set,
+// or else DefaultEndedRetryMillis.
+func writeEndedRetry(w http.ResponseWriter, retryMillis int) {
+	if retryMillis <= 0 {
+		retryMillis = DefaultEndedRetryMillis
+	}
+
+	_, _ = fmt.Fprintf(w, "retry: %d\n\n", jitter(time.Duration(retryMillis)*time.Millisecond).Milliseconds())
+}
+
+// writeEndComment writes the final ": end" comment of a bounded stream.
+func writeEndComment(w http.ResponseWriter, flusher http.Flusher) {
+	if _, err := fmt.Fprint(w, ": end\n\n"); err != nil {
+		return
+	}
+
+	flusher.Flush()
+}
+
+// writeOverloadedComment writes the final ": overloaded" comment of a stream whose client fell more than MaxLag events
+// behind.
+func writeOverloadedComment(w http.ResponseWriter, flusher http.Flusher) {
+	if _, err := fmt.Fprint(w, ": overloaded\n\n"); err != nil {
+		return
+	}
+
+	flusher.Flush()
+}
+
+// writeEndMarker writes the final "end" event of a bounded stream, including the offset of the last event sent.
+func writeEndMarker(w http.ResponseWriter, flusher http.Flusher, off memlog.Offset) {
+	if _, err := fmt.Fprintf(w, "event: end\ndata: {\"offset\":%d}\n\n", off); err != nil {
+		return
+	}
+
+	flusher.Flush()
 }
@@ -1,15 +1,43 @@
 package kinesis2sse
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/alevinval/sse/pkg/eventsource"
+	"github.com/embano1/memlog"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	cfg "github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+	kc "github.com/vmware/vmware-go-kcl-v2/clientlibrary/interfaces"
+	par "github.com/vmware/vmware-go-kcl-v2/clientlibrary/partition"
 )
 
 func TestServiceOneRoute(t *testing.T) {
@@ -22,8 +50,11 @@ func TestServiceOneRoute(t *testing.T) {
 				Pattern: "/",
 			},
 		},
-		disableKCL: true,
-		Logger:     slog.New(slog.DiscardHandler),
+		// NOTE(mroberts): eventsource can race its own Close with a reconnect, which leaks a connection and blocks Stop.
+		// Compressed responses reliably trigger this, so we test compression separately in TestServiceGzip.
+		DisableCompression: true,
+		disableKCL:         true,
+		Logger:             slog.New(slog.DiscardHandler),
 	})
 	r.NoError(err)
 
@@ -31,13 +62,14 @@ func TestServiceOneRoute(t *testing.T) {
 		r.NoError(s.Start())
 	}()
 
-	addr, err := s.Addr()
+	addr, err := waitForStart(s)
 	r.NoError(err)
 	fmt.Printf("Listening at %s…\n", addr.String())
 
 	var wait sync.WaitGroup
 	wait.Add(2)
 	events := []string{}
+	ids := []string{}
 
 	var es *eventsource.EventSource
 	go func() {
@@ -55,6 +87,7 @@ func TestServiceOneRoute(t *testing.T) {
 				} else {
 					fmt.Printf("[Event] ID: %s\n Name: %s\n Data: %s\n\n", event.ID, event.Name, event.Data)
 					events = append(events, event.Data)
+					ids = append(ids, event.ID)
 				}
 				wait.Done()
 			case state := <-es.ReadyState():
@@ -86,6 +119,8 @@ func TestServiceOneRoute(t *testing.T) {
 		`{"goodbye":"world"}`,
 	}, events)
 
+	r.Equal([]string{"0", "1"}, ids)
+
 	fmt.Println("Stopping service…")
 	err = s.Stop(context.Background())
 	r.NoError(err)
@@ -104,8 +139,11 @@ func TestServiceTwoRoutes(t *testing.T) {
 				Pattern: "/bar",
 			},
 		},
-		disableKCL: true,
-		Logger:     slog.New(slog.DiscardHandler),
+		// NOTE(mroberts): eventsource can race its own Close with a reconnect, which leaks a connection and blocks Stop.
+		// Compressed responses reliably trigger this, so we test compression separately in TestServiceGzip.
+		DisableCompression: true,
+		disableKCL:         true,
+		Logger:             slog.New(slog.DiscardHandler),
 	})
 	r.NoError(err)
 
@@ -113,7 +151,7 @@ func TestServiceTwoRoutes(t *testing.T) {
 		r.NoError(s.Start())
 	}()
 
-	addr, err := s.Addr()
+	addr, err := waitForStart(s)
 	r.NoError(err)
 	fmt.Printf("Listening at %s…\n", addr.String())
 
@@ -179,3 +217,3373 @@ func TestServiceTwoRoutes(t *testing.T) {
 	err = s.Stop(context.Background())
 	r.NoError(err)
 }
+
+func TestServiceEndMarker(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s?since=1970-01-01T00%%3A00%%3A00.000Z&limit=2&end_marker=true", addr.String()))
+	r.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	r.NoError(err)
+	r.NoError(resp.Body.Close())
+
+	r.Equal(1, strings.Count(string(body), "event: end\n"))
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\nevent: end\ndata: {\"offset\":1}\n\n: end\n\n", string(body))
+
+	// Without "end_marker", the stream just ends with a comment.
+	resp, err = http.Get(fmt.Sprintf("http://%s?since=1970-01-01T00%%3A00%%3A00.000Z&limit=1", addr.String()))
+	r.NoError(err)
+	body, err = io.ReadAll(resp.Body)
+	r.NoError(err)
+	r.NoError(resp.Body.Close())
+
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", string(body))
+
+	// "limit" must be a non-negative integer.
+	for _, limit := range []string{"-1", "ten"} {
+		resp, err = http.Get(fmt.Sprintf("http://%s?limit=%s", addr.String(), limit))
+		r.NoError(err)
+		r.NoError(resp.Body.Close())
+		r.Equal(http.StatusBadRequest, resp.StatusCode, limit)
+	}
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceHealthMaxLag(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern: "/foo",
+			},
+			{
+				Pattern:      "/bar",
+				HealthMaxLag: 10 * time.Minute,
+			},
+		},
+		HealthMaxLag: time.Minute,
+		disableKCL:   true,
+		Logger:       slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	getHealth := func(query string) int {
+		resp, err := http.Get(fmt.Sprintf("http://%s/health%s", addr.String(), query))
+		r.NoError(err)
+		r.NoError(resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	// No lag has been reported yet.
+	r.Equal(http.StatusOK, getHealth(""))
+	r.Equal(http.StatusOK, getHealth("?max_lag=60s"))
+	r.Equal(http.StatusBadRequest, getHealth("?max_lag=bogus"))
+
+	// "/bar" is within its own threshold, but not the one passed via "max_lag".
+	s.routes["/bar"].stats.behind("shardId-000000000000", 2*time.Minute)
+	r.Equal(http.StatusOK, getHealth(""))
+	r.Equal(http.StatusServiceUnavailable, getHealth("?max_lag=60s"))
+	r.Equal(http.StatusOK, getHealth("?max_lag=5m"))
+
+	// "/foo" exceeds the default threshold on one of its shards.
+	s.routes["/foo"].stats.behind("shardId-000000000000", 0)
+	s.routes["/foo"].stats.behind("shardId-000000000001", 90*time.Second)
+	r.Equal(http.StatusServiceUnavailable, getHealth(""))
+
+	// Once the lagging shard ends, "/foo" is healthy again.
+	s.routes["/foo"].stats.shardEnded("shardId-000000000001")
+	r.Equal(http.StatusOK, getHealth(""))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceAdminConnections(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		AdminToken: "secret",
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	getConnections := func(token string) (int, map[string][]ConnectionInfo) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/admin/connections", addr.String()), nil)
+		r.NoError(err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		r.NoError(err)
+		defer func() {
+			r.NoError(resp.Body.Close())
+		}()
+
+		var connections map[string][]ConnectionInfo
+		if resp.StatusCode == http.StatusOK {
+			r.NoError(json.NewDecoder(resp.Body).Decode(&connections))
+		}
+		return resp.StatusCode, connections
+	}
+
+	status, _ := getConnections("bogus")
+	r.Equal(http.StatusUnauthorized, status)
+
+	status, connections := getConnections("secret")
+	r.Equal(http.StatusOK, status)
+	r.Empty(connections["/"])
+
+	resp, err := http.Get(fmt.Sprintf("http://%s?since=1h&limit=10", addr.String()))
+	r.NoError(err)
+
+	err = s.routes["/"].t2o.Add(0, time.Now())
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"hello":"world"}`))
+	r.NoError(err)
+
+	r.Eventually(func() bool {
+		_, connections := getConnections("secret")
+		return len(connections["/"]) == 1 && connections["/"][0].EventsSent == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, connections = getConnections("secret")
+	r.Equal("1h", connections["/"][0].Since)
+	r.Equal(10, connections["/"][0].Limit)
+	r.Equal(int64(len("id: 0\ndata: {\"hello\":\"world\"}\n\n")), connections["/"][0].BytesSent)
+	r.Equal(int64(0), connections["/"][0].Offset)
+
+	// Closing the connection removes it from the registry.
+	r.NoError(resp.Body.Close())
+
+	r.Eventually(func() bool {
+		_, connections := getConnections("secret")
+		return len(connections["/"]) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceAdminShards(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		AdminToken: "secret",
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// Without KCL workers, there's no checkpointer, so provide one.
+	checkpointer := NewInMemoryCheckpointer("worker", slog.New(slog.DiscardHandler)).(*inMemoryCheckpointer)
+	leaseTimeout := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, shardID := range []string{"shardId-000000000001", "shardId-000000000000"} {
+		shard := &par.ShardStatus{ID: shardID, Mux: &sync.RWMutex{}, Checkpoint: "49590338271490256608559692538361571095921575989136588898", LeaseTimeout: leaseTimeout}
+		r.NoError(checkpointer.CheckpointSequence(shard))
+	}
+	rt := s.routes["/"]
+	rt.workers = []routeWorker{{stream: "test-stream", checkpointer: checkpointer}}
+	s.routes["/"] = rt
+
+	getShards := func(token string) (int, map[string][]ShardInfo) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/shards", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.srv.Handler.ServeHTTP(w, req)
+
+		var shards map[string][]ShardInfo
+		if w.Code == http.StatusOK {
+			r.NoError(json.NewDecoder(w.Body).Decode(&shards))
+		}
+		return w.Code, shards
+	}
+
+	status, _ := getShards("bogus")
+	r.Equal(http.StatusUnauthorized, status)
+
+	status, shards := getShards("secret")
+	r.Equal(http.StatusOK, status)
+	r.Equal([]ShardInfo{
+		{Stream: "test-stream", ShardID: "shardId-000000000000", AssignedTo: "worker", Checkpoint: "49590338271490256608559692538361571095921575989136588898", LeaseTimeout: leaseTimeout},
+		{Stream: "test-stream", ShardID: "shardId-000000000001", AssignedTo: "worker", Checkpoint: "49590338271490256608559692538361571095921575989136588898", LeaseTimeout: leaseTimeout},
+	}, shards["/"])
+}
+
+// slowResponseWriter is an http.ResponseWriter which takes delay to complete each write. It supports write deadlines.
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+	delay    time.Duration
+	deadline time.Time
+}
+
+func (w *slowResponseWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	if !w.deadline.IsZero() && time.Now().After(w.deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w *slowResponseWriter) SetWriteDeadline(deadline time.Time) error {
+	w.deadline = deadline
+	return nil
+}
+
+func TestServiceSlowClientPolicy(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:           "/block",
+				SlowClientPolicy:  SlowClientBlock,
+				SlowClientTimeout: 10 * time.Millisecond,
+			},
+			{
+				Pattern:           "/disconnect",
+				SlowClientPolicy:  SlowClientDisconnect,
+				SlowClientTimeout: 10 * time.Millisecond,
+			},
+			{
+				Pattern:           "/skip",
+				SlowClientPolicy:  SlowClientSkip,
+				SlowClientTimeout: 10 * time.Millisecond,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for _, rt := range s.routes {
+		for i := 0; i < 5; i++ {
+			err = rt.t2o.Add(i, time.UnixMilli(0))
+			r.NoError(err)
+			_, err = rt.ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+			r.NoError(err)
+		}
+	}
+
+	getSlowly := func(pattern string, limit int, query ...string) string {
+		w := &slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), delay: 20 * time.Millisecond}
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s?since=1970-01-01T00%%3A00%%3A00.000Z&limit=%d%s", pattern, limit, strings.Join(query, "")), nil)
+		s.handleFunc(s.routes[pattern], w, req)
+		return w.Body.String()
+	}
+
+	// Blocking delivers every event, however slowly.
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\nid: 2\ndata: {\"event\":2}\n\n: end\n\n", getSlowly("/block", 3))
+
+	// Disconnecting closes the connection on the first slow write.
+	r.Equal(": ok\n\n", getSlowly("/disconnect", 3))
+
+	// Skipping jumps to the latest offset after the first slow write, reporting the gap.
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nevent: gap\ndata: {\"from\":1,\"to\":3}\n\nid: 4\ndata: {\"event\":4}\n\n: end\n\n", getSlowly("/skip", 2))
+
+	// When batching, the gap follows the batch before it.
+	r.Equal(": ok\n\nid: 1\ndata: [{\"event\":0},{\"event\":1}]\n\nevent: gap\ndata: {\"from\":2,\"to\":3}\n\nid: 4\ndata: [{\"event\":4}]\n\n: end\n\n", getSlowly("/skip", 3, "&batch=2"))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+// stuckResponseWriter is an http.ResponseWriter whose writes block until their deadline, like those to a client which
+// stopped reading.
+type stuckResponseWriter struct {
+	*httptest.ResponseRecorder
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (w *stuckResponseWriter) Write(b []byte) (int, error) {
+	for {
+		w.mu.Lock()
+		deadline := w.deadline
+		w.mu.Unlock()
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (w *stuckResponseWriter) SetWriteDeadline(deadline time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deadline = deadline
+	return nil
+}
+
+func TestServiceWriteTimeout(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		WriteTimeout:    20 * time.Millisecond,
+		DisablePreamble: true,
+		disableKCL:      true,
+		Logger:          slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	rt := s.routes["/"]
+	err = rt.t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = rt.ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	// Even with SlowClientBlock, a stalled write times out.
+	start := time.Now()
+	w := &stuckResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	s.handleFunc(rt, w, httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00.000Z", nil))
+	r.Less(time.Since(start), time.Second)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+
+	// A stalled write fails as soon as the client goes away, well before the WriteTimeout.
+	s, err = NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		WriteTimeout:    time.Minute,
+		DisablePreamble: true,
+		disableKCL:      true,
+		Logger:          slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	rt = s.routes["/"]
+	err = rt.t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = rt.ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	w = &stuckResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	s.handleFunc(rt, w, httptest.NewRequestWithContext(ctx, http.MethodGet, "/?since=1970-01-01T00%3A00%3A00.000Z", nil))
+	r.Less(time.Since(start), time.Second)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceSchema(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/configured",
+				Schema:  json.RawMessage(`{ "type": "object" }`),
+			},
+			{
+				Pattern: "/inferred",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(pattern string) string {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, pattern+"?schema=true&limit=1", nil)
+		s.handleFunc(s.routes[pattern], w, req)
+		return w.Body.String()
+	}
+
+	// Without any events, there is nothing to infer, so no schema event is sent.
+	w := httptest.NewRecorder()
+	s.writeSchema(s.routes["/inferred"], w, w, httptest.NewRequest(http.MethodGet, "/inferred", nil))
+	r.Empty(w.Body.String())
+
+	for _, rt := range s.routes {
+		err = rt.t2o.Add(0, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = rt.ml.Write(context.Background(), []byte(`{"name":"world","count":1,"tags":["a","b"],"nested":{"ok":true,"missing":null}}`))
+		r.NoError(err)
+	}
+
+	r.Equal(": ok\n\nevent: schema\ndata: {\"type\":\"object\"}\n\nid: 0\ndata: {\"name\":\"world\",\"count\":1,\"tags\":[\"a\",\"b\"],\"nested\":{\"ok\":true,\"missing\":null}}\n\n: end\n\n", get("/configured"))
+	r.Equal(": ok\n\nevent: schema\ndata: {\"count\":\"number\",\"name\":\"string\",\"nested\":{\"missing\":\"null\",\"ok\":\"boolean\"},\"tags\":[\"string\"]}\n\nid: 0\ndata: {\"name\":\"world\",\"count\":1,\"tags\":[\"a\",\"b\"],\"nested\":{\"ok\":true,\"missing\":null}}\n\n: end\n\n", get("/inferred"))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceInheritedListener(t *testing.T) {
+	r := require.New(t)
+
+	// Simulate inheriting a listening socket from another process by passing a duplicate of its file descriptor.
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+
+	f, err := original.(*net.TCPListener).File()
+	r.NoError(err)
+	r.NoError(original.Close())
+
+	inherited, err := net.FileListener(f)
+	r.NoError(err)
+	r.NoError(f.Close())
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		Listener:   inherited,
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+	r.Equal(inherited.Addr().String(), addr.String())
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/health", addr.String()))
+	r.NoError(err)
+	r.NoError(resp.Body.Close())
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	// The listener can be handed off again.
+	f, err = s.ListenerFile()
+	r.NoError(err)
+	r.NoError(f.Close())
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceLastEventID(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:  "/",
+				Capacity: 3,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// [0, 1, 2, 3, 4, 5], of which only [3, 4, 5] are still available.
+	for i := 0; i < 6; i++ {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	get := func(lastEventID string) (int, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00.000Z&limit=1", nil)
+		req.Header.Set("Last-Event-ID", lastEventID)
+		s.handleFunc(s.routes["/"], w, req)
+		return w.Code, w.Body.String()
+	}
+
+	// Last-Event-ID wins over "since", resuming from the next offset.
+	code, body := get("3")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 4\ndata: {\"event\":4}\n\n: end\n\n", body)
+
+	// Offsets older than the oldest available offset resume from the oldest available offset.
+	code, body = get("0")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 3\ndata: {\"event\":3}\n\n: end\n\n", body)
+
+	// Offsets in the future (for example, from before a restart) resume from the latest offset.
+	code, body = get("100")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 5\ndata: {\"event\":5}\n\n: end\n\n", body)
+
+	code, _ = get("bogus")
+	r.Equal(http.StatusBadRequest, code)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceRetry(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:     "/retry",
+				RetryMillis: 5000,
+			},
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for _, pattern := range []string{"/retry", "/"} {
+		err = s.routes[pattern].t2o.Add(0, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes[pattern].ml.Write(context.Background(), []byte(`{"event":0}`))
+		r.NoError(err)
+	}
+
+	get := func(pattern string) string {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, pattern+"?limit=1", nil)
+		s.handleFunc(s.routes[pattern], w, req)
+		r.Equal(http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	r.Equal(": ok\n\nretry: 5000\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", get("/retry"))
+
+	// Without RetryMillis, no "retry" field is sent.
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", get("/"))
+
+	_, err = NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/", RetryMillis: -1}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.Error(err)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceHeartbeat(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:           "/",
+				HeartbeatInterval: 10 * time.Millisecond,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?limit=1", nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleFunc(s.routes["/"], w, req)
+	}()
+
+	// While no events are flowing, heartbeats are sent. Then the event is delivered as usual.
+	time.Sleep(100 * time.Millisecond)
+	err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	<-done
+
+	body := w.Body.String()
+	r.True(strings.HasPrefix(body, ": ok\n\n: no data yet\n\n: heartbeat\n\n"), body)
+	r.True(strings.HasSuffix(body, "id: 0\ndata: {\"event\":0}\n\n: end\n\n"), body)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceEventNameField(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:        "/",
+				EventNameField: "detail-type",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	events := []string{
+		`{"detail-type":"OrderPlaced"}`,
+		`{"detail-type":42}`,
+		`{"other":"field"}`,
+		`{"detail-type":"Evil\ndata: injected"}`,
+		`not json`,
+	}
+	for i, event := range events {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(event))
+		r.NoError(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/?since=1970-01-01T00%%3A00%%3A00.000Z&limit=%d", len(events)), nil)
+	s.handleFunc(s.routes["/"], w, req)
+
+	// Only the first event has a string "detail-type"; the rest fall back to unnamed events.
+	r.Equal(": ok\n\n"+
+		"event: OrderPlaced\nid: 0\ndata: {\"detail-type\":\"OrderPlaced\"}\n\n"+
+		"id: 1\ndata: {\"detail-type\":42}\n\n"+
+		"id: 2\ndata: {\"other\":\"field\"}\n\n"+
+		"id: 3\ndata: {\"detail-type\":\"Evil\\ndata: injected\"}\n\n"+
+		"id: 4\ndata: not json\n\n: end\n\n", w.Body.String())
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceGzip(t *testing.T) {
+	r := require.New(t)
+
+	for _, disableCompression := range []bool{false, true} {
+		s, err := NewService(ServiceOptions{
+			Port: -1,
+			Routes: []RouteOptions{
+				{
+					Pattern: "/",
+				},
+			},
+			DisableCompression: disableCompression,
+			disableKCL:         true,
+			Logger:             slog.New(slog.DiscardHandler),
+		})
+		r.NoError(err)
+
+		go func() {
+			r.NoError(s.Start())
+		}()
+
+		addr, err := waitForStart(s)
+		r.NoError(err)
+
+		err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+		r.NoError(err)
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s?since=1970-01-01T00%%3A00%%3A00.000Z", addr.String()), nil)
+		r.NoError(err)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		// NOTE(mroberts): We disable the transport's transparent decompression in order to check the Content-Encoding.
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+		resp, err := client.Do(req)
+		r.NoError(err)
+
+		var body io.Reader = resp.Body
+		if disableCompression {
+			r.Empty(resp.Header.Get("Content-Encoding"))
+		} else {
+			r.Equal("gzip", resp.Header.Get("Content-Encoding"))
+			body, err = gzip.NewReader(resp.Body)
+			r.NoError(err)
+		}
+
+		// The stream is still open, so reading the event means it was flushed all the way through.
+		expected := ": ok\n\nid: 0\ndata: {\"event\":0}\n\n"
+		actual := make([]byte, len(expected))
+		_, err = io.ReadFull(body, actual)
+		r.NoError(err)
+		r.Equal(expected, string(actual))
+
+		r.NoError(resp.Body.Close())
+
+		err = s.Stop(context.Background())
+		r.NoError(err)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	r := require.New(t)
+
+	for acceptEncoding, expected := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=1.0": true,
+		"GZIP":                true,
+		"br":                  false,
+		"gzip;q=0":            false,
+		"gzip; q=0.000":       false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		r.Equal(expected, acceptsGzip(req), acceptEncoding)
+	}
+}
+
+func TestServiceCORS(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		CORS: CORSOptions{
+			AllowedOrigins: []string{"https://example.com"},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// Preflight requests from allowed origins are answered with the allow headers.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusNoContent, w.Code)
+	r.Equal("https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	r.Equal("GET, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+	r.Equal("Authorization, Cache-Control, Last-Event-ID", w.Header().Get("Access-Control-Allow-Headers"))
+	r.Equal("Origin", w.Header().Get("Vary"))
+
+	// Other origins aren't echoed.
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusNoContent, w.Code)
+	r.Empty(w.Header().Get("Access-Control-Allow-Origin"))
+	r.Empty(w.Header().Get("Access-Control-Allow-Methods"))
+
+	// /health has CORS headers, too.
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://example.com")
+	s.handleHealth(w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+
+	// By default, any origin is allowed.
+	s, err = NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?limit=1", nil)
+	req.Header.Set("Origin", "https://example.com")
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("*", w.Header().Get("Access-Control-Allow-Origin"))
+	r.Empty(w.Header().Get("Vary"))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceFilter(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for i, event := range []string{
+		`{"detail":{"status":"inactive"}}`,
+		`not json`,
+		`{"detail":{"status":"active"}}`,
+	} {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(event))
+		r.NoError(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00.000Z&limit=1&filter=detail.status%3D%3Dactive", nil)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal(": ok\n\nid: 2\ndata: {\"detail\":{\"status\":\"active\"}}\n\n: end\n\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?filter=detail.status", nil)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusBadRequest, w.Code)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceUntil(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		err = s.routes["/"].t2o.Add(i, time.Unix(int64(i), 0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	// "since" and "until" define a closed window, and the stream ends at the first event at or after "until".
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A01Z&until=1970-01-01T00%3A00%3A03Z", nil)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal(": ok\n\nid: 1\ndata: {\"event\":1}\n\nid: 2\ndata: {\"event\":2}\n\n: end\n\n", w.Body.String())
+
+	// With "end_marker", the end marker reports the last event sent, not the one at "until".
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A01Z&until=1970-01-01T00%3A00%3A03Z&end_marker=true", nil)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal(": ok\n\nid: 1\ndata: {\"event\":1}\n\nid: 2\ndata: {\"event\":2}\n\nevent: end\ndata: {\"offset\":2}\n\n: end\n\n", w.Body.String())
+
+	// Batched events are sent before the end marker.
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A01Z&until=1970-01-01T00%3A00%3A03Z&batch=10&end_marker=true", nil)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal(": ok\n\nid: 2\ndata: [{\"event\":1},{\"event\":2}]\n\nevent: end\ndata: {\"offset\":2}\n\n: end\n\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A03Z&until=1970-01-01T00%3A00%3A01Z", nil)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?until=tomorrow", nil)
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal(http.StatusBadRequest, w.Code)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceReplay(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		err = s.routes["/"].t2o.Add(i, time.Unix(int64(i), 0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		return w
+	}
+
+	// A replay of a window ends at "until", like a live stream.
+	w := get("mode=replay&since=1970-01-01T00%3A00%3A01Z&until=1970-01-01T00%3A00%3A03Z")
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal(": ok\n\nid: 1\ndata: {\"event\":1}\n\nid: 2\ndata: {\"event\":2}\n\n: end\n\n", w.Body.String())
+
+	// But, unlike a live stream, it ends after the latest event, rather than waiting for one at or after "until".
+	w = get("mode=replay&since=1970-01-01T00%3A00%3A03Z&until=1970-01-01T00%3A01%3A00Z&end_marker=true")
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal(": ok\n\nid: 3\ndata: {\"event\":3}\n\nid: 4\ndata: {\"event\":4}\n\nevent: end\ndata: {\"offset\":4}\n\n: end\n\n", w.Body.String())
+
+	w = get("mode=replay&since=1970-01-01T00%3A00%3A04Z&batch=10")
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal(": ok\n\nid: 4\ndata: [{\"event\":4}]\n\n: end\n\n", w.Body.String())
+
+	r.Equal(http.StatusBadRequest, get("mode=replay").Code)
+	r.Equal(http.StatusBadRequest, get("mode=rewind&since=1h").Code)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceSince(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		MaxLookback: 24 * time.Hour,
+		disableKCL:  true,
+		Logger:      slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		err = s.routes["/"].t2o.Add(i, now.Add(time.Duration(i-3)*time.Hour))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	get := func(query string) (int, string) {
+		w := httptest.NewRecorder()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		return w.Code, w.Body.String()
+	}
+
+	// A lookback beyond every event we have starts from the oldest.
+	code, body := get("since=24h&limit=3")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\nid: 2\ndata: {\"event\":2}\n\n: end\n\n", body)
+
+	code, body = get("since=90m&limit=1")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 2\ndata: {\"event\":2}\n\n: end\n\n", body)
+
+	// Durations must be positive and have units.
+	for _, since := range []string{"1", "0", "-1h", "yesterday"} {
+		code, body = get("since=" + since)
+		r.Equal(http.StatusBadRequest, code, since)
+		r.Equal("since must be a positive duration or RFC3339 timestamp\n", body, since)
+	}
+
+	// Lookbacks beyond MaxLookback are rejected, whether durations or timestamps.
+	for _, since := range []string{"25h", "1970-01-01T00%3A00%3A00Z"} {
+		code, body = get("since=" + since)
+		r.Equal(http.StatusBadRequest, code, since)
+		r.Equal("since must be within the last 24h0m0s\n", body, since)
+	}
+
+	_, err = NewService(ServiceOptions{
+		MaxLookback: -time.Hour,
+		disableKCL:  true,
+		Logger:      slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, "max lookback must be non-negative")
+}
+
+func TestServiceLast(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:  "/",
+				Capacity: 3,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// [0, 1, 2, 3, 4, 5], of which only [3, 4, 5] are still available.
+	for i := 0; i < 6; i++ {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	get := func(query, lastEventID string) (int, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?limit=1&"+query, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		s.handleFunc(s.routes["/"], w, req)
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("last=2", "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 4\ndata: {\"event\":4}\n\n: end\n\n", body)
+
+	// More events than are available replays from the oldest available offset.
+	code, body = get("last=100", "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 3\ndata: {\"event\":3}\n\n: end\n\n", body)
+
+	// "last" takes precedence over "since".
+	code, body = get("last=1&since=1970-01-01T00%3A00%3A00.000Z", "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 5\ndata: {\"event\":5}\n\n: end\n\n", body)
+
+	// Last-Event-ID takes precedence over "last".
+	code, body = get("last=1", "3")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 4\ndata: {\"event\":4}\n\n: end\n\n", body)
+
+	for _, last := range []string{"-1", "ten"} {
+		code, _ = get("last="+last, "")
+		r.Equal(http.StatusBadRequest, code, last)
+	}
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceFrom(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:  "/",
+				Capacity: 3,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// [0, 1, 2, 3, 4, 5], of which only [3, 4, 5] are still available.
+	for i := 0; i < 6; i++ {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	get := func(ctx context.Context, query, lastEventID string) (int, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/?limit=1&"+query, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		s.handleFunc(s.routes["/"], w, req)
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get(context.Background(), "from=4", "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 4\ndata: {\"event\":4}\n\n: end\n\n", body)
+
+	// An offset which is no longer available starts from the oldest available offset.
+	code, body = get(context.Background(), "from=0", "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 3\ndata: {\"event\":3}\n\n: end\n\n", body)
+
+	// An offset ahead of the log only streams new events.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	code, body = get(ctx, "from=100", "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\n", body)
+
+	// "from" takes precedence over "last" and "since".
+	code, body = get(context.Background(), "from=4&last=1&since=1970-01-01T00%3A00%3A00.000Z", "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 4\ndata: {\"event\":4}\n\n: end\n\n", body)
+
+	// Last-Event-ID takes precedence over "from".
+	code, body = get(context.Background(), "from=3", "4")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 5\ndata: {\"event\":5}\n\n: end\n\n", body)
+
+	for _, from := range []string{"-1", "ten"} {
+		code, _ = get(context.Background(), "from="+from, "")
+		r.Equal(http.StatusBadRequest, code, from)
+	}
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceBatch(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(query, accept string) (int, string, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		req.Header.Set("Accept", accept)
+		s.handleFunc(s.routes["/"], w, req)
+		return w.Code, w.Header().Get("Content-Type"), w.Body.String()
+	}
+
+	code, contentType, body := get("since=1970-01-01T00%3A00%3A00Z", "application/json")
+	r.Equal(http.StatusOK, code)
+	r.Equal("application/json", contentType)
+	r.Equal("[]", body)
+
+	for i, event := range []string{`{"event":0}`, `not json`, `{"event":2}`, `{"event":3}`} {
+		err = s.routes["/"].t2o.Add(i, time.Unix(int64(i), 0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(event))
+		r.NoError(err)
+	}
+
+	// Events which aren't JSON are skipped.
+	code, _, body = get("since=1970-01-01T00%3A00%3A00Z", "application/json")
+	r.Equal(http.StatusOK, code)
+	r.Equal(`[{"event":0},{"event":2},{"event":3}]`, body)
+
+	// "until" excludes events at or after it.
+	code, _, body = get("since=1970-01-01T00%3A00%3A01Z&until=1970-01-01T00%3A00%3A03Z", "application/json")
+	r.Equal(http.StatusOK, code)
+	r.Equal(`[{"event":2}]`, body)
+
+	// "since" after every event doesn't replay the latest one.
+	code, _, body = get("since=1970-01-01T00%3A00%3A10Z", "application/json")
+	r.Equal(http.StatusOK, code)
+	r.Equal("[]", body)
+
+	code, _, body = get("last=2&limit=1", "application/json, text/event-stream")
+	r.Equal(http.StatusOK, code)
+	r.Equal(`[{"event":2}]`, body)
+
+	// EventSource clients still get an event stream.
+	code, contentType, _ = get("limit=1", "text/event-stream, application/json")
+	r.Equal(http.StatusOK, code)
+	r.Equal("text/event-stream", contentType)
+
+	code, _, _ = get("since=tomorrow", "application/json")
+	r.Equal(http.StatusBadRequest, code)
+
+	// Clients which accept none of our modes are rejected.
+	code, _, _ = get("limit=1", "application/xml")
+	r.Equal(http.StatusNotAcceptable, code)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceNDJSON(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:           "/",
+				RetryMillis:       5000,
+				HeartbeatInterval: time.Millisecond,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for i, event := range []string{"{\n  \"event\": 0\n}", `not json`, `{"event":2}`} {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(event))
+		r.NoError(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=2&end_marker=true&schema=true", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	s.handleFunc(s.routes["/"], w, req)
+
+	// Each JSON event is compacted onto its own line, without any SSE framing, and events which aren't JSON are skipped.
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("application/x-ndjson", w.Header().Get("Content-Type"))
+	r.Equal("{\"event\":0}\n{\"event\":2}\n", w.Body.String())
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceMaxConnectionDuration(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		MaxConnectionDuration: 50 * time.Millisecond,
+		disableKCL:            true,
+		Logger:                slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	// The stream would otherwise stay open, waiting for more events.
+	start := time.Now()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z", nil)
+	s.handleFunc(s.routes["/"], w, req)
+
+	r.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", w.Body.String())
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceMaxConnections(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern:        "/",
+				MaxConnections: 1,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	first, err := http.Get(fmt.Sprintf("http://%s", addr.String()))
+	r.NoError(err)
+	r.Equal(http.StatusOK, first.StatusCode)
+
+	// The route is full, so further streams are rejected.
+	second, err := http.Get(fmt.Sprintf("http://%s", addr.String()))
+	r.NoError(err)
+	r.NoError(second.Body.Close())
+	r.Equal(http.StatusServiceUnavailable, second.StatusCode)
+	retryAfter, err := strconv.Atoi(second.Header.Get("Retry-After"))
+	r.NoError(err)
+	r.GreaterOrEqual(retryAfter, DefaultConnectionLimitRetryAfter)
+	r.LessOrEqual(retryAfter, 2*DefaultConnectionLimitRetryAfter)
+
+	// Once the first client disconnects, its slot is released.
+	r.NoError(first.Body.Close())
+	r.Eventually(func() bool {
+		third, err := http.Get(fmt.Sprintf("http://%s?limit=1&last=0", addr.String()))
+		if err != nil {
+			return false
+		}
+		_ = third.Body.Close()
+		return third.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceMetrics(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+	s.routes["/"].stats.ingested(1, time.Now())
+	s.routes["/"].stats.skipped(map[skipReason]int{skipUnparseableJSON: 2})
+	s.routes["/"].stats.dropped(1)
+	s.routes["/"].stats.behind("shardId-000000000000", 1500*time.Millisecond)
+	s.routes["/"].stats.behind("shardId-000000000001", 0)
+
+	w := httptest.NewRecorder()
+	s.handleFunc(s.routes["/"], w, httptest.NewRequest(http.MethodGet, "/?limit=1", nil))
+	r.Equal(http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	r.Equal(http.StatusOK, w.Code)
+
+	body := w.Body.String()
+	r.Contains(body, `kinesis2sse_active_connections{route="/"} 0`)
+	r.Contains(body, `kinesis2sse_connections_total{route="/"} 1`)
+	r.Contains(body, `kinesis2sse_events_ingested_total{route="/"} 1`)
+	r.Contains(body, `kinesis2sse_events_skipped_total{route="/"} 2`)
+	r.Contains(body, `kinesis2sse_events_skipped_by_reason_total{reason="unparseable_json",route="/"} 2`)
+	r.Contains(body, `kinesis2sse_events_dropped_total{route="/"} 1`)
+	r.Contains(body, `kinesis2sse_events_delivered_total{route="/"} 1`)
+	r.Contains(body, `kinesis2sse_capacity{route="/"} 100000`)
+	r.Contains(body, `kinesis2sse_earliest_offset{route="/"} 0`)
+	r.Contains(body, `kinesis2sse_latest_offset{route="/"} 0`)
+	r.Contains(body, `kinesis2sse_events_retained{route="/"} 1`)
+	r.Contains(body, `kinesis2sse_events_evicted_total{route="/"} 0`)
+	r.Contains(body, `kinesis2sse_millis_behind_latest{route="/"} 1500`)
+	r.Contains(body, `kinesis2sse_shard_millis_behind_latest{route="/",shard="shardId-000000000000"} 1500`)
+	r.Contains(body, `kinesis2sse_shard_millis_behind_latest{route="/",shard="shardId-000000000001"} 0`)
+	r.Contains(body, "go_goroutines")
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceTLS(t *testing.T) {
+	r := require.New(t)
+
+	// Generate a self-signed certificate for localhost.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	r.NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	r.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	r.NoError(err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	r.NoError(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	r.NoError(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	_, err = NewService(ServiceOptions{
+		TLSCertFile: certFile,
+		disableKCL:  true,
+		Logger:      slog.New(slog.DiscardHandler),
+	})
+	r.Error(err)
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		disableKCL:  true,
+		Logger:      slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	cert, err := x509.ParseCertificate(der)
+	r.NoError(err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/health", addr.Port))
+	r.NoError(err)
+	r.NoError(resp.Body.Close())
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceAPIKeys(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+				APIKeys: []string{"key1", "key2"},
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(query, authorization string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		req.Header.Set("Accept", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		s.handleFunc(s.routes["/"], w, req)
+		return w.Code
+	}
+
+	r.Equal(http.StatusUnauthorized, get("", ""))
+	r.Equal(http.StatusUnauthorized, get("", "Bearer wrong"))
+	r.Equal(http.StatusUnauthorized, get("api_key=wrong", ""))
+	r.Equal(http.StatusOK, get("", "Bearer key1"))
+	r.Equal(http.StatusOK, get("", "Bearer key2"))
+	r.Equal(http.StatusOK, get("api_key=key2", ""))
+
+	// The Authorization header takes precedence over the query parameter.
+	r.Equal(http.StatusUnauthorized, get("api_key=key1", "Bearer wrong"))
+
+	// /health remains unauthenticated.
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	r.Equal(http.StatusOK, w.Code)
+}
+
+func TestServiceHost(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Host: "127.0.0.1",
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	// Addr reports the host we bound to, along with the random port.
+	addr, err := waitForStart(s)
+	r.NoError(err)
+	r.Equal("127.0.0.1", addr.IP.String())
+	r.NotZero(addr.Port)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceServerTimeouts(t *testing.T) {
+	r := require.New(t)
+
+	_, err := NewService(ServiceOptions{
+		ReadTimeout: -time.Second,
+		disableKCL:  true,
+		Logger:      slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, "server timeouts must be non-negative")
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		ReadTimeout:        50 * time.Millisecond,
+		IdleTimeout:        time.Minute,
+		DisableCompression: true,
+		disableKCL:         true,
+		Logger:             slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+	r.Equal(DefaultReadHeaderTimeout, s.srv.ReadHeaderTimeout)
+	r.Equal(50*time.Millisecond, s.srv.ReadTimeout)
+	r.Equal(time.Minute, s.srv.IdleTimeout)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/?limit=1", addr.String()))
+	r.NoError(err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	// The stream outlives the ReadTimeout.
+	time.Sleep(200 * time.Millisecond)
+	err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	body, err := io.ReadAll(resp.Body)
+	r.NoError(err)
+	r.Equal(": ok\n\n: no data yet\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", string(body))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceStopTimeout(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		DisableCompression: true,
+		disableKCL:         true,
+		Logger:             slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s", addr.String()))
+	r.NoError(err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	r.Equal(http.StatusOK, resp.StatusCode)
+
+	// The stream never ends on its own, so Stop gives up once its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Stop(ctx)
+	r.ErrorIs(err, context.DeadlineExceeded)
+
+	// And the stream is ended, advising the client when to reconnect.
+	body, err := io.ReadAll(resp.Body)
+	r.NoError(err)
+	r.Regexp(`\nretry: \d+\n\n: end\n\n$`, string(body))
+}
+
+func TestServiceReady(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/a",
+			},
+			{
+				Pattern: "/b",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	// /health is alive from the start, but /ready waits for every route to start consuming.
+	r.Equal(http.StatusOK, get("/health"))
+	r.Equal(http.StatusServiceUnavailable, get("/ready"))
+
+	s.routes["/a"].readiness.initialized("shard-0")
+	s.routes["/a"].readiness.processed("shard-0")
+	r.Equal(http.StatusServiceUnavailable, get("/ready"))
+
+	s.routes["/b"].readiness.initialized("shard-0")
+	s.routes["/b"].readiness.processed("shard-0")
+	r.Equal(http.StatusOK, get("/ready"))
+}
+
+func TestServiceCheckpointing(t *testing.T) {
+	r := require.New(t)
+
+	newService := func(checkpointing Checkpointing, checkpointFile string, routeCheckpointing Checkpointing) error {
+		_, err := NewService(ServiceOptions{
+			Routes: []RouteOptions{
+				{
+					Pattern:       "/",
+					KCLConfig:     cfg.NewKinesisClientLibConfig("kinesis2sse-test", "test-stream", "us-east-2", "worker"),
+					Checkpointing: routeCheckpointing,
+				},
+			},
+			Checkpointing:  checkpointing,
+			CheckpointFile: checkpointFile,
+			Logger:         slog.New(slog.DiscardHandler),
+		})
+		return err
+	}
+
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+
+	r.NoError(newService("", "", ""))
+	r.NoError(newService(CheckpointingInMemory, "", ""))
+	r.NoError(newService(CheckpointingDynamoDB, "", ""))
+	r.NoError(newService(CheckpointingFile, path, ""))
+	r.NoError(newService(CheckpointingNone, "", ""))
+	r.EqualError(newService("unknown", "", ""), `unknown checkpointing "unknown"`)
+
+	// A checkpoint file implies CheckpointingFile, and CheckpointingFile requires one.
+	r.NoError(newService("", path, ""))
+	r.Error(newService(CheckpointingFile, "", ""))
+
+	// Routes may checkpoint differently than the default, including to the checkpoint file.
+	r.NoError(newService(CheckpointingFile, path, CheckpointingNone))
+	r.NoError(newService(CheckpointingDynamoDB, path, CheckpointingFile))
+	r.EqualError(newService("", "", CheckpointingFile), `route "/": checkpoint file must be set if checkpointing to a file`)
+	r.EqualError(newService("", "", "unknown"), `route "/": unknown checkpointing "unknown"`)
+}
+
+func TestFormatData(t *testing.T) {
+	r := require.New(t)
+
+	for data, expected := range map[string]string{
+		`{"hello":"world"}`:     `{"hello":"world"}`,
+		"{\n  \"hello\": 1\n}":  "{\ndata:   \"hello\": 1\ndata: }",
+		"line 1\r\nline 2\rend": "line 1\ndata: line 2\ndata: end",
+	} {
+		r.Equal(expected, formatData([]byte(data)), data)
+	}
+}
+
+func TestServiceBinary(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:        "/",
+				Binary:         true,
+				EventNameField: "name",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for i, event := range [][]byte{{0x00, 0xff, '\n'}, []byte(`{"name":"json"}`)} {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), event)
+		r.NoError(err)
+	}
+
+	get := func(accept string) string {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=2&schema=true&filter=name%3D%3Dother", nil)
+		req.Header.Set("Accept", accept)
+		s.handleFunc(s.routes["/"], w, req)
+		r.Equal(http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	// Events are base64-encoded, even if they're JSON, and schemas, filters, and event names don't apply.
+	r.Equal(": ok\n\nid: 0\ndata: AP8K\n\nid: 1\ndata: eyJuYW1lIjoianNvbiJ9\n\n: end\n\n", get("text/event-stream"))
+	r.Equal("\"AP8K\"\n\"eyJuYW1lIjoianNvbiJ9\"\n", get("application/x-ndjson"))
+	r.Equal(`["AP8K","eyJuYW1lIjoianNvbiJ9"]`, get("application/json"))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceAddRemoveRoute(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/a",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	r.Equal(http.StatusNotFound, get("/b"))
+
+	err = s.AddRoute(RouteOptions{Pattern: "/b"})
+	r.NoError(err)
+	r.Equal(http.StatusOK, get("/b"))
+
+	// Patterns must be unique, including among the service's own endpoints.
+	r.Error(s.AddRoute(RouteOptions{Pattern: "/b"}))
+	r.Error(s.AddRoute(RouteOptions{Pattern: "/health"}))
+	r.Len(s.routesSnapshot(), 2)
+
+	rt := s.routes["/b"]
+	err = rt.t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = rt.ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/b?since=1970-01-01T00%3A00%3A00Z", nil))
+	}()
+	r.Eventually(func() bool { return len(rt.connections.list()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// Removing the route ends its open streams.
+	err = s.RemoveRoute("/b")
+	r.NoError(err)
+	<-done
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", w.Body.String())
+
+	r.Equal(http.StatusNotFound, get("/b"))
+	r.Equal(http.StatusOK, get("/a"))
+	r.Error(s.RemoveRoute("/b"))
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+
+	r.Error(s.AddRoute(RouteOptions{Pattern: "/c"}))
+}
+
+func TestServiceAccessLog(t *testing.T) {
+	r := require.New(t)
+
+	var logs bytes.Buffer
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	r.NoError(err)
+
+	err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=1", nil)
+	s.handleFunc(s.routes["/"], w, req)
+
+	var lines []map[string]any
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var line map[string]any
+		r.NoError(decoder.Decode(&line))
+		lines = append(lines, line)
+	}
+	r.Len(lines, 2)
+
+	opened, closed := lines[0], lines[1]
+	r.Equal("Connection opened", opened["msg"])
+	r.Equal("DEBUG", opened["level"])
+	r.Equal("Connection closed", closed["msg"])
+	r.Equal("INFO", closed["level"])
+
+	r.NotEmpty(opened["requestId"])
+	r.Equal(opened["requestId"], closed["requestId"])
+	for _, line := range lines {
+		r.Equal("/", line["route"])
+		r.Equal(req.RemoteAddr, line["remoteAddr"])
+		r.Equal("1970-01-01T00:00:00Z", line["since"])
+		r.Equal("", line["lastEventId"])
+	}
+
+	r.NotEmpty(closed["duration"])
+	r.EqualValues(1, closed["eventsDelivered"])
+	r.Equal("limit reached", closed["reason"])
+}
+
+func TestServiceMaxLag(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+				MaxLag:  2,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(query string) string {
+		w := httptest.NewRecorder()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		return w.Body.String()
+	}
+
+	for i := 0; i < 3; i++ {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	// Two events behind is within MaxLag.
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\n: end\n\n", get("since=1970-01-01T00%3A00%3A00Z&limit=2"))
+
+	err = s.routes["/"].t2o.Add(3, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":3}`))
+	r.NoError(err)
+
+	// But three events behind is not, and the client is advised to reconnect after a jittered delay.
+	r.Regexp(`^: ok\n\nretry: \d+\n\n: overloaded\n\n$`, get("since=1970-01-01T00%3A00%3A00Z&limit=2"))
+
+	_, err = NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/", MaxLag: -1}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.Error(err)
+}
+
+func TestServiceIncludeTimestamp(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	err = s.routes["/"].t2o.Add(0, time.UnixMilli(1_500))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	get := func(query string) (int, string) {
+		w := httptest.NewRecorder()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=1&"+query, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("include_timestamp=true")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\n: timestamp 1970-01-01T00:00:01.500Z\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", body)
+
+	code, body = get("include_timestamp=false")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", body)
+
+	code, _ = get("include_timestamp=bogus")
+	r.Equal(http.StatusBadRequest, code)
+}
+
+func TestServiceIncludeSequence(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// Event 0 came from Kinesis, whereas event 1 was added without a sequence number, like a backfilled event.
+	err = s.routes["/"].t2o.AddWithSequenceNumber(0, time.UnixMilli(1_500), "49590338271490256608559692538361571095921575989136588898")
+	r.NoError(err)
+	err = s.routes["/"].t2o.Add(1, time.UnixMilli(1_500))
+	r.NoError(err)
+	for i := 0; i < 2; i++ {
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	get := func(query string) (int, string) {
+		w := httptest.NewRecorder()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequest(http.MethodGet, "/?from=0&limit=2&"+query, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("include_sequence=true")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\n: sequence 49590338271490256608559692538361571095921575989136588898\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\n: end\n\n", body)
+
+	code, body = get("include_sequence=false")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\n: end\n\n", body)
+
+	// CloudEvents carry it in an extension attribute instead.
+	code, body = get("include_sequence=true&format=cloudevents&limit=1")
+	r.Equal(http.StatusOK, code)
+	r.Contains(body, `"kinesissequence":"49590338271490256608559692538361571095921575989136588898"`)
+
+	code, body = get("format=cloudevents&limit=1")
+	r.Equal(http.StatusOK, code)
+	r.NotContains(body, "kinesissequence")
+
+	code, _ = get("include_sequence=bogus")
+	r.Equal(http.StatusBadRequest, code)
+}
+
+func TestServiceBatchedStream(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for i, event := range []string{`{"event":0}`, `{"event":1}`, `not json`, `{"event":3}`, `{"event":4}`, `{"event":5}`} {
+		err = s.routes["/"].t2o.Add(i, time.Unix(int64(i), 0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(event))
+		r.NoError(err)
+	}
+
+	get := func(ctx context.Context, query string) (int, string) {
+		w := httptest.NewRecorder()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequestWithContext(ctx, http.MethodGet, "/?"+query, nil))
+		return w.Code, w.Body.String()
+	}
+
+	// Each batch's ID is its last event's offset. Events which aren't JSON are skipped, and the last batch is sent early
+	// once the limit is reached.
+	code, body := get(context.Background(), "from=0&limit=5&batch=2")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 1\ndata: [{\"event\":0},{\"event\":1}]\n\nid: 4\ndata: [{\"event\":3},{\"event\":4}]\n\nid: 5\ndata: [{\"event\":5}]\n\n: end\n\n", body)
+	r.Equal(int64(5), s.routes["/"].stats.snapshot(time.Now()).EventsDelivered)
+
+	// A partial batch is sent once batch_delay passes.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	code, body = get(ctx, "from=5&batch=10&batch_delay=10ms")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 5\ndata: [{\"event\":5}]\n\n", body)
+
+	// CloudEvents are batched, too.
+	code, body = get(context.Background(), "from=4&limit=2&batch=2&format=cloudevents")
+	r.Equal(http.StatusOK, code)
+	r.Contains(body, "id: 5\ndata: [{\"specversion\":\"1.0\",\"id\":\"4\",")
+	r.Contains(body, `},{"specversion":"1.0","id":"5",`)
+
+	for _, query := range []string{"batch=0", "batch=-1", "batch=ten", "batch_delay=1s", "batch=2&batch_delay=0s", "batch=2&batch_delay=soon"} {
+		code, _ = get(context.Background(), query)
+		r.Equal(http.StatusBadRequest, code, query)
+	}
+}
+
+func TestServicePretty(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for i, data := range []string{`{"event":0,"tags":["a"]}`, `not json`} {
+		err = s.routes["/"].t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(data))
+		r.NoError(err)
+	}
+
+	get := func(accept, query string) (int, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&"+query, nil)
+		req.Header.Set("Accept", accept)
+		s.handleFunc(s.routes["/"], w, req)
+		return w.Code, w.Body.String()
+	}
+
+	// JSON events span multiple "data" lines. Other events are unchanged.
+	code, body := get("text/event-stream", "limit=2&pretty=true")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\ndata:   \"event\": 0,\ndata:   \"tags\": [\ndata:     \"a\"\ndata:   ]\ndata: }\n\nid: 1\ndata: not json\n\n: end\n\n", body)
+
+	code, body = get("text/event-stream", "limit=2&pretty=false")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0,\"tags\":[\"a\"]}\n\nid: 1\ndata: not json\n\n: end\n\n", body)
+
+	// NDJSON is always single-line.
+	code, body = get("application/x-ndjson", "limit=1&pretty=true")
+	r.Equal(http.StatusOK, code)
+	r.Equal(`{"event":0,"tags":["a"]}`+"\n", body)
+
+	code, body = get("text/event-stream", "limit=1&pretty=true&format=cloudevents")
+	r.Equal(http.StatusOK, code)
+	r.Contains(body, "id: 0\ndata: {\ndata:   \"specversion\": \"1.0\",\n")
+	r.Contains(body, "\ndata:   \"data\": {\ndata:     \"event\": 0,\n")
+
+	code, _ = get("text/event-stream", "pretty=bogus")
+	r.Equal(http.StatusBadRequest, code)
+}
+
+func TestServiceSpeed(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// The events occurred 400ms apart.
+	for i, timestamp := range []time.Time{time.UnixMilli(1_000), time.UnixMilli(1_400)} {
+		err = s.routes["/"].t2o.Add(i, timestamp)
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	get := func(ctx context.Context, query string) (int, string, time.Duration) {
+		w := httptest.NewRecorder()
+		start := time.Now()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequestWithContext(ctx, http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=2&"+query, nil))
+		return w.Code, w.Body.String(), time.Since(start)
+	}
+
+	// By default, events are sent as fast as possible.
+	code, body, elapsed := get(context.Background(), "")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\n: end\n\n", body)
+	r.Less(elapsed, 200*time.Millisecond)
+
+	// With speed=2, they're sent 200ms apart.
+	code, body, elapsed = get(context.Background(), "speed=2")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\n: end\n\n", body)
+	r.GreaterOrEqual(elapsed, 200*time.Millisecond)
+
+	// With speed=0.001, the second event would take almost 7 minutes, but we stop as soon as the client disconnects.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	code, body, elapsed = get(ctx, "speed=0.001")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\n", body)
+	r.Less(elapsed, time.Second)
+
+	for _, speed := range []string{"-1", "bogus", "Inf"} {
+		code, _, _ = get(context.Background(), "speed="+speed)
+		r.Equal(http.StatusBadRequest, code, speed)
+	}
+}
+
+func TestServiceEmptyLog(t *testing.T) {
+	r := require.New(t)
+
+	var logs bytes.Buffer
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	r.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	w := httptest.NewRecorder()
+	s.handleFunc(s.routes["/"], w, httptest.NewRequestWithContext(ctx, http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z", nil))
+
+	// The client learns that there's no data yet, and we log why "since" found nothing.
+	r.Equal(": ok\n\n: no data yet\n\n", w.Body.String())
+	r.Contains(logs.String(), `"msg":"No events since the requested timestamp"`)
+	r.Contains(logs.String(), `"timestamp":"1970-01-01T00:00:00.000Z","empty":true`)
+}
+
+func TestServicePreamble(t *testing.T) {
+	r := require.New(t)
+
+	get := func(options ServiceOptions) string {
+		options.Routes = []RouteOptions{
+			{
+				Pattern:     "/",
+				RetryMillis: 1000,
+			},
+		}
+		options.disableKCL = true
+		options.Logger = slog.New(slog.DiscardHandler)
+
+		s, err := NewService(options)
+		r.NoError(err)
+
+		err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+		r.NoError(err)
+
+		w := httptest.NewRecorder()
+		s.handleFunc(s.routes["/"], w, httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=1", nil))
+		return w.Body.String()
+	}
+
+	r.Equal(": ok\n\nretry: 1000\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", get(ServiceOptions{}))
+	r.Equal(": live\n\nretry: 1000\n\n: hello\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", get(ServiceOptions{Preamble: "live", Greeting: "hello"}))
+	r.Equal("retry: 1000\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", get(ServiceOptions{DisablePreamble: true}))
+
+	_, err := NewService(ServiceOptions{Greeting: "hello\ndata: injected", Logger: slog.New(slog.DiscardHandler)})
+	r.ErrorContains(err, "greeting must be a single line")
+}
+
+func TestServiceRequestID(t *testing.T) {
+	r := require.New(t)
+
+	var logs bytes.Buffer
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		RequestIDComment: true,
+		disableKCL:       true,
+		Logger:           slog.New(slog.NewJSONHandler(&logs, nil)),
+	})
+	r.NoError(err)
+
+	err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	// The request ID injected at the edge is logged, echoed back, and sent in a comment.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=1", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	s.handleFunc(s.routes["/"], w, req)
+	r.Equal("abc123", w.Header().Get("X-Request-Id"))
+	r.Equal(": ok\n\n: request-id abc123\n\nid: 0\ndata: {\"event\":0}\n\n: end\n\n", w.Body.String())
+	r.Contains(logs.String(), `"requestId":"abc123"`)
+
+	// Without one, we generate one.
+	s, err = NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+			},
+		},
+		RequestIDHeader: "traceparent",
+		disableKCL:      true,
+		Logger:          slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+	r.NoError(err)
+	_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+	r.NoError(err)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=1", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	s.handleFunc(s.routes["/"], w, req)
+	_, err = uuid.Parse(w.Header().Get("traceparent"))
+	r.NoError(err)
+	r.Empty(w.Header().Get("X-Request-Id"))
+
+	_, err = NewService(ServiceOptions{RequestIDHeader: "X-Request Id", Logger: slog.New(slog.DiscardHandler)})
+	r.ErrorContains(err, `invalid request ID header "X-Request Id"`)
+}
+
+func TestServiceCloudEvents(t *testing.T) {
+	r := require.New(t)
+
+	newService := func(routeOptions RouteOptions) *Service {
+		routeOptions.Pattern = "/events"
+		routeOptions.KCLConfig = cfg.NewKinesisClientLibConfig("kinesis2sse-test", "test-stream", "us-east-2", "worker")
+		s, err := NewService(ServiceOptions{
+			Routes:     []RouteOptions{routeOptions},
+			disableKCL: true,
+			Logger:     slog.New(slog.DiscardHandler),
+		})
+		r.NoError(err)
+
+		for i, data := range []string{`{"kind":"OrderPlaced"}`, `not json`} {
+			err = s.routes["/events"].t2o.Add(i, time.UnixMilli(1_500))
+			r.NoError(err)
+			_, err = s.routes["/events"].ml.Write(context.Background(), []byte(data))
+			r.NoError(err)
+		}
+
+		return s
+	}
+
+	get := func(s *Service, accept, query string) (int, string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/events?since=1970-01-01T00%3A00%3A00Z&limit=2&"+query, nil)
+		req.Header.Set("Accept", accept)
+		s.handleFunc(s.routes["/events"], w, req)
+		return w.Code, w.Body.String()
+	}
+
+	s := newService(RouteOptions{CloudEventsTypeField: "kind", RawPassthrough: true})
+
+	placed := `{"specversion":"1.0","id":"0","source":"test-stream","type":"OrderPlaced","time":"1970-01-01T00:00:01.500Z","datacontenttype":"application/json","data":{"kind":"OrderPlaced"}}`
+	text := `{"specversion":"1.0","id":"1","source":"test-stream","type":"kinesis2sse.event","time":"1970-01-01T00:00:01.500Z","datacontenttype":"text/plain","data":"not json"}`
+
+	code, body := get(s, "text/event-stream", "format=cloudevents")
+	r.Equal(http.StatusOK, code)
+	r.Equal(": ok\n\nid: 0\ndata: "+placed+"\n\nid: 1\ndata: "+text+"\n\n: end\n\n", body)
+
+	code, body = get(s, "application/x-ndjson", "format=cloudevents")
+	r.Equal(http.StatusOK, code)
+	r.Equal(placed+"\n"+text+"\n", body)
+
+	code, body = get(s, "application/json", "format=cloudevents")
+	r.Equal(http.StatusOK, code)
+	r.Equal("["+placed+","+text+"]", body)
+
+	// Binary events are base64-encoded.
+	s = newService(RouteOptions{Binary: true})
+	code, body = get(s, "application/x-ndjson", "format=cloudevents")
+	r.Equal(http.StatusOK, code)
+	r.Equal(`{"specversion":"1.0","id":"0","source":"test-stream","type":"kinesis2sse.event","time":"1970-01-01T00:00:01.500Z","datacontenttype":"application/octet-stream","data_base64":"eyJraW5kIjoiT3JkZXJQbGFjZWQifQ=="}`+"\n"+
+		`{"specversion":"1.0","id":"1","source":"test-stream","type":"kinesis2sse.event","time":"1970-01-01T00:00:01.500Z","datacontenttype":"application/octet-stream","data_base64":"bm90IGpzb24="}`+"\n", body)
+
+	code, _ = get(s, "text/event-stream", "format=bogus")
+	r.Equal(http.StatusBadRequest, code)
+}
+
+func TestServiceLagLog(t *testing.T) {
+	r := require.New(t)
+
+	var logs bytes.Buffer
+	var lock sync.Mutex
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/a",
+			},
+			{
+				Pattern: "/b",
+			},
+		},
+		LagLogInterval: 10 * time.Millisecond,
+		disableKCL:     true,
+		Logger:         slog.New(slog.NewJSONHandler(&lockedWriter{w: &logs, lock: &lock}, nil)),
+	})
+	r.NoError(err)
+
+	s.routes["/a"].stats.behind("shardId-000000000000", 2*time.Second)
+	s.routes["/a"].stats.behind("shardId-000000000001", time.Second)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.logLag()
+	}()
+
+	r.Eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return logs.Len() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+	<-done
+
+	// Only /a has reported on any shards.
+	var line map[string]any
+	r.NoError(json.NewDecoder(&logs).Decode(&line))
+	r.Equal("Consumer lag", line["msg"])
+	r.Equal("INFO", line["level"])
+	r.Equal("/a", line["route"])
+	r.EqualValues(2000, line["millisBehindLatest"])
+	r.Equal(map[string]any{"shardId-000000000000": 2000.0, "shardId-000000000001": 1000.0}, line["shards"])
+}
+
+func TestServiceLogSkipped(t *testing.T) {
+	r := require.New(t)
+
+	var logs bytes.Buffer
+	s, err := NewService(ServiceOptions{
+		disableKCL: true,
+		Logger:     slog.New(slog.NewJSONHandler(&logs, nil)),
+	})
+	r.NoError(err)
+
+	previous := RouteStats{EventsIngested: 10, EventsSkipped: 1, EventsSkippedByReason: map[string]int64{"missing_time": 1}}
+
+	// Nothing is logged if nothing was skipped since the previous snapshot.
+	s.logSkipped("/", previous, previous)
+	r.Zero(logs.Len())
+
+	s.logSkipped("/", RouteStats{EventsIngested: 13, EventsSkipped: 10, EventsSkippedByReason: map[string]int64{"missing_time": 2, "unparseable_json": 8}}, previous)
+
+	var line map[string]any
+	r.NoError(json.NewDecoder(&logs).Decode(&line))
+	r.Equal("Skipped events", line["msg"])
+	r.Equal("WARN", line["level"])
+	r.Equal("/", line["route"])
+	r.EqualValues(9, line["skipped"])
+	r.EqualValues(3, line["ingested"])
+	r.EqualValues(75, line["skippedPercent"])
+	r.Equal(map[string]any{"missing_time": 1.0, "unparseable_json": 8.0}, line["reasons"])
+}
+
+// lockedWriter serializes writes, so that a test can read what was written while a goroutine logs.
+type lockedWriter struct {
+	w    io.Writer
+	lock *sync.Mutex
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.w.Write(p)
+}
+
+func TestServiceFanIn(t *testing.T) {
+	r := require.New(t)
+
+	kclConfig := func(stream string) *cfg.KinesisClientLibConfiguration {
+		return cfg.NewKinesisClientLibConfig("kinesis2sse-test", stream, "us-east-2", "worker")
+	}
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:              "/events",
+				KCLConfig:            kclConfig("events-a"),
+				AdditionalKCLConfigs: []*cfg.KinesisClientLibConfiguration{kclConfig("events-b")},
+			},
+		},
+		Logger: slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// Each stream gets its own KCL worker, feeding the same route.
+	rt := s.routes["/events"]
+	r.Equal([]string{"events-a", "events-b"}, rt.streams)
+	r.Len(rt.workers, 2)
+	r.Equal("events-a", rt.workers[0].stream)
+	r.Equal("events-b", rt.workers[1].stream)
+
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	r.Equal(`[{"pattern":"/events","stream":"events-a","additionalStreams":["events-b"]}]`+"\n", w.Body.String())
+
+	// Their shards are tracked separately, even though their IDs collide.
+	for _, stream := range rt.streams {
+		rp := &dumpRecordProcessor{stats: rt.stats, readiness: rt.readiness, shardPrefix: stream + "/", logger: slog.New(slog.DiscardHandler)}
+		rp.Initialize(&kc.InitializationInput{ShardId: "shardId-000000000000", ExtendedSequenceNumber: &kc.ExtendedSequenceNumber{}})
+		rp.ProcessRecords(&kc.ProcessRecordsInput{MillisBehindLatest: 1000})
+	}
+	r.Equal(map[string]time.Duration{"events-a/shardId-000000000000": time.Second, "events-b/shardId-000000000000": time.Second}, rt.stats.shardLags())
+
+	_, err = NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:              "/",
+				KCLConfig:            kclConfig("events-a"),
+				AdditionalKCLConfigs: []*cfg.KinesisClientLibConfiguration{kclConfig("events-a")},
+			},
+		},
+		Logger: slog.New(slog.DiscardHandler),
+	})
+	r.ErrorContains(err, `stream "events-a" feeds the route more than once`)
+}
+
+func TestServiceIndex(t *testing.T) {
+	r := require.New(t)
+
+	newService := func(disableIndex bool, patterns ...string) *Service {
+		var routes []RouteOptions
+		for _, pattern := range patterns {
+			routes = append(routes, RouteOptions{
+				Pattern:   pattern,
+				KCLConfig: cfg.NewKinesisClientLibConfig("kinesis2sse-test", "stream"+pattern, "us-east-2", "worker"),
+			})
+		}
+
+		s, err := NewService(ServiceOptions{
+			Routes:       routes,
+			DisableIndex: disableIndex,
+			disableKCL:   true,
+			Logger:       slog.New(slog.DiscardHandler),
+		})
+		r.NoError(err)
+		return s
+	}
+
+	get := func(s *Service, path string) (int, string) {
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	s := newService(false, "/b", "/a")
+	index := `[{"pattern":"/a","stream":"stream/a"},{"pattern":"/b","stream":"stream/b"}]` + "\n"
+
+	code, body := get(s, "/")
+	r.Equal(http.StatusOK, code)
+	r.Equal(index, body)
+
+	code, body = get(s, "/c")
+	r.Equal(http.StatusNotFound, code)
+	r.Equal(index, body)
+
+	s = newService(true, "/b", "/a")
+	code, body = get(s, "/")
+	r.Equal(http.StatusNotFound, code)
+	r.Equal("404 page not found\n", body)
+
+	// A route may claim "/" for itself.
+	s = newService(false, "/")
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	s.srv.Handler.ServeHTTP(w, req)
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("[]", w.Body.String())
+}
+
+func TestServiceWorkerStartOptions(t *testing.T) {
+	r := require.New(t)
+
+	_, err := NewService(ServiceOptions{
+		WorkerStartAttempts: -1,
+		disableKCL:          true,
+		Logger:              slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, "worker start attempts must be non-negative")
+
+	_, err = NewService(ServiceOptions{
+		WorkerStartRetryDelay: -time.Second,
+		disableKCL:            true,
+		Logger:                slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, "worker start retry delay must be non-negative")
+
+	s, err := NewService(ServiceOptions{
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+	r.Equal(DefaultWorkerStartAttempts, s.workerStartAttempts)
+	r.Equal(DefaultWorkerStartRetryDelay, s.workerStartRetryDelay)
+
+	s, err = NewService(ServiceOptions{
+		WorkerStartAttempts:   5,
+		WorkerStartRetryDelay: 100 * time.Millisecond,
+		disableKCL:            true,
+		Logger:                slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+	r.Equal(5, s.workerStartAttempts)
+	r.Equal(100*time.Millisecond, s.workerStartRetryDelay)
+}
+
+func TestServiceVersion(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Version:    "v1.2.3",
+		Commit:     "abc123",
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("application/json", w.Header().Get("Content-Type"))
+
+	var version VersionInfo
+	r.NoError(json.Unmarshal(w.Body.Bytes(), &version))
+	r.Equal(VersionInfo{Version: "v1.2.3", Commit: "abc123", GoVersion: runtime.Version()}, version)
+
+	// Routes can't claim the endpoint.
+	_, err = NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/version"}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.ErrorContains(err, "conflicts with the built-in /version endpoint")
+}
+
+func TestServiceViewer(t *testing.T) {
+	r := require.New(t)
+
+	// The viewer is disabled by default.
+	s, err := NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/events"}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/viewer", nil))
+	r.Equal(http.StatusNotFound, w.Code)
+
+	s, err = NewService(ServiceOptions{
+		Routes:       []RouteOptions{{Pattern: "/events"}, {Pattern: "GET /other"}},
+		EnableViewer: true,
+		disableKCL:   true,
+		Logger:       slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	w = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/viewer", nil))
+	r.Equal(http.StatusOK, w.Code)
+	r.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	r.Contains(w.Body.String(), `<option value="/events">/events</option>`)
+	r.Contains(w.Body.String(), `<option value="/other">/other</option>`)
+	r.Contains(w.Body.String(), "new EventSource(url)")
+
+	// Routes can't claim the endpoint.
+	_, err = NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/viewer"}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.ErrorContains(err, "conflicts with the built-in /viewer endpoint")
+}
+
+func TestServiceEncoding(t *testing.T) {
+	r := require.New(t)
+
+	_, err := NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/", Encoding: "zstd"}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.ErrorContains(err, `unknown encoding "zstd"`)
+
+	for _, encoding := range []Encoding{EncodingGzip, EncodingSnappy} {
+		s, err := NewService(ServiceOptions{
+			Routes:     []RouteOptions{{Pattern: "/", Encoding: encoding}},
+			disableKCL: true,
+			Logger:     slog.New(slog.DiscardHandler),
+		})
+		r.NoError(err)
+
+		// Events are stored compressed, as the record processor would write them.
+		rt := s.routes["/"]
+		for i := 0; i < 2; i++ {
+			err = rt.t2o.Add(i, time.Unix(int64(i), 0))
+			r.NoError(err)
+			data, err := encoding.encode([]byte(fmt.Sprintf(`{"event":%d}`, i)))
+			r.NoError(err)
+			_, err = rt.ml.Write(context.Background(), data)
+			r.NoError(err)
+		}
+
+		// …but served decompressed, whether streamed…
+		w := httptest.NewRecorder()
+		s.handleFunc(rt, w, httptest.NewRequest(http.MethodGet, "/?from=0&limit=2", nil))
+		r.Equal(http.StatusOK, w.Code, encoding)
+		r.Equal(": ok\n\nid: 0\ndata: {\"event\":0}\n\nid: 1\ndata: {\"event\":1}\n\n: end\n\n", w.Body.String(), encoding)
+
+		// …or batched.
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?from=0", nil)
+		req.Header.Set("Accept", "application/json")
+		s.handleFunc(rt, w, req)
+		r.Equal(http.StatusOK, w.Code, encoding)
+		r.Equal(`[{"event":0},{"event":1}]`, w.Body.String(), encoding)
+	}
+}
+
+// waitForStart blocks until s has started its KCL workers, and returns its address. Since s listens before it starts
+// them, s.Addr alone doesn't guarantee that its routes are serving.
+func waitForStart(s *Service) (*net.TCPAddr, error) {
+	addr, err := s.Addr()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		s.changeLock.Lock()
+		started := s.started
+		s.changeLock.Unlock()
+		if started {
+			return addr, nil
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServiceStartingUp(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/events"}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	// Holding changeLock stalls Start after it starts listening, but before it starts the KCL workers.
+	s.changeLock.Lock()
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := s.Addr()
+	r.NoError(err)
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", addr.String(), path), nil)
+		r.NoError(err)
+		req.Header.Set("Accept", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		r.NoError(err)
+		r.NoError(res.Body.Close())
+		return res
+	}
+
+	// Clients can connect, but the routes aren't serving yet, and the service isn't ready.
+	res := get("/events")
+	r.Equal(http.StatusServiceUnavailable, res.StatusCode)
+	r.Contains([]string{"1", "2"}, res.Header.Get("Retry-After"))
+	r.Equal(http.StatusServiceUnavailable, get("/ready").StatusCode)
+	r.Equal(http.StatusOK, get("/health").StatusCode)
+
+	s.changeLock.Unlock()
+	_, err = waitForStart(s)
+	r.NoError(err)
+
+	r.Equal(http.StatusOK, get("/events").StatusCode)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceDrain(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/events"}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	addr, err := waitForStart(s)
+	r.NoError(err)
+
+	url := fmt.Sprintf("http://%s/events", addr.String())
+
+	get := func(path string) int {
+		res, err := http.Get(fmt.Sprintf("http://%s%s", addr.String(), path))
+		r.NoError(err)
+		r.NoError(res.Body.Close())
+		return res.StatusCode
+	}
+
+	// With no streams, draining completes immediately.
+	r.NoError(s.Drain(context.Background()))
+	r.Equal(http.StatusServiceUnavailable, get("/events"))
+	r.Equal(http.StatusServiceUnavailable, get("/ready"))
+	r.Equal(http.StatusOK, get("/health"))
+
+	// A stream which was open before draining keeps flowing, until draining times out.
+	s.draining.Store(false)
+	res, err := http.Get(url)
+	r.NoError(err)
+	defer func() { _ = res.Body.Close() }()
+	r.Equal(http.StatusOK, res.StatusCode)
+
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadString('\n')
+	r.NoError(err)
+	r.Equal(": ok\n", line)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() {
+		drained <- s.Drain(ctx)
+	}()
+
+	r.NoError(s.routes["/events"].t2o.Add(0, time.UnixMilli(0)))
+	_, err = s.routes["/events"].ml.Write(context.Background(), []byte(`{"hello":"world"}`))
+	r.NoError(err)
+
+	body, err := io.ReadAll(reader)
+	r.NoError(err)
+	r.Contains(string(body), `data: {"hello":"world"}`)
+	r.Regexp(`\nretry: \d+\n\n: end\n\n$`, string(body))
+
+	err = <-drained
+	r.ErrorIs(err, context.DeadlineExceeded)
+	r.EqualError(err, "timed out waiting for 1 connections to close: context deadline exceeded")
+
+	r.NoError(s.Stop(context.Background()))
+}
+
+func TestServiceCapacityValidation(t *testing.T) {
+	r := require.New(t)
+
+	newService := func(memoryBudget int, routes ...RouteOptions) (*Service, error) {
+		return NewService(ServiceOptions{
+			Routes:       routes,
+			MemoryBudget: memoryBudget,
+			disableKCL:   true,
+			Logger:       slog.New(slog.DiscardHandler),
+		})
+	}
+
+	_, err := newService(0, RouteOptions{Pattern: "/", Capacity: -1})
+	r.EqualError(err, `route "/": capacity must be non-negative`)
+
+	// The largest capacity preallocates at most MaxPreallocatedBytes, rather than crashing the process.
+	r.LessOrEqual(MaxCapacity*memoryPerEvent, MaxPreallocatedBytes)
+	_, err = newService(0, RouteOptions{Pattern: "/", Capacity: MaxCapacity + 1})
+	r.EqualError(err, fmt.Sprintf(`route "/": capacity must be at most %d`, MaxCapacity))
+
+	// Larger events would be rejected by the memlog anyway.
+	_, err = newService(0, RouteOptions{Pattern: "/", MaxEventBytes: memlog.DefaultMaxRecordDataBytes + 1})
+	r.EqualError(err, fmt.Sprintf(`route "/": max event bytes must be at most %d`, memlog.DefaultMaxRecordDataBytes))
+
+	// The estimate only overflows an int on 32-bit platforms.
+	if math.MaxInt == math.MaxInt32 {
+		_, err = newService(0, RouteOptions{Pattern: "/", Capacity: MaxCapacity, MaxEventBytes: memlog.DefaultMaxRecordDataBytes})
+		r.EqualError(err, `route "/": capacity and max event bytes take more memory than can be addressed`)
+	}
+
+	// Each route's estimated memory, including up to twice its capacity of events' data, counts against the budget.
+	const capacity, maxEventBytes = 1000, 1 << 10
+	memory := capacity * (memoryPerEvent + 2*maxEventBytes)
+	routeOptions := func(pattern string) RouteOptions {
+		return RouteOptions{Pattern: pattern, Capacity: capacity, MaxEventBytes: maxEventBytes}
+	}
+
+	s, err := newService(2*memory, routeOptions("/a"), routeOptions("/b"))
+	r.NoError(err)
+
+	_, err = newService(2*memory, routeOptions("/a"), routeOptions("/b"), routeOptions("/c"))
+	r.EqualError(err, fmt.Sprintf(`route "/c": capacity takes an estimated %d bytes, but only 0 of the %d-byte memory budget remain`, memory, 2*memory))
+
+	_, err = newService(2*memory, RouteOptions{Pattern: "/", Capacity: capacity})
+	r.EqualError(err, `route "/": max event bytes must be set to fit within the memory budget`)
+
+	// Removing a route frees its share of the budget.
+	r.ErrorContains(s.AddRoute(routeOptions("/c")), `route "/c": capacity takes an estimated`)
+	r.NoError(s.RemoveRoute("/b"))
+	r.NoError(s.AddRoute(routeOptions("/c")))
+}
+
+func TestServiceDynamicRoutes(t *testing.T) {
+	r := require.New(t)
+
+	_, err := NewService(ServiceOptions{
+		DynamicRoutes: []DynamicRouteOptions{{Pattern: "/tenants/events"}},
+		disableKCL:    true,
+		Logger:        slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, `dynamic route "/tenants/events": pattern "/tenants/events" must have a wildcard`)
+
+	_, err = NewService(ServiceOptions{
+		DynamicRoutes: []DynamicRouteOptions{{Pattern: "/tenants/{tenant}/events", StreamTemplate: "{stream}"}},
+		disableKCL:    true,
+		Logger:        slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, `dynamic route "/tenants/{tenant}/events": stream template "{stream}" uses wildcard "stream", which the pattern lacks`)
+
+	var streams []string
+	s, err := NewService(ServiceOptions{
+		DynamicRoutes: []DynamicRouteOptions{
+			{
+				Pattern:        "/tenants/{tenant}/events",
+				StreamTemplate: "{tenant}-events",
+				NewKCLConfig: func(stream string) (*cfg.KinesisClientLibConfiguration, error) {
+					streams = append(streams, stream)
+					return nil, nil
+				},
+				MaxRoutes:   2,
+				IdleTimeout: time.Minute,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Requesting a route creates it, once.
+	r.Equal(http.StatusOK, get("/tenants/a/events").Code)
+	r.Equal(http.StatusOK, get("/tenants/a/events").Code)
+	r.Equal([]string{"a-events"}, streams)
+	r.Contains(s.routesSnapshot(), "/tenants/a/events")
+
+	// Values which aren't Kinesis Stream names are rejected.
+	r.Equal(http.StatusNotFound, get("/tenants/a%20b/events").Code)
+	r.Equal(http.StatusNotFound, get("/tenants/a:b/events").Code)
+
+	// Once the limit is reached, the least recently active idle route makes room for the next.
+	r.Equal(http.StatusOK, get("/tenants/b/events").Code)
+	r.Equal(http.StatusOK, get("/tenants/c/events").Code)
+	r.Equal([]string{"a-events", "b-events", "c-events"}, streams)
+	r.NotContains(s.routesSnapshot(), "/tenants/a/events")
+	r.Len(s.routesSnapshot(), 2)
+
+	// Routes with connections aren't removed.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, tenant := range []string{"b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/tenants/"+tenant+"/events", nil)
+			s.srv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	r.Eventually(func() bool {
+		return s.activeConnections() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	w := get("/tenants/d/events")
+	r.Equal(http.StatusServiceUnavailable, w.Code)
+	r.NotEmpty(w.Header().Get("Retry-After"))
+	r.Len(s.routesSnapshot(), 2)
+
+	cancel()
+	wg.Wait()
+
+	// Routes are removed once they've been idle for the idle timeout.
+	s.removeIdleDynamicRoutes(time.Now())
+	r.Len(s.routesSnapshot(), 2)
+	s.removeIdleDynamicRoutes(time.Now().Add(time.Minute))
+	r.Empty(s.routesSnapshot())
+
+	r.Equal(http.StatusOK, get("/tenants/a/events").Code)
+	r.Len(s.routesSnapshot(), 1)
+}
+
+func TestServiceDynamicRouteStartFailure(t *testing.T) {
+	r := require.New(t)
+
+	gate := make(chan error)
+	s, err := NewService(ServiceOptions{
+		Port: -1,
+		DynamicRoutes: []DynamicRouteOptions{
+			{
+				Pattern: "/tenants/{tenant}/events",
+				Route: RouteOptions{
+					BackfillS3URI:    "s3://my-bucket/events/",
+					BackfillWindow:   time.Hour,
+					BackfillS3Client: &gatedS3Client{gate: gate},
+				},
+				MaxRoutes: 1,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	go func() {
+		r.NoError(s.Start())
+	}()
+
+	_, err = waitForStart(s)
+	r.NoError(err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Requests wait for the route to start.
+	created := make(chan int)
+	go func() {
+		created <- get("/tenants/a/events").Code
+	}()
+	gate <- nil
+	r.Equal(http.StatusOK, <-created)
+
+	// While a route is starting, other routes are still served, and still added and removed.
+	failed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		failed <- get("/tenants/missing/events")
+	}()
+	r.Eventually(func() bool {
+		s.dynamicLock.Lock()
+		defer s.dynamicLock.Unlock()
+		return len(s.dynamicRoutes[0].creating) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	r.Equal(http.StatusOK, get("/tenants/a/events").Code)
+	r.NoError(s.AddRoute(RouteOptions{Pattern: "/static"}))
+	r.NoError(s.RemoveRoute("/static"))
+	s.removeIdleDynamicRoutes(time.Now())
+
+	// Once it fails to start, it's rejected, and the route it would have replaced remains.
+	gate <- errors.New("no such bucket")
+	w := <-failed
+	r.Equal(http.StatusServiceUnavailable, w.Code)
+	r.Contains(s.routesSnapshot(), "/tenants/a/events")
+	r.NotContains(s.routesSnapshot(), "/tenants/missing/events")
+
+	// Once a route does start, the idle route makes room for it.
+	go func() {
+		created <- get("/tenants/b/events").Code
+	}()
+	gate <- nil
+	r.Equal(http.StatusOK, <-created)
+	r.NotContains(s.routesSnapshot(), "/tenants/a/events")
+	r.Len(s.routesSnapshot(), 1)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceDynamicRouteSlowRemoval(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		DynamicRoutes: []DynamicRouteOptions{
+			{
+				Pattern:     "/tenants/{tenant}/events",
+				MaxRoutes:   2,
+				IdleTimeout: time.Minute,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+	dr := s.dynamicRoutes[0]
+
+	// get requests the dynamic route for the tenant, as handleDynamic does before the route is in the ServeMux.
+	get := func(ctx context.Context, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/tenants/"+tenant+"/events", nil)
+		req.Header.Set("Accept", "application/json")
+		req.SetPathValue("tenant", tenant)
+		w := httptest.NewRecorder()
+		s.handleDynamic(dr, w, req)
+		return w
+	}
+
+	r.Equal(http.StatusOK, get(context.Background(), "a").Code)
+	r.Equal(http.StatusOK, get(context.Background(), "b").Code)
+
+	// b has a connection, so only a is idle.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{})
+	go func() {
+		defer close(connected)
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/tenants/b/events", nil)
+		s.srv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	r.Eventually(func() bool {
+		return s.activeConnections() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Removing a is slow, as if its KCL worker were slow to shut down.
+	s.changeLock.Lock()
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		s.removeIdleDynamicRoutes(time.Now().Add(time.Minute))
+	}()
+	r.Eventually(func() bool {
+		s.dynamicLock.Lock()
+		defer s.dynamicLock.Unlock()
+		_, ok := dr.routes["/tenants/a/events"]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	// Meanwhile, requests for b aren't blocked.
+	done := make(chan int)
+	go func() {
+		done <- get(context.Background(), "b").Code
+	}()
+	select {
+	case code := <-done:
+		r.Equal(http.StatusOK, code)
+	case <-time.After(time.Second):
+		r.Fail("request for an existing dynamic route was blocked by a slow removal")
+	}
+
+	s.changeLock.Unlock()
+	<-swept
+	r.NotContains(s.routesSnapshot(), "/tenants/a/events")
+	r.Contains(s.routesSnapshot(), "/tenants/b/events")
+
+	cancel()
+	<-connected
+}
+
+// flushRecordingResponseWriter is an http.ResponseWriter which records what it had written at each flush.
+type flushRecordingResponseWriter struct {
+	*httptest.ResponseRecorder
+	mu      sync.Mutex
+	flushed []string
+}
+
+func (w *flushRecordingResponseWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ResponseRecorder.Write(b)
+}
+
+func (w *flushRecordingResponseWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushed = append(w.flushed, w.ResponseRecorder.Body.String())
+}
+
+func (w *flushRecordingResponseWriter) flushes() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.flushed)
+}
+
+func TestServiceFlushPolicy(t *testing.T) {
+	r := require.New(t)
+
+	_, err := NewService(ServiceOptions{
+		Routes:     []RouteOptions{{Pattern: "/", FlushEvery: -1}},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, `route "/": flush every must be non-negative`)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:       "/every",
+				FlushEvery:    2,
+				FlushInterval: time.Hour,
+			},
+			{
+				Pattern:       "/interval",
+				FlushInterval: 200 * time.Millisecond,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	for _, rt := range s.routes {
+		for i := 0; i < 5; i++ {
+			err = rt.t2o.Add(i, time.UnixMilli(0))
+			r.NoError(err)
+			_, err = rt.ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+			r.NoError(err)
+		}
+	}
+
+	event := func(i int) string {
+		return fmt.Sprintf("id: %d\ndata: {\"event\":%d}\n\n", i, i)
+	}
+
+	// Events are flushed in pairs, and the last one with the end of the stream.
+	w := &flushRecordingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	s.handleFunc(s.routes["/every"], w, httptest.NewRequest(http.MethodGet, "/every?since=1970-01-01T00%3A00%3A00.000Z&limit=5", nil))
+	r.Equal([]string{
+		": ok\n\n",
+		": ok\n\n" + event(0) + event(1),
+		": ok\n\n" + event(0) + event(1) + event(2) + event(3),
+		": ok\n\n" + event(0) + event(1) + event(2) + event(3) + event(4) + ": end\n\n",
+	}, w.flushes()[:4])
+
+	// Events are flushed together once the interval passes.
+	ctx, cancel := context.WithCancel(context.Background())
+	w = &flushRecordingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleFunc(s.routes["/interval"], w, httptest.NewRequestWithContext(ctx, http.MethodGet, "/interval?since=1970-01-01T00%3A00%3A00.000Z", nil))
+	}()
+	r.Eventually(func() bool { return len(w.flushes()) == 2 }, time.Second, 10*time.Millisecond)
+	r.Equal([]string{
+		": ok\n\n",
+		": ok\n\n" + event(0) + event(1) + event(2) + event(3) + event(4),
+	}, w.flushes())
+	cancel()
+	<-done
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
+
+func TestServiceErrorResponses(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern: "/",
+				APIKeys: []string{"key"},
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		s.srv.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Clients which accept JSON get a JSON object with a stable code.
+	w := get("/", "application/json")
+	r.Equal(http.StatusUnauthorized, w.Code)
+	r.Equal("application/json", w.Header().Get("Content-Type"))
+	r.Equal("Bearer", w.Header().Get("WWW-Authenticate"))
+	r.JSONEq(`{"error":"Unauthorized","code":"unauthorized"}`, w.Body.String())
+
+	w = get("/?api_key=key&limit=-1", "application/x-ndjson")
+	r.Equal(http.StatusBadRequest, w.Code)
+	r.JSONEq(`{"error":"limit must be a non-negative integer","code":"bad_request"}`, w.Body.String())
+
+	w = get("/health?max_lag=bogus", "application/json")
+	r.Equal(http.StatusBadRequest, w.Code)
+	r.JSONEq(`{"error":"Bad Request","code":"bad_request"}`, w.Body.String())
+
+	// Other clients, like curl, get plain text.
+	for _, accept := range []string{"", "text/plain", "*/*"} {
+		w = get("/", accept)
+		r.Equal(http.StatusUnauthorized, w.Code)
+		r.Equal("text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+		r.Equal("Unauthorized\n", w.Body.String())
+	}
+
+	w = get("/?api_key=key", "image/png")
+	r.Equal(http.StatusNotAcceptable, w.Code)
+	r.Equal("Not Acceptable\n", w.Body.String())
+}
+
+func TestServiceStreamHeaders(t *testing.T) {
+	r := require.New(t)
+
+	_, err := NewService(ServiceOptions{
+		Routes:        []RouteOptions{{Pattern: "/"}},
+		StreamHeaders: http.Header{"X-Bogus": {"a\r\nb"}},
+		disableKCL:    true,
+		Logger:        slog.New(slog.DiscardHandler),
+	})
+	r.EqualError(err, `stream header "X-Bogus" must be a single line`)
+
+	newService := func(streamHeaders http.Header) *Service {
+		s, err := NewService(ServiceOptions{
+			Routes:        []RouteOptions{{Pattern: "/"}},
+			StreamHeaders: streamHeaders,
+			disableKCL:    true,
+			Logger:        slog.New(slog.DiscardHandler),
+		})
+		r.NoError(err)
+
+		err = s.routes["/"].t2o.Add(0, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = s.routes["/"].ml.Write(context.Background(), []byte(`{"event":0}`))
+		r.NoError(err)
+		return s
+	}
+
+	get := func(s *Service, accept string) http.Header {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?since=1970-01-01T00%3A00%3A00Z&limit=1", nil)
+		req.Header.Set("Accept", accept)
+		s.handleFunc(s.routes["/"], w, req)
+		r.Equal(http.StatusOK, w.Code)
+		return w.Header()
+	}
+
+	// Streams get the standard SSE headers by default, so that proxies don't buffer them.
+	s := newService(nil)
+	for _, accept := range []string{"text/event-stream", "application/x-ndjson"} {
+		headers := get(s, accept)
+		r.Equal("no-cache", headers.Get("Cache-Control"))
+		r.Equal("keep-alive", headers.Get("Connection"))
+		r.Equal("no", headers.Get("X-Accel-Buffering"))
+	}
+
+	// They can be overridden, removed, or added to.
+	s = newService(http.Header{
+		"cache-control":     {"no-cache, no-transform"},
+		"X-Accel-Buffering": {""},
+		"X-Custom":          {"1"},
+	})
+	headers := get(s, "text/event-stream")
+	r.Equal("no-cache, no-transform", headers.Get("Cache-Control"))
+	r.Equal("keep-alive", headers.Get("Connection"))
+	r.NotContains(headers, "X-Accel-Buffering")
+	r.Equal("1", headers.Get("X-Custom"))
+}
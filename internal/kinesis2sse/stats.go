@@ -0,0 +1,270 @@
+package kinesis2sse
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/embano1/memlog"
+)
+
+// ingestRateWindow is the width of the sliding window used to compute the events-per-second ingest rate.
+const ingestRateWindow = time.Second
+
+// routeStats tracks per-route counters, along with their high-water marks since startup. It's safe for concurrent use.
+type routeStats struct {
+	lock *sync.Mutex
+
+	// eventsIngested is the total number of events written to the memlog.
+	eventsIngested int64
+
+	// eventsSkipped is the total number of records skipped during ingest, for example due to un-parseable JSON.
+	eventsSkipped int64
+
+	// eventsSkippedByReason breaks eventsSkipped down by reason.
+	eventsSkippedByReason map[skipReason]int64
+
+	// eventsDropped is the total number of events dropped during ingest for exceeding the route's MaxEventBytes.
+	eventsDropped int64
+
+	// eventsDelivered is the total number of events written to clients.
+	eventsDelivered int64
+
+	// activeConnections is the number of currently-open connections.
+	activeConnections int64
+
+	// totalConnections is the total number of connections accepted.
+	totalConnections int64
+
+	// peakConnections is the highest value activeConnections has reached.
+	peakConnections int64
+
+	// peakEventsPerSecond is the highest ingest rate observed over ingestRateWindow.
+	peakEventsPerSecond float64
+
+	// window stores recent ingest samples, oldest first, for computing the ingest rate.
+	window []ingestSample
+
+	// windowEvents is the sum of the events in window.
+	windowEvents int64
+
+	// shardLag stores the latest MillisBehindLatest reported for each shard, as a duration.
+	shardLag map[string]time.Duration
+}
+
+type ingestSample struct {
+	at     time.Time
+	events int64
+}
+
+// RouteStats is a point-in-time snapshot of a route's counters.
+type RouteStats struct {
+	EventsIngested      int64   `json:"eventsIngested"`
+	EventsSkipped       int64   `json:"eventsSkipped"`
+	EventsDropped       int64   `json:"eventsDropped"`
+	EventsDelivered     int64   `json:"eventsDelivered"`
+	ActiveConnections   int64   `json:"activeConnections"`
+	TotalConnections    int64   `json:"totalConnections"`
+	PeakConnections     int64   `json:"peakConnections"`
+	EventsPerSecond     float64 `json:"eventsPerSecond"`
+	PeakEventsPerSecond float64 `json:"peakEventsPerSecond"`
+	MillisBehindLatest  int64   `json:"millisBehindLatest"`
+
+	// EventsSkippedByReason breaks EventsSkipped down by reason, like "unparseable_json" or "missing_time".
+	EventsSkippedByReason map[string]int64 `json:"eventsSkippedByReason,omitempty"`
+
+	// Capacity is the route's configured Capacity. EarliestOffset and LatestOffset are the range of offsets we serve,
+	// or -1 if the route has no events, and EventsRetained is the number of events in that range. EventsEvicted is the
+	// number of events which have been evicted to stay within Capacity.
+	Capacity       int   `json:"capacity"`
+	EarliestOffset int64 `json:"earliestOffset"`
+	LatestOffset   int64 `json:"latestOffset"`
+	EventsRetained int64 `json:"eventsRetained"`
+	EventsEvicted  int64 `json:"eventsEvicted"`
+}
+
+func newRouteStats() *routeStats {
+	return &routeStats{
+		lock:                  &sync.Mutex{},
+		eventsSkippedByReason: make(map[skipReason]int64),
+		shardLag:              make(map[string]time.Duration),
+	}
+}
+
+// ingested records that n events were written to the memlog at the specified time, and updates the peak ingest rate.
+func (s *routeStats) ingested(n int, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.eventsIngested += int64(n)
+	s.window = append(s.window, ingestSample{at: now, events: int64(n)})
+	s.windowEvents += int64(n)
+	s.expire(now)
+
+	if rate := s.rate(); rate > s.peakEventsPerSecond {
+		s.peakEventsPerSecond = rate
+	}
+}
+
+// skipped records how many records were skipped during ingest, by reason.
+func (s *routeStats) skipped(skipped map[skipReason]int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for reason, n := range skipped {
+		s.eventsSkipped += int64(n)
+		s.eventsSkippedByReason[reason] += int64(n)
+	}
+}
+
+// dropped records that n events were dropped during ingest for being too large.
+func (s *routeStats) dropped(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.eventsDropped += int64(n)
+}
+
+// delivered records that the specified number of events were written to a client.
+func (s *routeStats) delivered(events int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.eventsDelivered += int64(events)
+}
+
+// expire drops samples which have fallen out of the sliding window. Callers must hold the lock.
+func (s *routeStats) expire(now time.Time) {
+	i := 0
+	for ; i < len(s.window); i++ {
+		if now.Sub(s.window[i].at) < ingestRateWindow {
+			break
+		}
+		s.windowEvents -= s.window[i].events
+	}
+	s.window = s.window[i:]
+}
+
+// rate returns the ingest rate over the sliding window. Callers must hold the lock.
+func (s *routeStats) rate() float64 {
+	return float64(s.windowEvents) / ingestRateWindow.Seconds()
+}
+
+// connected records a newly-opened connection.
+func (s *routeStats) connected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.activeConnections++
+	s.totalConnections++
+	if s.activeConnections > s.peakConnections {
+		s.peakConnections = s.activeConnections
+	}
+}
+
+// disconnected records a closed connection.
+func (s *routeStats) disconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.activeConnections--
+}
+
+// behind records how far behind the tip of the Kinesis Stream the specified shard's consumer is.
+func (s *routeStats) behind(shardID string, lag time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.shardLag[shardID] = lag
+}
+
+// shardEnded stops tracking the specified shard's lag.
+func (s *routeStats) shardEnded(shardID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.shardLag, shardID)
+}
+
+// lag returns the maximum lag across all shards.
+func (s *routeStats) lag() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.maxLag()
+}
+
+// shardLags returns a copy of each shard's lag.
+func (s *routeStats) shardLags() map[string]time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return maps.Clone(s.shardLag)
+}
+
+// maxLag returns the maximum lag across all shards. Callers must hold the lock.
+func (s *routeStats) maxLag() time.Duration {
+	var lag time.Duration
+	for _, shardLag := range s.shardLag {
+		lag = max(lag, shardLag)
+	}
+	return lag
+}
+
+// snapshot returns the current counters.
+func (s *routeStats) snapshot(now time.Time) RouteStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expire(now)
+
+	var skippedByReason map[string]int64
+	if len(s.eventsSkippedByReason) > 0 {
+		skippedByReason = make(map[string]int64, len(s.eventsSkippedByReason))
+		for reason, n := range s.eventsSkippedByReason {
+			skippedByReason[string(reason)] = n
+		}
+	}
+
+	return RouteStats{
+		EventsIngested:      s.eventsIngested,
+		EventsSkipped:       s.eventsSkipped,
+		EventsDropped:       s.eventsDropped,
+		EventsDelivered:     s.eventsDelivered,
+		ActiveConnections:   s.activeConnections,
+		TotalConnections:    s.totalConnections,
+		PeakConnections:     s.peakConnections,
+		EventsPerSecond:     s.rate(),
+		PeakEventsPerSecond: s.peakEventsPerSecond,
+		MillisBehindLatest:  s.maxLag().Milliseconds(),
+
+		EventsSkippedByReason: skippedByReason,
+	}
+}
+
+// snapshot returns the current counters of the route, along with the occupancy of its memlog.
+func (rt route) snapshot(ctx context.Context, now time.Time) RouteStats {
+	stats := rt.stats.snapshot(now)
+	stats.Capacity = rt.capacity
+	stats.EarliestOffset, stats.LatestOffset = -1, -1
+
+	earliest, latest := rt.ml.Range(ctx)
+	if latest < 0 {
+		return stats
+	}
+
+	// The memlog may retain events which Timestamp2Offset has already evicted, and which we no longer serve (see
+	// startOffset), so count those as evicted, too.
+	if oldestOff, ok := rt.t2o.OldestOffset(); ok {
+		earliest = max(earliest, memlog.Offset(oldestOff))
+	}
+
+	// NOTE(mroberts): Offsets start at zero, so every offset before the earliest one was evicted.
+	stats.EarliestOffset = int64(earliest)
+	stats.LatestOffset = int64(latest)
+	stats.EventsRetained = max(int64(latest-earliest)+1, 0)
+	stats.EventsEvicted = int64(earliest)
+
+	return stats
+}
@@ -0,0 +1,95 @@
+package kinesis2sse
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteStats(t *testing.T) {
+	r := require.New(t)
+
+	stats := newRouteStats()
+	start := time.UnixMilli(0)
+
+	// Peak connections persist after connections close.
+	stats.connected()
+	stats.connected()
+	stats.disconnected()
+	stats.connected()
+	stats.disconnected()
+	stats.disconnected()
+
+	snapshot := stats.snapshot(start)
+	r.Equal(int64(0), snapshot.ActiveConnections)
+	r.Equal(int64(3), snapshot.TotalConnections)
+	r.Equal(int64(2), snapshot.PeakConnections)
+
+	// Ingest within the same window accumulates…
+	stats.ingested(10, start)
+	stats.ingested(20, start.Add(500*time.Millisecond))
+
+	snapshot = stats.snapshot(start.Add(500 * time.Millisecond))
+	r.Equal(int64(30), snapshot.EventsIngested)
+	r.Equal(float64(30), snapshot.EventsPerSecond)
+	r.Equal(float64(30), snapshot.PeakEventsPerSecond)
+
+	// …but slides out of the window, while the peak remains.
+	stats.ingested(5, start.Add(1_200*time.Millisecond))
+
+	snapshot = stats.snapshot(start.Add(1_200 * time.Millisecond))
+	r.Equal(int64(35), snapshot.EventsIngested)
+	r.Equal(float64(25), snapshot.EventsPerSecond)
+	r.Equal(float64(30), snapshot.PeakEventsPerSecond)
+
+	snapshot = stats.snapshot(start.Add(10 * time.Second))
+	r.Equal(float64(0), snapshot.EventsPerSecond)
+	r.Equal(float64(30), snapshot.PeakEventsPerSecond)
+}
+
+func TestRouteSnapshot(t *testing.T) {
+	r := require.New(t)
+
+	s, err := NewService(ServiceOptions{
+		Routes: []RouteOptions{
+			{
+				Pattern:  "/",
+				Capacity: 3,
+			},
+		},
+		disableKCL: true,
+		Logger:     slog.New(slog.DiscardHandler),
+	})
+	r.NoError(err)
+
+	rt := s.routes["/"]
+
+	snapshot := rt.snapshot(context.Background(), time.Now())
+	r.Equal(3, snapshot.Capacity)
+	r.Equal(int64(-1), snapshot.EarliestOffset)
+	r.Equal(int64(-1), snapshot.LatestOffset)
+	r.Equal(int64(0), snapshot.EventsRetained)
+	r.Equal(int64(0), snapshot.EventsEvicted)
+
+	// [0, 1, 2, 3, 4, 5], of which only [3, 4, 5] are still served.
+	for i := 0; i < 6; i++ {
+		err = rt.t2o.Add(i, time.UnixMilli(0))
+		r.NoError(err)
+		_, err = rt.ml.Write(context.Background(), []byte(fmt.Sprintf(`{"event":%d}`, i)))
+		r.NoError(err)
+	}
+
+	snapshot = rt.snapshot(context.Background(), time.Now())
+	r.Equal(3, snapshot.Capacity)
+	r.Equal(int64(3), snapshot.EarliestOffset)
+	r.Equal(int64(5), snapshot.LatestOffset)
+	r.Equal(int64(3), snapshot.EventsRetained)
+	r.Equal(int64(3), snapshot.EventsEvicted)
+
+	err = s.Stop(context.Background())
+	r.NoError(err)
+}
@@ -0,0 +1,51 @@
+package kinesis2sse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultStreamHeaders are set on each SSE and NDJSON stream's response, so that caches and proxies pass events through
+// as they're sent, rather than buffering them. X-Accel-Buffering disables nginx's proxy buffering.
+//
+// NOTE(mroberts): HTTP/2 forbids Connection, so net/http drops it from HTTP/2 responses.
+var defaultStreamHeaders = http.Header{
+	"Cache-Control":     {"no-cache"},
+	"Connection":        {"keep-alive"},
+	"X-Accel-Buffering": {"no"},
+}
+
+// newStreamHeaders returns the headers to set on each stream's response: the defaults, overridden by the specified
+// headers. A header with no values, or only an empty value, removes the default.
+func newStreamHeaders(overrides http.Header) (http.Header, error) {
+	headers := defaultStreamHeaders.Clone()
+	for name, values := range overrides {
+		// NOTE(mroberts): A line break would end the header early, and let it inject others.
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid stream header %q", name)
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("stream header %q must be a single line", name)
+			}
+		}
+
+		name = http.CanonicalHeaderKey(name)
+		if len(values) == 0 || len(values) == 1 && values[0] == "" {
+			headers.Del(name)
+			continue
+		}
+		headers[name] = values
+	}
+	return headers, nil
+}
+
+// setStreamHeaders sets the stream headers on the response, without replacing any which were already set, like by CORS.
+func (s *Service) setStreamHeaders(w http.ResponseWriter) {
+	for name, values := range s.streamHeaders {
+		if _, ok := w.Header()[name]; !ok {
+			w.Header()[name] = values
+		}
+	}
+}
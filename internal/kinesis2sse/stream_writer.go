@@ -0,0 +1,433 @@
+package kinesis2sse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/embano1/memlog"
+)
+
+// streamWriter writes a route's events to a single SSE (or NDJSON) stream, buffering and batching them as configured.
+// However the stream ends, it ends through finish, so that clients are told why consistently.
+type streamWriter struct {
+	s       *Service
+	rt      route
+	r       *http.Request
+	w       http.ResponseWriter
+	flusher http.Flusher
+	rc      *http.ResponseController
+	conn    *connection
+	params  streamParams
+	ndjson  bool
+
+	// ctx is done when the stream should end, because the client went away, the route was removed, the service is
+	// draining, or the stream reached MaxConnectionDuration.
+	ctx context.Context
+
+	// reason is why the stream ended, for the connection's log.
+	reason string
+
+	// With FlushEvery or FlushInterval, events are buffered until flushEvery of them are, or until flushDeadline, which
+	// fires flushInterval after the first of them.
+	buffering     bool
+	buffered      int
+	flushTimer    *time.Timer
+	flushDeadline <-chan time.Time
+
+	// A nil channel never receives, so heartbeats are disabled unless configured.
+	heartbeat  *time.Ticker
+	heartbeats <-chan time.Time
+
+	// With "batch", events accumulate in batched until the batch is full, or batchDelay after its first event, whichever
+	// comes first. SSE streams only; NDJSON is already one line per event. batchedOffset is the offset of the last
+	// batched event, which is the batch's ID, so that clients resume after it.
+	batching      bool
+	batched       [][]byte
+	batchedOffset memlog.Offset
+	batchTimer    *time.Timer
+	batchDeadline <-chan time.Time
+
+	// sent counts the events sent, for "limit", and lastOffset is the offset of the last of them (or -1), which the end
+	// marker reports.
+	sent       int
+	lastOffset memlog.Offset
+
+	// previous is the timestamp of the previous event sent, which "speed" paces the next event by.
+	previous *time.Time
+}
+
+func newStreamWriter(ctx context.Context, s *Service, rt route, w http.ResponseWriter, flusher http.Flusher, rc *http.ResponseController, r *http.Request, conn *connection, params streamParams, ndjson bool, empty bool) *streamWriter {
+	sw := &streamWriter{
+		s:          s,
+		rt:         rt,
+		r:          r,
+		w:          w,
+		flusher:    flusher,
+		rc:         rc,
+		conn:       conn,
+		params:     params,
+		ndjson:     ndjson,
+		ctx:        ctx,
+		reason:     "write failed",
+		buffering:  rt.flushEvery > 0 || rt.flushInterval > 0,
+		batching:   params.batch > 0 && !ndjson,
+		lastOffset: -1,
+	}
+
+	if sw.buffering {
+		sw.flushTimer = time.NewTimer(rt.flushInterval)
+		sw.flushTimer.Stop()
+	}
+
+	// NDJSON has no comments, so there are no heartbeats either. If the route has no events yet, we send heartbeats
+	// regardless, until the first event.
+	heartbeatInterval := rt.heartbeatInterval
+	if heartbeatInterval == 0 && empty {
+		heartbeatInterval = DefaultEmptyLogHeartbeatInterval
+	}
+	if heartbeatInterval > 0 && !ndjson {
+		sw.heartbeat = time.NewTicker(heartbeatInterval)
+		sw.heartbeats = sw.heartbeat.C
+	}
+
+	if sw.batching {
+		sw.batchTimer = time.NewTimer(params.batchDelay)
+		sw.batchTimer.Stop()
+	}
+
+	return sw
+}
+
+// stop stops the streamWriter's timers.
+func (sw *streamWriter) stop() {
+	if sw.flushTimer != nil {
+		sw.flushTimer.Stop()
+	}
+	if sw.heartbeat != nil {
+		sw.heartbeat.Stop()
+	}
+	if sw.batchTimer != nil {
+		sw.batchTimer.Stop()
+	}
+}
+
+// send writes an SSE (or SSE comment) to the client. Unless buffer is set, it flushes it, along with any buffered
+// events.
+func (sw *streamWriter) send(ssEvent string, buffer bool) (int, error) {
+	// A write deadline ensures a stuck client fails the write instead of blocking it. With SlowClientDisconnect, the
+	// route's SlowClientTimeout applies, if it's shorter than the service's WriteTimeout.
+	timeout := sw.s.writeTimeout
+	if sw.rt.slowClientPolicy == SlowClientDisconnect {
+		timeout = min(timeout, sw.rt.slowClientTimeout)
+	}
+	if err := sw.rc.SetWriteDeadline(time.Now().Add(timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		sw.s.logger.Error("Unable to set write deadline", "err", err)
+	}
+	// Don't extend the deadline of a client which already went away.
+	if err := sw.r.Context().Err(); err != nil {
+		sw.reason = "client disconnected"
+		return 0, err
+	}
+
+	n, err := fmt.Fprint(sw.w, ssEvent)
+	if err == nil && buffer {
+		sw.buffered++
+		buffer = sw.rt.flushEvery == 0 || sw.buffered < sw.rt.flushEvery
+		if buffer && sw.flushDeadline == nil && sw.rt.flushInterval > 0 {
+			sw.flushTimer.Reset(sw.rt.flushInterval)
+			sw.flushDeadline = sw.flushTimer.C
+		}
+	}
+	if err == nil && !buffer {
+		err = sw.rc.Flush()
+		if sw.buffering {
+			sw.buffered = 0
+			sw.flushTimer.Stop()
+			sw.flushDeadline = nil
+		}
+	}
+
+	switch {
+	case err == nil:
+	case sw.r.Context().Err() != nil:
+		sw.reason = "client disconnected"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		sw.reason = "write timed out"
+	}
+
+	// NOTE(mroberts): Once a write fails, the buffered events are lost, so there's no use retrying them.
+	if err != nil {
+		sw.buffered = 0
+	}
+
+	return n, err
+}
+
+// writeHeartbeat writes a heartbeat comment. It returns false if the write failed.
+func (sw *streamWriter) writeHeartbeat() bool {
+	_, err := sw.send(": heartbeat\n\n", false)
+	return err == nil
+}
+
+// resetHeartbeat postpones the next heartbeat after a write. Events keep the connection alive, too, so we only send
+// heartbeats after an idle interval. If heartbeats were only sent because the route had no events, stop them now that
+// it does.
+func (sw *streamWriter) resetHeartbeat() {
+	if sw.heartbeat != nil && sw.rt.heartbeatInterval > 0 {
+		sw.heartbeat.Reset(sw.rt.heartbeatInterval)
+	} else if sw.heartbeat != nil {
+		sw.heartbeat.Stop()
+		sw.heartbeats = nil
+	}
+}
+
+// flushBuffered flushes any buffered events. It returns false if the write failed.
+func (sw *streamWriter) flushBuffered() bool {
+	if sw.buffered == 0 {
+		return true
+	}
+	_, err := sw.send("", false)
+	return err == nil
+}
+
+// flushBatch writes the batched events, if any, as a single SSE whose data is a JSON array. It returns false if the
+// write failed.
+func (sw *streamWriter) flushBatch() bool {
+	if len(sw.batched) == 0 {
+		return true
+	}
+
+	sw.batchTimer.Stop()
+	sw.batchDeadline = nil
+
+	data := append([]byte{'['}, bytes.Join(sw.batched, []byte{','})...)
+	data = append(data, ']')
+	if sw.params.pretty {
+		data = indentData(data)
+	}
+
+	n, err := sw.send(fmt.Sprintf("id: %d\ndata: %s\n\n", sw.batchedOffset, formatData(data)), sw.buffering)
+	if err != nil {
+		return false
+	}
+
+	sw.conn.sent(int(sw.batchedOffset), len(sw.batched), n)
+	sw.rt.stats.delivered(len(sw.batched))
+	sw.resetHeartbeat()
+	sw.batched = sw.batched[:0]
+	return true
+}
+
+// writeGap writes a "gap" event, reporting the inclusive range of offsets skipped for a slow client, after any batched
+// or buffered events, so that it arrives in order. NDJSON has no event types, so NDJSON streams get no "gap" event. It
+// returns false if the write failed.
+func (sw *streamWriter) writeGap(from, to memlog.Offset) bool {
+	if !sw.flushBatch() {
+		return false
+	}
+	if sw.ndjson {
+		return true
+	}
+
+	_, err := sw.send(fmt.Sprintf("event: gap\ndata: {\"from\":%d,\"to\":%d}\n\n", from, to), false)
+	return err == nil
+}
+
+// format formats the event as an SSE (or NDJSON line), or, when batching, as a JSON array element. It returns false if
+// the event should be skipped, because it doesn't decode, doesn't match the filters, or doesn't fit the format.
+func (sw *streamWriter) format(cloudEvent memlog.Record) (ssEvent string, element []byte, ok bool) {
+	rt, params, ndjson := sw.rt, sw.params, sw.ndjson
+	off := cloudEvent.Metadata.Offset
+
+	data, err := rt.encoding.decode(cloudEvent.Data)
+	if err != nil {
+		sw.s.logger.Error(fmt.Sprintf("Skipping offset %d, which we were unable to decode", off), "err", err)
+		return "", nil, false
+	}
+
+	// Binary events are opaque, so filters and event names don't apply to them.
+	if !rt.binary && !matchesAll(params.filters, data) {
+		return "", nil, false
+	}
+
+	// Batched events are JSON array elements, so event names and comments don't apply to them.
+	if sw.batching {
+		element, ok = rt.formatJSONEvent(off, data, params)
+		return "", element, ok
+	}
+
+	// NOTE(mroberts): The ID is the memlog offset, rather than a per-connection counter, so that it is stable across
+	// connections.
+	formatted := data
+	if params.pretty && !rt.binary {
+		formatted = indentData(formatted)
+	}
+	ssEvent = fmt.Sprintf("id: %d\ndata: %s\n\n", off, formatData(formatted))
+	if params.cloudEvents {
+		// CloudEvents are always JSON, even for binary and non-JSON events, and single-line unless "pretty" is set.
+		formatted := rt.formatCloudEvent(off, data, params.includeSequence)
+		if ndjson {
+			ssEvent = string(formatted) + "\n"
+		} else {
+			if params.pretty {
+				formatted = indentData(formatted)
+			}
+			ssEvent = fmt.Sprintf("id: %d\ndata: %s\n\n", off, formatData(formatted))
+			if !rt.binary && rt.eventNameField != "" {
+				if name, ok := eventName(data, rt.eventNameField); ok {
+					ssEvent = fmt.Sprintf("event: %s\n%s", name, ssEvent)
+				}
+			}
+		}
+	} else if rt.binary {
+		ssEvent = fmt.Sprintf("id: %d\ndata: %s\n\n", off, encodeBinary(data))
+		if ndjson {
+			ssEvent = string(encodeBinaryJSON(data)) + "\n"
+		}
+	} else if ndjson {
+		// NDJSON requires each event to be a single line of JSON, so we skip events which aren't JSON.
+		if ssEvent, ok = formatNDJSON(data); !ok {
+			return "", nil, false
+		}
+	} else if rt.eventNameField != "" {
+		if name, ok := eventName(data, rt.eventNameField); ok {
+			ssEvent = fmt.Sprintf("event: %s\n%s", name, ssEvent)
+		}
+	}
+
+	// NOTE(mroberts): A comment, rather than a field, leaves the event itself unchanged for EventSource clients.
+	if params.includeSequence && !ndjson {
+		if sequenceNumber, ok := rt.t2o.SequenceNumberForOffset(int(off)); ok {
+			ssEvent = fmt.Sprintf(": sequence %s\n%s", sequenceNumber, ssEvent)
+		}
+	}
+	if params.includeTimestamp && !ndjson {
+		if timestamp, ok := rt.t2o.TimestampForOffset(int(off)); ok {
+			ssEvent = fmt.Sprintf(": timestamp %s\n%s", timestamp.UTC().Format(TimestampFormat), ssEvent)
+		}
+	}
+
+	return ssEvent, nil, true
+}
+
+// pace waits to send the event at the specified offset, spaced from the previous event by the delta between their
+// timestamps, scaled by "speed". It returns false if the stream ended meanwhile.
+func (sw *streamWriter) pace(off memlog.Offset) bool {
+	timestamp, ok := sw.rt.t2o.TimestampForOffset(int(off))
+	if !ok {
+		return true
+	}
+
+	if sw.previous != nil {
+		// Don't hold buffered events while pacing, which may take longer than FlushInterval.
+		if !sw.flushBuffered() {
+			return false
+		}
+		if !pace(sw.ctx, time.Duration(float64(timestamp.Sub(*sw.previous))/sw.params.speed)) {
+			sw.expire()
+			return false
+		}
+	}
+	sw.previous = &timestamp
+	return true
+}
+
+// writeEvent writes the formatted event at the specified offset, flushing it according to the route's FlushEvery and
+// FlushInterval, or else adds it to the batch. It returns false if the write failed.
+func (sw *streamWriter) writeEvent(off memlog.Offset, ssEvent string, element []byte) bool {
+	sw.sent++
+	sw.lastOffset = off
+
+	if sw.batching {
+		// Hold the event until its batch is full, or the stream is about to end, or else until batchDelay passes.
+		sw.batched = append(sw.batched, element)
+		sw.batchedOffset = off
+		if len(sw.batched) < sw.params.batch && !sw.reachedLimit() {
+			if sw.batchDeadline == nil {
+				sw.batchTimer.Reset(sw.params.batchDelay)
+				sw.batchDeadline = sw.batchTimer.C
+			}
+			return true
+		}
+
+		return sw.flushBatch()
+	}
+
+	n, err := sw.send(ssEvent, sw.buffering)
+	if err != nil {
+		return false
+	}
+
+	sw.conn.sent(int(off), 1, n)
+	sw.rt.stats.delivered(1)
+	sw.resetHeartbeat()
+	return true
+}
+
+// reachedLimit returns whether the stream sent the events its "limit" allows.
+func (sw *streamWriter) reachedLimit() bool {
+	return sw.params.limit > 0 && sw.sent >= sw.params.limit
+}
+
+// expire ends a stream whose context is done, or whose events ended, determining why.
+func (sw *streamWriter) expire() {
+	switch {
+	case sw.r.Context().Err() != nil:
+		sw.finish("client disconnected")
+	case sw.rt.ctx.Err() != nil:
+		sw.finish("route removed")
+	case sw.s.isStopped():
+		sw.finish("service stopped")
+	case sw.s.drainCtx.Err() != nil:
+		sw.finish("drained")
+	case sw.ctx.Err() != nil:
+		sw.finish("max connection duration")
+	default:
+		sw.finish("stream ended")
+	}
+}
+
+// finish ends the stream for the specified reason. Unless the client went away, it first sends any batched or buffered
+// events, and then lets the client know how the stream ended:
+//
+//   - Streams bounded by "limit", "until", or "mode=replay" end with the end marker, if requested, and ": end", so that
+//     clients can tell this was intentional.
+//   - Streams whose client fell too far behind end with a jittered "retry" and ": overloaded".
+//   - Streams ended by the service end with ": end", preceded by a jittered "retry" if the service is going away.
+func (sw *streamWriter) finish(reason string) {
+	sw.reason = reason
+	if sw.r.Context().Err() != nil {
+		sw.reason = "client disconnected"
+		return
+	}
+
+	if !sw.flushBatch() {
+		return
+	}
+
+	// The final comments flush any buffered events along with them. Otherwise, we flush them ourselves.
+	switch {
+	case sw.ndjson:
+		sw.flushBuffered()
+	case reason == "limit reached" || reason == "until reached" || reason == "replay finished":
+		if sw.params.endMarker && sw.lastOffset >= 0 {
+			writeEndMarker(sw.w, sw.flusher, sw.lastOffset)
+		}
+		writeEndComment(sw.w, sw.flusher)
+	case reason == "overloaded":
+		writeEndedRetry(sw.w, sw.rt.retryMillis)
+		writeOverloadedComment(sw.w, sw.flusher)
+	case reason == "service stopped" || reason == "drained":
+		writeEndedRetry(sw.w, sw.rt.retryMillis)
+		writeEndComment(sw.w, sw.flusher)
+	case reason == "route removed" || reason == "max connection duration":
+		writeEndComment(sw.w, sw.flusher)
+	default:
+		sw.flushBuffered()
+	}
+}
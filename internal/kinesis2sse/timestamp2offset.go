@@ -1,43 +1,59 @@
 package kinesis2sse
 
 import (
-	"cmp"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
 	"time"
-
-	"modernc.org/b/v2"
 )
 
-// Timestamp2Offset is a map from offsets to timestamps. It's not thread-safe by default. Callers should use the embedded mutex.
+// Timestamp2Offset is a map from offsets to timestamps. It's thread-safe: each exported method locks the embedded mutex
+// itself, so callers must not hold it, except when calling the methods suffixed "Unlocked". Those require the caller to
+// hold the mutex, so that a batch of operations, like ingesting a batch of records, can be made atomic:
+//
+//	t2o.Lock()
+//	defer t2o.Unlock()
+//	if last, ok := t2o.LastTimestampUnlocked(); ok && timestamp.Before(last) {
+//		timestamp = last
+//	}
+//	err := t2o.AddWithSequenceNumberUnlocked(offset, timestamp, sequenceNumber)
+//
+// Offsets are consecutive, so Timestamp2Offset stores them in a fixed-size ring buffer, ordered by offset. Timestamps
+// are usually monotonic, too, in which case lookups by timestamp binary search the buffer. If any timestamps are out of
+// order, lookups fall back to a linear scan until the out-of-order entries are evicted.
 type Timestamp2Offset struct {
 	*sync.Mutex
 
 	// capacity is the capacity of Timestamp2Offset.
 	capacity int
 
+	// firstOffset is the oldest added offset which has not been evicted.
+	firstOffset int
+
 	// lastOffset is the last added offset (used for error checking).
 	lastOffset int
 
-	// offset2Timestamp stores the mapping from offsets to timestamps.
-	offset2Timestamp map[int]time.Time
+	// entries is the ring buffer of entries, with firstOffset's entry at head.
+	entries []timestamp2OffsetEntry
+
+	// head is the index of firstOffset's entry in entries.
+	head int
+
+	// n is the number of entries.
+	n int
 
-	// timestamp2Offsets stores the mapping from timestamps to unordered offsets.
-	timestamp2Offsets *b.Tree[timestamp2OffsetsKey, struct{}]
+	// outOfOrder is the number of entries whose timestamp is before the previous entry's.
+	outOfOrder int
 }
 
-type timestamp2OffsetsKey struct {
+type timestamp2OffsetEntry struct {
 	timestamp time.Time
-	offset    int
-}
 
-func timestamp2OffsetsKeyCmp(a, b timestamp2OffsetsKey) int {
-	c := a.timestamp.Compare(b.timestamp)
-	if c == 0 {
-		c = cmp.Compare(a.offset, b.offset)
-	}
-	return c
+	// sequenceNumber is the Kinesis sequence number of the offset's record, if known.
+	sequenceNumber string
 }
 
 // NewTimestamp2Offset returns a new Timestamp2Offset with the specified capacity.
@@ -47,80 +63,393 @@ func NewTimestamp2Offset(capacity int) (*Timestamp2Offset, error) {
 	}
 
 	return &Timestamp2Offset{
-		Mutex:             &sync.Mutex{},
-		capacity:          capacity,
-		lastOffset:        -1,
-		offset2Timestamp:  make(map[int]time.Time),
-		timestamp2Offsets: b.TreeNew[timestamp2OffsetsKey, struct{}](timestamp2OffsetsKeyCmp),
+		Mutex:       &sync.Mutex{},
+		capacity:    capacity,
+		firstOffset: -1,
+		lastOffset:  -1,
+		entries:     make([]timestamp2OffsetEntry, capacity),
 	}, nil
 }
 
+// at returns the i-th oldest entry.
+func (m *Timestamp2Offset) at(i int) timestamp2OffsetEntry {
+	return m.entries[(m.head+i)%m.capacity]
+}
+
+// lookup returns the entry for the specified offset, if it has not been evicted.
+func (m *Timestamp2Offset) lookup(offset int) (timestamp2OffsetEntry, bool) {
+	if m.n == 0 || offset < m.firstOffset || offset > m.lastOffset {
+		return timestamp2OffsetEntry{}, false
+	}
+
+	return m.at(offset - m.firstOffset), true
+}
+
+// firstAtOrAfter returns the index of the entry with the earliest timestamp at or after the specified timestamp,
+// breaking ties by the smallest offset, or -1 if there is none.
+func (m *Timestamp2Offset) firstAtOrAfter(timestamp time.Time) int {
+	if m.outOfOrder == 0 {
+		if i := sort.Search(m.n, func(i int) bool { return !m.at(i).timestamp.Before(timestamp) }); i < m.n {
+			return i
+		}
+		return -1
+	}
+
+	found := -1
+	for i := 0; i < m.n; i++ {
+		if t := m.at(i).timestamp; !t.Before(timestamp) && (found < 0 || t.Before(m.at(found).timestamp)) {
+			found = i
+		}
+	}
+	return found
+}
+
+// lastAtOrBefore returns the index of the entry with the latest timestamp at or before (or, if strict, before) the
+// specified timestamp, breaking ties by the largest offset, or -1 if there is none.
+func (m *Timestamp2Offset) lastAtOrBefore(timestamp time.Time, strict bool) int {
+	before := func(t time.Time) bool {
+		if strict {
+			return t.Before(timestamp)
+		}
+		return !t.After(timestamp)
+	}
+
+	if m.outOfOrder == 0 {
+		return sort.Search(m.n, func(i int) bool { return !before(m.at(i).timestamp) }) - 1
+	}
+
+	found := -1
+	for i := 0; i < m.n; i++ {
+		if t := m.at(i).timestamp; before(t) && (found < 0 || !t.Before(m.at(found).timestamp)) {
+			found = i
+		}
+	}
+	return found
+}
+
+// LastTimestamp returns the timestamp of the last added offset, if any.
+func (m *Timestamp2Offset) LastTimestamp() (time.Time, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.LastTimestampUnlocked()
+}
+
+// LastTimestampUnlocked is like LastTimestamp, but the caller must hold the embedded mutex.
+func (m *Timestamp2Offset) LastTimestampUnlocked() (time.Time, bool) {
+	entry, ok := m.lookup(m.lastOffset)
+	return entry.timestamp, ok
+}
+
+// TimestampForOffset returns the timestamp of the specified offset, or false if it has been evicted (or was never
+// added).
+func (m *Timestamp2Offset) TimestampForOffset(offset int) (time.Time, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	entry, ok := m.lookup(offset)
+	return entry.timestamp, ok
+}
+
+// SequenceNumberForOffset returns the Kinesis sequence number of the specified offset's record, or false if it has been
+// evicted (or was never added), or was added without one.
+func (m *Timestamp2Offset) SequenceNumberForOffset(offset int) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	entry, ok := m.lookup(offset)
+	return entry.sequenceNumber, ok && entry.sequenceNumber != ""
+}
+
+// OldestOffset returns the oldest offset which has not been evicted, if any.
+func (m *Timestamp2Offset) OldestOffset() (int, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.OldestOffsetUnlocked()
+}
+
+// OldestOffsetUnlocked is like OldestOffset, but the caller must hold the embedded mutex.
+func (m *Timestamp2Offset) OldestOffsetUnlocked() (int, bool) {
+	if m.n == 0 {
+		return -1, false
+	}
+
+	return m.firstOffset, true
+}
+
 // NearestOffset returns the smallest offset since the specified timestamp. If there is no smallest timestamp since
 // the specified timestamp, it returns the next earliest offset, if any.
+//
+// Timestamps need not be added in order. NearestOffset seeks by timestamp, so it returns the offset with the earliest
+// timestamp at or after the specified timestamp (breaking ties by the smallest offset). If timestamps are out of order,
+// smaller offsets may have later timestamps, and streaming from the returned offset skips them. Callers that need
+// contiguous results should clamp timestamps to be monotonic before adding them (see LastTimestamp).
 func (m *Timestamp2Offset) NearestOffset(timestamp time.Time) (int, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.NearestOffsetUnlocked(timestamp)
+}
+
+// NearestOffsetUnlocked is like NearestOffset, but the caller must hold the embedded mutex.
+func (m *Timestamp2Offset) NearestOffsetUnlocked(timestamp time.Time) (int, bool) {
 	// Go forward…
-	e, _ := m.timestamp2Offsets.Seek(timestamp2OffsetsKey{
-		timestamp: timestamp,
-		offset:    0,
-	})
-	if k, _, err := e.Next(); err == nil {
-		return k.offset, true
+	if i := m.firstAtOrAfter(timestamp); i >= 0 {
+		return m.firstOffset + i, true
 	}
 
 	// Go backward…
-	e, _ = m.timestamp2Offsets.Seek(timestamp2OffsetsKey{
-		timestamp: timestamp,
-		offset:    0,
-	})
-	if k, _, err := e.Prev(); err == nil {
-		return k.offset, true
+	if i := m.lastAtOrBefore(timestamp, true); i >= 0 {
+		return m.firstOffset + i, true
+	}
+
+	return -1, false
+}
+
+// OffsetsBetween returns the inclusive range of offsets covering the events with timestamps in [start, end], or false
+// if there are none.
+//
+// Like NearestOffset, OffsetsBetween seeks by timestamp: forward from start to the offset with the earliest timestamp
+// at or after start (breaking ties by the smallest offset), and backward from end to the offset with the latest
+// timestamp at or before end (breaking ties by the largest offset). If timestamps are out of order, the range between
+// these offsets may include events outside [start, end], and exclude some within it.
+func (m *Timestamp2Offset) OffsetsBetween(start, end time.Time) (from, to int, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if end.Before(start) {
+		return -1, -1, false
+	}
+
+	// Go forward from start…
+	first := m.firstAtOrAfter(start)
+	if first < 0 || m.at(first).timestamp.After(end) {
+		return -1, -1, false
+	}
+
+	// Go backward from end…
+	last := m.lastAtOrBefore(end, false)
+	if last < 0 {
+		return -1, -1, false
+	}
+
+	return m.firstOffset + min(first, last), m.firstOffset + max(first, last), true
+}
+
+// NearestOffsetAfter is like NearestOffset, but without the fallback: it returns the offset with the earliest timestamp
+// at or after the specified timestamp (breaking ties by the smallest offset), or false if there is none.
+func (m *Timestamp2Offset) NearestOffsetAfter(timestamp time.Time) (int, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.NearestOffsetAfterUnlocked(timestamp)
+}
+
+// NearestOffsetAfterUnlocked is like NearestOffsetAfter, but the caller must hold the embedded mutex.
+func (m *Timestamp2Offset) NearestOffsetAfterUnlocked(timestamp time.Time) (int, bool) {
+	if i := m.firstAtOrAfter(timestamp); i >= 0 {
+		return m.firstOffset + i, true
 	}
 
 	return -1, false
 }
 
+// SurroundingOffsets returns the offsets bracketing the specified timestamp, like for positioning a seek: before is the
+// offset with the latest timestamp before it (breaking ties by the largest offset), and after is the offset with the
+// earliest timestamp at or after it (breaking ties by the smallest offset). Either is -1 if the timestamp is before or
+// after every offset, and ok is false if there are no offsets at all.
+//
+// Like NearestOffset, SurroundingOffsets seeks by timestamp, so if timestamps are out of order, before may be greater
+// than after.
+func (m *Timestamp2Offset) SurroundingOffsets(timestamp time.Time) (before int, after int, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.n == 0 {
+		return -1, -1, false
+	}
+
+	before, after = -1, -1
+	if i := m.lastAtOrBefore(timestamp, true); i >= 0 {
+		before = m.firstOffset + i
+	}
+	if i := m.firstAtOrAfter(timestamp); i >= 0 {
+		after = m.firstOffset + i
+	}
+
+	return before, after, true
+}
+
 // Add adds an offset and its timestamp. Offsets must be added in order.
 func (m *Timestamp2Offset) Add(offset int, timestamp time.Time) error {
+	return m.AddWithSequenceNumber(offset, timestamp, "")
+}
+
+// AddWithSequenceNumber is like Add, but also records the Kinesis sequence number of the offset's record, so
+// that it can be looked up with SequenceNumberForOffset.
+func (m *Timestamp2Offset) AddWithSequenceNumber(offset int, timestamp time.Time, sequenceNumber string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.AddWithSequenceNumberUnlocked(offset, timestamp, sequenceNumber)
+}
+
+// AddWithSequenceNumberUnlocked is like AddWithSequenceNumber, but the caller must hold the embedded mutex.
+func (m *Timestamp2Offset) AddWithSequenceNumberUnlocked(offset int, timestamp time.Time, sequenceNumber string) error {
 	if offset < 0 {
 		return errors.New("offsets must be non-negative")
 	}
 
-	n := len(m.offset2Timestamp)
-	if n == 0 {
-		// Set the initial offset.
-		m.lastOffset = offset
-	} else if m.lastOffset != offset-1 {
+	if m.n > 0 && m.lastOffset != offset-1 {
 		return fmt.Errorf("cannot add offset %d when last offset was %d", offset, m.lastOffset)
 	}
 
-	if n == m.capacity {
-		// We are at capacity. Remove the oldest entry oldestOffset.
-		oldestOffset := offset - m.capacity
-		oldestOffsetTimestamp, ok := m.offset2Timestamp[oldestOffset]
-		if !ok {
-			return fmt.Errorf("old offset to remove %d not found", oldestOffset)
+	// Remove the oldest entry if we are at capacity.
+	if m.n == m.capacity {
+		m.evictOldest()
+	}
+
+	if m.n == 0 {
+		// Set the initial offset. (Or, if everything was evicted, start over at this offset.)
+		m.head = 0
+		m.firstOffset = offset
+	} else if timestamp.Before(m.at(m.n - 1).timestamp) {
+		m.outOfOrder++
+	}
+
+	// Add the newest entry offset.
+	m.entries[(m.head+m.n)%m.capacity] = timestamp2OffsetEntry{
+		timestamp:      timestamp,
+		sequenceNumber: sequenceNumber,
+	}
+	m.n++
+
+	m.lastOffset = offset
+	return nil
+}
+
+// snapshotVersion is the version of the format written by Snapshot. Version 1 lacked sequence numbers, and versions 1
+// and 2 included event sizes, but Restore still accepts them.
+const snapshotVersion = 3
+
+// Snapshot serializes the offsets, along with their timestamps and sequence numbers, so that they can be restored with
+// Restore.
+//
+// The format is compact: a version byte, followed by uvarints for the first offset and the number of offsets, followed
+// by a varint timestamp (in Unix nanoseconds) and a length-prefixed sequence number for each offset, in order. Offsets are consecutive, so they needn't be written individually.
+func (m *Timestamp2Offset) Snapshot() []byte {
+	m.Lock()
+	defer m.Unlock()
+
+	buf := make([]byte, 0, 1+3*binary.MaxVarintLen64*(m.n+1))
+	buf = append(buf, snapshotVersion)
+	buf = binary.AppendUvarint(buf, uint64(max(m.firstOffset, 0)))
+	buf = binary.AppendUvarint(buf, uint64(m.n))
+	for i := 0; i < m.n; i++ {
+		entry := m.at(i)
+		buf = binary.AppendVarint(buf, entry.timestamp.UnixNano())
+		buf = binary.AppendUvarint(buf, uint64(len(entry.sequenceNumber)))
+		buf = append(buf, entry.sequenceNumber...)
+	}
+
+	return buf
+}
+
+// Restore replaces the offsets with those serialized by Snapshot. The offsets are re-added in order, so the capacity
+// is enforced as usual, evicting the oldest offsets if the snapshot doesn't fit, and subsequent
+// calls to Add must continue from the last restored offset. If the snapshot is invalid, Restore returns an error and
+// leaves the offsets unchanged.
+func (m *Timestamp2Offset) Restore(snapshot []byte) error {
+	if len(snapshot) == 0 || snapshot[0] < 1 || snapshot[0] > snapshotVersion {
+		return errors.New("unsupported snapshot version")
+	}
+	version := snapshot[0]
+	snapshot = snapshot[1:]
+
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(snapshot)
+		if n <= 0 {
+			return 0, errors.New("truncated snapshot")
 		}
+		snapshot = snapshot[n:]
+		return v, nil
+	}
 
-		if ok = m.timestamp2Offsets.Delete(timestamp2OffsetsKey{
-			timestamp: oldestOffsetTimestamp,
-			offset:    oldestOffset,
-		}); !ok {
-			return fmt.Errorf("timestamp %s for old offset to remove %d not found", oldestOffsetTimestamp.Format(time.RFC3339), oldestOffset)
+	firstOffset, err := readUvarint()
+	if err != nil {
+		return err
+	}
+	n, err := readUvarint()
+	if err != nil {
+		return err
+	}
+	if firstOffset > math.MaxInt32 || n > math.MaxInt32 {
+		return errors.New("snapshot offsets out of range")
+	}
+
+	restored, err := NewTimestamp2Offset(m.capacity)
+	if err != nil {
+		return err
+	}
+
+	for offset := int(firstOffset); offset < int(firstOffset+n); offset++ {
+		timestamp, k := binary.Varint(snapshot)
+		if k <= 0 {
+			return errors.New("truncated snapshot")
+		}
+		snapshot = snapshot[k:]
+
+		if version <= 2 {
+			// Skip the event's size, which we no longer track.
+			if _, err := readUvarint(); err != nil {
+				return err
+			}
 		}
 
-		delete(m.offset2Timestamp, oldestOffset)
+		var sequenceNumber string
+		if version >= 2 {
+			length, err := readUvarint()
+			if err != nil {
+				return err
+			}
+			if length > uint64(len(snapshot)) {
+				return errors.New("truncated snapshot")
+			}
+			sequenceNumber = string(snapshot[:length])
+			snapshot = snapshot[length:]
+		}
+
+		if err := restored.AddWithSequenceNumber(offset, time.Unix(0, timestamp), sequenceNumber); err != nil {
+			return err
+		}
 	}
 
-	// Add the newest entry offset.
-	m.offset2Timestamp[offset] = timestamp
-	m.timestamp2Offsets.Set(
-		timestamp2OffsetsKey{
-			timestamp: timestamp,
-			offset:    offset,
-		},
-		struct{}{},
-	)
+	if len(snapshot) > 0 {
+		return errors.New("trailing data in snapshot")
+	}
 
-	m.lastOffset = offset
+	m.Lock()
+	defer m.Unlock()
+
+	m.firstOffset = restored.firstOffset
+	m.lastOffset = restored.lastOffset
+	m.entries = restored.entries
+	m.head = restored.head
+	m.n = restored.n
+	m.outOfOrder = restored.outOfOrder
 	return nil
 }
+
+// evictOldest removes the oldest entry.
+func (m *Timestamp2Offset) evictOldest() {
+	oldest := m.at(0)
+	if m.n > 1 && m.at(1).timestamp.Before(oldest.timestamp) {
+		m.outOfOrder--
+	}
+
+	m.entries[m.head] = timestamp2OffsetEntry{}
+	m.head = (m.head + 1) % m.capacity
+	m.n--
+	m.firstOffset++
+}
@@ -1,6 +1,9 @@
 package kinesis2sse
 
 import (
+	"math/rand"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -90,3 +93,379 @@ func TestTimestamp2Offset(t *testing.T) {
 	r.Equal(1, off)
 	r.True(ok)
 }
+
+func TestTimestamp2OffsetOffsetsBetween(t *testing.T) {
+	r := require.New(t)
+
+	t2o, err := NewTimestamp2Offset(3)
+	r.NoError(err)
+
+	// t2o is empty. Therefore, OffsetsBetween returns nothing.
+	// []
+	_, _, ok := t2o.OffsetsBetween(time.UnixMilli(0), time.UnixMilli(1_000))
+	r.False(ok)
+
+	// [0 → 100, 1 → 200, 2 → 200, 3 → 300], but the earliest has been shifted out.
+	// [1 → 200, 2 → 200, 3 → 300]
+	for i, ms := range []int64{100, 200, 200, 300} {
+		err = t2o.Add(i, time.UnixMilli(ms))
+		r.NoError(err)
+	}
+
+	for _, tc := range []struct {
+		start, end int64
+		from, to   int
+		ok         bool
+	}{
+		// Ranges covering every offset.
+		{start: 0, end: 1_000, from: 1, to: 3, ok: true},
+		{start: 200, end: 300, from: 1, to: 3, ok: true},
+
+		// Boundaries are inclusive, and ties include every offset at that timestamp.
+		{start: 200, end: 200, from: 1, to: 2, ok: true},
+		{start: 300, end: 300, from: 3, to: 3, ok: true},
+		{start: 150, end: 250, from: 1, to: 2, ok: true},
+
+		// Ranges covering no offsets, including those of evicted offsets.
+		{start: 0, end: 150, ok: false},
+		{start: 100, end: 100, ok: false},
+		{start: 250, end: 275, ok: false},
+		{start: 350, end: 1_000, ok: false},
+
+		// Ranges which end before they start.
+		{start: 300, end: 200, ok: false},
+	} {
+		from, to, ok := t2o.OffsetsBetween(time.UnixMilli(tc.start), time.UnixMilli(tc.end))
+		r.Equal(tc.ok, ok, "[%d, %d]", tc.start, tc.end)
+		if tc.ok {
+			r.Equal(tc.from, from, "[%d, %d]", tc.start, tc.end)
+			r.Equal(tc.to, to, "[%d, %d]", tc.start, tc.end)
+		}
+	}
+}
+
+func TestTimestamp2OffsetTimestampForOffset(t *testing.T) {
+	r := require.New(t)
+
+	t2o, err := NewTimestamp2Offset(2)
+	r.NoError(err)
+
+	// Offsets which were never added have no timestamp.
+	_, ok := t2o.TimestampForOffset(0)
+	r.False(ok)
+
+	// [0 → 100, 1 → 500]
+	err = t2o.Add(0, time.UnixMilli(100))
+	r.NoError(err)
+	err = t2o.Add(1, time.UnixMilli(500))
+	r.NoError(err)
+
+	timestamp, ok := t2o.TimestampForOffset(0)
+	r.True(ok)
+	r.Equal(time.UnixMilli(100), timestamp)
+
+	timestamp, ok = t2o.TimestampForOffset(1)
+	r.True(ok)
+	r.Equal(time.UnixMilli(500), timestamp)
+
+	// Once an offset is evicted past capacity, its timestamp is no longer available.
+	// [1 → 500, 2 → 250]
+	err = t2o.Add(2, time.UnixMilli(250))
+	r.NoError(err)
+
+	_, ok = t2o.TimestampForOffset(0)
+	r.False(ok)
+
+	timestamp, ok = t2o.TimestampForOffset(2)
+	r.True(ok)
+	r.Equal(time.UnixMilli(250), timestamp)
+}
+
+func TestTimestamp2OffsetNearestOffsetAfter(t *testing.T) {
+	r := require.New(t)
+
+	t2o, err := NewTimestamp2Offset(2)
+	r.NoError(err)
+
+	// t2o is empty. Therefore, NearestOffsetAfter returns nothing.
+	// []
+	off, ok := t2o.NearestOffsetAfter(time.UnixMilli(0))
+	r.Equal(-1, off)
+	r.False(ok)
+
+	// [0 → 100, 1 → 500]
+	err = t2o.Add(0, time.UnixMilli(100))
+	r.NoError(err)
+	err = t2o.Add(1, time.UnixMilli(500))
+	r.NoError(err)
+
+	for _, tc := range []struct {
+		timestamp int64
+		off       int
+		ok        bool
+	}{
+		{timestamp: 0, off: 0, ok: true},
+		{timestamp: 100, off: 0, ok: true},
+		{timestamp: 250, off: 1, ok: true},
+		{timestamp: 500, off: 1, ok: true},
+
+		// Unlike NearestOffset, there's no fallback to an earlier offset.
+		{timestamp: 1_000, off: -1, ok: false},
+	} {
+		off, ok := t2o.NearestOffsetAfter(time.UnixMilli(tc.timestamp))
+		r.Equal(tc.off, off, tc.timestamp)
+		r.Equal(tc.ok, ok, tc.timestamp)
+	}
+}
+
+func TestTimestamp2OffsetSurroundingOffsets(t *testing.T) {
+	r := require.New(t)
+
+	t2o, err := NewTimestamp2Offset(3)
+	r.NoError(err)
+
+	// t2o is empty. Therefore, SurroundingOffsets returns nothing.
+	// []
+	before, after, ok := t2o.SurroundingOffsets(time.UnixMilli(0))
+	r.Equal(-1, before)
+	r.Equal(-1, after)
+	r.False(ok)
+
+	// [0 → 100, 1 → 500, 2 → 500]
+	err = t2o.Add(0, time.UnixMilli(100))
+	r.NoError(err)
+	err = t2o.Add(1, time.UnixMilli(500))
+	r.NoError(err)
+	err = t2o.Add(2, time.UnixMilli(500))
+	r.NoError(err)
+
+	for _, tc := range []struct {
+		timestamp int64
+		before    int
+		after     int
+	}{
+		{timestamp: 0, before: -1, after: 0},
+		{timestamp: 100, before: -1, after: 0},
+		{timestamp: 250, before: 0, after: 1},
+		{timestamp: 500, before: 0, after: 1},
+		{timestamp: 1_000, before: 2, after: -1},
+	} {
+		before, after, ok := t2o.SurroundingOffsets(time.UnixMilli(tc.timestamp))
+		r.Equal(tc.before, before, tc.timestamp)
+		r.Equal(tc.after, after, tc.timestamp)
+		r.True(ok, tc.timestamp)
+	}
+}
+
+func TestTimestamp2OffsetSnapshot(t *testing.T) {
+	r := require.New(t)
+
+	t2o, err := NewTimestamp2Offset(3)
+	r.NoError(err)
+
+	// An empty snapshot restores to empty.
+	restored, err := NewTimestamp2Offset(3)
+	r.NoError(err)
+	r.NoError(restored.Restore(t2o.Snapshot()))
+	_, ok := restored.OldestOffset()
+	r.False(ok)
+
+	// [0 → 100, 1 → 500, 2 → 250, 3 → 300], but the earliest has been shifted out.
+	// [1 → 500, 2 → 250, 3 → 300]
+	for i, ms := range []int64{100, 500, 250, 300} {
+		err = t2o.AddWithSequenceNumber(i, time.UnixMilli(ms), strconv.Itoa(i))
+		r.NoError(err)
+	}
+
+	snapshot := t2o.Snapshot()
+
+	restored, err = NewTimestamp2Offset(3)
+	r.NoError(err)
+	r.NoError(restored.Restore(snapshot))
+
+	off, ok := restored.OldestOffset()
+	r.True(ok)
+	r.Equal(1, off)
+
+	for _, ms := range []int64{0, 250, 260, 500, 1_000} {
+		expected, expectedOK := t2o.NearestOffset(time.UnixMilli(ms))
+		off, ok := restored.NearestOffset(time.UnixMilli(ms))
+		r.Equal(expected, off, ms)
+		r.Equal(expectedOK, ok, ms)
+	}
+
+	timestamp, ok := restored.TimestampForOffset(2)
+	r.True(ok)
+	r.True(time.UnixMilli(250).Equal(timestamp))
+
+	sequenceNumber, ok := restored.SequenceNumberForOffset(2)
+	r.True(ok)
+	r.Equal("2", sequenceNumber)
+
+	// Subsequent offsets must continue from the last restored offset.
+	r.Error(restored.Add(5, time.UnixMilli(600)))
+	r.NoError(restored.Add(4, time.UnixMilli(600)))
+
+	// Restoring into a smaller capacity keeps the newest offsets.
+	// [2 → 250, 3 → 300]
+	smaller, err := NewTimestamp2Offset(2)
+	r.NoError(err)
+	r.NoError(smaller.Restore(snapshot))
+
+	off, ok = smaller.OldestOffset()
+	r.True(ok)
+	r.Equal(2, off)
+
+	// Invalid snapshots are rejected, leaving the offsets unchanged.
+	r.Error(smaller.Restore(nil))
+	r.Error(smaller.Restore(snapshot[:len(snapshot)-1]))
+	r.Error(smaller.Restore(append(snapshot, 0)))
+
+	off, ok = smaller.OldestOffset()
+	r.True(ok)
+	r.Equal(2, off)
+
+	// Version 1 snapshots, which lack sequence numbers, and version 2 snapshots, which include event sizes, can still be
+	// restored.
+	// [7 → 100]
+	r.NoError(smaller.Restore([]byte{1, 7, 1, 128, 132, 175, 95, 10}))
+	timestamp, ok = smaller.TimestampForOffset(7)
+	r.True(ok)
+	r.True(time.UnixMilli(100).Equal(timestamp), timestamp)
+	_, ok = smaller.SequenceNumberForOffset(7)
+	r.False(ok)
+
+	// [7 → 100 ("7")]
+	r.NoError(smaller.Restore([]byte{2, 7, 1, 128, 132, 175, 95, 10, 1, '7'}))
+	timestamp, ok = smaller.TimestampForOffset(7)
+	r.True(ok)
+	r.True(time.UnixMilli(100).Equal(timestamp), timestamp)
+	sequenceNumber, ok = smaller.SequenceNumberForOffset(7)
+	r.True(ok)
+	r.Equal("7", sequenceNumber)
+}
+
+func TestTimestamp2OffsetSequenceNumberForOffset(t *testing.T) {
+	r := require.New(t)
+
+	t2o, err := NewTimestamp2Offset(2)
+	r.NoError(err)
+
+	// [0 → "a", 1 → "", 2 → "c"], but the earliest has been shifted out.
+	// [1 → "", 2 → "c"]
+	r.NoError(t2o.AddWithSequenceNumber(0, time.UnixMilli(0), "a"))
+	r.NoError(t2o.Add(1, time.UnixMilli(0)))
+	r.NoError(t2o.AddWithSequenceNumber(2, time.UnixMilli(0), "c"))
+
+	for off, expected := range map[int]string{0: "", 1: "", 2: "c", 3: ""} {
+		sequenceNumber, ok := t2o.SequenceNumberForOffset(off)
+		r.Equal(expected, sequenceNumber, off)
+		r.Equal(expected != "", ok, off)
+	}
+}
+
+func TestTimestamp2OffsetOutOfOrder(t *testing.T) {
+	r := require.New(t)
+
+	// nearestOffset is a brute-force NearestOffset over timestamps, indexed from firstOffset.
+	nearestOffset := func(timestamps []int64, firstOffset int, timestamp int64) (int, bool) {
+		found := -1
+		for i, ts := range timestamps {
+			if ts >= timestamp && (found < 0 || ts < timestamps[found]) {
+				found = i
+			}
+		}
+		if found < 0 {
+			for i, ts := range timestamps {
+				if ts < timestamp && (found < 0 || ts >= timestamps[found]) {
+					found = i
+				}
+			}
+		}
+		if found < 0 {
+			return -1, false
+		}
+		return firstOffset + found, true
+	}
+
+	t2o, err := NewTimestamp2Offset(8)
+	r.NoError(err)
+
+	// Mostly-monotonic timestamps, with some skew and ties, so that lookups switch between binary search and scanning
+	// as out-of-order timestamps are added and evicted.
+	rng := rand.New(rand.NewSource(1))
+	var timestamps []int64
+	for offset := 0; offset < 200; offset++ {
+		ts := int64(offset*10) + rng.Int63n(40) - 20
+		err = t2o.Add(offset, time.UnixMilli(ts))
+		r.NoError(err)
+
+		timestamps = append(timestamps, ts)
+		if len(timestamps) > 8 {
+			timestamps = timestamps[1:]
+		}
+		firstOffset := offset - len(timestamps) + 1
+
+		for _, query := range []int64{ts - 50, ts - 15, ts, ts + 5, ts + 50} {
+			expected, expectedOK := nearestOffset(timestamps, firstOffset, query)
+			off, ok := t2o.NearestOffset(time.UnixMilli(query))
+			r.Equal(expectedOK, ok, "offset %d, query %d", offset, query)
+			r.Equal(expected, off, "offset %d, query %d", offset, query)
+		}
+	}
+}
+
+func TestTimestamp2OffsetConcurrent(t *testing.T) {
+	r := require.New(t)
+
+	t2o, err := NewTimestamp2Offset(16)
+	r.NoError(err)
+
+	// One goroutine adds offsets, as a KCL worker would, while others look them up, as streams would. Run with -race to
+	// check that the exported methods lock.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for offset := 0; offset < 1_000; offset++ {
+			if offset%2 == 0 {
+				r.NoError(t2o.Add(offset, time.UnixMilli(int64(offset))))
+				continue
+			}
+
+			// Batches hold the lock themselves.
+			t2o.Lock()
+			last, ok := t2o.LastTimestampUnlocked()
+			r.True(ok)
+			r.NoError(t2o.AddWithSequenceNumberUnlocked(offset, last.Add(time.Millisecond), strconv.Itoa(offset)))
+			t2o.Unlock()
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1_000; j++ {
+				t2o.NearestOffset(time.UnixMilli(int64(j)))
+				t2o.NearestOffsetAfter(time.UnixMilli(int64(j)))
+				t2o.OffsetsBetween(time.UnixMilli(int64(j)), time.UnixMilli(int64(j+10)))
+				t2o.SurroundingOffsets(time.UnixMilli(int64(j)))
+				t2o.OldestOffset()
+				t2o.LastTimestamp()
+				t2o.TimestampForOffset(j)
+				t2o.SequenceNumberForOffset(j)
+				t2o.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+
+	off, ok := t2o.OldestOffset()
+	r.True(ok)
+	r.Equal(1_000-16, off)
+
+	sequenceNumber, ok := t2o.SequenceNumberForOffset(999)
+	r.True(ok)
+	r.Equal("999", sequenceNumber)
+}
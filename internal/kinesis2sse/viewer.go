@@ -0,0 +1,31 @@
+package kinesis2sse
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"slices"
+)
+
+//go:embed viewer/index.html
+var viewerFS embed.FS
+
+// viewerTemplate renders the viewer page, given the paths of the routes to offer.
+var viewerTemplate = template.Must(template.ParseFS(viewerFS, "viewer/index.html"))
+
+// handleViewer serves an HTML page which connects to a route with EventSource and lists the events it receives, for
+// demos and debugging.
+func (s *Service) handleViewer(w http.ResponseWriter, _ *http.Request) {
+	routes := s.routesSnapshot()
+	paths := make([]string, 0, len(routes))
+	for pattern := range routes {
+		paths = append(paths, patternPath(pattern))
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := viewerTemplate.Execute(w, paths); err != nil {
+		s.logger.Error("Unable to render viewer", "err", err)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -26,19 +28,76 @@ const (
 )
 
 var (
+	host                    string
 	port                    int
 	appNamePrefix           string
 	shardSyncIntervalMillis int
 	failoverTimeMillis      int
+	maxRecords              int
+	pollIntervalMillis      int
 	region                  string
+	awsProfile              string
+	assumeRoleARN           string
+	kinesisEndpoint         string
+	dynamoDBEndpoint        string
+	kclCloudWatchMetrics    bool
+	kclCloudWatchNamespace  string
+	kclCloudWatchLevel      string
 	unparsedRoutes          string
 	debug                   bool
+	healthMaxLag            time.Duration
+	memoryBudget            int
+	deadLetterFile          string
+	maxConnectionDuration   time.Duration
+	writeTimeout            time.Duration
+	maxLookback             time.Duration
+	readHeaderTimeout       time.Duration
+	readTimeout             time.Duration
+	idleTimeout             time.Duration
+	workerStartAttempts     int
+	workerStartRetryDelay   time.Duration
+	shutdownTimeout         time.Duration
+	drainTimeout            time.Duration
+	checkpointing           string
+	checkpointFile          string
+	tlsCert                 string
+	tlsKey                  string
+	adminToken              string
+	disableCompression      bool
+	disableIndex            bool
+	enableViewer            bool
+	preamble                string
+	disablePreamble         bool
+	greeting                string
+	requestIDHeader         string
+	streamHeaders           []string
+	requestIDComment        bool
+	corsAllowedOrigins      []string
+	configPaths             []string
 )
 
 // RouteOptionsCLI are the RouteOptions that can be passed via CLI.
 type RouteOptionsCLI struct {
-	// Stream is the name of the Kinesis Stream to expose.
-	Stream string `json:"stream"`
+	// Stream is the name or ARN of the Kinesis Stream to expose, or an array of them to feed into the route.
+	Stream StreamNames `json:"stream"`
+
+	// Region is the AWS region of the Kinesis Stream. Defaults to the region of the stream ARN, if Stream is one, or else
+	// the --region flag.
+	Region string `json:"region"`
+
+	// AWSProfile is the named profile, from the shared AWS config and credentials files, with which to access the route's
+	// streams and checkpoints. Defaults to the --aws-profile flag.
+	AWSProfile string `json:"awsProfile"`
+
+	// AssumeRoleARN is the ARN of an IAM role to assume to access the route's streams, like for cross-account access.
+	// Checkpoints are still written with the profile's or the default credentials. Defaults to the --assume-role-arn
+	// flag.
+	AssumeRoleARN string `json:"assumeRoleArn"`
+
+	// KinesisEndpoint and DynamoDBEndpoint are custom endpoint URLs for the route's KCL workers' Kinesis and DynamoDB
+	// clients, like LocalStack's. Default to the --kinesis-endpoint and --dynamodb-endpoint flags.
+	KinesisEndpoint  string `json:"kinesisEndpoint"`
+	DynamoDBEndpoint string `json:"dynamodbEndpoint"`
 
 	// Path is the path to expose the Kinesis Stream at.
 	Path string `json:"path"`
@@ -55,6 +114,134 @@ type RouteOptionsCLI struct {
 	//
 	// Definitions of these can be found in the Amazon Kinesis documentation. Defaults to "LATEST".
 	Start string `json:"start"`
+
+	// EnhancedFanOut reads the route's streams through an enhanced fan-out consumer, which gets its own read throughput
+	// rather than sharing the stream's with other consumers. The consumer is registered, if it doesn't already exist,
+	// and named EnhancedFanOutConsumerName.
+	EnhancedFanOut bool `json:"enhancedFanOut"`
+
+	// EnhancedFanOutConsumerName is the name of the enhanced fan-out consumer, and implies EnhancedFanOut. Defaults to
+	// the --app-name-prefix flag.
+	EnhancedFanOutConsumerName string `json:"enhancedFanOutConsumerName"`
+
+	// EnhancedFanOutConsumerARN is the ARN of an already-registered enhanced fan-out consumer, and implies
+	// EnhancedFanOut. Since a consumer belongs to one stream, it can't be used by routes with multiple streams.
+	EnhancedFanOutConsumerARN string `json:"enhancedFanOutConsumerArn"`
+
+	// ShardSyncIntervalMillis is how often, in milliseconds, to sync the stream's shards, like after resharding.
+	// Defaults to the --shard-sync-interval-millis flag.
+	ShardSyncIntervalMillis int `json:"shardSyncIntervalMillis"`
+
+	// FailoverTimeMillis is how long, in milliseconds, a shard's lease lasts before another worker may take it over.
+	// Defaults to the --failover-time-millis flag.
+	FailoverTimeMillis int `json:"failoverTimeMillis"`
+
+	// MaxRecords is the maximum number of records to fetch per GetRecords call. Defaults to the --max-records flag.
+	MaxRecords int `json:"maxRecords"`
+
+	// PollIntervalMillis is how long, in milliseconds, to wait between GetRecords calls. Defaults to the
+	// --poll-interval-millis flag.
+	PollIntervalMillis int `json:"pollIntervalMillis"`
+
+	// HealthMaxLag is the consumer lag, like "60s", beyond which /health reports the route as unhealthy. Defaults to
+	// the --health-max-lag flag.
+	HealthMaxLag string `json:"healthMaxLag"`
+
+	// MonotonicTimestamps clamps each event's indexed timestamp to be no earlier than the previous event's, which
+	// guards "since" lookups against producer clock skew.
+	MonotonicTimestamps bool `json:"monotonicTimestamps"`
+
+	// SlowClientPolicy is what to do when a client can't keep up: "block" (the default), "disconnect", or "skip".
+	SlowClientPolicy string `json:"slowClientPolicy"`
+
+	// SlowClientTimeout is how long a write to a client may take, like "10s", before the client is considered slow.
+	SlowClientTimeout string `json:"slowClientTimeout"`
+
+	// Schema is a JSON Schema describing the route's events, sent to clients which pass "schema=true".
+	Schema json.RawMessage `json:"schema"`
+
+	// Retry is how long, in milliseconds, clients should wait before reconnecting. If unset, clients use their default.
+	Retry int `json:"retry"`
+
+	// HeartbeatInterval is how often, like "15s", to send a heartbeat comment to idle clients. If unset, no heartbeats
+	// are sent.
+	HeartbeatInterval string `json:"heartbeatInterval"`
+
+	// FlushEvery and FlushInterval, like "100ms", buffer events and flush them to each client together, once FlushEvery
+	// of them are buffered or FlushInterval after the first, trading latency for throughput. If unset, every event is
+	// flushed as soon as it's written.
+	FlushEvery    int    `json:"flushEvery"`
+	FlushInterval string `json:"flushInterval"`
+
+	// EventNameField is a top-level field of each event, like "detail-type", to use as its SSE event name.
+	EventNameField string `json:"eventNameField"`
+
+	// CloudEventsTypeField is a top-level field of each event to use as its CloudEvents "type".
+	CloudEventsTypeField string `json:"cloudEventsTypeField"`
+
+	// MaxConnections is the maximum number of concurrent streams the route serves. Defaults to unlimited.
+	MaxConnections int `json:"maxConnections"`
+
+	// MaxEventBytes is the maximum size, in bytes, of an event, up to 1 MiB. Larger events are dropped. Defaults to 1 MiB.
+	MaxEventBytes int `json:"maxEventBytes"`
+
+	// MaxLag is the number of events a client may fall behind the latest event before its connection is closed.
+	// Defaults to unlimited.
+	MaxLag int `json:"maxLag"`
+
+	// TimeField is the top-level field of each record containing its RFC 3339 timestamp. Defaults to "time".
+	TimeField string `json:"timeField"`
+
+	// PayloadField is the top-level field of each record containing the event to serve. Defaults to "detail".
+	PayloadField string `json:"payloadField"`
+
+	// TimestampFallback is how to timestamp records whose TimeField is missing or un-parseable: "skip" them (the
+	// default), use when Kinesis received them ("arrival"), or use when we ingest them ("now").
+	TimestampFallback string `json:"timestampFallback"`
+
+	// Envelope is whether to serve only each record's PayloadField ("detail", the default), or the whole record
+	// ("full").
+	Envelope string `json:"envelope"`
+
+	// EnvelopeKeys, if set, are the top-level fields of each record to serve alongside its PayloadField, rather than the
+	// whole record. Requires "full" Envelope.
+	EnvelopeKeys []string `json:"envelopeKeys"`
+
+	// RawPassthrough serves each record unchanged, indexed by the time Kinesis received it, instead of unwrapping it.
+	RawPassthrough bool `json:"rawPassthrough"`
+
+	// Binary treats each record as opaque bytes, served base64-encoded.
+	Binary bool `json:"binary"`
+
+	// Projection, if set, is a list of dotted key paths, like "order.id", into each record's payload. Only the values at
+	// these paths are served.
+	Projection []string `json:"projection"`
+
+	// Checkpointing is where the route checkpoints its progress through each shard: "memory", "dynamodb", "file", or
+	// "none", which doesn't checkpoint at all. Defaults to the --checkpointing flag.
+	Checkpointing string `json:"checkpointing"`
+
+	// Encoding is how events are stored in memory: uncompressed ("none", the default), or compressed with "gzip" or
+	// "snappy".
+	Encoding string `json:"encoding"`
+
+	// APIKeys, if set, are the keys clients must present, as a bearer token or the "api_key" query parameter, to connect
+	// to the route. They're secrets, so they're redacted in logs.
+	APIKeys []string `json:"apiKeys" redact:"true"`
+
+	// BackfillS3URI, if set, is an S3 prefix, like "s3://my-bucket/events/", of archived records to backfill on startup.
+	BackfillS3URI string `json:"backfillS3Uri"`
+
+	// BackfillWindow is how far back, like "168h", to backfill from S3.
+	BackfillWindow string `json:"backfillWindow"`
+
+	// MaxRoutes is, for a Path with wildcards, like "/tenants/{tenant}/events", the number of its matches which may be
+	// served at once. Defaults to 100.
+	MaxRoutes int `json:"maxRoutes"`
+
+	// IdleTimeout is, for a Path with wildcards, how long, like "10m", one of its matches may go without connections
+	// before it's removed. Defaults to "10m".
+	IdleTimeout string `json:"idleTimeout"`
 }
 
 var rootCmd = &cobra.Command{
@@ -65,8 +252,17 @@ var rootCmd = &cobra.Command{
   kinesis2sse --route {"stream":"my-event-stream","path":"my-events","start":"1h"}`,
 	Args: cobra.ExactArgs(0),
 	RunE: func(cmd *cobra.Command, _ []string) error {
-		if region == "" {
-			return errors.New("region must be specified with the --region flag or AWS_REGION environment variable and cannot be empty")
+		var configConflicts []string
+		if len(configPaths) > 0 {
+			config, conflicts, err := loadConfigs(configPaths)
+			if err != nil {
+				return err
+			}
+
+			if err := applyConfig(cmd, config); err != nil {
+				return err
+			}
+			configConflicts = conflicts
 		}
 
 		if len(unparsedRoutes) == 0 {
@@ -78,6 +274,22 @@ var rootCmd = &cobra.Command{
 		}
 		appName := appNamePrefix + "-" + uuid.New().String()
 
+		if shardSyncIntervalMillis <= 0 {
+			return errors.New("--shard-sync-interval-millis must be positive")
+		}
+
+		if failoverTimeMillis <= 0 {
+			return errors.New("--failover-time-millis must be positive")
+		}
+
+		if maxRecords <= 0 {
+			return errors.New("--max-records must be positive")
+		}
+
+		if pollIntervalMillis <= 0 {
+			return errors.New("--poll-interval-millis must be positive")
+		}
+
 		var programLevel = new(slog.LevelVar)
 		logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: programLevel}))
 		if debug {
@@ -90,52 +302,313 @@ var rootCmd = &cobra.Command{
 
 		kclLogger := kinesis2sse.NewKCLLogger(logger)
 
+		for _, conflict := range configConflicts {
+			logger.Debug(conflict)
+		}
+
 		var parsedRoutes []RouteOptionsCLI
 		if err := json.Unmarshal([]byte(unparsedRoutes), &parsedRoutes); err != nil {
 			return fmt.Errorf("unable to parse routes: %w", err)
 		}
 
-		routes := make([]kinesis2sse.RouteOptions, len(parsedRoutes))
+		if len(configPaths) > 0 {
+			effectiveConfig := Config{
+				Host:                    host,
+				Port:                    port,
+				AppNamePrefix:           appNamePrefix,
+				ShardSyncIntervalMillis: shardSyncIntervalMillis,
+				FailoverTimeMillis:      failoverTimeMillis,
+				MaxRecords:              maxRecords,
+				PollIntervalMillis:      pollIntervalMillis,
+				Region:                  region,
+				HealthMaxLag:            healthMaxLag.String(),
+				Routes:                  redactFields(parsedRoutes),
+			}
+			if marshalledConfig, err := json.Marshal(effectiveConfig); err == nil {
+				logger.Debug(fmt.Sprintf("Effective config: %s", marshalledConfig))
+			}
+		}
+
+		routes := make([]kinesis2sse.RouteOptions, 0, len(parsedRoutes))
+		var dynamicRoutes []kinesis2sse.DynamicRouteOptions
 
 		for i, parsedRoute := range parsedRoutes {
 			if parsedRoute.Path == "" {
 				return fmt.Errorf(`route at index %d has an empty "path"`, i)
 			}
 
-			if parsedRoute.Stream == "" {
+			if len(parsedRoute.Stream) == 0 || slices.Contains(parsedRoute.Stream, "") {
 				return fmt.Errorf(`route at index %d has an empty "stream"`, i)
 			}
 
-			// NOTE(mroberts): We should not have such big streams we are subscribed to such that this is a problem.
-			maxLeasesForWorker := 100_000
-			kclConfig := cfg.NewKinesisClientLibConfig(appName, parsedRoute.Stream, region, appName).
-				WithMaxLeasesForWorker(maxLeasesForWorker).
-				WithShardSyncIntervalMillis(shardSyncIntervalMillis).
-				WithFailoverTimeMillis(failoverTimeMillis).
-				WithLogger(kclLogger)
+			// NOTE(mroberts): The KCL panics on non-positive values, so we validate these ourselves.
+			routeShardSyncIntervalMillis, routeFailoverTimeMillis := shardSyncIntervalMillis, failoverTimeMillis
+			if parsedRoute.ShardSyncIntervalMillis < 0 {
+				return fmt.Errorf(`route at index %d has a negative "shardSyncIntervalMillis"`, i)
+			} else if parsedRoute.ShardSyncIntervalMillis > 0 {
+				routeShardSyncIntervalMillis = parsedRoute.ShardSyncIntervalMillis
+			}
+			if parsedRoute.FailoverTimeMillis < 0 {
+				return fmt.Errorf(`route at index %d has a negative "failoverTimeMillis"`, i)
+			} else if parsedRoute.FailoverTimeMillis > 0 {
+				routeFailoverTimeMillis = parsedRoute.FailoverTimeMillis
+			}
+			routeMaxRecords, routePollIntervalMillis := maxRecords, pollIntervalMillis
+			if parsedRoute.MaxRecords < 0 {
+				return fmt.Errorf(`route at index %d has a negative "maxRecords"`, i)
+			} else if parsedRoute.MaxRecords > 0 {
+				routeMaxRecords = parsedRoute.MaxRecords
+			}
+			if parsedRoute.PollIntervalMillis < 0 {
+				return fmt.Errorf(`route at index %d has a negative "pollIntervalMillis"`, i)
+			} else if parsedRoute.PollIntervalMillis > 0 {
+				routePollIntervalMillis = parsedRoute.PollIntervalMillis
+			}
+
+			newKCLConfig := func(unresolvedStream string) (*cfg.KinesisClientLibConfiguration, error) {
+				stream, routeRegion, err := resolveStream(unresolvedStream, parsedRoute.Region, region)
+				if err != nil {
+					return nil, fmt.Errorf(`route at index %d: %w`, i, err)
+				}
+
+				// NOTE(mroberts): We should not have such big streams we are subscribed to such that this is a problem.
+				maxLeasesForWorker := 100_000
+				routeProfile, routeRoleARN := awsProfile, assumeRoleARN
+				if parsedRoute.AWSProfile != "" {
+					routeProfile = parsedRoute.AWSProfile
+				}
+				if parsedRoute.AssumeRoleARN != "" {
+					routeRoleARN = parsedRoute.AssumeRoleARN
+				}
+				kinesisCreds, dynamoDBCreds, err := resolveCredentials(context.Background(), routeRegion, routeProfile, routeRoleARN)
+				if err != nil {
+					return nil, fmt.Errorf(`route at index %d: %w`, i, err)
+				}
+
+				kclConfig := cfg.NewKinesisClientLibConfigWithCredentials(appName, stream, routeRegion, appName, kinesisCreds, dynamoDBCreds).
+					WithMaxLeasesForWorker(maxLeasesForWorker).
+					WithShardSyncIntervalMillis(routeShardSyncIntervalMillis).
+					WithFailoverTimeMillis(routeFailoverTimeMillis).
+					WithMaxRecords(routeMaxRecords).
+					WithIdleTimeBetweenReadsInMillis(routePollIntervalMillis).
+					WithLogger(kclLogger)
+
+				// NOTE(mroberts): The app name is random, so that each kinesis2sse process gets its own leases. But
+				// durable checkpoints need a table which outlives the process, so we name it after the prefix and stream.
+				routeCheckpointing := parsedRoute.Checkpointing
+				if routeCheckpointing == "" {
+					routeCheckpointing = checkpointing
+				}
+				if kinesis2sse.Checkpointing(routeCheckpointing) == kinesis2sse.CheckpointingDynamoDB {
+					kclConfig = kclConfig.WithTableName(appNamePrefix + "-" + stream)
+				}
+
+				if parsedRoute.Start == "" || parsedRoute.Start == "LATEST" {
+					kclConfig = kclConfig.WithInitialPositionInStream(cfg.LATEST)
+				} else if parsedRoute.Start == "TRIM_HORIZON" {
+					kclConfig = kclConfig.WithInitialPositionInStream(cfg.TRIM_HORIZON)
+				} else if ts, err := time.Parse(time.RFC3339, parsedRoute.Start); err == nil {
+					kclConfig = kclConfig.WithTimestampAtInitialPositionInStream(&ts)
+				} else if d, err := time.ParseDuration(parsedRoute.Start); err != nil {
+					ts := time.Now().Add(-1 * d)
+					kclConfig = kclConfig.WithTimestampAtInitialPositionInStream(&ts)
+				}
+
+				if kclConfig, err = withEndpoints(kclConfig, parsedRoute, kinesisEndpoint, dynamoDBEndpoint); err != nil {
+					return nil, fmt.Errorf(`route at index %d: %w`, i, err)
+				}
+
+				if kclConfig, err = withEnhancedFanOut(kclConfig, parsedRoute, appNamePrefix); err != nil {
+					return nil, fmt.Errorf(`route at index %d: %w`, i, err)
+				}
+
+				// NOTE(mroberts): Metrics are published to the same account as the checkpoints, rather than the stream's.
+				if kclCloudWatchMetrics {
+					if kclConfig, err = withKCLCloudWatchMetrics(kclConfig, routeRegion, dynamoDBCreds, kclCloudWatchNamespace, kclCloudWatchLevel, kclLogger); err != nil {
+						return nil, err
+					}
+				}
 
-			if parsedRoute.Start == "" || parsedRoute.Start == "LATEST" {
-				kclConfig = kclConfig.WithInitialPositionInStream(cfg.LATEST)
-			} else if parsedRoute.Start == "TRIM_HORIZON" {
-				kclConfig = kclConfig.WithInitialPositionInStream(cfg.TRIM_HORIZON)
-			} else if ts, err := time.Parse(time.RFC3339, parsedRoute.Start); err == nil {
-				kclConfig = kclConfig.WithTimestampAtInitialPositionInStream(&ts)
-			} else if d, err := time.ParseDuration(parsedRoute.Start); err != nil {
-				ts := time.Now().Add(-1 * d)
-				kclConfig = kclConfig.WithTimestampAtInitialPositionInStream(&ts)
+				return kclConfig, nil
 			}
 
-			routes[i] = kinesis2sse.RouteOptions{
-				Pattern:   parsedRoute.Path,
-				Capacity:  parsedRoute.Capacity,
-				KCLConfig: kclConfig,
+			var routeHealthMaxLag time.Duration
+			if parsedRoute.HealthMaxLag != "" {
+				var err error
+				if routeHealthMaxLag, err = time.ParseDuration(parsedRoute.HealthMaxLag); err != nil {
+					return fmt.Errorf(`route at index %d has an invalid "healthMaxLag": %w`, i, err)
+				}
+			}
+
+			var slowClientTimeout time.Duration
+			if parsedRoute.SlowClientTimeout != "" {
+				var err error
+				if slowClientTimeout, err = time.ParseDuration(parsedRoute.SlowClientTimeout); err != nil {
+					return fmt.Errorf(`route at index %d has an invalid "slowClientTimeout": %w`, i, err)
+				}
+			}
+
+			var heartbeatInterval time.Duration
+			if parsedRoute.HeartbeatInterval != "" {
+				var err error
+				if heartbeatInterval, err = time.ParseDuration(parsedRoute.HeartbeatInterval); err != nil {
+					return fmt.Errorf(`route at index %d has an invalid "heartbeatInterval": %w`, i, err)
+				}
+			}
+
+			var flushInterval time.Duration
+			if parsedRoute.FlushInterval != "" {
+				var err error
+				if flushInterval, err = time.ParseDuration(parsedRoute.FlushInterval); err != nil {
+					return fmt.Errorf(`route at index %d has an invalid "flushInterval": %w`, i, err)
+				}
+			}
+
+			var backfillWindow time.Duration
+			if parsedRoute.BackfillWindow != "" {
+				var err error
+				if backfillWindow, err = time.ParseDuration(parsedRoute.BackfillWindow); err != nil {
+					return fmt.Errorf(`route at index %d has an invalid "backfillWindow": %w`, i, err)
+				}
+			}
+
+			routeOptions := kinesis2sse.RouteOptions{
+				Pattern:              parsedRoute.Path,
+				Capacity:             parsedRoute.Capacity,
+				HealthMaxLag:         routeHealthMaxLag,
+				MonotonicTimestamps:  parsedRoute.MonotonicTimestamps,
+				SlowClientPolicy:     kinesis2sse.SlowClientPolicy(parsedRoute.SlowClientPolicy),
+				SlowClientTimeout:    slowClientTimeout,
+				Schema:               parsedRoute.Schema,
+				RetryMillis:          parsedRoute.Retry,
+				HeartbeatInterval:    heartbeatInterval,
+				FlushEvery:           parsedRoute.FlushEvery,
+				FlushInterval:        flushInterval,
+				EventNameField:       parsedRoute.EventNameField,
+				CloudEventsTypeField: parsedRoute.CloudEventsTypeField,
+				MaxConnections:       parsedRoute.MaxConnections,
+				MaxLag:               parsedRoute.MaxLag,
+				MaxEventBytes:        parsedRoute.MaxEventBytes,
+				TimeField:            parsedRoute.TimeField,
+				PayloadField:         parsedRoute.PayloadField,
+				TimestampFallback:    kinesis2sse.TimestampFallback(parsedRoute.TimestampFallback),
+				Envelope:             kinesis2sse.EnvelopeMode(parsedRoute.Envelope),
+				EnvelopeKeys:         parsedRoute.EnvelopeKeys,
+				RawPassthrough:       parsedRoute.RawPassthrough,
+				Binary:               parsedRoute.Binary,
+				Projection:           parsedRoute.Projection,
+				Checkpointing:        kinesis2sse.Checkpointing(parsedRoute.Checkpointing),
+				Encoding:             kinesis2sse.Encoding(parsedRoute.Encoding),
+				APIKeys:              parsedRoute.APIKeys,
+				BackfillS3URI:        parsedRoute.BackfillS3URI,
+				BackfillWindow:       backfillWindow,
+			}
+
+			// NOTE(mroberts): A path with wildcards, like "/tenants/{tenant}/events", is a dynamic route. Each of its
+			// matches gets its own route, reading the stream named by substituting the wildcards, like "{tenant}-events".
+			if strings.Contains(parsedRoute.Path, "{") {
+				if len(parsedRoute.Stream) != 1 {
+					return fmt.Errorf(`route at index %d has a wildcard "path", so it must have exactly one "stream"`, i)
+				}
+
+				var routeIdleTimeout time.Duration
+				if parsedRoute.IdleTimeout != "" {
+					var err error
+					if routeIdleTimeout, err = time.ParseDuration(parsedRoute.IdleTimeout); err != nil {
+						return fmt.Errorf(`route at index %d has an invalid "idleTimeout": %w`, i, err)
+					}
+				}
+
+				routeOptions.Pattern = ""
+				dynamicRoutes = append(dynamicRoutes, kinesis2sse.DynamicRouteOptions{
+					Pattern:        parsedRoute.Path,
+					StreamTemplate: parsedRoute.Stream[0],
+					NewKCLConfig:   newKCLConfig,
+					Route:          routeOptions,
+					MaxRoutes:      parsedRoute.MaxRoutes,
+					IdleTimeout:    routeIdleTimeout,
+				})
+				continue
+			}
+
+			if parsedRoute.MaxRoutes != 0 || parsedRoute.IdleTimeout != "" {
+				return fmt.Errorf(`route at index %d sets "maxRoutes" or "idleTimeout", but its "path" has no wildcards`, i)
+			}
+
+			// NOTE(mroberts): A route may be fed by multiple streams. The first is its primary stream, and we build a KCL
+			// configuration for each.
+			kclConfigs := make([]*cfg.KinesisClientLibConfiguration, 0, len(parsedRoute.Stream))
+			for _, unresolvedStream := range parsedRoute.Stream {
+				kclConfig, err := newKCLConfig(unresolvedStream)
+				if err != nil {
+					return err
+				}
+				kclConfigs = append(kclConfigs, kclConfig)
+			}
+			routeOptions.KCLConfig = kclConfigs[0]
+			routeOptions.AdditionalKCLConfigs = kclConfigs[1:]
+
+			routes = append(routes, routeOptions)
+		}
+
+		listener, err := inheritedListener()
+		if err != nil {
+			return err
+		}
+
+		// NOTE(mroberts): An explicitly empty --cors-allowed-origins parses as nil, which would mean the default.
+		if corsAllowedOrigins == nil {
+			corsAllowedOrigins = []string{}
+		}
+
+		parsedStreamHeaders, err := parseStreamHeaders(streamHeaders)
+		if err != nil {
+			return err
+		}
+
+		var deadLetter func(kinesis2sse.DeadLetter)
+		if deadLetterFile != "" {
+			if deadLetter, err = openDeadLetterFile(deadLetterFile, logger); err != nil {
+				return err
 			}
 		}
 
 		s, err := kinesis2sse.NewService(kinesis2sse.ServiceOptions{
-			Port:   port,
-			Logger: logger,
-			Routes: routes,
+			Host:          host,
+			Port:          port,
+			Logger:        logger,
+			Routes:        routes,
+			DynamicRoutes: dynamicRoutes,
+			HealthMaxLag:  healthMaxLag,
+			MemoryBudget:  memoryBudget,
+			DeadLetter:    deadLetter,
+			AdminToken:    adminToken,
+			Listener:      listener,
+
+			TLSCertFile:           tlsCert,
+			TLSKeyFile:            tlsKey,
+			MaxConnectionDuration: maxConnectionDuration,
+			WriteTimeout:          writeTimeout,
+			MaxLookback:           maxLookback,
+			ReadHeaderTimeout:     readHeaderTimeout,
+			ReadTimeout:           readTimeout,
+			IdleTimeout:           idleTimeout,
+			WorkerStartAttempts:   workerStartAttempts,
+			WorkerStartRetryDelay: workerStartRetryDelay,
+			CORS:                  kinesis2sse.CORSOptions{AllowedOrigins: corsAllowedOrigins},
+			DisableCompression:    disableCompression,
+			DisableIndex:          disableIndex,
+			EnableViewer:          enableViewer,
+			Version:               version,
+			Commit:                buildCommit(),
+			Preamble:              preamble,
+			DisablePreamble:       disablePreamble,
+			Greeting:              greeting,
+			RequestIDHeader:       requestIDHeader,
+			StreamHeaders:         parsedStreamHeaders,
+			RequestIDComment:      requestIDComment,
+			Checkpointing:         kinesis2sse.Checkpointing(checkpointing),
+			CheckpointFile:        checkpointFile,
 		})
 		if err != nil {
 			return err
@@ -144,13 +617,65 @@ var rootCmd = &cobra.Command{
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+		restartSigs := make(chan os.Signal, 1)
+		if len(restartSignals) > 0 {
+			signal.Notify(restartSigs, restartSignals...)
+		}
+
+		drainSigs := make(chan os.Signal, 1)
+		if len(drainSignals) > 0 {
+			signal.Notify(drainSigs, drainSignals...)
+		}
+
 		// Signal processing.
 		go func() {
-			sig := <-sigs
-			logger.Info(fmt.Sprintf("Received signal %s. Exiting…\n", sig))
-			// NOTE(mroberts): We don't give a timeout here, for simplicity. If stopping takes to long, the user can
-			// issue a SIGKILL. This is what Fargate does. By avoiding choosing a timeout, we keep things simple.
-			_ = s.Stop(context.Background())
+			for {
+				select {
+				case sig := <-sigs:
+					logger.Info(fmt.Sprintf("Received signal %s. Exiting…\n", sig))
+				case sig := <-restartSigs:
+					process, err := handOff(s)
+					if err != nil {
+						logger.Error(fmt.Sprintf("Received signal %s, but unable to hand off the listener", sig), "err", err)
+						continue
+					}
+					logger.Info(fmt.Sprintf("Received signal %s. Handed off the listener to PID %d. Draining…\n", sig, process.Pid))
+				case sig := <-drainSigs:
+					logger.Info(fmt.Sprintf("Received signal %s. Draining…\n", sig))
+
+					// NOTE(mroberts): We keep running after draining, until we're stopped, so that a deploy can shift
+					// traffic away before stopping us.
+					go func() {
+						ctx := context.Background()
+						if drainTimeout > 0 {
+							var cancel context.CancelFunc
+							ctx, cancel = context.WithTimeout(ctx, drainTimeout)
+							defer cancel()
+						}
+						if err := s.Drain(ctx); err != nil {
+							logger.Warn("Closed connections which outlasted draining", "err", err)
+							return
+						}
+						logger.Info("Drained")
+					}()
+					continue
+				}
+				break
+			}
+
+			// NOTE(mroberts): By default, we don't give a timeout here, since draining connections after a graceful
+			// restart can take arbitrarily long. If stopping takes too long, the user can issue a SIGKILL (this is what
+			// Fargate does), or set --shutdown-timeout.
+			ctx := context.Background()
+			if shutdownTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
+				defer cancel()
+			}
+			if err := s.Stop(ctx); err != nil {
+				logger.Error("Unable to stop cleanly", "err", err)
+				os.Exit(1)
+			}
 			os.Exit(0)
 		}()
 
@@ -164,14 +689,272 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// applyConfig sets any flags which were not passed explicitly from the config.
+func applyConfig(cmd *cobra.Command, config Config) error {
+	flags := cmd.Flags()
+
+	if config.Host != "" && !flags.Changed("host") {
+		host = config.Host
+	}
+
+	if config.Port != 0 && !flags.Changed("port") {
+		port = config.Port
+	}
+
+	if config.AppNamePrefix != "" && !flags.Changed("app-name-prefix") {
+		appNamePrefix = config.AppNamePrefix
+	}
+
+	if config.ShardSyncIntervalMillis != 0 && !flags.Changed("shard-sync-interval-millis") {
+		shardSyncIntervalMillis = config.ShardSyncIntervalMillis
+	}
+
+	if config.FailoverTimeMillis != 0 && !flags.Changed("failover-time-millis") {
+		failoverTimeMillis = config.FailoverTimeMillis
+	}
+
+	if config.MaxRecords != 0 && !flags.Changed("max-records") {
+		maxRecords = config.MaxRecords
+	}
+
+	if config.PollIntervalMillis != 0 && !flags.Changed("poll-interval-millis") {
+		pollIntervalMillis = config.PollIntervalMillis
+	}
+
+	if config.Region != "" && !flags.Changed("region") {
+		region = config.Region
+	}
+
+	if config.AWSProfile != "" && !flags.Changed("aws-profile") {
+		awsProfile = config.AWSProfile
+	}
+
+	if config.AssumeRoleARN != "" && !flags.Changed("assume-role-arn") {
+		assumeRoleARN = config.AssumeRoleARN
+	}
+
+	if config.KinesisEndpoint != "" && !flags.Changed("kinesis-endpoint") {
+		kinesisEndpoint = config.KinesisEndpoint
+	}
+
+	if config.DynamoDBEndpoint != "" && !flags.Changed("dynamodb-endpoint") {
+		dynamoDBEndpoint = config.DynamoDBEndpoint
+	}
+
+	if config.KCLCloudWatchMetrics && !flags.Changed("kcl-cloudwatch-metrics") {
+		kclCloudWatchMetrics = config.KCLCloudWatchMetrics
+	}
+
+	if config.KCLCloudWatchNamespace != "" && !flags.Changed("kcl-cloudwatch-namespace") {
+		kclCloudWatchNamespace = config.KCLCloudWatchNamespace
+	}
+
+	if config.KCLCloudWatchLevel != "" && !flags.Changed("kcl-cloudwatch-level") {
+		kclCloudWatchLevel = config.KCLCloudWatchLevel
+	}
+
+	if config.MemoryBudget != 0 && !flags.Changed("memory-budget") {
+		memoryBudget = config.MemoryBudget
+	}
+
+	if config.DeadLetterFile != "" && !flags.Changed("dead-letter-file") {
+		deadLetterFile = config.DeadLetterFile
+	}
+
+	if config.HealthMaxLag != "" && !flags.Changed("health-max-lag") {
+		var err error
+		if healthMaxLag, err = time.ParseDuration(config.HealthMaxLag); err != nil {
+			return fmt.Errorf(`config has an invalid "healthMaxLag": %w`, err)
+		}
+	}
+
+	if config.TLSCert != "" && !flags.Changed("tls-cert") {
+		tlsCert = config.TLSCert
+	}
+
+	if config.TLSKey != "" && !flags.Changed("tls-key") {
+		tlsKey = config.TLSKey
+	}
+
+	if config.MaxConnectionDuration != "" && !flags.Changed("max-connection-duration") {
+		var err error
+		if maxConnectionDuration, err = time.ParseDuration(config.MaxConnectionDuration); err != nil {
+			return fmt.Errorf(`config has an invalid "maxConnectionDuration": %w`, err)
+		}
+	}
+
+	if config.WriteTimeout != "" && !flags.Changed("write-timeout") {
+		var err error
+		if writeTimeout, err = time.ParseDuration(config.WriteTimeout); err != nil {
+			return fmt.Errorf(`config has an invalid "writeTimeout": %w`, err)
+		}
+	}
+
+	if config.MaxLookback != "" && !flags.Changed("max-lookback") {
+		var err error
+		if maxLookback, err = time.ParseDuration(config.MaxLookback); err != nil {
+			return fmt.Errorf(`config has an invalid "maxLookback": %w`, err)
+		}
+	}
+
+	if config.ReadHeaderTimeout != "" && !flags.Changed("read-header-timeout") {
+		var err error
+		if readHeaderTimeout, err = time.ParseDuration(config.ReadHeaderTimeout); err != nil {
+			return fmt.Errorf(`config has an invalid "readHeaderTimeout": %w`, err)
+		}
+	}
+
+	if config.ReadTimeout != "" && !flags.Changed("read-timeout") {
+		var err error
+		if readTimeout, err = time.ParseDuration(config.ReadTimeout); err != nil {
+			return fmt.Errorf(`config has an invalid "readTimeout": %w`, err)
+		}
+	}
+
+	if config.IdleTimeout != "" && !flags.Changed("idle-timeout") {
+		var err error
+		if idleTimeout, err = time.ParseDuration(config.IdleTimeout); err != nil {
+			return fmt.Errorf(`config has an invalid "idleTimeout": %w`, err)
+		}
+	}
+
+	if config.WorkerStartAttempts != 0 && !flags.Changed("worker-start-attempts") {
+		workerStartAttempts = config.WorkerStartAttempts
+	}
+
+	if config.WorkerStartRetryDelay != "" && !flags.Changed("worker-start-retry-delay") {
+		var err error
+		if workerStartRetryDelay, err = time.ParseDuration(config.WorkerStartRetryDelay); err != nil {
+			return fmt.Errorf(`config has an invalid "workerStartRetryDelay": %w`, err)
+		}
+	}
+
+	if config.ShutdownTimeout != "" && !flags.Changed("shutdown-timeout") {
+		var err error
+		if shutdownTimeout, err = time.ParseDuration(config.ShutdownTimeout); err != nil {
+			return fmt.Errorf(`config has an invalid "shutdownTimeout": %w`, err)
+		}
+	}
+
+	if config.DrainTimeout != "" && !flags.Changed("drain-timeout") {
+		var err error
+		if drainTimeout, err = time.ParseDuration(config.DrainTimeout); err != nil {
+			return fmt.Errorf(`config has an invalid "drainTimeout": %w`, err)
+		}
+	}
+
+	if config.Checkpointing != "" && !flags.Changed("checkpointing") {
+		checkpointing = config.Checkpointing
+	}
+
+	if config.CheckpointFile != "" && !flags.Changed("checkpoint-file") {
+		checkpointFile = config.CheckpointFile
+	}
+
+	if config.CORSAllowedOrigins != nil && !flags.Changed("cors-allowed-origins") {
+		corsAllowedOrigins = config.CORSAllowedOrigins
+	}
+
+	if config.DisableCompression && !flags.Changed("disable-compression") {
+		disableCompression = config.DisableCompression
+	}
+
+	if config.DisableIndex && !flags.Changed("disable-index") {
+		disableIndex = config.DisableIndex
+	}
+
+	if config.EnableViewer && !flags.Changed("enable-viewer") {
+		enableViewer = config.EnableViewer
+	}
+
+	if config.Preamble != "" && !flags.Changed("preamble") {
+		preamble = config.Preamble
+	}
+
+	if config.DisablePreamble && !flags.Changed("disable-preamble") {
+		disablePreamble = config.DisablePreamble
+	}
+
+	if config.Greeting != "" && !flags.Changed("greeting") {
+		greeting = config.Greeting
+	}
+
+	if config.RequestIDHeader != "" && !flags.Changed("request-id-header") {
+		requestIDHeader = config.RequestIDHeader
+	}
+
+	if config.StreamHeaders != nil && !flags.Changed("stream-header") {
+		streamHeaders = make([]string, 0, len(config.StreamHeaders))
+		for name, value := range config.StreamHeaders {
+			streamHeaders = append(streamHeaders, name+": "+value)
+		}
+	}
+
+	if config.RequestIDComment && !flags.Changed("request-id-comment") {
+		requestIDComment = config.RequestIDComment
+	}
+
+	if len(config.Routes) > 0 && !flags.Changed("routes") {
+		routes, err := json.Marshal(config.Routes)
+		if err != nil {
+			return err
+		}
+		unparsedRoutes = string(routes)
+	}
+
+	return nil
+}
+
 func init() {
+	rootCmd.Version = versionString()
+	rootCmd.SetVersionTemplate("kinesis2sse {{.Version}}\n")
+
+	rootCmd.PersistentFlags().StringVar(&host, "host", kinesis2sse.DefaultHost, "set the host or IP address to listen on, like 127.0.0.1 (empty listens on all interfaces)")
 	rootCmd.PersistentFlags().IntVar(&port, "port", defaultPort, "set the port")
 	rootCmd.PersistentFlags().StringVar(&appNamePrefix, "app-name-prefix", defaultAppNamePrefix, "set the app name prefix to which a random suffix will be appended")
-	rootCmd.PersistentFlags().IntVar(&shardSyncIntervalMillis, "shard-sync-interval-millis", defaultShardSyncIntervalMillis, "set the shard sync interval in milliseconds, shared by all routes")
-	rootCmd.PersistentFlags().IntVar(&failoverTimeMillis, "failover-time-millis", defaultFailoverTimeMillis, "set the failover time in milliseconds, shared by all routes")
-	rootCmd.PersistentFlags().StringVar(&region, "region", os.Getenv("AWS_REGION"), "set the region, if not already set by the AWS_REGION environment variable")
+	rootCmd.PersistentFlags().IntVar(&shardSyncIntervalMillis, "shard-sync-interval-millis", defaultShardSyncIntervalMillis, "set the shard sync interval in milliseconds, unless a route sets its own")
+	rootCmd.PersistentFlags().IntVar(&failoverTimeMillis, "failover-time-millis", defaultFailoverTimeMillis, "set the failover time in milliseconds, unless a route sets its own")
+	rootCmd.PersistentFlags().IntVar(&maxRecords, "max-records", cfg.DefaultMaxRecords, "set the maximum number of records per GetRecords call, unless a route sets its own")
+	rootCmd.PersistentFlags().IntVar(&pollIntervalMillis, "poll-interval-millis", cfg.DefaultIdleTimeBetweenReadsMillis, "set the time between GetRecords calls in milliseconds, unless a route sets its own")
+	rootCmd.PersistentFlags().StringVar(&region, "region", os.Getenv("AWS_REGION"), "set the default region for routes, if not already set by the AWS_REGION environment variable")
+	rootCmd.PersistentFlags().StringVar(&awsProfile, "aws-profile", "", "set the named AWS profile with which routes access their streams and checkpoints, unless a route sets its own (empty uses the default credential chain)")
+	rootCmd.PersistentFlags().StringVar(&assumeRoleARN, "assume-role-arn", "", "set the ARN of an IAM role to assume to access routes' streams, like for cross-account access, unless a route sets its own")
+	rootCmd.PersistentFlags().StringVar(&kinesisEndpoint, "kinesis-endpoint", "", "set a custom Kinesis endpoint URL, like LocalStack's, unless a route sets its own")
+	rootCmd.PersistentFlags().StringVar(&dynamoDBEndpoint, "dynamodb-endpoint", "", "set a custom DynamoDB endpoint URL for checkpoints, like LocalStack's, unless a route sets its own")
+	rootCmd.PersistentFlags().BoolVar(&kclCloudWatchMetrics, "kcl-cloudwatch-metrics", false, "enable publishing the KCL workers' own metrics, like leases and lag per shard, to CloudWatch (which incurs CloudWatch costs)")
+	rootCmd.PersistentFlags().StringVar(&kclCloudWatchNamespace, "kcl-cloudwatch-namespace", defaultKCLCloudWatchNamespace, "set the CloudWatch namespace to publish KCL metrics under")
+	rootCmd.PersistentFlags().StringVar(&kclCloudWatchLevel, "kcl-cloudwatch-level", kclMetricsSummary, "set which KCL metrics to publish: \"summary\", or \"detailed\" to include the time taken to get and process records")
 	rootCmd.PersistentFlags().StringVar(&unparsedRoutes, "routes", "[]", "set an array of JSON routes")
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "enable debug logging")
+	rootCmd.PersistentFlags().StringArrayVar(&configPaths, "config", nil, "load configuration from a JSON or YAML file; repeat to deep-merge multiple files in order")
+	rootCmd.PersistentFlags().StringVar(&adminToken, "admin-token", os.Getenv("KINESIS2SSE_ADMIN_TOKEN"), "set the bearer token for the /admin endpoints, if not already set by the KINESIS2SSE_ADMIN_TOKEN environment variable (empty disables them)")
+	rootCmd.PersistentFlags().StringVar(&tlsCert, "tls-cert", "", "serve HTTPS using the PEM-encoded certificate at this path (requires --tls-key)")
+	rootCmd.PersistentFlags().StringVar(&tlsKey, "tls-key", "", "serve HTTPS using the PEM-encoded private key at this path (requires --tls-cert)")
+	rootCmd.PersistentFlags().DurationVar(&maxConnectionDuration, "max-connection-duration", 0, "set how long a stream may stay open before it is ended (0 means unlimited)")
+	rootCmd.PersistentFlags().DurationVar(&writeTimeout, "write-timeout", kinesis2sse.DefaultWriteTimeout, "set how long a write to a client may take before its connection is closed")
+	rootCmd.PersistentFlags().DurationVar(&maxLookback, "max-lookback", 0, "set how far back the \"since\" query parameter may reach (0 means unlimited)")
+	rootCmd.PersistentFlags().DurationVar(&readHeaderTimeout, "read-header-timeout", kinesis2sse.DefaultReadHeaderTimeout, "set how long to wait to read a request's headers")
+	rootCmd.PersistentFlags().DurationVar(&readTimeout, "read-timeout", 0, "set how long to wait to read a whole request (0 means unlimited; SSE streams are unaffected)")
+	rootCmd.PersistentFlags().DurationVar(&idleTimeout, "idle-timeout", 0, "set how long to keep an idle keep-alive connection open (0 means --read-timeout)")
+	rootCmd.PersistentFlags().IntVar(&workerStartAttempts, "worker-start-attempts", kinesis2sse.DefaultWorkerStartAttempts, "set how many times to try starting each KCL worker before failing (1 means no retries)")
+	rootCmd.PersistentFlags().DurationVar(&workerStartRetryDelay, "worker-start-retry-delay", kinesis2sse.DefaultWorkerStartRetryDelay, "set how long to wait before the first retry to start a KCL worker, which doubles after each attempt")
+	rootCmd.PersistentFlags().DurationVar(&drainTimeout, "drain-timeout", 0, "set how long to wait, after receiving SIGUSR1, for existing connections to close before closing them (0 means wait indefinitely)")
+	rootCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "set how long to wait for connections to drain and KCL workers to stop before forcibly closing connections and exiting (0 means wait indefinitely)")
+	rootCmd.PersistentFlags().StringSliceVar(&corsAllowedOrigins, "cors-allowed-origins", kinesis2sse.DefaultAllowedOrigins, "set the origins browsers may connect from, or \"*\" for any (empty disallows cross-origin requests)")
+	rootCmd.PersistentFlags().BoolVar(&disableCompression, "disable-compression", false, "disable gzip-compressing SSE streams, for example when a proxy already handles compression")
+	rootCmd.PersistentFlags().BoolVar(&disableIndex, "disable-index", false, "disable listing the routes at / and in 404 responses, to avoid exposing the service's topology")
+	rootCmd.PersistentFlags().BoolVar(&enableViewer, "enable-viewer", false, "enable an HTML page at /viewer which connects to a route and lists its events, for demos and debugging")
+	rootCmd.PersistentFlags().StringVar(&preamble, "preamble", kinesis2sse.DefaultPreamble, "set the text of the comment which begins each SSE stream")
+	rootCmd.PersistentFlags().BoolVar(&disablePreamble, "disable-preamble", false, "disable the comment which begins each SSE stream, for clients which choke on comments")
+	rootCmd.PersistentFlags().StringVar(&greeting, "greeting", "", "set the text of a comment to send at the start of each SSE stream, after the preamble")
+	rootCmd.PersistentFlags().StringVar(&requestIDHeader, "request-id-header", kinesis2sse.DefaultRequestIDHeader, "set the header from which to read each stream's request ID, which is logged and echoed back")
+	rootCmd.PersistentFlags().StringArrayVar(&streamHeaders, "stream-header", nil, "set a header, like \"X-Accel-Buffering: no\", on each stream's response, overriding the defaults, \"Cache-Control: no-cache\", \"Connection: keep-alive\", and \"X-Accel-Buffering: no\" (an empty value removes the default; may be repeated)")
+	rootCmd.PersistentFlags().BoolVar(&requestIDComment, "request-id-comment", false, "send each stream's request ID in a comment at the start of the stream")
+	rootCmd.PersistentFlags().StringVar(&checkpointing, "checkpointing", "", "set where to checkpoint progress through each shard: \"memory\" (the default), \"dynamodb\", which persists checkpoints to a table named \"<app-name-prefix>-<stream>\", or \"file\" (see --checkpoint-file), so that restarts resume from them, or \"none\", which doesn't checkpoint at all")
+	rootCmd.PersistentFlags().StringVar(&checkpointFile, "checkpoint-file", "", "persist checkpoints to the JSON file at this path, so that restarts resume from them (implies --checkpointing file)")
+	rootCmd.PersistentFlags().IntVar(&memoryBudget, "memory-budget", 0, "set the estimated bytes of memory all routes' events may take up together, rejecting routes which would exceed it; requires each route to set \"maxEventBytes\" (0 means unlimited)")
+	rootCmd.PersistentFlags().StringVar(&deadLetterFile, "dead-letter-file", "", "append each record a route is unable to serve, like one which isn't valid JSON, to the file at this path as a line of JSON, with its base64-encoded data and why")
+	rootCmd.PersistentFlags().DurationVar(&healthMaxLag, "health-max-lag", 0, "set the consumer lag beyond which /health fails, unless overridden per route (0 disables the check)")
 }
 
 func main() {
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	cfg "github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+)
+
+// StreamNames are the Kinesis Streams feeding a route. In JSON, a single stream may be a string, rather than an array.
+type StreamNames []string
+
+// UnmarshalJSON implements json.Unmarshaler, accepting either a string or an array of strings.
+func (s *StreamNames) UnmarshalJSON(data []byte) error {
+	var stream string
+	if err := json.Unmarshal(data, &stream); err == nil {
+		*s = StreamNames{stream}
+		return nil
+	}
+
+	var streams []string
+	if err := json.Unmarshal(data, &streams); err != nil {
+		return fmt.Errorf(`"stream" must be a string or an array of strings: %w`, err)
+	}
+	*s = streams
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, marshalling a single stream as a string.
+func (s StreamNames) MarshalJSON() ([]byte, error) {
+	if len(s) == 1 {
+		return json.Marshal(s[0])
+	}
+	return json.Marshal([]string(s))
+}
+
+// resolveStream returns the name and region of one of a route's Kinesis Streams. The stream may be a name or a full
+// stream ARN, like "arn:aws:kinesis:us-east-2:123456789012:stream/my-stream". The region is routeRegion (the route's
+// "region"), if set, or else the ARN's region, or else defaultRegion (from --region).
+func resolveStream(unresolvedStream, routeRegion, defaultRegion string) (string, string, error) {
+	stream, streamRegion := unresolvedStream, ""
+	if arn.IsARN(unresolvedStream) {
+		parsed, err := arn.Parse(unresolvedStream)
+		if err != nil {
+			return "", "", fmt.Errorf(`invalid stream ARN %q: %w`, unresolvedStream, err)
+		}
+
+		name, ok := strings.CutPrefix(parsed.Resource, "stream/")
+		if parsed.Service != "kinesis" || !ok || name == "" {
+			return "", "", fmt.Errorf(`%q is not a Kinesis Stream ARN`, unresolvedStream)
+		}
+		stream, streamRegion = name, parsed.Region
+	}
+
+	region := routeRegion
+	if region == "" {
+		region = streamRegion
+	} else if streamRegion != "" && streamRegion != region {
+		return "", "", fmt.Errorf(`"region" %q does not match the stream ARN's region %q`, region, streamRegion)
+	}
+	if region == "" {
+		region = defaultRegion
+	}
+	if region == "" {
+		return "", "", fmt.Errorf(`no region: set the route's "region", use a stream ARN, or pass --region (or set AWS_REGION)`)
+	}
+
+	return stream, region, nil
+}
+
+// withEnhancedFanOut configures a route's KCL configuration to read through an enhanced fan-out consumer, if the route
+// enables one. The consumer is the route's EnhancedFanOutConsumerARN, if set, or else it's registered (or reused) by
+// name, defaulting to defaultConsumerName.
+func withEnhancedFanOut(kclConfig *cfg.KinesisClientLibConfiguration, route RouteOptionsCLI, defaultConsumerName string) (*cfg.KinesisClientLibConfiguration, error) {
+	switch {
+	case route.EnhancedFanOutConsumerARN != "":
+		if len(route.Stream) > 1 {
+			return nil, errors.New(`"enhancedFanOutConsumerArn" can't be used with multiple streams, since a consumer belongs to one stream`)
+		}
+		return kclConfig.WithEnhancedFanOutConsumerARN(route.EnhancedFanOutConsumerARN), nil
+	case route.EnhancedFanOutConsumerName != "":
+		return kclConfig.WithEnhancedFanOutConsumerName(route.EnhancedFanOutConsumerName), nil
+	case route.EnhancedFanOut:
+		return kclConfig.WithEnhancedFanOutConsumerName(defaultConsumerName), nil
+	default:
+		return kclConfig, nil
+	}
+}
+
+// withEndpoints points a route's KCL configuration at custom Kinesis and DynamoDB endpoints, like LocalStack's, if set.
+// The route's endpoints take precedence over defaultKinesisEndpoint and defaultDynamoDBEndpoint (from the flags).
+func withEndpoints(kclConfig *cfg.KinesisClientLibConfiguration, route RouteOptionsCLI, defaultKinesisEndpoint, defaultDynamoDBEndpoint string) (*cfg.KinesisClientLibConfiguration, error) {
+	kinesisEndpoint := route.KinesisEndpoint
+	if kinesisEndpoint == "" {
+		kinesisEndpoint = defaultKinesisEndpoint
+	}
+	dynamoDBEndpoint := route.DynamoDBEndpoint
+	if dynamoDBEndpoint == "" {
+		dynamoDBEndpoint = defaultDynamoDBEndpoint
+	}
+
+	for _, endpoint := range []string{kinesisEndpoint, dynamoDBEndpoint} {
+		if endpoint == "" {
+			continue
+		}
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf(`endpoint %q must be an http or https URL`, endpoint)
+		}
+	}
+
+	return kclConfig.WithKinesisEndpoint(kinesisEndpoint).WithDynamoDBEndpoint(dynamoDBEndpoint), nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseStreamHeaders parses --stream-header flags, like "Cache-Control: no-cache, no-transform", into headers. A header
+// with an empty value, like "X-Accel-Buffering:", removes the default of the same name.
+func parseStreamHeaders(unparsed []string) (http.Header, error) {
+	if len(unparsed) == 0 {
+		return nil, nil
+	}
+
+	headers := make(http.Header, len(unparsed))
+	for _, header := range unparsed {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("stream header %q must be of the form \"Name: value\"", header)
+		}
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		headers[name] = append(headers[name], strings.TrimSpace(value))
+	}
+	return headers, nil
+}
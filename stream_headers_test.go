@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStreamHeaders(t *testing.T) {
+	r := require.New(t)
+
+	headers, err := parseStreamHeaders(nil)
+	r.NoError(err)
+	r.Nil(headers)
+
+	headers, err = parseStreamHeaders([]string{"cache-control: no-cache, no-transform", "X-Accel-Buffering:", "X-Custom: 1", "X-Custom: 2"})
+	r.NoError(err)
+	r.Equal(http.Header{
+		"Cache-Control":     {"no-cache, no-transform"},
+		"X-Accel-Buffering": {""},
+		"X-Custom":          {"1", "2"},
+	}, headers)
+
+	_, err = parseStreamHeaders([]string{"X-Custom"})
+	r.EqualError(err, `stream header "X-Custom" must be of the form "Name: value"`)
+}
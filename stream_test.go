@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/stretchr/testify/require"
+	cfg "github.com/vmware/vmware-go-kcl-v2/clientlibrary/config"
+)
+
+func TestResolveStream(t *testing.T) {
+	r := require.New(t)
+
+	const streamARN = "arn:aws:kinesis:us-west-2:123456789012:stream/my-stream"
+
+	for _, tc := range []struct {
+		name          string
+		route         RouteOptionsCLI
+		defaultRegion string
+		stream        string
+		region        string
+		err           bool
+	}{
+		{name: "default region", route: RouteOptionsCLI{Stream: StreamNames{"my-stream"}}, defaultRegion: "us-east-2", stream: "my-stream", region: "us-east-2"},
+		{name: "route region", route: RouteOptionsCLI{Stream: StreamNames{"my-stream"}, Region: "eu-west-1"}, defaultRegion: "us-east-2", stream: "my-stream", region: "eu-west-1"},
+		{name: "ARN region", route: RouteOptionsCLI{Stream: StreamNames{streamARN}}, defaultRegion: "us-east-2", stream: "my-stream", region: "us-west-2"},
+		{name: "ARN without default region", route: RouteOptionsCLI{Stream: StreamNames{streamARN}}, stream: "my-stream", region: "us-west-2"},
+		{name: "ARN and matching route region", route: RouteOptionsCLI{Stream: StreamNames{streamARN}, Region: "us-west-2"}, stream: "my-stream", region: "us-west-2"},
+		{name: "ARN and mismatched route region", route: RouteOptionsCLI{Stream: StreamNames{streamARN}, Region: "eu-west-1"}, err: true},
+		{name: "no region", route: RouteOptionsCLI{Stream: StreamNames{"my-stream"}}, err: true},
+		{name: "not a Kinesis ARN", route: RouteOptionsCLI{Stream: StreamNames{"arn:aws:sqs:us-west-2:123456789012:my-queue"}}, err: true},
+		{name: "invalid ARN", route: RouteOptionsCLI{Stream: StreamNames{"arn:aws:kinesis"}}, err: true},
+	} {
+		stream, region, err := resolveStream(tc.route.Stream[0], tc.route.Region, tc.defaultRegion)
+		if tc.err {
+			r.Error(err, tc.name)
+			continue
+		}
+		r.NoError(err, tc.name)
+		r.Equal(tc.stream, stream, tc.name)
+		r.Equal(tc.region, region, tc.name)
+	}
+}
+
+func TestStreamNames(t *testing.T) {
+	r := require.New(t)
+
+	var route RouteOptionsCLI
+	r.NoError(json.Unmarshal([]byte(`{"stream":"my-stream"}`), &route))
+	r.Equal(StreamNames{"my-stream"}, route.Stream)
+
+	r.NoError(json.Unmarshal([]byte(`{"stream":["my-stream-a","my-stream-b"]}`), &route))
+	r.Equal(StreamNames{"my-stream-a", "my-stream-b"}, route.Stream)
+
+	r.Error(json.Unmarshal([]byte(`{"stream":42}`), &route))
+
+	// A single stream round-trips as a string, so that configs are unchanged.
+	marshalled, err := json.Marshal(StreamNames{"my-stream"})
+	r.NoError(err)
+	r.Equal(`"my-stream"`, string(marshalled))
+
+	marshalled, err = json.Marshal(StreamNames{"my-stream-a", "my-stream-b"})
+	r.NoError(err)
+	r.Equal(`["my-stream-a","my-stream-b"]`, string(marshalled))
+}
+
+func TestWithEnhancedFanOut(t *testing.T) {
+	r := require.New(t)
+
+	const consumerARN = "arn:aws:kinesis:us-east-2:123456789012:stream/my-stream/consumer/my-consumer:1700000000"
+
+	for _, tc := range []struct {
+		name         string
+		route        RouteOptionsCLI
+		enabled      bool
+		consumerName string
+		consumerARN  string
+		err          bool
+	}{
+		{name: "disabled", route: RouteOptionsCLI{Stream: StreamNames{"my-stream"}}, consumerName: "kinesis2sse-app"},
+		{name: "default name", route: RouteOptionsCLI{Stream: StreamNames{"my-stream"}, EnhancedFanOut: true}, enabled: true, consumerName: "kinesis2sse"},
+		{name: "name", route: RouteOptionsCLI{Stream: StreamNames{"my-stream"}, EnhancedFanOutConsumerName: "my-consumer"}, enabled: true, consumerName: "my-consumer"},
+		{name: "ARN", route: RouteOptionsCLI{Stream: StreamNames{"my-stream"}, EnhancedFanOutConsumerARN: consumerARN}, enabled: true, consumerName: "kinesis2sse-app", consumerARN: consumerARN},
+		{name: "ARN with multiple streams", route: RouteOptionsCLI{Stream: StreamNames{"my-stream", "my-other-stream"}, EnhancedFanOutConsumerARN: consumerARN}, err: true},
+	} {
+		kclConfig := cfg.NewKinesisClientLibConfig("kinesis2sse-app", "my-stream", "us-east-2", "kinesis2sse-app")
+		kclConfig, err := withEnhancedFanOut(kclConfig, tc.route, "kinesis2sse")
+		if tc.err {
+			r.Error(err, tc.name)
+			continue
+		}
+		r.NoError(err, tc.name)
+		r.Equal(tc.enabled, kclConfig.EnableEnhancedFanOutConsumer, tc.name)
+		r.Equal(tc.consumerName, kclConfig.EnhancedFanOutConsumerName, tc.name)
+		r.Equal(tc.consumerARN, kclConfig.EnhancedFanOutConsumerARN, tc.name)
+	}
+}
+
+func TestWithEndpoints(t *testing.T) {
+	r := require.New(t)
+
+	const localStack = "http://localhost:4566"
+
+	for _, tc := range []struct {
+		name             string
+		route            RouteOptionsCLI
+		defaultEndpoint  string
+		kinesisEndpoint  string
+		dynamoDBEndpoint string
+		err              bool
+	}{
+		{name: "unset"},
+		{name: "defaults", defaultEndpoint: localStack, kinesisEndpoint: localStack, dynamoDBEndpoint: localStack},
+		{name: "route", route: RouteOptionsCLI{KinesisEndpoint: "https://kinesis.example.com"}, defaultEndpoint: localStack, kinesisEndpoint: "https://kinesis.example.com", dynamoDBEndpoint: localStack},
+		{name: "invalid", route: RouteOptionsCLI{DynamoDBEndpoint: "localhost:8000"}, err: true},
+	} {
+		kclConfig := cfg.NewKinesisClientLibConfig("kinesis2sse-app", "my-stream", "us-east-2", "kinesis2sse-app")
+		kclConfig, err := withEndpoints(kclConfig, tc.route, tc.defaultEndpoint, tc.defaultEndpoint)
+		if tc.err {
+			r.EqualError(err, `endpoint "localhost:8000" must be an http or https URL`, tc.name)
+			continue
+		}
+		r.NoError(err, tc.name)
+		r.Equal(tc.kinesisEndpoint, kclConfig.KinesisEndpoint, tc.name)
+		r.Equal(tc.dynamoDBEndpoint, kclConfig.DynamoDBEndpoint, tc.name)
+	}
+}
+
+func TestWithKCLCloudWatchMetrics(t *testing.T) {
+	r := require.New(t)
+
+	creds := credentials.NewStaticCredentialsProvider("key", "secret", "")
+
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		level     string
+		err       string
+	}{
+		{name: "summary", namespace: "kinesis2sse", level: "summary"},
+		{name: "detailed", namespace: "my-namespace", level: "detailed"},
+		{name: "empty namespace", level: "summary", err: "KCL CloudWatch namespace must not be empty"},
+		{name: "invalid level", namespace: "kinesis2sse", level: "verbose", err: `KCL CloudWatch metrics level must be "summary" or "detailed"`},
+	} {
+		kclConfig := cfg.NewKinesisClientLibConfig("kinesis2sse-app", "my-stream", "us-east-2", "kinesis2sse-app")
+		kclConfig, err := withKCLCloudWatchMetrics(kclConfig, "us-east-2", creds, tc.namespace, tc.level, kclConfig.Logger)
+		if tc.err != "" {
+			r.EqualError(err, tc.err, tc.name)
+			continue
+		}
+		r.NoError(err, tc.name)
+
+		monitoringService, ok := kclConfig.MonitoringService.(*kclCloudWatchMonitoringService)
+		r.True(ok, tc.name)
+		r.Equal(tc.namespace, monitoringService.namespace, tc.name)
+		r.Equal(tc.level == "detailed", monitoringService.detailed, tc.name)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import rtdebug "runtime/debug"
+
+// version and commit identify the build. Set them at build time, like:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildCommit returns commit or, if it wasn't set at build time, the VCS revision which Go stamps into binaries built
+// from a checkout, if any.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+
+	if info, ok := rtdebug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// versionString describes the build for --version.
+func versionString() string {
+	if c := buildCommit(); c != "" {
+		return version + " (commit " + c + ")"
+	}
+	return version
+}